@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// registerV1Routes adds the namespaced JSON API to the router:
+//
+//	GET    /v1/ns                   list namespaces
+//	GET    /v1/ns/{ns}              the options of a namespace
+//	PUT    /v1/ns/{ns}              create a namespace, the body may hold its options
+//	DELETE /v1/ns/{ns}              drop a namespace
+//	GET    /v1/ns/{ns}/keys/{key}   get a key
+//	PUT    /v1/ns/{ns}/keys/{key}   set a key to the request body
+//	DELETE /v1/ns/{ns}/keys/{key}   delete a key, returning its value
+//	POST   /v1/batch                apply a list of operations atomically
+//	POST   /v1/ns/{ns}/vlog/gc      garbage collect the value log of a namespace
+//	GET    /v1/stats                sizes and compression ratio of every namespace
+//	GET    /v1/watch                changes of the keys with a prefix, as Server-Sent Events
+func registerV1Routes(r *mux.Router) {
+	r.HandleFunc("/v1/ns", handleListNamespaces).Methods("GET")
+	r.HandleFunc("/v1/ns/{ns}", handleGetNamespace).Methods("GET")
+	r.HandleFunc("/v1/ns/{ns}", handleCreateNamespace).Methods("PUT", "POST")
+	r.HandleFunc("/v1/ns/{ns}", handleDropNamespace).Methods("DELETE")
+	r.HandleFunc("/v1/ns/{ns}/keys/{key:.+}", handleNSGet).Methods("GET")
+	r.HandleFunc("/v1/ns/{ns}/keys/{key:.+}", handleNSSet).Methods("PUT", "POST")
+	r.HandleFunc("/v1/ns/{ns}/keys/{key:.+}", handleNSDelete).Methods("DELETE")
+	r.HandleFunc("/v1/ns/{ns}/vlog/gc", handleVlogGC).Methods("POST")
+	r.HandleFunc("/v1/batch", handleBatch).Methods("POST")
+	r.HandleFunc("/v1/stats", handleStats).Methods("GET")
+	r.HandleFunc("/v1/watch", handleWatch).Methods("GET")
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// namespaceFromRequest looks up the {ns} route variable, writing a 404 if
+// there is no such namespace.
+func namespaceFromRequest(w http.ResponseWriter, r *http.Request) (*memDB, bool) {
+	mem, err := st.Namespace(mux.Vars(r)["ns"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return nil, false
+	}
+	return mem, true
+}
+
+func handleListNamespaces(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, st.ListNamespaces())
+}
+
+func handleGetNamespace(w http.ResponseWriter, r *http.Request) {
+	mem, ok := namespaceFromRequest(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, mem.opts)
+}
+
+func handleCreateNamespace(w http.ResponseWriter, r *http.Request) {
+	var opts nsOptions
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &opts); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	}
+
+	mem, err := st.CreateNamespace(mux.Vars(r)["ns"], opts)
+	switch {
+	case errors.Is(err, errNamespaceExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusCreated, mem.opts)
+}
+
+func handleDropNamespace(w http.ResponseWriter, r *http.Request) {
+	err := st.DropNamespace(mux.Vars(r)["ns"])
+	switch {
+	case errors.Is(err, errNamespaceNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleNSGet(w http.ResponseWriter, r *http.Request) {
+	mem, ok := namespaceFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	value, err := mem.Get([]byte(mux.Vars(r)["key"]))
+	if err != nil {
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return
+	}
+	w.Write(value)
+}
+
+func handleNSSet(w http.ResponseWriter, r *http.Request) {
+	mem, ok := namespaceFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	value, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := mem.Set([]byte(mux.Vars(r)["key"]), value); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleNSDelete(w http.ResponseWriter, r *http.Request) {
+	mem, ok := namespaceFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	value, err := mem.Del(mux.Vars(r)["key"])
+	if err != nil {
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return
+	}
+	w.Write([]byte(value))
+}
+
+// handleVlogGC runs a value log garbage collection pass. Segments are only
+// rewritten if at least min_dead_ratio (default 0.5) of their bytes are dead.
+func handleVlogGC(w http.ResponseWriter, r *http.Request) {
+	mem, ok := namespaceFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	ratio := 0.5
+	if s := r.URL.Query().Get("min_dead_ratio"); s != "" {
+		var err error
+		ratio, err = strconv.ParseFloat(s, 64)
+		if err != nil {
+			http.Error(w, "Invalid min_dead_ratio", http.StatusBadRequest)
+			return
+		}
+	}
+
+	result, err := mem.GCValueLog(ratio)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// batchRequestOp is one operation of a /v1/batch request body.
+type batchRequestOp struct {
+	Op    string `json:"op"` // "set" or "del"
+	NS    string `json:"ns"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+func handleBatch(w http.ResponseWriter, r *http.Request) {
+	var ops []batchRequestOp
+	if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	b := &writeBatch{}
+	for _, op := range ops {
+		ns := op.NS
+		if ns == "" {
+			ns = defaultNamespace
+		}
+		switch op.Op {
+		case "set":
+			b.Put(ns, []byte(op.Key), []byte(op.Value))
+		case "del":
+			b.Delete(ns, []byte(op.Key))
+		default:
+			http.Error(w, "Unknown op "+op.Op, http.StatusBadRequest)
+			return
+		}
+	}
+
+	err := st.Write(b)
+	switch {
+	case errors.Is(err, errNamespaceNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Identities are kept in a reserved namespace, one per key:
+//
+//	identity/<name>  an authIdentity
+//
+// Only the SHA-256 of their tokens is stored, tokens are shown once, when
+// created.
+const authNamespace = "_auth"
+
+// Permissions, each granting the ones before it.
+const (
+	permRead  = "read"
+	permWrite = "write"
+	permAdmin = "admin"
+)
+
+var (
+	errBadGrant         = errors.New("a grant needs a namespace and a permission of read, write or admin")
+	errBadIdentityName  = errors.New("identity names may only contain letters, digits, _ and -, up to 64 of them")
+	errIdentityNotFound = errors.New("identity not found")
+)
+
+func permLevel(perm string) int {
+	switch perm {
+	case permRead:
+		return 1
+	case permWrite:
+		return 2
+	case permAdmin:
+		return 3
+	}
+	return 0
+}
+
+// authGrant grants a permission on the keys of Namespace starting with
+// Prefix. Namespace "*" is every namespace but the reserved ones, whose
+// names start with _, which only admin grants on "*" cover. Operations on
+// a whole namespace, like dropping it, need a grant with no prefix.
+type authGrant struct {
+	Namespace  string `json:"ns"`
+	Prefix     string `json:"prefix,omitempty"`
+	Permission string `json:"permission"`
+}
+
+func (g authGrant) allows(ns, key, perm string) bool {
+	switch {
+	case g.Namespace == "*":
+		if strings.HasPrefix(ns, "_") && g.Permission != permAdmin {
+			return false
+		}
+	case g.Namespace != ns:
+		return false
+	}
+	return strings.HasPrefix(key, g.Prefix) && permLevel(g.Permission) >= permLevel(perm)
+}
+
+// authIdentity is who a token authenticates, and what it may do.
+type authIdentity struct {
+	Name      string      `json:"name"`
+	TokenHash string      `json:"token_hash,omitempty"`
+	Grants    []authGrant `json:"grants"`
+	Created   time.Time   `json:"created"`
+}
+
+// Allows reports whether a grant of the identity allows perm on a key.
+func (id *authIdentity) Allows(ns, key, perm string) bool {
+	for _, g := range id.Grants {
+		if g.allows(ns, key, perm) {
+			return true
+		}
+	}
+	return false
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newToken() string {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return "kv_" + hex.EncodeToString(b)
+}
+
+// authenticator checks the credentials and permissions of HTTP requests.
+type authenticator struct {
+	s     *store
+	mem   *memDB
+	audit *slog.Logger
+
+	mu         sync.Mutex
+	identities map[string]*authIdentity // by name
+}
+
+// newAuthenticator creates the reserved namespace if needed and loads the
+// identities. With none yet, it creates a root identity with admin on
+// every namespace and returns its token, to be handed to the operator.
+func newAuthenticator(s *store) (*authenticator, string, error) {
+	mem, err := s.Namespace(authNamespace)
+	if errors.Is(err, errNamespaceNotFound) {
+		mem, err = s.CreateNamespace(authNamespace, nsOptions{})
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	a := &authenticator{
+		s:          s,
+		mem:        mem,
+		audit:      s.logger.With("log", "audit"),
+		identities: make(map[string]*authIdentity),
+	}
+	entries, err := scanPrefix(mem, "identity/")
+	if err != nil {
+		return nil, "", err
+	}
+	for _, entry := range entries {
+		var id authIdentity
+		if err := json.Unmarshal([]byte(entry.value), &id); err != nil {
+			return nil, "", fmt.Errorf("%s: %v", entry.key, err)
+		}
+		a.identities[id.Name] = &id
+	}
+
+	if len(a.identities) > 0 {
+		return a, "", nil
+	}
+	_, token, err := a.PutIdentity("root", []authGrant{{Namespace: "*", Permission: permAdmin}}, true)
+	if err != nil {
+		return nil, "", err
+	}
+	return a, token, nil
+}
+
+// Identities returns the identities sorted by name, without their token
+// hashes.
+func (a *authenticator) Identities() []authIdentity {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	list := []authIdentity{}
+	for _, id := range a.identities {
+		c := *id
+		c.TokenHash = ""
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// PutIdentity creates an identity, or replaces the grants of an existing
+// one. The token of a new identity, or of one rotated, is returned; an
+// existing identity keeps its token otherwise.
+func (a *authenticator) PutIdentity(name string, grants []authGrant, rotate bool) (authIdentity, string, error) {
+	if !validNamespaceName.MatchString(name) {
+		return authIdentity{}, "", errBadIdentityName
+	}
+	for _, g := range grants {
+		if g.Namespace == "" || permLevel(g.Permission) == 0 {
+			return authIdentity{}, "", errBadGrant
+		}
+	}
+	if grants == nil {
+		grants = []authGrant{}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	id := authIdentity{Name: name, Grants: grants, Created: time.Now().UTC()}
+	if old, ok := a.identities[name]; ok {
+		id.TokenHash, id.Created = old.TokenHash, old.Created
+	}
+	var token string
+	if id.TokenHash == "" || rotate {
+		token = newToken()
+		id.TokenHash = hashToken(token)
+	}
+	data, err := json.Marshal(id)
+	if err != nil {
+		return authIdentity{}, "", err
+	}
+	b := &writeBatch{}
+	b.Put(authNamespace, []byte("identity/"+name), data)
+	if err := a.s.Write(b); err != nil {
+		return authIdentity{}, "", err
+	}
+	stored := id
+	a.identities[name] = &stored
+	id.TokenHash = ""
+	return id, token, nil
+}
+
+// DeleteIdentity deletes an identity, its token no longer authenticates.
+func (a *authenticator) DeleteIdentity(name string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.identities[name]; !ok {
+		return errIdentityNotFound
+	}
+	b := &writeBatch{}
+	b.Delete(authNamespace, []byte("identity/"+name))
+	if err := a.s.Write(b); err != nil {
+		return err
+	}
+	delete(a.identities, name)
+	return nil
+}
+
+// authenticate returns the identity of a token, nil if none has it.
+func (a *authenticator) authenticate(token string) *authIdentity {
+	if token == "" {
+		return nil
+	}
+	hash := []byte(hashToken(token))
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, id := range a.identities {
+		if subtle.ConstantTimeCompare(hash, []byte(id.TokenHash)) == 1 {
+			return id
+		}
+	}
+	return nil
+}
+
+// identity returns the identity with a name, the common name of a client
+// certificate, nil if there is none.
+func (a *authenticator) identity(name string) *authIdentity {
+	if name == "" {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.identities[name]
+}
+
+// requestToken returns the bearer token or API key of a request.
+func requestToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// authCheck is a permission a request needs on a key of a namespace, or on
+// the whole namespace when key is empty.
+type authCheck struct {
+	ns, key, perm string
+}
+
+// requestChecks returns the permissions a request needs, from the route it
+// matched. Unknown routes need admin on every namespace.
+func requestChecks(r *http.Request) ([]authCheck, error) {
+	q := r.URL.Query()
+	queryNS := q.Get("ns")
+	if queryNS == "" {
+		queryNS = defaultNamespace
+	}
+	vars := mux.Vars(r)
+	template := ""
+	if route := mux.CurrentRoute(r); route != nil {
+		template, _ = route.GetPathTemplate()
+	}
+
+	switch template {
+	case "/":
+		return nil, nil
+	case "/get":
+		return []authCheck{{defaultNamespace, r.FormValue("key"), permRead}}, nil
+	case "/set", "/del":
+		return []authCheck{{defaultNamespace, r.FormValue("key"), permWrite}}, nil
+	case "/v1/ns":
+		// Any identity may list the namespaces
+		return nil, nil
+	case "/v1/ns/{ns}":
+		if r.Method == "GET" {
+			return []authCheck{{vars["ns"], "", permRead}}, nil
+		}
+		return []authCheck{{vars["ns"], "", permAdmin}}, nil
+	case "/v1/ns/{ns}/keys/{key:.+}":
+		if r.Method == "GET" {
+			return []authCheck{{vars["ns"], vars["key"], permRead}}, nil
+		}
+		return []authCheck{{vars["ns"], vars["key"], permWrite}}, nil
+	case "/v1/ns/{ns}/vlog/gc":
+		return []authCheck{{vars["ns"], "", permAdmin}}, nil
+	case "/v1/watch":
+		return []authCheck{{queryNS, q.Get("prefix"), permRead}}, nil
+	case "/v1/batch":
+		// The body is read here and put back for the handler
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(data))
+		var ops []batchRequestOp
+		if err := json.Unmarshal(data, &ops); err != nil {
+			// Left to the handler to reject
+			return nil, nil
+		}
+		checks := make([]authCheck, 0, len(ops))
+		for _, op := range ops {
+			ns := op.NS
+			if ns == "" {
+				ns = defaultNamespace
+			}
+			checks = append(checks, authCheck{ns, op.Key, permWrite})
+		}
+		return checks, nil
+	case "/replication/stream", "/replication/checkpoint", "/replication/status":
+		// Replicas read every namespace, reserved ones included
+		return []authCheck{{"*", "", permAdmin}}, nil
+	case "/admin/export":
+		return []authCheck{{queryNS, "", permRead}}, nil
+	case "/admin/import":
+		return []authCheck{{queryNS, "", permWrite}}, nil
+	}
+	return []authCheck{{"*", "", permAdmin}}, nil
+}
+
+// middleware authenticates requests by their token or, without one, by
+// the common name of their verified client certificate, which names an
+// identity. It rejects requests it cannot authenticate with 401, and those
+// whose identity lacks a permission the route needs with 403. Every
+// denial is written to the audit log.
+func (a *authenticator) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, cn := requestToken(r), clientCommonName(r)
+		var id *authIdentity
+		if token != "" || cn == "" {
+			id = a.authenticate(token)
+		} else {
+			id = a.identity(cn)
+		}
+		if id == nil {
+			reason := "missing or unknown token"
+			if token == "" && cn != "" {
+				reason = "no identity named after the client certificate"
+			}
+			a.deny(r, cn, reason, authCheck{})
+			w.Header().Set("WWW-Authenticate", `Bearer realm="kv"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		checks, err := requestChecks(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, c := range checks {
+			if !id.Allows(c.ns, c.key, c.perm) {
+				a.deny(r, id.Name, "permission denied", c)
+				http.Error(w, fmt.Sprintf("Forbidden: %s needs %s on %s", id.Name, c.perm, describeCheck(c)), http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func describeCheck(c authCheck) string {
+	if c.key == "" {
+		return "namespace " + c.ns
+	}
+	return fmt.Sprintf("key %q of namespace %s", c.key, c.ns)
+}
+
+func (a *authenticator) deny(r *http.Request, identity, reason string, c authCheck) {
+	attrs := []any{"reason", reason, "identity", identity, "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr}
+	if c.perm != "" {
+		attrs = append(attrs, "ns", c.ns, "key", c.key, "permission", c.perm)
+	}
+	a.audit.Warn("access denied", attrs...)
+}
+
+// register adds the admin routes of the identities:
+//
+//	GET    /admin/auth/identities                list the identities
+//	PUT    /admin/auth/identities/{name}         create an identity or set its grants, ?rotate=true for a new token
+//	DELETE /admin/auth/identities/{name}         delete an identity
+func (a *authenticator) register(r *mux.Router) {
+	r.HandleFunc("/admin/auth/identities", a.handleList).Methods("GET")
+	r.HandleFunc("/admin/auth/identities/{name}", a.handlePut).Methods("PUT")
+	r.HandleFunc("/admin/auth/identities/{name}", a.handleDelete).Methods("DELETE")
+}
+
+func (a *authenticator) handleList(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.Identities())
+}
+
+func (a *authenticator) handlePut(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Grants []authGrant `json:"grants"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	id, token, err := a.PutIdentity(mux.Vars(r)["name"], req.Grants, r.URL.Query().Get("rotate") == "true")
+	switch {
+	case errors.Is(err, errBadGrant), errors.Is(err, errBadIdentityName):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp := struct {
+		authIdentity
+		Token string `json:"token,omitempty"`
+	}{id, token}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (a *authenticator) handleDelete(w http.ResponseWriter, r *http.Request) {
+	err := a.DeleteIdentity(mux.Vars(r)["name"])
+	switch {
+	case errors.Is(err, errIdentityNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
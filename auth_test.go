@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// lockedBuffer is a bytes.Buffer safe to write from server goroutines.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestAuthGrants(t *testing.T) {
+	id := authIdentity{Grants: []authGrant{
+		{Namespace: "users", Prefix: "user:", Permission: permWrite},
+		{Namespace: "*", Permission: permRead},
+	}}
+	tests := []struct {
+		ns, key, perm string
+		want          bool
+	}{
+		{"users", "user:1", permWrite, true},
+		{"users", "user:1", permAdmin, false},
+		{"users", "other", permWrite, false},
+		{"users", "other", permRead, true},
+		{"users", "", permWrite, false},
+		{"orders", "o1", permRead, true},
+		{authNamespace, "identity/root", permRead, false},
+	}
+	for _, tt := range tests {
+		if got := id.Allows(tt.ns, tt.key, tt.perm); got != tt.want {
+			t.Errorf("Allows(%s, %q, %s) = %v, expected %v", tt.ns, tt.key, tt.perm, got, tt.want)
+		}
+	}
+	admin := authIdentity{Grants: []authGrant{{Namespace: "*", Permission: permAdmin}}}
+	if !admin.Allows(authNamespace, "identity/root", permRead) {
+		t.Errorf("Expected admin on * to cover the reserved namespaces")
+	}
+}
+
+func TestAuth(t *testing.T) {
+	var logs lockedBuffer
+	opts := defaultStoreOptions()
+	opts.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+	s, err := openStoreWith(filepath.Join(t.TempDir(), "data"), opts)
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	st = s
+	rs := newReplicationServer(s, 1<<20)
+	if _, err := s.CreateNamespace("users", nsOptions{}); err != nil {
+		t.Fatalf("Error creating namespace: %v", err)
+	}
+	auth, rootToken, err := newAuthenticator(s)
+	if err != nil || rootToken == "" {
+		t.Fatalf("Expected a root token, got %q, %v", rootToken, err)
+	}
+	r := mux.NewRouter()
+	registerV1Routes(r)
+	auth.register(r)
+	rs.register(r)
+	r.Use(auth.middleware)
+	url := serveLoopback(t, r)
+
+	do := func(method, path, token, body string) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, url+path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error requesting %s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode
+	}
+
+	if status := do("GET", "/v1/ns", "", ""); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a token, got %d", status)
+	}
+	if status := do("GET", "/v1/ns", "kv_wrong", ""); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 with an unknown token, got %d", status)
+	}
+
+	// The root identity creates one limited to part of a namespace
+	req, _ := http.NewRequest("PUT", url+"/admin/auth/identities/alice", strings.NewReader(
+		`{"grants":[{"ns":"users","prefix":"user:","permission":"write"},{"ns":"default","permission":"read"}]}`))
+	req.Header.Set("X-API-Key", rootToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error creating identity: %v", err)
+	}
+	var created struct {
+		Name  string `json:"name"`
+		Token string `json:"token"`
+	}
+	json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || created.Token == "" {
+		t.Fatalf("Unexpected identity %d %+v", resp.StatusCode, created)
+	}
+	alice := created.Token
+
+	tests := []struct {
+		method, path, body string
+		want               int
+	}{
+		{"PUT", "/v1/ns/users/keys/user:1", "x", http.StatusNoContent},
+		{"GET", "/v1/ns/users/keys/user:1", "", http.StatusOK},
+		{"PUT", "/v1/ns/users/keys/admin:1", "x", http.StatusForbidden},
+		{"GET", "/v1/ns/default/keys/a", "", http.StatusNotFound},
+		{"PUT", "/v1/ns/default/keys/a", "x", http.StatusForbidden},
+		{"DELETE", "/v1/ns/users", "", http.StatusForbidden},
+		{"POST", "/v1/batch", `[{"op":"set","ns":"users","key":"user:2","value":"y"}]`, http.StatusNoContent},
+		{"POST", "/v1/batch", `[{"op":"set","ns":"users","key":"user:3","value":"y"},{"op":"del","key":"a"}]`, http.StatusForbidden},
+		{"GET", "/v1/stats", "", http.StatusForbidden},
+		{"GET", "/admin/auth/identities", "", http.StatusForbidden},
+		{"GET", "/replication/status", "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if status := do(tt.method, tt.path, alice, tt.body); status != tt.want {
+			t.Errorf("%s %s: expected %d, got %d", tt.method, tt.path, tt.want, status)
+		}
+	}
+	if _, err := s.namespaces["users"].Get([]byte("user:3")); err == nil {
+		t.Errorf("Expected the denied batch not to be applied")
+	}
+	if got := logs.String(); !strings.Contains(got, "access denied") || !strings.Contains(got, "identity=alice") ||
+		!strings.Contains(got, "key=admin:1") || !strings.Contains(got, "reason=\"missing or unknown token\"") {
+		t.Errorf("Expected the denials in the audit log, got %s", got)
+	}
+
+	// Replicas follow with the token of an admin
+	replica, err := openStore(filepath.Join(t.TempDir(), "replica"))
+	if err != nil {
+		t.Fatalf("Error opening replica: %v", err)
+	}
+	rep := startReplica(replica, url, defaultStoreOptions(), replicaConfig{Token: rootToken})
+	defer rep.Close()
+	waitForSeq(t, replica, s)
+
+	// Identities are kept in the store
+	reloaded, token, err := newAuthenticator(s)
+	if err != nil || token != "" {
+		t.Fatalf("Expected no new root token, got %q, %v", token, err)
+	}
+	if ids := reloaded.Identities(); len(ids) != 2 || ids[0].Name != "alice" || ids[0].TokenHash != "" {
+		t.Errorf("Unexpected identities %+v", ids)
+	}
+	if reloaded.authenticate(alice) == nil {
+		t.Errorf("Expected the token to authenticate after reloading")
+	}
+
+	if status := do("DELETE", "/admin/auth/identities/alice", alice, ""); status != http.StatusForbidden {
+		t.Errorf("Expected alice not to delete identities, got %d", status)
+	}
+	if status := do("DELETE", "/admin/auth/identities/alice", rootToken, ""); status != http.StatusNoContent {
+		t.Errorf("Error deleting identity: %d", status)
+	}
+	if status := do("GET", "/v1/ns/users/keys/user:1", alice, ""); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 once the identity is deleted, got %d", status)
+	}
+}
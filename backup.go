@@ -0,0 +1,373 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+var errBackupNotFound = errors.New("backup not found")
+
+// backupEngine keeps incremental backups of a store in a directory:
+//
+//	files/<sha256>   the content of every file backed up, stored once
+//	meta/<id>.json   the list of files making up each backup
+//
+// Files are named after their content, so a backup only adds the files
+// that changed since the others, typically the WAL and the SST files written
+// since; unchanged SST files are shared.
+type backupEngine struct {
+	mu  sync.Mutex
+	dir string
+}
+
+// backupInfo describes one backup, as stored in meta/<id>.json.
+type backupInfo struct {
+	ID       int          `json:"id"`
+	Created  time.Time    `json:"created"`
+	Size     int64        `json:"size"`      // bytes of all its files
+	NewBytes int64        `json:"new_bytes"` // bytes it did not share with earlier backups
+	Files    []backupFile `json:"files"`
+}
+
+// backupFile is a file of a backup, by its path in the store directory.
+type backupFile struct {
+	Path string `json:"path"`
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+func openBackupEngine(dir string) (*backupEngine, error) {
+	for _, sub := range []string{"files", "meta"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &backupEngine{dir: dir}, nil
+}
+
+func (be *backupEngine) metaPath(id int) string {
+	return filepath.Join(be.dir, "meta", fmt.Sprintf("%d.json", id))
+}
+
+func (be *backupEngine) filePath(hash string) string {
+	return filepath.Join(be.dir, "files", hash)
+}
+
+// CreateBackup backs s up while it keeps serving: it takes a checkpoint,
+// which only blocks writes while it is linked and copied, then moves the
+// files of the checkpoint the backup does not hold yet into files/.
+func (be *backupEngine) CreateBackup(s *store) (backupInfo, error) {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	backups, err := be.list()
+	if err != nil {
+		return backupInfo{}, err
+	}
+	info := backupInfo{ID: 1, Created: time.Now().UTC()}
+	if len(backups) > 0 {
+		info.ID = backups[len(backups)-1].ID + 1
+	}
+
+	tmp := filepath.Join(be.dir, fmt.Sprintf("tmp_%d", info.ID))
+	os.RemoveAll(tmp)
+	defer os.RemoveAll(tmp)
+	if err := s.Checkpoint(tmp); err != nil {
+		return info, err
+	}
+
+	err = filepath.Walk(tmp, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(tmp, path)
+		if err != nil {
+			return err
+		}
+		hash, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		info.Files = append(info.Files, backupFile{Path: filepath.ToSlash(rel), Hash: hash, Size: fi.Size()})
+		info.Size += fi.Size()
+
+		if _, err := os.Stat(be.filePath(hash)); err == nil {
+			return nil
+		}
+		info.NewBytes += fi.Size()
+		return os.Rename(path, be.filePath(hash))
+	})
+	if err != nil {
+		return info, err
+	}
+
+	// The backup only exists once its meta file does
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return info, err
+	}
+	metaTmp := be.metaPath(info.ID) + ".tmp"
+	if err := os.WriteFile(metaTmp, data, 0644); err != nil {
+		return info, err
+	}
+	return info, os.Rename(metaTmp, be.metaPath(info.ID))
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// List returns every backup, oldest first.
+func (be *backupEngine) List() ([]backupInfo, error) {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	return be.list()
+}
+
+func (be *backupEngine) list() ([]backupInfo, error) {
+	matches, err := filepath.Glob(filepath.Join(be.dir, "meta", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var backups []backupInfo
+	for _, path := range matches {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var info backupInfo
+		if err := json.Unmarshal(data, &info); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		backups = append(backups, info)
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].ID < backups[j].ID
+	})
+	return backups, nil
+}
+
+// Restore writes backup id, or the latest one if id is 0, to dir, which must
+// not exist yet. Every file is checked against its hash.
+func (be *backupEngine) Restore(id int, dir string) error {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	backups, err := be.list()
+	if err != nil {
+		return err
+	}
+	var info *backupInfo
+	for i := range backups {
+		if backups[i].ID == id || (id == 0 && i == len(backups)-1) {
+			info = &backups[i]
+		}
+	}
+	if info == nil {
+		return errBackupNotFound
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("%s already exists", dir)
+	}
+
+	tmp := dir + ".tmp"
+	os.RemoveAll(tmp)
+	for _, file := range info.Files {
+		dst := filepath.Join(tmp, filepath.FromSlash(file.Path))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			os.RemoveAll(tmp)
+			return err
+		}
+		if err := copyFile(be.filePath(file.Hash), dst); err != nil {
+			os.RemoveAll(tmp)
+			return err
+		}
+		if hash, err := hashFile(dst); err != nil || hash != file.Hash {
+			os.RemoveAll(tmp)
+			return fmt.Errorf("%s of backup %d is corrupt", file.Path, info.ID)
+		}
+	}
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dir)
+}
+
+// Purge deletes all backups but the keep most recent ones, and the files
+// only they used. It returns the number of backups deleted.
+func (be *backupEngine) Purge(keep int) (int, error) {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	backups, err := be.list()
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for len(backups) > keep {
+		if err := os.Remove(be.metaPath(backups[0].ID)); err != nil {
+			return purged, err
+		}
+		backups = backups[1:]
+		purged++
+	}
+
+	used := make(map[string]bool)
+	for _, info := range backups {
+		for _, file := range info.Files {
+			used[file.Hash] = true
+		}
+	}
+	files, err := os.ReadDir(filepath.Join(be.dir, "files"))
+	if err != nil {
+		return purged, err
+	}
+	for _, f := range files {
+		if !used[f.Name()] {
+			if err := os.Remove(be.filePath(f.Name())); err != nil {
+				return purged, err
+			}
+		}
+	}
+	return purged, nil
+}
+
+// backups is the backup engine of the server, nil unless -backup-dir is set.
+var backups *backupEngine
+
+func handleCreateBackup(w http.ResponseWriter, r *http.Request) {
+	if backups == nil {
+		http.Error(w, "backups are not enabled, start the server with -backup-dir", http.StatusNotFound)
+		return
+	}
+	info, err := backups.CreateBackup(st)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	info.Files = nil
+	writeJSON(w, http.StatusCreated, info)
+}
+
+func handleListBackups(w http.ResponseWriter, r *http.Request) {
+	if backups == nil {
+		http.Error(w, "backups are not enabled, start the server with -backup-dir", http.StatusNotFound)
+		return
+	}
+	list, err := backups.List()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := range list {
+		list[i].Files = nil
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// runBackup runs kv backup create, list, restore and purge.
+func runBackup(args []string) error {
+	const usage = "usage: kv backup create|list|restore|purge [flags]"
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+	fs := flag.NewFlagSet("backup "+args[0], flag.ExitOnError)
+	backupDir := fs.String("backup-dir", "", "directory holding the backups")
+	var sf storeFlags
+	var (
+		id   *int
+		keep *int
+	)
+	switch args[0] {
+	case "create":
+		sf.register(fs)
+	case "restore":
+		id = fs.Int("id", 0, "backup to restore, the latest if 0")
+	case "purge":
+		keep = fs.Int("keep", 1, "number of most recent backups to keep")
+	case "list":
+	default:
+		return errors.New(usage)
+	}
+	fs.Parse(args[1:])
+	if *backupDir == "" {
+		return errors.New("-backup-dir is required")
+	}
+	be, err := openBackupEngine(*backupDir)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "create":
+		s, err := sf.open()
+		if err != nil {
+			return err
+		}
+		info, err := be.CreateBackup(s)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("backup %d: %d files, %d bytes, %d new\n", info.ID, len(info.Files), info.Size, info.NewBytes)
+	case "list":
+		list, err := be.List()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tCREATED\tFILES\tSIZE\tNEW")
+		for _, info := range list {
+			fmt.Fprintf(tw, "%d\t%s\t%d\t%d\t%d\n", info.ID, info.Created.Format(time.RFC3339), len(info.Files), info.Size, info.NewBytes)
+		}
+		return tw.Flush()
+	case "restore":
+		if fs.NArg() != 1 {
+			return errors.New("usage: kv backup restore -backup-dir <dir> [-id N] <target dir>")
+		}
+		if err := be.Restore(*id, fs.Arg(0)); err != nil {
+			return err
+		}
+		fmt.Printf("restored to %s\n", fs.Arg(0))
+	case "purge":
+		if *keep < 0 {
+			return errors.New("-keep must not be negative")
+		}
+		purged, err := be.Purge(*keep)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("purged %s\n", plural(purged, "backup"))
+	}
+	return nil
+}
+
+func plural(n int, what string) string {
+	s := strconv.Itoa(n) + " " + what
+	if n != 1 {
+		s += "s"
+	}
+	return s
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackupEngine(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openStore(filepath.Join(dir, "data"))
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	mem, err := s.CreateNamespace("backup", nsOptions{FlushSize: 1 << 20})
+	if err != nil {
+		t.Fatalf("Error creating namespace: %v", err)
+	}
+	be, err := openBackupEngine(filepath.Join(dir, "backups"))
+	if err != nil {
+		t.Fatalf("Error opening backup engine: %v", err)
+	}
+
+	mem.Set([]byte("a"), []byte("1"))
+	if _, err := mem.Flush(); err != nil {
+		t.Fatalf("Error flushing: %v", err)
+	}
+	first, err := be.CreateBackup(s)
+	if err != nil {
+		t.Fatalf("Error creating backup: %v", err)
+	}
+	if first.ID != 1 || first.NewBytes != first.Size {
+		t.Errorf("Expected backup 1 to only hold new files, got %+v", first)
+	}
+
+	mem.Set([]byte("b"), []byte("2"))
+	mem.Flush()
+	mem.Set([]byte("c"), []byte("3"))
+	second, err := be.CreateBackup(s)
+	if err != nil {
+		t.Fatalf("Error creating backup: %v", err)
+	}
+	if second.ID != 2 || second.NewBytes >= second.Size {
+		t.Errorf("Expected backup 2 to share files with backup 1, got %+v", second)
+	}
+	hashes := make(map[string]string)
+	for _, file := range first.Files {
+		hashes[file.Path] = file.Hash
+	}
+	for _, file := range second.Files {
+		if file.Path == "ns_backup/sst_1.sst" && file.Hash != hashes[file.Path] {
+			t.Errorf("Expected sst_1.sst to be shared by both backups")
+		}
+	}
+
+	// Restore the first backup, then the latest one after purging the first
+	restored := filepath.Join(dir, "restored-1")
+	if err := be.Restore(1, restored); err != nil {
+		t.Fatalf("Error restoring: %v", err)
+	}
+	if err := be.Restore(1, restored); err == nil {
+		t.Errorf("Expected restoring over an existing directory to fail")
+	}
+	if n, err := be.Purge(1); err != nil || n != 1 {
+		t.Fatalf("Expected 1 backup purged, got %d, %v", n, err)
+	}
+	if err := be.Restore(1, filepath.Join(dir, "purged")); err != errBackupNotFound {
+		t.Errorf("Expected %v, got %v", errBackupNotFound, err)
+	}
+	restored = filepath.Join(dir, "restored-2")
+	if err := be.Restore(0, restored); err != nil {
+		t.Fatalf("Error restoring: %v", err)
+	}
+
+	s2, err := openStore(restored)
+	if err != nil {
+		t.Fatalf("Error opening restored store: %v", err)
+	}
+	mem2, err := s2.Namespace("backup")
+	if err != nil {
+		t.Fatalf("Error opening restored namespace: %v", err)
+	}
+	for key, want := range map[string]string{"a": "1", "b": "2", "c": "3"} {
+		if got, err := mem2.Get([]byte(key)); err != nil || string(got) != want {
+			t.Errorf("Expected %s=%s, got %q, %v", key, want, got, err)
+		}
+	}
+
+	// Every file left is used by the remaining backup
+	files, _ := os.ReadDir(filepath.Join(dir, "backups", "files"))
+	used := make(map[string]bool)
+	for _, file := range second.Files {
+		used[file.Hash] = true
+	}
+	if len(files) != len(used) {
+		t.Errorf("Expected %d files after purging, got %d", len(used), len(files))
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Operation types shared by the WAL, the memtable and SST files.
+const (
+	opDel      byte = iota // key was deleted
+	opSet                  // key was set
+	opSetTTL               // key was set with an expiry (SST files only)
+	opDropNS               // namespace was dropped (WAL only)
+	opValuePtr             // key was set, the value is in the value log (SST files only)
+	opIngest               // SST files were added to the namespace, its earlier writes are flushed (WAL only)
+)
+
+var errCorruptBatch = errors.New("corrupt write batch")
+
+type batchOp struct {
+	op      byte
+	ns      string
+	key     []byte
+	value   []byte
+	expires int64 // unix nanoseconds, 0 means the key never expires
+}
+
+// writeBatch groups writes that are logged as a single WAL record, so they
+// are applied all together or not at all, even when they touch several
+// namespaces.
+type writeBatch struct {
+	seq uint64
+	ops []batchOp
+}
+
+func (b *writeBatch) Put(ns string, key, value []byte) {
+	b.ops = append(b.ops, batchOp{op: opSet, ns: ns, key: key, value: value})
+}
+
+func (b *writeBatch) Delete(ns string, key []byte) {
+	b.ops = append(b.ops, batchOp{op: opDel, ns: ns, key: key})
+}
+
+func (b *writeBatch) Len() int {
+	return len(b.ops)
+}
+
+// encode lays the batch out as
+// seq(8) count(4) then for every op: op(1) nsLen(2) ns keyLen(4) key valueLen(4) value expires(8)
+func (b *writeBatch) encode() []byte {
+	buf := make([]byte, 0, 12)
+	buf = binary.LittleEndian.AppendUint64(buf, b.seq)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(b.ops)))
+	for _, op := range b.ops {
+		buf = append(buf, op.op)
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(len(op.ns)))
+		buf = append(buf, op.ns...)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(op.key)))
+		buf = append(buf, op.key...)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(op.value)))
+		buf = append(buf, op.value...)
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(op.expires))
+	}
+	return buf
+}
+
+func decodeBatch(buf []byte) (*writeBatch, error) {
+	if len(buf) < 12 {
+		return nil, errCorruptBatch
+	}
+	b := &writeBatch{seq: binary.LittleEndian.Uint64(buf[:8])}
+	count := int(binary.LittleEndian.Uint32(buf[8:12]))
+	buf = buf[12:]
+
+	for i := 0; i < count; i++ {
+		if len(buf) < 3 {
+			return nil, errCorruptBatch
+		}
+		var op batchOp
+		op.op = buf[0]
+		nsLen := int(binary.LittleEndian.Uint16(buf[1:3]))
+		buf = buf[3:]
+		if len(buf) < nsLen+4 {
+			return nil, errCorruptBatch
+		}
+		op.ns = string(buf[:nsLen])
+		buf = buf[nsLen:]
+
+		keyLen := int(binary.LittleEndian.Uint32(buf[:4]))
+		buf = buf[4:]
+		if len(buf) < keyLen+4 {
+			return nil, errCorruptBatch
+		}
+		op.key = buf[:keyLen]
+		buf = buf[keyLen:]
+
+		valueLen := int(binary.LittleEndian.Uint32(buf[:4]))
+		buf = buf[4:]
+		if len(buf) < valueLen+8 {
+			return nil, errCorruptBatch
+		}
+		op.value = buf[:valueLen]
+		op.expires = int64(binary.LittleEndian.Uint64(buf[valueLen : valueLen+8]))
+		buf = buf[valueLen+8:]
+
+		b.ops = append(b.ops, op)
+	}
+	return b, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+)
+
+// bloomBitsPerKey gives a false positive rate of about 1%.
+const bloomBitsPerKey = 10
+
+// bloomFilter is a bit array followed by one byte holding the number of
+// probes per key.
+type bloomFilter []byte
+
+// bloomFilterSize returns the size of the filter built for n keys, so it can
+// be known before the keys are written.
+func bloomFilterSize(n int) int {
+	bits := n * bloomBitsPerKey
+	if bits < 64 {
+		bits = 64
+	}
+	return (bits+7)/8 + 1
+}
+
+func newBloomFilter(entries []memEntry) bloomFilter {
+	hashes := make([]uint32, len(entries))
+	for i, entry := range entries {
+		hashes[i] = bloomHash(entry.key)
+	}
+	return newBloomFilterFromHashes(hashes)
+}
+
+// newBloomFilterFromHashes builds the filter of the keys hashed with
+// bloomHash.
+func newBloomFilterFromHashes(hashes []uint32) bloomFilter {
+	size := bloomFilterSize(len(hashes))
+	filter := make(bloomFilter, size)
+	bits := uint32((size - 1) * 8)
+
+	// k = bitsPerKey * ln(2), rounded down
+	k := byte(bloomBitsPerKey * 69 / 100)
+	filter[size-1] = k
+
+	for _, h := range hashes {
+		delta := h>>17 | h<<15
+		for i := byte(0); i < k; i++ {
+			pos := h % bits
+			filter[pos/8] |= 1 << (pos % 8)
+			h += delta
+		}
+	}
+	return filter
+}
+
+// mayContain returns false if key is certainly not in the filter. An empty
+// filter matches everything.
+func (f bloomFilter) mayContain(key string) bool {
+	if len(f) < 2 {
+		return true
+	}
+	bits := uint32((len(f) - 1) * 8)
+	k := f[len(f)-1]
+
+	h := bloomHash(key)
+	delta := h>>17 | h<<15
+	for i := byte(0); i < k; i++ {
+		pos := h % bits
+		if f[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+		h += delta
+	}
+	return true
+}
+
+func bloomHash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// bloomStats count how well the filters of SST files avoid block reads.
+type bloomStats struct {
+	checks         atomic.Uint64 // lookups that consulted a filter
+	negatives      atomic.Uint64 // lookups the filter answered without a read
+	falsePositives atomic.Uint64 // lookups the filter let through for nothing
+}
+
+// record counts one lookup; a nil bloomStats counts nothing.
+func (b *bloomStats) record(negative, found bool) {
+	if b == nil {
+		return
+	}
+	b.checks.Add(1)
+	if negative {
+		b.negatives.Add(1)
+	} else if !found {
+		b.falsePositives.Add(1)
+	}
+}
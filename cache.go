@@ -0,0 +1,234 @@
+package main
+
+import (
+	"container/list"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+const blockCacheShards = 16
+
+// cacheStats are the counters reported for the table and block caches.
+// For the block cache Used and Capacity are bytes, for the table cache they
+// are open files.
+type cacheStats struct {
+	Hits     uint64  `json:"hits"`
+	Misses   uint64  `json:"misses"`
+	HitRate  float64 `json:"hit_rate"`
+	Used     int64   `json:"used"`
+	Capacity int64   `json:"capacity"`
+}
+
+func newCacheStats(hits, misses uint64, used, capacity int64) cacheStats {
+	stats := cacheStats{Hits: hits, Misses: misses, Used: used, Capacity: capacity}
+	if hits+misses > 0 {
+		stats.HitRate = float64(hits) / float64(hits+misses)
+	}
+	return stats
+}
+
+type blockCacheKey struct {
+	table  uint64
+	offset int64
+}
+
+type blockCacheItem struct {
+	key     blockCacheKey
+	entries []memEntry
+	size    int64
+}
+
+type blockCacheShard struct {
+	mu       sync.Mutex
+	capacity int64
+	used     int64
+	ll       *list.List // most recently used at the front
+	items    map[blockCacheKey]*list.Element
+}
+
+// blockCache is a sharded LRU cache of decoded data blocks, bounded by the
+// uncompressed size of the blocks it holds. A zero capacity disables it.
+type blockCache struct {
+	shards [blockCacheShards]*blockCacheShard
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+func newBlockCache(capacity int64) *blockCache {
+	c := &blockCache{}
+	for i := range c.shards {
+		c.shards[i] = &blockCacheShard{
+			capacity: capacity / blockCacheShards,
+			ll:       list.New(),
+			items:    make(map[blockCacheKey]*list.Element),
+		}
+	}
+	return c
+}
+
+func (c *blockCache) shard(key blockCacheKey) *blockCacheShard {
+	h := key.table*31 + uint64(key.offset)
+	return c.shards[h%blockCacheShards]
+}
+
+func (c *blockCache) get(key blockCacheKey) ([]memEntry, bool) {
+	sh := c.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	el, ok := sh.items[key]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	sh.ll.MoveToFront(el)
+	return el.Value.(*blockCacheItem).entries, true
+}
+
+func (c *blockCache) add(key blockCacheKey, entries []memEntry, size int64) {
+	sh := c.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if size > sh.capacity {
+		return
+	}
+	if el, ok := sh.items[key]; ok {
+		sh.ll.MoveToFront(el)
+		return
+	}
+
+	sh.items[key] = sh.ll.PushFront(&blockCacheItem{key: key, entries: entries, size: size})
+	sh.used += size
+	for sh.used > sh.capacity {
+		oldest := sh.ll.Back()
+		item := oldest.Value.(*blockCacheItem)
+		sh.ll.Remove(oldest)
+		delete(sh.items, item.key)
+		sh.used -= item.size
+	}
+}
+
+func (c *blockCache) Stats() cacheStats {
+	var used, capacity int64
+	for _, sh := range c.shards {
+		sh.mu.Lock()
+		used += sh.used
+		capacity += sh.capacity
+		sh.mu.Unlock()
+	}
+	return newCacheStats(c.hits.Load(), c.misses.Load(), used, capacity)
+}
+
+type cachedTable struct {
+	reader  *sstReader
+	refs    int
+	evicted bool
+}
+
+// tableCache keeps up to max SST readers open, least recently used first
+// out. Readers are reference counted so one being used by a lookup is only
+// closed once the lookup releases it.
+type tableCache struct {
+	mu     sync.Mutex
+	max    int
+	nextID uint64
+	ll     *list.List // of *cachedTable, most recently used at the front
+	tables map[string]*list.Element
+	keys   *keyring
+	hits   uint64
+	misses uint64
+	bloom  bloomStats
+}
+
+func newTableCache(max int, keys *keyring) *tableCache {
+	return &tableCache{
+		max:    max,
+		keys:   keys,
+		ll:     list.New(),
+		tables: make(map[string]*list.Element),
+	}
+}
+
+// get returns the reader of the SST file at path, opening it if needed. The
+// returned function must be called once the reader is no longer used.
+func (c *tableCache) get(path string) (*sstReader, func(), error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.tables[path]
+	if ok {
+		c.hits++
+		c.ll.MoveToFront(el)
+	} else {
+		c.misses++
+		c.nextID++
+		r, err := openSSTReader(path, c.nextID, c.keys)
+		if err != nil {
+			return nil, nil, err
+		}
+		r.bloom = &c.bloom
+		el = c.ll.PushFront(&cachedTable{reader: r})
+		c.tables[path] = el
+		c.evictOverflow()
+	}
+
+	t := el.Value.(*cachedTable)
+	t.refs++
+	release := func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		t.refs--
+		if t.evicted && t.refs == 0 {
+			t.reader.Close()
+		}
+	}
+	return t.reader, release, nil
+}
+
+func (c *tableCache) evictOverflow() {
+	for c.ll.Len() > c.max && c.ll.Len() > 1 {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+func (c *tableCache) removeElement(el *list.Element) {
+	t := el.Value.(*cachedTable)
+	c.ll.Remove(el)
+	delete(c.tables, t.reader.path)
+	t.evicted = true
+	if t.refs == 0 {
+		t.reader.Close()
+	}
+}
+
+// evict drops the reader of path, which is about to be removed or replaced.
+func (c *tableCache) evict(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.tables[path]; ok {
+		c.removeElement(el)
+	}
+}
+
+// evictDir drops the readers of every file in dir.
+func (c *tableCache) evictDir(dir string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for path, el := range c.tables {
+		if filepath.Dir(path) == filepath.Clean(dir) {
+			c.removeElement(el)
+		}
+	}
+}
+
+func (c *tableCache) Stats() cacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return newCacheStats(c.hits, c.misses, int64(c.ll.Len()), int64(c.max))
+}
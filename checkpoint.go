@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var errCheckpointExists = errors.New("checkpoint directory already exists")
+
+// Checkpoint writes a consistent copy of the store to dir, which must not
+// exist yet, and can be opened like any other store. SST files and full
+// value log segments never change once written, so they are hard linked when
+// dir is on the same file system; the WAL, OPTIONS files and the value log
+// segments still being appended to are copied. Writes are blocked while the
+// checkpoint is taken.
+func (s *store) Checkpoint(dir string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, err := os.Stat(dir); err == nil {
+		return errCheckpointExists
+	}
+
+	// Build the checkpoint aside so a failure leaves nothing behind
+	tmp := dir + ".tmp"
+	os.RemoveAll(tmp)
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return err
+	}
+	if err := s.checkpointLocked(tmp); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	return os.Rename(tmp, dir)
+}
+
+func (s *store) checkpointLocked(dir string) error {
+	for name, mem := range s.namespaces {
+		rel, err := filepath.Rel(s.dir, s.nsDir(name))
+		if err != nil {
+			return err
+		}
+		nsDir := filepath.Join(dir, rel)
+		if err := os.MkdirAll(nsDir, 0755); err != nil {
+			return err
+		}
+
+		optionsPath := filepath.Join(mem.file.dir, optionsFileName)
+		if _, err := os.Stat(optionsPath); err == nil {
+			if err := copyFile(optionsPath, filepath.Join(nsDir, optionsFileName)); err != nil {
+				return err
+			}
+		}
+		for i := 1; i <= mem.file.noFiles; i++ {
+			if err := linkOrCopyFile(mem.file.sstPath(i), filepath.Join(nsDir, filepath.Base(mem.file.sstPath(i)))); err != nil {
+				return err
+			}
+		}
+		active := mem.vlog.activeSegment()
+		for _, n := range mem.vlog.segments {
+			src := mem.vlog.segmentPath(n)
+			dst := filepath.Join(nsDir, filepath.Base(src))
+			if n == active {
+				err = copyFile(src, dst)
+			} else {
+				err = linkOrCopyFile(src, dst)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := s.wal.Sync(); err != nil {
+		return err
+	}
+	return copyFile(filepath.Join(s.dir, walFileName), filepath.Join(dir, walFileName))
+}
+
+// linkOrCopyFile hard links src to dst, copying it when linking is not
+// possible, such as across file systems.
+func linkOrCopyFile(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	return copyFile(src, dst)
+}
+
+// copyFile copies src to dst and syncs dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// copyDir copies the files under src to dst, which must not exist yet.
+func copyDir(src, dst string) error {
+	return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return os.MkdirAll(filepath.Join(dst, rel), 0755)
+		}
+		return copyFile(path, filepath.Join(dst, rel))
+	})
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// fullCompactionTrigger is the number of SST files above which a namespace
+// using compactionFull merges them into one.
+const fullCompactionTrigger = 4
+
+func (mem *memDB) maybeCompact() error {
+	if mem.opts.Compaction != compactionFull || mem.file.noFiles <= fullCompactionTrigger {
+		return nil
+	}
+	return mem.compactAll()
+}
+
+// Compact merges every SST file of the namespace into one, whatever its
+// compaction style.
+func (mem *memDB) Compact() error {
+	mem.store.mu.Lock()
+	defer mem.store.mu.Unlock()
+
+	return mem.compactAll()
+}
+
+// CompactRange merges the SST files holding keys between start and end,
+// inclusive; an empty end means no upper bound. As files are searched newest
+// first, the merge covers the oldest file overlapping the range and every
+// newer file. It returns the number of files merged.
+func (mem *memDB) CompactRange(start, end string) (int, error) {
+	mem.store.mu.Lock()
+	defer mem.store.mu.Unlock()
+
+	for i := 1; i <= mem.file.noFiles; i++ {
+		reader, release, err := mem.store.tables.get(mem.file.sstPath(i))
+		if err != nil {
+			return 0, err
+		}
+		first, last, err := reader.keyRange(mem.store.blocks)
+		release()
+		if err != nil {
+			return 0, err
+		}
+		if last < start || (end != "" && first > end) {
+			continue
+		}
+		merged := mem.file.noFiles - i + 1
+		return merged, mem.compactFrom(i)
+	}
+	return 0, nil
+}
+
+// compactAll merges every SST file of the namespace into a single sst_1.sst.
+// As no older file remains, deleted and expired keys are dropped entirely.
+func (mem *memDB) compactAll() error {
+	return mem.compactFrom(1)
+}
+
+// compactFrom merges SST files from..noFiles into sst_<from>.sst. Deleted and
+// expired keys are only dropped when no older file remains, as they may
+// still hide an older value otherwise.
+func (mem *memDB) compactFrom(from int) error {
+	if mem.file.noFiles < from {
+		return nil
+	}
+	start := time.Now()
+	now := start.UnixNano()
+	info := CompactionInfo{Namespace: mem.name, Output: mem.file.sstPath(from)}
+	for i := from; i <= mem.file.noFiles; i++ {
+		info.Inputs = append(info.Inputs, mem.file.sstPath(i))
+	}
+	mem.store.events.OnCompactionBegin(info)
+	err := mem.mergeFiles(from, now)
+	info.Duration, info.Err = time.Since(start), err
+	if err != nil {
+		mem.store.logger.Error("compaction failed", "namespace", mem.name, "files", len(info.Inputs), "err", err)
+	} else {
+		mem.store.metrics.compactions.observe(info.Duration)
+		mem.store.logger.Debug("compacted", "namespace", mem.name, "files", len(info.Inputs), "output", info.Output, "duration", info.Duration)
+	}
+	mem.store.events.OnCompactionEnd(info)
+	return err
+}
+
+// mergeFiles does the work of compactFrom, telling the event listener about
+// the files it replaces.
+func (mem *memDB) mergeFiles(from int, now int64) error {
+
+	// Read files from oldest to newest so newer entries win
+	latest := make(map[string]memEntry)
+	for i := from; i <= mem.file.noFiles; i++ {
+		entries, err := readSSTEntries(mem.file.sstPath(i), mem.store.keys)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			latest[entry.key] = entry
+		}
+	}
+
+	entries := make([]memEntry, 0, len(latest))
+	for _, entry := range latest {
+		if from == 1 && (entry.op == opDel || entry.expired(now)) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+
+	codec, err := codecByName(mem.opts.BottomCompression)
+	if err != nil {
+		return err
+	}
+
+	// Write the merged file aside, then swap it in
+	tmpPath := filepath.Join(mem.file.dir, "sst_compact.tmp")
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	mem.file.closeFile()
+	mem.file.file = tmp
+	if err := mem.file.createSST(entries, codec, mem.store.keys); err != nil {
+		mem.file.closeFile()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		mem.file.closeFile()
+		os.Remove(tmpPath)
+		return err
+	}
+	mem.file.closeFile()
+
+	// The merged file replaces sst_<from>.sst first: if we stop before the
+	// newer files are removed, they only repeat what it already holds.
+	mem.store.tables.evict(mem.file.sstPath(from))
+	if err := os.Rename(tmpPath, mem.file.sstPath(from)); err != nil {
+		return err
+	}
+	if err := syncDir(mem.file.dir); err != nil {
+		return err
+	}
+	mem.store.events.OnTableDeleted(TableInfo{Namespace: mem.name, Path: mem.file.sstPath(from), Reason: "compaction"})
+	mem.store.events.OnTableCreated(TableInfo{Namespace: mem.name, Path: mem.file.sstPath(from), Reason: "compaction"})
+	for i := mem.file.noFiles; i > from; i-- {
+		mem.store.tables.evict(mem.file.sstPath(i))
+		if err := os.Remove(mem.file.sstPath(i)); err != nil {
+			return err
+		}
+		mem.file.noFiles--
+		mem.store.events.OnTableDeleted(TableInfo{Namespace: mem.name, Path: mem.file.sstPath(i), Reason: "compaction"})
+	}
+
+	return nil
+}
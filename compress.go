@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Codecs a block can be stored with. The codec is recorded in every block
+// trailer, so files written with different settings stay readable.
+const (
+	codecNone byte = iota
+	codecSnappy
+	codecFlate
+)
+
+var errCorruptSnappy = errors.New("corrupt snappy block")
+
+var codecNames = map[string]byte{
+	"none":   codecNone,
+	"snappy": codecSnappy,
+	"flate":  codecFlate,
+}
+
+func codecByName(name string) (byte, error) {
+	codec, ok := codecNames[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown compression %q", name)
+	}
+	return codec, nil
+}
+
+func codecName(codec byte) string {
+	for name, c := range codecNames {
+		if c == codec {
+			return name
+		}
+	}
+	return fmt.Sprintf("codec(%d)", codec)
+}
+
+// compressBlock returns the stored form of raw and the codec it ended up
+// using. Blocks that do not shrink are stored uncompressed.
+func compressBlock(codec byte, raw []byte) ([]byte, byte, error) {
+	var out []byte
+	switch codec {
+	case codecNone:
+		return raw, codecNone, nil
+	case codecSnappy:
+		out = snappyEncode(raw)
+	case codecFlate:
+		var buf bytes.Buffer
+		w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return nil, 0, err
+		}
+		if _, err := w.Write(raw); err != nil {
+			return nil, 0, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, 0, err
+		}
+		out = buf.Bytes()
+	default:
+		return nil, 0, fmt.Errorf("unknown codec %d", codec)
+	}
+
+	if len(out) >= len(raw) {
+		return raw, codecNone, nil
+	}
+	return out, codec, nil
+}
+
+func decompressBlock(codec byte, stored []byte) ([]byte, error) {
+	switch codec {
+	case codecNone:
+		return stored, nil
+	case codecSnappy:
+		return snappyDecode(stored)
+	case codecFlate:
+		r := flate.NewReader(bytes.NewReader(stored))
+		defer r.Close()
+		return io.ReadAll(r)
+	default:
+		return nil, fmt.Errorf("unknown codec %d", codec)
+	}
+}
+
+// snappyEncode compresses src in the Snappy block format: the uncompressed
+// length as a uvarint, followed by literal and copy elements.
+func snappyEncode(src []byte) []byte {
+	dst := binary.AppendUvarint(nil, uint64(len(src)))
+
+	const tableBits = 14
+	table := make([]int32, 1<<tableBits) // position+1 of the last occurrence of a hash
+	hash := func(u uint32) uint32 {
+		return (u * 0x1e35a7bd) >> (32 - tableBits)
+	}
+
+	lit, i := 0, 0
+	for i+4 <= len(src) {
+		cur := binary.LittleEndian.Uint32(src[i:])
+		h := hash(cur)
+		cand := int(table[h]) - 1
+		table[h] = int32(i + 1)
+
+		if cand < 0 || i-cand > 65535 || binary.LittleEndian.Uint32(src[cand:]) != cur {
+			i++
+			continue
+		}
+
+		// Emit what came before the match, then extend the match as far as it goes
+		dst = snappyEmitLiteral(dst, src[lit:i])
+		length := 4
+		for i+length < len(src) && src[cand+length] == src[i+length] {
+			length++
+		}
+		dst = snappyEmitCopy(dst, i-cand, length)
+		i += length
+		lit = i
+	}
+
+	return snappyEmitLiteral(dst, src[lit:])
+}
+
+func snappyEmitLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+	n := len(lit) - 1
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2)
+	case n < 1<<8:
+		dst = append(dst, 60<<2, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+func snappyEmitCopy(dst []byte, offset, length int) []byte {
+	// Long copies are split into 64 byte copies, keeping at least 4 bytes
+	// for the last one
+	for length >= 68 {
+		dst = append(dst, 63<<2|2, byte(offset), byte(offset>>8))
+		length -= 64
+	}
+	if length > 64 {
+		dst = append(dst, 59<<2|2, byte(offset), byte(offset>>8))
+		length -= 60
+	}
+	if length >= 4 && length < 12 && offset < 2048 {
+		return append(dst, byte(offset>>8)<<5|byte(length-4)<<2|1, byte(offset))
+	}
+	return append(dst, byte(length-1)<<2|2, byte(offset), byte(offset>>8))
+}
+
+func snappyDecode(src []byte) ([]byte, error) {
+	n, k := binary.Uvarint(src)
+	if k <= 0 || n > maxWALRecordSize {
+		return nil, errCorruptSnappy
+	}
+	src = src[k:]
+	// n may be corrupt, so it is checked against what is decoded instead of
+	// allocated up front; the buffer grows as elements are appended
+	dst := make([]byte, 0, min(n, uint64(len(src))*4))
+
+	for len(src) > 0 {
+		tag := src[0]
+		var offset, length int
+
+		switch tag & 3 {
+		case 0:
+			// Literal
+			length = int(tag >> 2)
+			src = src[1:]
+			if length >= 60 {
+				extra := length - 59
+				if len(src) < extra {
+					return nil, errCorruptSnappy
+				}
+				length = 0
+				for i := 0; i < extra; i++ {
+					length |= int(src[i]) << (8 * i)
+				}
+				src = src[extra:]
+			}
+			length++
+			if length <= 0 || len(src) < length {
+				return nil, errCorruptSnappy
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+		case 1:
+			if len(src) < 2 {
+				return nil, errCorruptSnappy
+			}
+			length = 4 + int(tag>>2&7)
+			offset = int(tag&0xe0)<<3 | int(src[1])
+			src = src[2:]
+		case 2:
+			if len(src) < 3 {
+				return nil, errCorruptSnappy
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:3]))
+			src = src[3:]
+		case 3:
+			if len(src) < 5 {
+				return nil, errCorruptSnappy
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:5]))
+			src = src[5:]
+		}
+
+		// Copies may overlap their own output, so go byte by byte
+		if offset <= 0 || offset > len(dst) || uint64(len(dst)+length) > n {
+			return nil, errCorruptSnappy
+		}
+		for i := 0; i < length; i++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+
+	if uint64(len(dst)) != n {
+		return nil, errCorruptSnappy
+	}
+	return dst, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Files written while encryption is enabled record the ID of the key they
+// are encrypted with in their header: WAL records, SST blocks and value log
+// records are then sealed with AES-GCM under that key. Key ID 0 means the
+// file is in plaintext.
+//
+// Keys are rotated by configuring a new current key and keeping the old ones
+// around: new files use the current key, and older files are re-encrypted as
+// they are rewritten (SST files by compaction, value log segments by garbage
+// collection, the WAL when it is reset).
+
+var (
+	errUnknownKey = errors.New("encryption key not configured")
+	errDecrypt    = errors.New("decryption failed, wrong encryption key or corrupt data")
+)
+
+// keyring holds the current encryption key and the older ones still needed
+// to read files written before a rotation.
+type keyring struct {
+	current uint32
+	aeads   map[uint32]cipher.AEAD
+}
+
+// keyID derives the ID stored in file headers from a key. It is never 0.
+func keyID(key []byte) uint32 {
+	sum := sha256.Sum256(key)
+	id := binary.BigEndian.Uint32(sum[:4])
+	if id == 0 {
+		id = 1
+	}
+	return id
+}
+
+// newKeyring builds a keyring from the current key and older keys. A nil
+// current key disables encryption of new files.
+func newKeyring(current []byte, old [][]byte) (*keyring, error) {
+	k := &keyring{aeads: make(map[uint32]cipher.AEAD)}
+	for i, key := range append([][]byte{current}, old...) {
+		if key == nil {
+			continue
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key: %v", err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		id := keyID(key)
+		k.aeads[id] = aead
+		if i == 0 {
+			k.current = id
+		}
+	}
+	return k, nil
+}
+
+// loadKeyFile reads hex encoded AES keys, one per line. The first key is the
+// current one, the following ones are older keys kept for reading.
+func loadKeyFile(path string) ([]byte, [][]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var keys [][]byte
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := hex.DecodeString(line)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", path, err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, nil, fmt.Errorf("%s: no key found", path)
+	}
+	return keys[0], keys[1:], nil
+}
+
+// aead returns the cipher of key id, nil for plaintext files.
+func (k *keyring) aead(id uint32) (cipher.AEAD, error) {
+	if id == 0 {
+		return nil, nil
+	}
+	aead, ok := k.aeads[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: key id %08x", errUnknownKey, id)
+	}
+	return aead, nil
+}
+
+// seal encrypts plaintext with a random nonce, returned in front of the
+// ciphertext. A nil aead leaves the data as is.
+func seal(aead cipher.AEAD, plaintext, ad []byte) ([]byte, error) {
+	if aead == nil {
+		return plaintext, nil
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, ad), nil
+}
+
+func unseal(aead cipher.AEAD, sealed, ad []byte) ([]byte, error) {
+	if aead == nil {
+		return sealed, nil
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errDecrypt
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], ad)
+	if err != nil {
+		return nil, errDecrypt
+	}
+	return plaintext, nil
+}
+
+// sealOverhead is how much longer seal makes its input.
+func sealOverhead(aead cipher.AEAD) int {
+	if aead == nil {
+		return 0
+	}
+	return aead.NonceSize() + aead.Overhead()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func encryptedOptions(current []byte, old ...[]byte) storeOptions {
+	opts := defaultStoreOptions()
+	opts.EncryptionKey = current
+	opts.OldEncryptionKeys = old
+	return opts
+}
+
+func TestEncryption_RoundTripAndWrongKey(t *testing.T) {
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{1}, 32)
+
+	s, err := openStoreWith(dir, encryptedOptions(key))
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	mem, err := s.CreateNamespace("secret", nsOptions{FlushSize: 60, ValueThreshold: 50})
+	if err != nil {
+		t.Fatalf("Error creating namespace: %v", err)
+	}
+	large := strings.Repeat("confidential", 10)
+	for i := 0; i < 10; i++ {
+		mem.Set([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("plaintext-value-%d", i)))
+	}
+	mem.Set([]byte("large"), []byte(large))
+	mem.Set([]byte("pending"), []byte("plaintext-in-wal"))
+
+	// No file may hold the values in clear
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, _ := os.ReadFile(path)
+		if bytes.Contains(data, []byte("plaintext")) || bytes.Contains(data, []byte("confidential")) {
+			t.Errorf("Expected %s to be encrypted", path)
+		}
+		return nil
+	})
+
+	reopened, err := openStoreWith(dir, encryptedOptions(key))
+	if err != nil {
+		t.Fatalf("Error reopening store: %v", err)
+	}
+	mem, _ = reopened.Namespace("secret")
+	for i := 0; i < 10; i++ {
+		want := fmt.Sprintf("plaintext-value-%d", i)
+		if v, err := mem.Get([]byte(fmt.Sprintf("key-%d", i))); err != nil || string(v) != want {
+			t.Errorf("Expected %s, got %s (%v)", want, v, err)
+		}
+	}
+	if v, err := mem.Get([]byte("large")); err != nil || string(v) != large {
+		t.Errorf("Expected the large value back, got %d bytes (%v)", len(v), err)
+	}
+	if v, err := mem.Get([]byte("pending")); err != nil || string(v) != "plaintext-in-wal" {
+		t.Errorf("Expected plaintext-in-wal, got %s (%v)", v, err)
+	}
+
+	if _, err := openStoreWith(dir, defaultStoreOptions()); !errors.Is(err, errUnknownKey) {
+		t.Errorf("Expected opening without the key to fail with %v, got %v", errUnknownKey, err)
+	}
+	if _, err := openStoreWith(dir, encryptedOptions(bytes.Repeat([]byte{2}, 32))); !errors.Is(err, errUnknownKey) {
+		t.Errorf("Expected opening with another key to fail with %v, got %v", errUnknownKey, err)
+	}
+}
+
+func TestEncryption_KeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	oldKey := bytes.Repeat([]byte{1}, 16)
+	newKey := bytes.Repeat([]byte{2}, 16)
+
+	s, err := openStoreWith(dir, encryptedOptions(oldKey))
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	mem, _ := s.CreateNamespace("rotate", nsOptions{FlushSize: 1, Compaction: compactionFull})
+	for i := 0; i < 3; i++ {
+		mem.Set([]byte(fmt.Sprintf("key-%d", i)), []byte("value"))
+	}
+
+	s, err = openStoreWith(dir, encryptedOptions(newKey, oldKey))
+	if err != nil {
+		t.Fatalf("Error reopening store with the rotated key: %v", err)
+	}
+	mem, _ = s.Namespace("rotate")
+	if v, err := mem.Get([]byte("key-0")); err != nil || string(v) != "value" {
+		t.Fatalf("Expected files of the old key to stay readable, got %s (%v)", v, err)
+	}
+
+	// The next compaction rewrites every file with the new key
+	mem.Set([]byte("key-3"), []byte("value"))
+	mem.Set([]byte("key-4"), []byte("value"))
+	if mem.file.noFiles != 1 {
+		t.Fatalf("Expected a full compaction, got %d files", mem.file.noFiles)
+	}
+	header := make([]byte, 16)
+	f, err := os.Open(mem.file.sstPath(1))
+	if err != nil {
+		t.Fatalf("Error opening SST file: %v", err)
+	}
+	f.ReadAt(header, 0)
+	f.Close()
+	if id := binary.BigEndian.Uint32(header[12:16]); id != keyID(newKey) {
+		t.Fatalf("Expected the compacted file to use key %08x, got %08x", keyID(newKey), id)
+	}
+
+	s, err = openStoreWith(dir, encryptedOptions(newKey))
+	if err != nil {
+		t.Fatalf("Error reopening store without the old key: %v", err)
+	}
+	mem, _ = s.Namespace("rotate")
+	for i := 0; i < 5; i++ {
+		if v, err := mem.Get([]byte(fmt.Sprintf("key-%d", i))); err != nil || string(v) != "value" {
+			t.Errorf("Expected key-%d to be readable with the new key only, got %s (%v)", i, v, err)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"time"
+)
+
+// FlushInfo describes a memtable flush. Path, Duration and Err are only set
+// once it ended.
+type FlushInfo struct {
+	Namespace string
+	Entries   int // distinct keys written
+	Path      string
+	Duration  time.Duration
+	Err       error
+}
+
+// CompactionInfo describes a compaction merging Inputs, oldest first, into
+// Output. Duration and Err are only set once it ended.
+type CompactionInfo struct {
+	Namespace string
+	Inputs    []string
+	Output    string
+	Duration  time.Duration
+	Err       error
+}
+
+// TableInfo describes an SST file being created or deleted, and why:
+// "flush", "compaction" or "drop namespace".
+type TableInfo struct {
+	Namespace string
+	Path      string
+	Reason    string
+}
+
+// WALInfo describes the WAL after it was emptied, once every memtable was
+// flushed. Seq is the sequence number it starts from.
+type WALInfo struct {
+	Path string
+	Seq  uint64
+}
+
+// EventListener is told about the work the engine does besides serving
+// reads and writes. Its methods are called with the store locked, so they
+// must not use the store and should return quickly. Embed
+// NoopEventListener to only implement some of them.
+type EventListener interface {
+	OnFlushBegin(info FlushInfo)
+	OnFlushEnd(info FlushInfo)
+	OnCompactionBegin(info CompactionInfo)
+	OnCompactionEnd(info CompactionInfo)
+	OnWALRotated(info WALInfo)
+	// OnBackgroundError is called when a flush or compaction triggered by a
+	// write fails. The write itself is logged and applied to the memtable.
+	OnBackgroundError(err error)
+	OnTableCreated(info TableInfo)
+	OnTableDeleted(info TableInfo)
+}
+
+// NoopEventListener ignores every event.
+type NoopEventListener struct{}
+
+func (NoopEventListener) OnFlushBegin(FlushInfo)           {}
+func (NoopEventListener) OnFlushEnd(FlushInfo)             {}
+func (NoopEventListener) OnCompactionBegin(CompactionInfo) {}
+func (NoopEventListener) OnCompactionEnd(CompactionInfo)   {}
+func (NoopEventListener) OnWALRotated(WALInfo)             {}
+func (NoopEventListener) OnBackgroundError(error)          {}
+func (NoopEventListener) OnTableCreated(TableInfo)         {}
+func (NoopEventListener) OnTableDeleted(TableInfo)         {}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type recordingListener struct {
+	NoopEventListener
+	events []string
+}
+
+func (l *recordingListener) OnFlushBegin(info FlushInfo) {
+	l.events = append(l.events, fmt.Sprintf("flush begin %s %d", info.Namespace, info.Entries))
+}
+
+func (l *recordingListener) OnFlushEnd(info FlushInfo) {
+	l.events = append(l.events, fmt.Sprintf("flush end %s %v", filepath.Base(info.Path), info.Err))
+}
+
+func (l *recordingListener) OnCompactionBegin(info CompactionInfo) {
+	l.events = append(l.events, fmt.Sprintf("compaction begin %d", len(info.Inputs)))
+}
+
+func (l *recordingListener) OnCompactionEnd(info CompactionInfo) {
+	l.events = append(l.events, fmt.Sprintf("compaction end %s %v", filepath.Base(info.Output), info.Err))
+}
+
+func (l *recordingListener) OnWALRotated(info WALInfo) {
+	l.events = append(l.events, fmt.Sprintf("wal rotated %d", info.Seq))
+}
+
+func (l *recordingListener) OnTableCreated(info TableInfo) {
+	l.events = append(l.events, fmt.Sprintf("created %s %s", filepath.Base(info.Path), info.Reason))
+}
+
+func (l *recordingListener) OnTableDeleted(info TableInfo) {
+	l.events = append(l.events, fmt.Sprintf("deleted %s %s", filepath.Base(info.Path), info.Reason))
+}
+
+func TestEventListener(t *testing.T) {
+	var logs bytes.Buffer
+	listener := &recordingListener{}
+	opts := defaultStoreOptions()
+	opts.Logger = slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	opts.EventListener = listener
+	s, err := openStoreWith(t.TempDir(), opts)
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	mem, err := s.CreateNamespace("events", nsOptions{FlushSize: 1 << 20})
+	if err != nil {
+		t.Fatalf("Error creating namespace: %v", err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if err := mem.Set([]byte(key), []byte("v")); err != nil {
+			t.Fatalf("Error setting %s: %v", key, err)
+		}
+		if _, err := mem.Flush(); err != nil {
+			t.Fatalf("Error flushing: %v", err)
+		}
+	}
+	if err := mem.Compact(); err != nil {
+		t.Fatalf("Error compacting: %v", err)
+	}
+	if err := s.DropNamespace("events"); err != nil {
+		t.Fatalf("Error dropping namespace: %v", err)
+	}
+
+	want := []string{
+		"flush begin events 1",
+		"created sst_1.sst flush",
+		"flush end sst_1.sst <nil>",
+		"wal rotated 1",
+		"flush begin events 1",
+		"created sst_2.sst flush",
+		"flush end sst_2.sst <nil>",
+		"wal rotated 2",
+		"compaction begin 2",
+		"deleted sst_1.sst compaction",
+		"created sst_1.sst compaction",
+		"deleted sst_2.sst compaction",
+		"compaction end sst_1.sst <nil>",
+		"deleted sst_1.sst drop namespace",
+		"wal rotated 3",
+	}
+	if strings.Join(listener.events, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Expected events\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(listener.events, "\n"))
+	}
+	if !strings.Contains(logs.String(), "msg=\"flushed memtable\" namespace=events entries=1") {
+		t.Errorf("Expected the flush to be logged, got %q", logs.String())
+	}
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// exportPageSize is the number of entries export reads at a time. The store
+// is only locked while a page is read, so writes go on during an export,
+// which sees each page as of when it was read.
+const exportPageSize = 1000
+
+var errUnknownFormat = errors.New("unknown format, expected json or csv")
+
+// exportRecord is a key as exported and imported. Keys and values that are
+// not valid UTF-8 are base64 encoded, which Encoding tells.
+type exportRecord struct {
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Encoding string `json:"encoding,omitempty"`
+	Expires  int64  `json:"expires,omitempty"` // unix nanoseconds
+}
+
+var csvHeader = []string{"key", "value", "encoding", "expires"}
+
+func newExportRecord(entry memEntry) exportRecord {
+	rec := exportRecord{Key: entry.key, Value: entry.value, Expires: entry.expires}
+	if !utf8.ValidString(rec.Key) || !utf8.ValidString(rec.Value) {
+		rec.Encoding = "base64"
+		rec.Key = base64.StdEncoding.EncodeToString([]byte(rec.Key))
+		rec.Value = base64.StdEncoding.EncodeToString([]byte(rec.Value))
+	}
+	return rec
+}
+
+func (rec exportRecord) decode() (key, value []byte, err error) {
+	switch rec.Encoding {
+	case "":
+		return []byte(rec.Key), []byte(rec.Value), nil
+	case "base64":
+		if key, err = base64.StdEncoding.DecodeString(rec.Key); err != nil {
+			return nil, nil, fmt.Errorf("key: %v", err)
+		}
+		if value, err = base64.StdEncoding.DecodeString(rec.Value); err != nil {
+			return nil, nil, fmt.Errorf("value: %v", err)
+		}
+		return key, value, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown encoding %q", rec.Encoding)
+	}
+}
+
+// exportOptions select the keys to export, from Start inclusive to End
+// exclusive, an empty End meaning no upper bound, and the format: "json"
+// for JSON Lines or "csv".
+type exportOptions struct {
+	Start  string
+	End    string
+	Format string
+}
+
+// exportNamespace writes the live keys of mem in the range of opts to w,
+// in key order, and returns the number of keys written.
+func exportNamespace(mem *memDB, w io.Writer, opts exportOptions) (int, error) {
+	bw := bufio.NewWriter(w)
+	var write func(rec exportRecord) error
+	flush := bw.Flush
+	switch opts.Format {
+	case "json", "":
+		enc := json.NewEncoder(bw)
+		enc.SetEscapeHTML(false)
+		write = func(rec exportRecord) error { return enc.Encode(rec) }
+	case "csv":
+		cw := csv.NewWriter(bw)
+		if err := cw.Write(csvHeader); err != nil {
+			return 0, err
+		}
+		flush = func() error {
+			cw.Flush()
+			if err := cw.Error(); err != nil {
+				return err
+			}
+			return bw.Flush()
+		}
+		write = func(rec exportRecord) error {
+			expires := ""
+			if rec.Expires != 0 {
+				expires = strconv.FormatInt(rec.Expires, 10)
+			}
+			return cw.Write([]string{rec.Key, rec.Value, rec.Encoding, expires})
+		}
+	default:
+		return 0, errUnknownFormat
+	}
+
+	n := 0
+	start := opts.Start
+	for {
+		entries, err := mem.Scan(start, exportPageSize)
+		if err != nil {
+			return n, err
+		}
+		for _, entry := range entries {
+			if opts.End != "" && entry.key >= opts.End {
+				return n, flush()
+			}
+			if err := write(newExportRecord(entry)); err != nil {
+				return n, err
+			}
+			n++
+		}
+		if len(entries) < exportPageSize {
+			break
+		}
+		// The smallest key after the last one
+		start = entries[len(entries)-1].key + "\x00"
+	}
+	return n, flush()
+}
+
+// importOptions tell how to read records and how to load them: in write
+// batches of BatchSize keys, or, with SST set, by writing sorted SST files
+// of about SSTSize bytes straight into the namespace.
+type importOptions struct {
+	Format    string
+	BatchSize int
+	SST       bool
+	SSTSize   int
+}
+
+func defaultImportOptions() importOptions {
+	return importOptions{Format: "json", BatchSize: 1000, SSTSize: 64 << 20}
+}
+
+// recordReader returns the records of r one at a time, and io.EOF after
+// the last one.
+func recordReader(r io.Reader, format string) (func() (exportRecord, error), error) {
+	switch format {
+	case "json", "":
+		dec := json.NewDecoder(bufio.NewReader(r))
+		return func() (exportRecord, error) {
+			var rec exportRecord
+			err := dec.Decode(&rec)
+			return rec, err
+		}, nil
+	case "csv":
+		cr := csv.NewReader(bufio.NewReader(r))
+		cr.FieldsPerRecord = -1
+		header, err := cr.Read()
+		if err == io.EOF {
+			return func() (exportRecord, error) { return exportRecord{}, io.EOF }, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		columns := make(map[string]int)
+		for i, name := range header {
+			columns[name] = i
+		}
+		if _, ok := columns["key"]; !ok {
+			return nil, errors.New("csv header has no key column")
+		}
+		if _, ok := columns["value"]; !ok {
+			return nil, errors.New("csv header has no value column")
+		}
+		field := func(row []string, name string) string {
+			if i, ok := columns[name]; ok && i < len(row) {
+				return row[i]
+			}
+			return ""
+		}
+		return func() (exportRecord, error) {
+			row, err := cr.Read()
+			if err != nil {
+				return exportRecord{}, err
+			}
+			rec := exportRecord{Key: field(row, "key"), Value: field(row, "value"), Encoding: field(row, "encoding")}
+			if expires := field(row, "expires"); expires != "" {
+				if rec.Expires, err = strconv.ParseInt(expires, 10, 64); err != nil {
+					return rec, fmt.Errorf("expires: %v", err)
+				}
+			}
+			return rec, nil
+		}, nil
+	default:
+		return nil, errUnknownFormat
+	}
+}
+
+// importNamespace loads the records of r into mem and returns the number
+// of keys loaded. Records that already expired are skipped. When a key is
+// given more than once, the last record wins. On error, the batches or
+// files loaded before it stay loaded.
+func importNamespace(mem *memDB, r io.Reader, opts importOptions) (int, error) {
+	read, err := recordReader(r, opts.Format)
+	if err != nil {
+		return 0, err
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultImportOptions().BatchSize
+	}
+	if opts.SSTSize <= 0 {
+		opts.SSTSize = defaultImportOptions().SSTSize
+	}
+
+	var (
+		batch   writeBatch
+		entries []memEntry
+		size    int
+		n       int
+	)
+	load := func() error {
+		switch {
+		case opts.SST && len(entries) > 0:
+			err := mem.ingestEntries(entries)
+			entries, size = nil, 0
+			return err
+		case !opts.SST && batch.Len() > 0:
+			err := mem.store.Write(&batch)
+			batch = writeBatch{}
+			return err
+		}
+		return nil
+	}
+
+	now := time.Now().UnixNano()
+	for i := 1; ; i++ {
+		rec, err := read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, fmt.Errorf("record %d: %v", i, err)
+		}
+		key, value, err := rec.decode()
+		if err != nil {
+			return n, fmt.Errorf("record %d: %v", i, err)
+		}
+		if rec.Expires != 0 && rec.Expires <= now {
+			continue
+		}
+
+		if opts.SST {
+			entries = append(entries, memEntry{op: opSet, key: string(key), value: string(value), expires: rec.Expires})
+			size += len(key) + len(value)
+			if size < opts.SSTSize {
+				continue
+			}
+		} else {
+			batch.ops = append(batch.ops, batchOp{op: opSet, ns: mem.name, key: key, value: value, expires: rec.Expires})
+			if batch.Len() < opts.BatchSize {
+				continue
+			}
+		}
+		loaded := len(entries) + batch.Len()
+		if err := load(); err != nil {
+			return n, err
+		}
+		n += loaded
+	}
+	loaded := len(entries) + batch.Len()
+	if err := load(); err != nil {
+		return n, err
+	}
+	return n + loaded, nil
+}
+
+// ingestEntries writes entries as a new SST file of the namespace, without
+// going through the memtable and the WAL. The entries get the sequence
+// number of the ingestion. They need not be sorted; the last one of a key
+// wins.
+func (mem *memDB) ingestEntries(entries []memEntry) error {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+	unique := entries[:0]
+	for _, entry := range entries {
+		if len(unique) > 0 && unique[len(unique)-1].key == entry.key {
+			unique[len(unique)-1] = entry
+			continue
+		}
+		unique = append(unique, entry)
+	}
+	entries = unique
+
+	s := mem.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seq, err := mem.beginIngestLocked()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for i := range entries {
+		entries[i].seq = seq
+		if entries[i].expires == 0 && mem.opts.TTL > 0 {
+			entries[i].expires = now.Add(time.Duration(mem.opts.TTL) * time.Second).UnixNano()
+		}
+	}
+
+	if err := mem.separateValues(entries); err != nil {
+		return err
+	}
+	if err := mem.createNewSSTFile(); err != nil {
+		return err
+	}
+	path := mem.file.sstPath(mem.file.noFiles)
+	if err := mem.appendEntriesToSST(entries); err != nil {
+		return err
+	}
+	mem.file.closeFile()
+	s.logger.Debug("ingested SST file", "namespace", mem.name, "entries", len(entries), "path", path)
+	s.events.OnTableCreated(TableInfo{Namespace: mem.name, Path: path, Reason: "import"})
+
+	return mem.maybeCompact()
+}
+
+// handleExport streams a namespace, by default the default one, as JSON
+// Lines or CSV:
+//
+//	GET /admin/export?ns=users&start=a&end=b&format=csv
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	mem, ok := namespaceFromQuery(w, r)
+	if !ok {
+		return
+	}
+	opts := exportOptions{Start: q.Get("start"), End: q.Get("end"), Format: q.Get("format")}
+	switch opts.Format {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+	default:
+		http.Error(w, errUnknownFormat.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := exportNamespace(mem, w, opts); err != nil {
+		// The status is already sent, all that can be done is to cut the body
+		st.logger.Error("export failed", "namespace", mem.name, "err", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// handleImport loads the request body into a namespace:
+//
+//	POST /admin/import?ns=users&format=csv&batch=1000&sst=true
+func handleImport(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	mem, ok := namespaceFromQuery(w, r)
+	if !ok {
+		return
+	}
+	opts := defaultImportOptions()
+	if format := q.Get("format"); format != "" {
+		opts.Format = format
+	}
+	if batch := q.Get("batch"); batch != "" {
+		n, err := strconv.Atoi(batch)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid batch size", http.StatusBadRequest)
+			return
+		}
+		opts.BatchSize = n
+	}
+	opts.SST = q.Get("sst") == "true"
+
+	n, err := importNamespace(mem, r.Body, opts)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"imported": n, "error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"imported": n})
+}
+
+// namespaceFromQuery looks up the ns query parameter, writing a 404 if
+// there is no such namespace.
+func namespaceFromQuery(w http.ResponseWriter, r *http.Request) (*memDB, bool) {
+	name := r.URL.Query().Get("ns")
+	if name == "" {
+		name = defaultNamespace
+	}
+	mem, err := st.Namespace(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return nil, false
+	}
+	return mem, true
+}
+
+// runExport writes a namespace of a local data directory to stdout or a
+// file.
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	var sf storeFlags
+	sf.register(fs)
+	ns := fs.String("ns", defaultNamespace, "namespace to export")
+	start := fs.String("start", "", "first key to export")
+	end := fs.String("end", "", "key to stop before, none if empty")
+	format := fs.String("format", "json", "output format: json (JSON Lines) or csv")
+	out := fs.String("o", "", "file to write, stdout if empty")
+	fs.Parse(args)
+
+	s, err := sf.open()
+	if err != nil {
+		return err
+	}
+	mem, err := s.Namespace(*ns)
+	if err != nil {
+		return err
+	}
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	n, err := exportNamespace(mem, w, exportOptions{Start: *start, End: *end, Format: *format})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %s\n", plural(n, "key"))
+	return nil
+}
+
+// runImport loads a file, or stdin, into a namespace of a local data
+// directory, creating the namespace if needed.
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	var sf storeFlags
+	sf.register(fs)
+	opts := defaultImportOptions()
+	ns := fs.String("ns", defaultNamespace, "namespace to import into, created if missing")
+	fs.StringVar(&opts.Format, "format", opts.Format, "input format: json (JSON Lines) or csv")
+	fs.IntVar(&opts.BatchSize, "batch", opts.BatchSize, "keys per write batch")
+	fs.BoolVar(&opts.SST, "sst", false, "write sorted SST files directly instead of going through the memtable and the WAL")
+	fs.IntVar(&opts.SSTSize, "sst-size", opts.SSTSize, "bytes of keys and values per SST file with -sst")
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		return errors.New("usage: kv import [flags] [file]")
+	}
+
+	s, err := sf.open()
+	if err != nil {
+		return err
+	}
+	mem, err := s.Namespace(*ns)
+	if errors.Is(err, errNamespaceNotFound) {
+		mem, err = s.CreateNamespace(*ns, nsOptions{})
+	}
+	if err != nil {
+		return err
+	}
+	r := io.Reader(os.Stdin)
+	if fs.NArg() == 1 {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	n, err := importNamespace(mem, r, opts)
+	fmt.Fprintf(os.Stderr, "imported %s\n", plural(n, "key"))
+	if err != nil {
+		return err
+	}
+	return s.SyncWAL()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestExportImport(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openStore(dir)
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	src, err := s.CreateNamespace("src", nsOptions{FlushSize: 1 << 20})
+	if err != nil {
+		t.Fatalf("Error creating namespace: %v", err)
+	}
+	want := map[string]string{
+		"a":      "1",
+		"b":      "line\nbreak, \"quoted\"",
+		"binary": "\x00\xff\xfe",
+		"c":      "3",
+	}
+	for key, value := range want {
+		src.Set([]byte(key), []byte(value))
+	}
+	src.Flush()
+	src.Set([]byte("c"), []byte("33"))
+	want["c"] = "33"
+
+	var out bytes.Buffer
+	n, err := exportNamespace(src, &out, exportOptions{Start: "b", End: "c"})
+	if err != nil || n != 2 {
+		t.Fatalf("Expected 2 keys exported, got %d, %v", n, err)
+	}
+	if !strings.Contains(out.String(), `"encoding":"base64"`) || strings.Contains(out.String(), `"key":"a"`) {
+		t.Errorf("Unexpected export of [b, c): %s", out.String())
+	}
+
+	for _, tc := range []struct {
+		ns   string
+		opts importOptions
+	}{
+		{"json", importOptions{Format: "json", BatchSize: 2}},
+		{"csv", importOptions{Format: "csv", BatchSize: 2}},
+		{"sst", importOptions{Format: "json", SST: true, SSTSize: 10}},
+	} {
+		out.Reset()
+		if _, err := exportNamespace(src, &out, exportOptions{Format: tc.opts.Format}); err != nil {
+			t.Fatalf("%s: error exporting: %v", tc.ns, err)
+		}
+		dst, err := s.CreateNamespace(tc.ns, nsOptions{FlushSize: 1 << 20})
+		if err != nil {
+			t.Fatalf("Error creating namespace: %v", err)
+		}
+		// An older value in the memtable must not hide the imported one
+		dst.Set([]byte("a"), []byte("old"))
+		n, err := importNamespace(dst, &out, tc.opts)
+		if err != nil || n != len(want) {
+			t.Fatalf("%s: expected %d keys imported, got %d, %v", tc.ns, len(want), n, err)
+		}
+		for key, value := range want {
+			if got, err := dst.Get([]byte(key)); err != nil || string(got) != value {
+				t.Errorf("%s: expected %q=%q, got %q, %v", tc.ns, key, value, got, err)
+			}
+		}
+	}
+
+	// Ingested files survive a restart, and so does the sequence number
+	seq := s.seq
+	s2, err := openStore(dir)
+	if err != nil {
+		t.Fatalf("Error reopening store: %v", err)
+	}
+	if s2.seq != seq {
+		t.Errorf("Expected seq %d after reopening, got %d", seq, s2.seq)
+	}
+	mem, _ := s2.Namespace("sst")
+	if got, err := mem.Get([]byte("a")); err != nil || string(got) != "1" {
+		t.Errorf("Expected a=1 after reopening, got %q, %v", got, err)
+	}
+
+	if _, err := importNamespace(mem, strings.NewReader(`{"key":"x","value":"!","encoding":"base64"}`), defaultImportOptions()); err == nil {
+		t.Errorf("Expected an error importing invalid base64")
+	}
+}
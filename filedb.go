@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -9,30 +10,60 @@ import (
 )
 
 type fileDB struct {
+	dir         string
 	file        io.ReadWriteSeeker
 	noFiles     int
 	maxFileSize int
 }
 
-func newFileDB(sz int) (*fileDB, error) {
+func newFileDB(dir string, sz int) (*fileDB, error) {
 
-	dir, _ := filepath.Split("sst_1.sst")
 	files, err := filepath.Glob(filepath.Join(dir, "sst_*.sst"))
 	if err != nil {
 		return nil, err
 	}
 
 	noFiles := len(files)
-	var f *os.File
-	f, _ = os.OpenFile("testfile.txt", os.O_RDWR|os.O_CREATE, 0666)
 
 	return &fileDB{
-		file:        f,
+		dir:         dir,
 		noFiles:     noFiles,
 		maxFileSize: sz,
 	}, nil
 }
 
+// sstPath returns the path of the i-th SST file of this file set.
+func (fl *fileDB) sstPath(i int) string {
+	return filepath.Join(fl.dir, fmt.Sprintf("sst_%d.sst", i))
+}
+
+// closeFile closes the SST file currently open for writing, if any.
+func (fl *fileDB) closeFile() {
+	if c, ok := fl.file.(io.Closer); ok {
+		c.Close()
+	}
+	fl.file = nil
+}
+
+// syncFile flushes the SST file currently open for writing to disk.
+func (fl *fileDB) syncFile() error {
+	if f, ok := fl.file.(interface{ Sync() error }); ok {
+		return f.Sync()
+	}
+	return nil
+}
+
+// syncDir flushes the entries of dir to disk, so files created or renamed
+// in it survive a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
 func (fl *fileDB) getFileVariable(s string) ([]byte, error) {
 	offset := 0
 	switch s {
@@ -115,99 +146,103 @@ func (fl *fileDB) IncrementCount() error {
 	return nil
 
 }
-func (file *fileDB) createSST(entries map[string]string) error {
+
+// createSST writes entries, sorted by key, to the current SST file as
+// blocks compressed with codec and encrypted with the current key.
+func (file *fileDB) createSST(entries []memEntry, codec byte, keys *keyring) error {
 	// Seek to the end of the file to append
 	_, err := file.file.Seek(0, io.SeekEnd)
 	if err != nil {
 		return err
 	}
 
-	// Write SST file header
-	header := make([]byte, magicNumberSize+entryCountSize+keyLengthSize+keyLengthSize)
-	binary.BigEndian.PutUint32(header[:magicNumberSize], 12345) // Placeholder magic number
-	binary.BigEndian.PutUint32(header[magicNumberSize:magicNumberSize+entryCountSize], uint32(len(entries)))
-	binary.BigEndian.PutUint32(header[magicNumberSize+entryCountSize:magicNumberSize+entryCountSize+keyLengthSize], uint32(len(entries)))
-	binary.BigEndian.PutUint32(header[magicNumberSize+entryCountSize+keyLengthSize:magicNumberSize+entryCountSize+keyLengthSize+keyLengthSize], uint32(len(entries)))
-	_, err = file.file.Write(header)
+	return writeBlockSST(file.file, entries, codec, keys)
+}
+
+// readSSTEntries decodes every entry of an SST file. Entries of legacy
+// files are laid out to be read from the end of the file, so for those the
+// returned slice is in the reverse of the order they were written in.
+func readSSTEntries(path string, keys *keyring) ([]memEntry, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	// Write entries to SST file
-	for key, value := range entries {
-		// Determine operation type based on key prefix
-		var opType byte
-		if len(key) > 3 && key[:3] == "set" {
-			opType = 1 // 1 for set
-
-		} else {
-			opType = 0 // 0 for del
+	headerSize := sstHeaderSize
+	if len(data) < headerSize {
+		return nil, fmt.Errorf("%s: file too short for SST header", path)
+	}
+	if isBlockSST(data) {
+		entries, err := readBlockSSTEntries(bytes.NewReader(data), int64(len(data)), keys)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
 		}
-		key = key[4:]
+		return entries, nil
+	}
 
-		// Write value length and value
-		valueb := []byte(value)
-		keyb := []byte(key)
-		valueLen := uint32(len(valueb))
-		valueLenBuf := make([]byte, valueLengthSize)
-		binary.BigEndian.PutUint32(valueLenBuf, valueLen)
+	var entries []memEntry
+	idx := len(data)
+	for idx > headerSize {
+		var entry memEntry
+
+		// Read operation type
+		idx--
+		entry.op = data[idx]
+		if entry.op == opSetTTL {
+			if idx-expiresSize < headerSize {
+				return nil, fmt.Errorf("%s: truncated entry", path)
+			}
+			idx -= expiresSize
+			entry.expires = int64(binary.BigEndian.Uint64(data[idx : idx+expiresSize]))
+			entry.op = opSet
+		}
 
-		_, err = file.file.Write(valueb)
-		if err != nil {
-			return err
+		// Read key length and key
+		if idx-keyLengthSize < headerSize {
+			return nil, fmt.Errorf("%s: truncated entry", path)
 		}
-		_, err = file.file.Write(valueLenBuf)
-		if err != nil {
-			return err
+		idx -= keyLengthSize
+		keyLen := int(binary.BigEndian.Uint32(data[idx : idx+keyLengthSize]))
+		if idx-keyLen < headerSize {
+			return nil, fmt.Errorf("%s: truncated entry", path)
 		}
+		idx -= keyLen
+		entry.key = string(data[idx : idx+keyLen])
 
-		// Write key length and key
-		keyLen := uint32(len(key))
-		keyLenBuf := make([]byte, keyLengthSize)
-		binary.BigEndian.PutUint32(keyLenBuf, keyLen)
-
-		_, err = file.file.Write(keyb)
-		if err != nil {
-			return err
+		// Read value length and value
+		if idx-valueLengthSize < headerSize {
+			return nil, fmt.Errorf("%s: truncated entry", path)
 		}
-		_, err = file.file.Write(keyLenBuf)
-		if err != nil {
-			return err
+		idx -= valueLengthSize
+		valueLen := int(binary.BigEndian.Uint32(data[idx : idx+valueLengthSize]))
+		if idx-valueLen < headerSize {
+			return nil, fmt.Errorf("%s: truncated entry", path)
 		}
+		idx -= valueLen
+		entry.value = string(data[idx : idx+valueLen])
 
-		// Write operation type
-
-		_, err = file.file.Write([]byte{opType})
-		if err != nil {
-			return err
-		}
+		entries = append(entries, entry)
 	}
 
-	return nil
+	return entries, nil
 }
 
 func (mem *memDB) createNewSSTFile() error {
 	// Create a new SST file
-	file, err := os.Create(fmt.Sprintf("sst_%d.sst", mem.file.noFiles+1))
+	if err := os.MkdirAll(mem.file.dir, 0755); err != nil {
+		return err
+	}
+	path := mem.file.sstPath(mem.file.noFiles + 1)
+	mem.store.tables.evict(path)
+	file, err := os.Create(path)
 	if err != nil {
 		return err
 	}
+	mem.file.closeFile()
 	mem.file.file = file
 	mem.file.noFiles++
 	return nil
 }
 
-func printSSTFileContents(fileDB *fileDB) {
-	file, err := os.Open(fmt.Sprintf("sst_%d.sst", fileDB.noFiles))
-	if err != nil {
-		panic(err)
-	}
-	defer file.Close()
-
-	fmt.Println("SST File Contents:")
-	io.Copy(os.Stdout, file)
-}
-
 func (mem *memDB) CreateNewFile() error {
 	mem.file.noFiles += 1
 	f, err := os.OpenFile("f"+fmt.Sprint(mem.file.noFiles)+".sst", os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0755)
@@ -229,4 +264,4 @@ func (mem *memDB) CreateNewFile() error {
 
 	return nil
 
-}
\ No newline at end of file
+}
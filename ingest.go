@@ -0,0 +1,344 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+var errKeyOrder = errors.New("keys must be added in increasing order")
+
+// SSTWriterOptions configure the files built by an SSTWriter. Files are
+// compressed with Compression, snappy if empty, and encrypted with
+// EncryptionKey if set, which must then be a key of the store ingesting them.
+type SSTWriterOptions struct {
+	Compression   string
+	EncryptionKey []byte
+}
+
+// SSTWriter builds an SST file offline, from keys added in increasing
+// order, for IngestExternalFiles. Entries are streamed to the file as blocks
+// fill up, so only the key hashes for the bloom filter stay in memory. The
+// file is written next to its path and only appears there once Finish
+// returns.
+type SSTWriter struct {
+	path    string
+	f       *os.File
+	builder *sstBuilder
+	entries int
+	last    string
+}
+
+func NewSSTWriter(path string, opts SSTWriterOptions) (*SSTWriter, error) {
+	if opts.Compression == "" {
+		opts.Compression = defaultNSOptions().Compression
+	}
+	codec, err := codecByName(opts.Compression)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := newKeyring(opts.EncryptionKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	// The number of entries is only known once done, Finish rewrites the header
+	builder, err := newSSTBuilder(f, 0, codec, keys)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &SSTWriter{path: path, f: f, builder: builder}, nil
+}
+
+// Put adds key, expiring at expires (unix nanoseconds, 0 for never). The
+// TTL of the namespace the file is ingested into does not apply.
+func (w *SSTWriter) Put(key, value []byte, expires int64) error {
+	return w.add(memEntry{op: opSet, key: string(key), value: string(value), expires: expires})
+}
+
+// Delete adds a tombstone for key, hiding it in the files older than this
+// one once ingested.
+func (w *SSTWriter) Delete(key []byte) error {
+	return w.add(memEntry{op: opDel, key: string(key)})
+}
+
+func (w *SSTWriter) add(entry memEntry) error {
+	if w.entries > 0 && entry.key <= w.last {
+		return fmt.Errorf("%w: %s after %s", errKeyOrder, formatValue(entry.key), formatValue(w.last))
+	}
+	if err := w.builder.add(entry); err != nil {
+		return err
+	}
+	w.entries++
+	w.last = entry.key
+	return nil
+}
+
+// Entries returns the number of keys added so far.
+func (w *SSTWriter) Entries() int {
+	return w.entries
+}
+
+// Finish completes the file and moves it to its path.
+func (w *SSTWriter) Finish() error {
+	if err := w.builder.finish(); err != nil {
+		w.Abort()
+		return err
+	}
+	if _, err := w.f.WriteAt(w.builder.header(w.entries), 0); err != nil {
+		w.Abort()
+		return err
+	}
+	if err := w.f.Sync(); err != nil {
+		w.Abort()
+		return err
+	}
+	if err := w.f.Close(); err != nil {
+		os.Remove(w.f.Name())
+		return err
+	}
+	return os.Rename(w.f.Name(), w.path)
+}
+
+// Abort drops the file being written.
+func (w *SSTWriter) Abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+// externalSST is an SST file to ingest, once validated.
+type externalSST struct {
+	path     string // staged copy
+	source   string
+	entries  int
+	firstKey string
+	lastKey  string
+}
+
+// validateExternalSST checks that path is an intact block based SST file,
+// with sorted keys, that holds nothing tied to another store: no sequence
+// numbers, which are only meaningful in the store that assigned them, and
+// no value log pointers. Problems are reported against name, the file the
+// caller passed.
+func validateExternalSST(path, name string, keys *keyring) (externalSST, error) {
+	check := checkSST(path, keys)
+	if len(check.Problems) > 0 {
+		return externalSST{}, fmt.Errorf("%s: %s", name, check.Problems[0])
+	}
+	if check.Format != "block" {
+		return externalSST{}, fmt.Errorf("%s: %s files cannot be ingested", name, check.Format)
+	}
+	entries, err := readSSTEntries(path, keys)
+	if err != nil {
+		return externalSST{}, fmt.Errorf("%s: %w", name, err)
+	}
+	if len(entries) == 0 {
+		return externalSST{}, fmt.Errorf("%s: no entries", name)
+	}
+	for _, entry := range entries {
+		if entry.seq != 0 {
+			return externalSST{}, fmt.Errorf("%s: key %s has sequence number %d, external files must not have any", name, formatValue(entry.key), entry.seq)
+		}
+		if entry.op != opSet && entry.op != opDel {
+			return externalSST{}, fmt.Errorf("%s: key %s is a %s entry, external files only hold sets and deletes", name, formatValue(entry.key), opName(entry.op))
+		}
+	}
+	return externalSST{path: path, source: name, entries: len(entries), firstKey: entries[0].key, lastKey: entries[len(entries)-1].key}, nil
+}
+
+// IngestOptions configure IngestExternalFiles. By default the files are
+// copied and left in place. With Move, they are hard linked when possible
+// and removed from their paths once ingested; they must not be written to
+// meanwhile.
+type IngestOptions struct {
+	Move bool
+}
+
+const (
+	ingestStagingPattern = "ingest_*.tmp"
+	ingestCommitDir      = "ingest.commit"
+)
+
+// IngestExternalFiles adds SST files built by SSTWriter to the namespace as
+// its newest files, so their keys win over the ones already stored. The
+// files are staged in the namespace directory, and the staged copies are
+// validated, so later changes to the originals do not reach the store.
+// Their key ranges must not overlap, as their order among themselves would
+// be arbitrary; nothing is ingested if one of them fails. The staging
+// directory is renamed once the files are numbered, so that after a crash
+// the namespace opens with either none or all of them.
+func (mem *memDB) IngestExternalFiles(paths []string, opts IngestOptions) error {
+	if err := os.MkdirAll(mem.file.dir, 0755); err != nil {
+		return err
+	}
+	staging, err := os.MkdirTemp(mem.file.dir, ingestStagingPattern)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	var files []externalSST
+	for i, path := range paths {
+		staged := filepath.Join(staging, fmt.Sprintf("%d.sst", i))
+		if opts.Move {
+			err = linkOrCopyFile(path, staged)
+		} else {
+			err = copyFile(path, staged)
+		}
+		if err != nil {
+			return err
+		}
+		file, err := validateExternalSST(staged, path, mem.store.keys)
+		if err != nil {
+			return err
+		}
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].firstKey < files[j].firstKey
+	})
+	for i := 1; i < len(files); i++ {
+		if files[i].firstKey <= files[i-1].lastKey {
+			return fmt.Errorf("key ranges of %s and %s overlap", files[i-1].source, files[i].source)
+		}
+	}
+
+	s := mem.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := mem.beginIngestLocked(); err != nil {
+		return err
+	}
+	mem.file.closeFile()
+	for i, file := range files {
+		name := filepath.Base(mem.file.sstPath(mem.file.noFiles + 1 + i))
+		if err := os.Rename(file.path, filepath.Join(staging, name)); err != nil {
+			return err
+		}
+		s.tables.evict(mem.file.sstPath(mem.file.noFiles + 1 + i))
+	}
+	if err := syncDir(staging); err != nil {
+		return err
+	}
+	commit := filepath.Join(mem.file.dir, ingestCommitDir)
+	if err := os.Rename(staging, commit); err != nil {
+		return err
+	}
+	if err := syncDir(mem.file.dir); err != nil {
+		return err
+	}
+	if err := finishIngest(mem.file.dir); err != nil {
+		return err
+	}
+	mem.file.noFiles += len(files)
+
+	for i, file := range files {
+		path := mem.file.sstPath(mem.file.noFiles - len(files) + 1 + i)
+		if opts.Move {
+			os.Remove(file.source)
+		}
+		s.logger.Info("ingested external SST file", "namespace", mem.name, "source", file.source, "path", path, "entries", file.entries)
+		s.events.OnTableCreated(TableInfo{Namespace: mem.name, Path: path, Reason: "ingest"})
+	}
+	return mem.maybeCompact()
+}
+
+// finishIngest moves the files of a committed ingestion into dir, which
+// is left to the next open when a crash interrupts it.
+func finishIngest(dir string) error {
+	commit := filepath.Join(dir, ingestCommitDir)
+	files, err := filepath.Glob(filepath.Join(commit, "sst_*.sst"))
+	if err != nil {
+		return err
+	}
+	for _, path := range files {
+		if err := os.Rename(path, filepath.Join(dir, filepath.Base(path))); err != nil {
+			return err
+		}
+	}
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+	return os.RemoveAll(commit)
+}
+
+// recoverIngest finishes an ingestion committed before a crash and drops
+// the files staged by the ones that were not.
+func recoverIngest(dir string) error {
+	staged, err := filepath.Glob(filepath.Join(dir, ingestStagingPattern))
+	if err != nil {
+		return err
+	}
+	for _, path := range staged {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, ingestCommitDir)); err != nil {
+		return nil
+	}
+	return finishIngest(dir)
+}
+
+// beginIngestLocked prepares the namespace for SST files written outside
+// the memtable: the memtable is flushed, so its older writes cannot hide
+// the new files, and an opIngest record is logged, so that the WAL replay
+// does not bring those writes back to the memtable either. It returns the
+// sequence number of the ingestion. The new files are not in the WAL, so
+// replicas have to bootstrap again to get them.
+func (mem *memDB) beginIngestLocked() (uint64, error) {
+	s := mem.store
+	if s.readOnly {
+		return 0, errReadOnly
+	}
+	if err := mem.flushLocked(); err != nil {
+		return 0, err
+	}
+	s.seq++
+	b := &writeBatch{seq: s.seq, ops: []batchOp{{op: opIngest, ns: mem.name}}}
+	if err := s.wal.AppendBatch(b); err != nil {
+		return 0, err
+	}
+	s.repl.reset(s.seq)
+	return s.seq, nil
+}
+
+// runIngest ingests SST files built by SSTWriter into a namespace of a
+// local data directory.
+func runIngest(args []string) error {
+	fs := flag.NewFlagSet("ingest", flag.ExitOnError)
+	var sf storeFlags
+	sf.register(fs)
+	ns := fs.String("ns", defaultNamespace, "namespace to ingest into, created if missing")
+	move := fs.Bool("move", false, "move the files into the store instead of copying them")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return errors.New("usage: kv ingest [flags] <file>...")
+	}
+
+	s, err := sf.open()
+	if err != nil {
+		return err
+	}
+	mem, err := s.Namespace(*ns)
+	if errors.Is(err, errNamespaceNotFound) {
+		mem, err = s.CreateNamespace(*ns, nsOptions{})
+	}
+	if err != nil {
+		return err
+	}
+	if err := mem.IngestExternalFiles(fs.Args(), IngestOptions{Move: *move}); err != nil {
+		return err
+	}
+	fmt.Printf("ingested %s\n", plural(fs.NArg(), "file"))
+	return nil
+}
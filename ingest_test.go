@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeExternalSST(t *testing.T, path string, keys ...string) {
+	t.Helper()
+	w, err := NewSSTWriter(path, SSTWriterOptions{})
+	if err != nil {
+		t.Fatalf("Error creating SST writer: %v", err)
+	}
+	for _, key := range keys {
+		if key == "deleted" {
+			err = w.Delete([]byte(key))
+		} else {
+			err = w.Put([]byte(key), []byte("ext-"+key), 0)
+		}
+		if err != nil {
+			t.Fatalf("Error adding %s: %v", key, err)
+		}
+	}
+	if err := w.Finish(); err != nil {
+		t.Fatalf("Error finishing SST file: %v", err)
+	}
+}
+
+func TestIngestExternalFiles(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openStore(filepath.Join(dir, "data"))
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	mem, err := s.CreateNamespace("ingest", nsOptions{FlushSize: 1 << 20})
+	if err != nil {
+		t.Fatalf("Error creating namespace: %v", err)
+	}
+	mem.Set([]byte("deleted"), []byte("old"))
+	mem.Flush()
+	mem.Set([]byte("a"), []byte("old"))
+	mem.Set([]byte("kept"), []byte("old"))
+
+	// Enough keys for several blocks
+	var keys []string
+	for i := 0; i < 500; i++ {
+		keys = append(keys, fmt.Sprintf("b-%04d", i))
+	}
+	first := filepath.Join(dir, "first.sst")
+	writeExternalSST(t, first, append([]string{"a"}, keys...)...)
+	second := filepath.Join(dir, "second.sst")
+	writeExternalSST(t, second, "c", "deleted")
+
+	w, _ := NewSSTWriter(filepath.Join(dir, "unsorted.sst"), SSTWriterOptions{})
+	w.Put([]byte("b"), nil, 0)
+	if err := w.Put([]byte("a"), nil, 0); !errors.Is(err, errKeyOrder) {
+		t.Errorf("Expected %v, got %v", errKeyOrder, err)
+	}
+	w.Abort()
+
+	// Overlapping files and files written by a store are refused
+	overlapping := filepath.Join(dir, "overlapping.sst")
+	writeExternalSST(t, overlapping, "b-0100")
+	if err := mem.IngestExternalFiles([]string{first, overlapping}, IngestOptions{}); err == nil {
+		t.Errorf("Expected overlapping files to be refused")
+	}
+	if err := mem.IngestExternalFiles([]string{mem.file.sstPath(1)}, IngestOptions{}); err == nil {
+		t.Errorf("Expected a file with sequence numbers to be refused")
+	}
+	if mem.file.noFiles != 1 {
+		t.Fatalf("Expected nothing ingested after failures, got %d files", mem.file.noFiles)
+	}
+
+	if err := mem.IngestExternalFiles([]string{second, first}, IngestOptions{}); err != nil {
+		t.Fatalf("Error ingesting: %v", err)
+	}
+	// The store has its own copies
+	if err := os.WriteFile(first, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	check := func(mem *memDB) {
+		t.Helper()
+		for key, want := range map[string]string{"a": "ext-a", "b-0499": "ext-b-0499", "c": "ext-c", "kept": "old"} {
+			if got, err := mem.Get([]byte(key)); err != nil || string(got) != want {
+				t.Errorf("Expected %s=%s, got %q, %v", key, want, got, err)
+			}
+		}
+		if _, err := mem.Get([]byte("deleted")); err == nil {
+			t.Errorf("Expected the tombstone to hide the older value")
+		}
+	}
+	check(mem)
+
+	s2, err := openStore(filepath.Join(dir, "data"))
+	if err != nil {
+		t.Fatalf("Error reopening store: %v", err)
+	}
+	mem2, _ := s2.Namespace("ingest")
+	check(mem2)
+	if matches, _ := filepath.Glob(filepath.Join(mem2.file.dir, "ingest*")); len(matches) != 0 {
+		t.Errorf("Expected no staged files left, got %v", matches)
+	}
+
+	// Moved files are gone from their paths
+	moved := filepath.Join(dir, "moved.sst")
+	writeExternalSST(t, moved, "d")
+	if err := mem2.IngestExternalFiles([]string{moved}, IngestOptions{Move: true}); err != nil {
+		t.Fatalf("Error ingesting: %v", err)
+	}
+	if _, err := os.Stat(moved); !os.IsNotExist(err) {
+		t.Errorf("Expected the moved file to be removed, got %v", err)
+	}
+	if got, err := mem2.Get([]byte("d")); err != nil || string(got) != "ext-d" {
+		t.Errorf("Expected d=ext-d, got %q, %v", got, err)
+	}
+}
+
+func TestIngestRecovery(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openStore(filepath.Join(dir, "data"))
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	mem := s.namespaces[defaultNamespace]
+	mem.Set([]byte("a"), []byte("old"))
+	mem.Flush()
+
+	// A crash after the commit leaves the files to move in, one before it
+	// leaves a staging directory to drop
+	commit := filepath.Join(mem.file.dir, ingestCommitDir)
+	os.Mkdir(commit, 0755)
+	writeExternalSST(t, filepath.Join(commit, "sst_2.sst"), "a")
+	writeExternalSST(t, filepath.Join(commit, "sst_3.sst"), "b")
+	staging := filepath.Join(mem.file.dir, "ingest_1.tmp")
+	os.Mkdir(staging, 0755)
+	writeExternalSST(t, filepath.Join(staging, "0.sst"), "c")
+
+	s2, err := openStore(filepath.Join(dir, "data"))
+	if err != nil {
+		t.Fatalf("Error reopening store: %v", err)
+	}
+	mem2 := s2.namespaces[defaultNamespace]
+	for key, want := range map[string]string{"a": "ext-a", "b": "ext-b"} {
+		if got, err := mem2.Get([]byte(key)); err != nil || string(got) != want {
+			t.Errorf("Expected %s=%s, got %q, %v", key, want, got, err)
+		}
+	}
+	if _, err := mem2.Get([]byte("c")); err == nil {
+		t.Errorf("Expected the uncommitted file not to be ingested")
+	}
+	if matches, _ := filepath.Glob(filepath.Join(mem2.file.dir, "ingest*")); len(matches) != 0 {
+		t.Errorf("Expected no staged files left, got %v", matches)
+	}
+}
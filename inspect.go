@@ -0,0 +1,574 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// sstDump is everything kv sst dump decodes from an SST file.
+type sstDump struct {
+	Path         string         `json:"path"`
+	Format       string         `json:"format"` // "block" or "legacy"
+	Size         int64          `json:"size"`
+	EntryCount   int            `json:"entry_count"` // as recorded in the header
+	KeyID        uint32         `json:"key_id,omitempty"`
+	Footer       *sstFooterDump `json:"footer,omitempty"`
+	Index        []sstIndexDump `json:"index,omitempty"`
+	FilterBytes  int            `json:"filter_bytes"`
+	FilterProbes int            `json:"filter_probes"`
+	Entries      []entryDump    `json:"entries"`
+}
+
+type sstFooterDump struct {
+	IndexOffset int64 `json:"index_offset"`
+	IndexSize   int   `json:"index_size"`
+	RawBytes    int64 `json:"raw_bytes"`
+	StoredBytes int64 `json:"stored_bytes"`
+}
+
+type sstIndexDump struct {
+	LastKey string `json:"last_key"`
+	Offset  int64  `json:"offset"`
+	Size    int    `json:"size"`
+}
+
+// entryDump is one entry of an SST file or one operation of a WAL record.
+type entryDump struct {
+	Op        string `json:"op"`
+	Namespace string `json:"namespace,omitempty"`
+	Seq       uint64 `json:"seq,omitempty"`
+	Expires   int64  `json:"expires,omitempty"`
+	Key       string `json:"key"`
+	Value     string `json:"value,omitempty"`
+
+	// Values moved to the value log are shown as the pointer to them
+	Pointer *valuePointerDump `json:"pointer,omitempty"`
+}
+
+type valuePointerDump struct {
+	Segment int   `json:"segment"`
+	Offset  int64 `json:"offset"`
+	Length  int   `json:"length"`
+}
+
+// dumpFormat turns keys and values into text for dumps: as they are if
+// printable, quoted otherwise, or always as hex.
+type dumpFormat struct {
+	hex bool
+}
+
+func (f dumpFormat) bytes(s string) string {
+	if f.hex {
+		return hex.EncodeToString([]byte(s))
+	}
+	return formatValue(s)
+}
+
+func opName(op byte) string {
+	switch op {
+	case opDel:
+		return "del"
+	case opSet:
+		return "set"
+	case opSetTTL:
+		return "set_ttl"
+	case opDropNS:
+		return "drop_namespace"
+	case opValuePtr:
+		return "value_ptr"
+	case opIngest:
+		return "ingest"
+	}
+	return fmt.Sprintf("unknown(%d)", op)
+}
+
+func (f dumpFormat) entry(entry memEntry) entryDump {
+	d := entryDump{
+		Op:      opName(entry.op),
+		Seq:     entry.seq,
+		Expires: entry.expires,
+		Key:     f.bytes(entry.key),
+	}
+	if entry.op == opValuePtr {
+		if ptr, err := decodeValuePointer(entry.value); err == nil {
+			d.Pointer = &valuePointerDump{Segment: ptr.segment, Offset: ptr.offset, Length: ptr.length}
+			return d
+		}
+	}
+	if entry.op != opDel {
+		d.Value = f.bytes(entry.value)
+	}
+	return d
+}
+
+// dumpSST decodes every part of the SST file at path, stopping at the first
+// corruption.
+func dumpSST(path string, keys *keyring, f dumpFormat) (sstDump, error) {
+	dump := sstDump{Path: path}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return dump, err
+	}
+	dump.Size = int64(len(data))
+	if len(data) < sstHeaderSize {
+		return dump, fmt.Errorf("%s: file too short for SST header", path)
+	}
+	dump.EntryCount = int(binary.BigEndian.Uint32(data[magicNumberSize : magicNumberSize+entryCountSize]))
+
+	if !isBlockSST(data) {
+		if magic := binary.BigEndian.Uint32(data[:magicNumberSize]); magic != legacySSTMagic {
+			return dump, fmt.Errorf("%s: %w: unknown magic number %#x", path, errCorruptSST, magic)
+		}
+		dump.Format = "legacy"
+		entries, err := readSSTEntries(path, keys)
+		if err != nil {
+			return dump, err
+		}
+		for _, entry := range entries {
+			dump.Entries = append(dump.Entries, f.entry(entry))
+		}
+		return dump, nil
+	}
+
+	dump.Format = "block"
+	dump.KeyID = binary.BigEndian.Uint32(data[12:16])
+	r := bytes.NewReader(data)
+	aead, err := sstAEAD(data, keys)
+	if err != nil {
+		return dump, fmt.Errorf("%s: %w", path, err)
+	}
+	footer, err := readSSTFooter(r, dump.Size)
+	if err != nil {
+		return dump, fmt.Errorf("%s: footer: %w", path, err)
+	}
+	dump.Footer = &sstFooterDump{
+		IndexOffset: footer.indexOffset,
+		IndexSize:   footer.indexSize,
+		RawBytes:    footer.rawBytes,
+		StoredBytes: footer.storedBytes,
+	}
+	index, err := readSSTIndex(r, footer, aead)
+	if err != nil {
+		return dump, fmt.Errorf("%s: index: %w", path, err)
+	}
+	for _, h := range index {
+		dump.Index = append(dump.Index, sstIndexDump{LastKey: f.bytes(h.lastKey), Offset: h.offset, Size: h.size})
+	}
+
+	filter, err := readSSTFilter(r, data, footer, aead)
+	if err != nil {
+		return dump, fmt.Errorf("%s: filter: %w", path, err)
+	}
+	dump.FilterBytes = len(filter)
+	if len(filter) > 0 {
+		dump.FilterProbes = int(filter[len(filter)-1])
+	}
+
+	for i, h := range index {
+		block, err := readBlock(r, h, aead)
+		if err != nil {
+			return dump, fmt.Errorf("%s: block %d at offset %d: %w", path, i, h.offset, err)
+		}
+		entries, err := decodeBlockEntries(block)
+		if err != nil {
+			return dump, fmt.Errorf("%s: block %d at offset %d: %w", path, i, h.offset, err)
+		}
+		for _, entry := range entries {
+			dump.Entries = append(dump.Entries, f.entry(entry))
+		}
+	}
+	return dump, nil
+}
+
+// sstCheck is the result of checking an SST file. Problems is empty when the
+// file is sound.
+type sstCheck struct {
+	Path     string   `json:"path"`
+	Format   string   `json:"format,omitempty"`
+	Blocks   int      `json:"blocks"`
+	Entries  int      `json:"entries"`
+	FirstKey string   `json:"first_key,omitempty"`
+	LastKey  string   `json:"last_key,omitempty"`
+	Problems []string `json:"problems,omitempty"`
+}
+
+func (c *sstCheck) problem(format string, args ...interface{}) {
+	c.Problems = append(c.Problems, fmt.Sprintf(format, args...))
+}
+
+// checkSST verifies the checksum of every block of an SST file, that its
+// keys are sorted and match the index, and that the header, footer and
+// filter agree with the data. It carries on past corrupt data blocks to
+// report all of them.
+func checkSST(path string, keys *keyring) sstCheck {
+	check := sstCheck{Path: path}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		check.problem("%v", err)
+		return check
+	}
+	if len(data) < sstHeaderSize {
+		check.problem("file too short for SST header: %d bytes", len(data))
+		return check
+	}
+
+	if !isBlockSST(data) {
+		if magic := binary.BigEndian.Uint32(data[:magicNumberSize]); magic != legacySSTMagic {
+			check.problem("unknown magic number %#x", magic)
+			return check
+		}
+		check.Format = "legacy"
+		entries, err := readSSTEntries(path, keys)
+		if err != nil {
+			check.problem("%v", err)
+			return check
+		}
+		check.Entries = len(entries)
+		return check
+	}
+
+	check.Format = "block"
+	r := bytes.NewReader(data)
+	aead, err := sstAEAD(data, keys)
+	if err != nil {
+		check.problem("%v", err)
+		return check
+	}
+	footer, err := readSSTFooter(r, int64(len(data)))
+	if err != nil {
+		check.problem("footer: %v", err)
+		return check
+	}
+	index, err := readSSTIndex(r, footer, aead)
+	if err != nil {
+		check.problem("index: %v", err)
+		return check
+	}
+	check.Blocks = len(index)
+
+	var (
+		keysSeen      []string
+		raw, stored   int64
+		prev          string
+		corruptBlocks bool
+	)
+	for i, h := range index {
+		stored += int64(h.size)
+		if i > 0 && h.offset <= index[i-1].offset {
+			check.problem("block %d at offset %d is not after block %d", i, h.offset, i-1)
+		}
+		block, err := readBlock(r, h, aead)
+		if err != nil {
+			check.problem("block %d at offset %d: %v", i, h.offset, err)
+			corruptBlocks = true
+			continue
+		}
+		raw += int64(len(block))
+		entries, err := decodeBlockEntries(block)
+		if err != nil {
+			check.problem("block %d at offset %d: %v", i, h.offset, err)
+			corruptBlocks = true
+			continue
+		}
+		if len(entries) == 0 {
+			check.problem("block %d at offset %d is empty", i, h.offset)
+			continue
+		}
+		for _, entry := range entries {
+			if len(keysSeen) > 0 && entry.key <= prev {
+				check.problem("block %d: key %s is not after %s", i, formatValue(entry.key), formatValue(prev))
+			}
+			prev = entry.key
+			keysSeen = append(keysSeen, entry.key)
+		}
+		if last := entries[len(entries)-1].key; last != h.lastKey {
+			check.problem("block %d: last key %s, the index says %s", i, formatValue(last), formatValue(h.lastKey))
+		}
+	}
+
+	check.Entries = len(keysSeen)
+	if len(keysSeen) > 0 {
+		check.FirstKey = formatValue(keysSeen[0])
+		check.LastKey = formatValue(keysSeen[len(keysSeen)-1])
+	}
+	if corruptBlocks {
+		return check
+	}
+	if count := int(binary.BigEndian.Uint32(data[magicNumberSize : magicNumberSize+entryCountSize])); count != len(keysSeen) {
+		check.problem("header counts %d entries, found %d", count, len(keysSeen))
+	}
+	if raw != footer.rawBytes || stored != footer.storedBytes {
+		check.problem("footer records %d/%d raw/stored bytes, found %d/%d", footer.rawBytes, footer.storedBytes, raw, stored)
+	}
+
+	filter, err := readSSTFilter(r, data, footer, aead)
+	if err != nil {
+		check.problem("filter: %v", err)
+		return check
+	}
+	for _, key := range keysSeen {
+		if !filter.mayContain(key) {
+			check.problem("filter does not match key %s", formatValue(key))
+			break
+		}
+	}
+	return check
+}
+
+// walDump is everything kv wal dump decodes from a WAL file.
+type walDump struct {
+	Path      string          `json:"path"`
+	Encrypted bool            `json:"encrypted"`
+	KeyID     uint32          `json:"key_id,omitempty"`
+	Records   []walRecordDump `json:"records"`
+
+	// Tail describes what follows the last complete record, if anything:
+	// the remains of a write that never completed, or corruption.
+	Tail string `json:"tail,omitempty"`
+}
+
+type walRecordDump struct {
+	Offset int64       `json:"offset"`
+	Length int         `json:"length"`
+	Seq    uint64      `json:"seq"`
+	Ops    []entryDump `json:"ops"`
+}
+
+// dumpWAL decodes every complete record of the WAL file at path. A record
+// that cannot be decrypted or decoded is an error, while a short or
+// mismatching record ends the dump as it ends a replay.
+func dumpWAL(path string, keys *keyring, f dumpFormat) (walDump, error) {
+	dump := walDump{Path: path}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return dump, err
+	}
+
+	var aead cipher.AEAD
+	offset := 0
+	if len(data) >= walFileHeaderSize && binary.BigEndian.Uint32(data[:4]) == walMagic {
+		dump.KeyID = binary.BigEndian.Uint32(data[4:8])
+		dump.Encrypted = dump.KeyID != 0
+		aead, err = keys.aead(dump.KeyID)
+		if err != nil {
+			return dump, fmt.Errorf("%s: %w", path, err)
+		}
+		offset = walFileHeaderSize
+	}
+
+	for offset < len(data) {
+		if len(data)-offset < walHeaderSize {
+			dump.Tail = fmt.Sprintf("%d bytes of a truncated record header at offset %d", len(data)-offset, offset)
+			break
+		}
+		length := int(binary.LittleEndian.Uint32(data[offset+4 : offset+8]))
+		if length > maxWALRecordSize || len(data)-offset-walHeaderSize < length {
+			dump.Tail = fmt.Sprintf("record at offset %d is truncated: %d bytes long, %d left", offset, length, len(data)-offset-walHeaderSize)
+			break
+		}
+		payload := data[offset+walHeaderSize : offset+walHeaderSize+length]
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(data[offset:offset+4]) {
+			dump.Tail = fmt.Sprintf("record at offset %d has a bad checksum", offset)
+			break
+		}
+		plain, err := unseal(aead, payload, nil)
+		if err != nil {
+			return dump, fmt.Errorf("%s: record at offset %d: %w", path, offset, err)
+		}
+		b, err := decodeBatch(plain)
+		if err != nil {
+			return dump, fmt.Errorf("%s: record at offset %d: %w", path, offset, err)
+		}
+
+		record := walRecordDump{Offset: int64(offset), Length: length, Seq: b.seq, Ops: []entryDump{}}
+		for _, op := range b.ops {
+			d := f.entry(memEntry{op: op.op, key: string(op.key), value: string(op.value), expires: op.expires})
+			d.Namespace = op.ns
+			record.Ops = append(record.Ops, d)
+		}
+		dump.Records = append(dump.Records, record)
+		offset += walHeaderSize + length
+	}
+	return dump, nil
+}
+
+// inspectFlags are the flags shared by kv sst and kv wal.
+type inspectFlags struct {
+	keyFile string
+	json    bool
+	hex     bool
+}
+
+func (f *inspectFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.keyFile, "encryption-key-file", "", "file of hex encoded AES keys the files may be encrypted with")
+	fs.BoolVar(&f.json, "json", false, "write JSON instead of text")
+	fs.BoolVar(&f.hex, "hex", false, "show every key and value as hex")
+}
+
+func (f *inspectFlags) keys() (*keyring, error) {
+	if f.keyFile == "" {
+		return newKeyring(nil, nil)
+	}
+	current, old, err := loadKeyFile(f.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return newKeyring(current, old)
+}
+
+// runSST runs kv sst dump and kv sst check.
+func runSST(args []string) error {
+	if len(args) == 0 || (args[0] != "dump" && args[0] != "check") {
+		return errors.New("usage: kv sst dump|check [flags] <file>...")
+	}
+	fs := flag.NewFlagSet("sst "+args[0], flag.ExitOnError)
+	var inf inspectFlags
+	inf.register(fs)
+	fs.Parse(args[1:])
+	if fs.NArg() == 0 {
+		return fmt.Errorf("usage: kv sst %s [flags] <file>...", args[0])
+	}
+	keys, err := inf.keys()
+	if err != nil {
+		return err
+	}
+
+	if args[0] == "dump" {
+		for _, path := range fs.Args() {
+			dump, err := dumpSST(path, keys, dumpFormat{hex: inf.hex})
+			if err != nil {
+				return err
+			}
+			if inf.json {
+				if err := json.NewEncoder(os.Stdout).Encode(dump); err != nil {
+					return err
+				}
+				continue
+			}
+			printSSTDump(os.Stdout, dump)
+		}
+		return nil
+	}
+
+	failed := 0
+	for _, path := range fs.Args() {
+		check := checkSST(path, keys)
+		if len(check.Problems) > 0 {
+			failed++
+		}
+		if inf.json {
+			if err := json.NewEncoder(os.Stdout).Encode(check); err != nil {
+				return err
+			}
+			continue
+		}
+		printSSTCheck(os.Stdout, check)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files have problems", failed, fs.NArg())
+	}
+	return nil
+}
+
+// runWAL runs kv wal dump.
+func runWAL(args []string) error {
+	if len(args) == 0 || args[0] != "dump" {
+		return errors.New("usage: kv wal dump [flags] <file>")
+	}
+	fs := flag.NewFlagSet("wal dump", flag.ExitOnError)
+	var inf inspectFlags
+	inf.register(fs)
+	fs.Parse(args[1:])
+	if fs.NArg() != 1 {
+		return errors.New("usage: kv wal dump [flags] <file>")
+	}
+	keys, err := inf.keys()
+	if err != nil {
+		return err
+	}
+
+	dump, err := dumpWAL(fs.Arg(0), keys, dumpFormat{hex: inf.hex})
+	if err != nil {
+		return err
+	}
+	if inf.json {
+		return json.NewEncoder(os.Stdout).Encode(dump)
+	}
+	printWALDump(os.Stdout, dump)
+	return nil
+}
+
+func printEntryDump(w io.Writer, d entryDump) {
+	fmt.Fprintf(w, "  %-9s", d.Op)
+	if d.Namespace != "" {
+		fmt.Fprintf(w, " ns=%s", d.Namespace)
+	}
+	if d.Seq != 0 {
+		fmt.Fprintf(w, " seq=%d", d.Seq)
+	}
+	if d.Expires != 0 {
+		fmt.Fprintf(w, " expires=%d", d.Expires)
+	}
+	fmt.Fprintf(w, " %s", d.Key)
+	if d.Pointer != nil {
+		fmt.Fprintf(w, " -> vlog_%d offset=%d length=%d", d.Pointer.Segment, d.Pointer.Offset, d.Pointer.Length)
+	} else if d.Op != "del" {
+		fmt.Fprintf(w, " %s", d.Value)
+	}
+	fmt.Fprintln(w)
+}
+
+func printSSTDump(w io.Writer, dump sstDump) {
+	fmt.Fprintf(w, "%s: %s format, %d bytes, %d entries in header\n", dump.Path, dump.Format, dump.Size, dump.EntryCount)
+	if dump.Footer != nil {
+		fmt.Fprintf(w, "key id: %d\n", dump.KeyID)
+		fmt.Fprintf(w, "footer: index at %d (%d bytes), %d raw bytes, %d stored bytes\n",
+			dump.Footer.IndexOffset, dump.Footer.IndexSize, dump.Footer.RawBytes, dump.Footer.StoredBytes)
+		fmt.Fprintf(w, "filter: %d bytes, %d probes per key\n", dump.FilterBytes, dump.FilterProbes)
+		fmt.Fprintf(w, "index: %d blocks\n", len(dump.Index))
+		for i, h := range dump.Index {
+			fmt.Fprintf(w, "  block %d: offset=%d size=%d last_key=%s\n", i, h.Offset, h.Size, h.LastKey)
+		}
+	}
+	fmt.Fprintf(w, "entries: %d\n", len(dump.Entries))
+	for _, d := range dump.Entries {
+		printEntryDump(w, d)
+	}
+}
+
+func printSSTCheck(w io.Writer, check sstCheck) {
+	if len(check.Problems) == 0 {
+		fmt.Fprintf(w, "%s: OK, %d blocks, %d entries\n", check.Path, check.Blocks, check.Entries)
+		return
+	}
+	fmt.Fprintf(w, "%s: %d problems\n", check.Path, len(check.Problems))
+	for _, p := range check.Problems {
+		fmt.Fprintf(w, "  %s\n", p)
+	}
+}
+
+func printWALDump(w io.Writer, dump walDump) {
+	fmt.Fprintf(w, "%s: %d records", dump.Path, len(dump.Records))
+	if dump.Encrypted {
+		fmt.Fprintf(w, ", encrypted with key %d", dump.KeyID)
+	}
+	fmt.Fprintln(w)
+	for _, record := range dump.Records {
+		fmt.Fprintf(w, "record at offset %d: seq=%d, %d bytes, %d ops\n", record.Offset, record.Seq, record.Length, len(record.Ops))
+		for _, d := range record.Ops {
+			printEntryDump(w, d)
+		}
+	}
+	if dump.Tail != "" {
+		fmt.Fprintf(w, "tail: %s\n", dump.Tail)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInspect_SST(t *testing.T) {
+	s, err := openStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	mem, err := s.CreateNamespace("inspect", nsOptions{FlushSize: 1 << 20})
+	if err != nil {
+		t.Fatalf("Error creating namespace: %v", err)
+	}
+	if err := mem.Update(func(tx *memTxn) error {
+		tx.Put([]byte("a"), []byte("apple"), 0)
+		tx.Put([]byte("b"), []byte{0, 1}, 0)
+		tx.Delete([]byte("c"))
+		return nil
+	}); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	path, err := mem.Flush()
+	if err != nil {
+		t.Fatalf("Error flushing: %v", err)
+	}
+
+	dump, err := dumpSST(path, s.keys, dumpFormat{})
+	if err != nil {
+		t.Fatalf("Error dumping: %v", err)
+	}
+	if dump.Format != "block" || dump.EntryCount != 3 || len(dump.Index) != 1 || dump.FilterProbes == 0 {
+		t.Errorf("Unexpected dump metadata: %+v", dump)
+	}
+	want := []entryDump{
+		{Op: "set", Seq: 1, Key: "a", Value: "apple"},
+		{Op: "set", Seq: 1, Key: "b", Value: `"\x00\x01"`},
+		{Op: "del", Seq: 1, Key: "c"},
+	}
+	for i, d := range dump.Entries {
+		if i >= len(want) || d != want[i] {
+			t.Errorf("Entry %d: got %+v", i, d)
+		}
+	}
+	hexDump, err := dumpSST(path, s.keys, dumpFormat{hex: true})
+	if err != nil || hexDump.Entries[1].Value != "0001" {
+		t.Errorf("Expected hex values, got %+v, %v", hexDump.Entries, err)
+	}
+
+	if check := checkSST(path, s.keys); len(check.Problems) != 0 || check.Entries != 3 || check.FirstKey != "a" || check.LastKey != "c" {
+		t.Errorf("Expected a sound file, got %+v", check)
+	}
+
+	// Flip a byte of the data block
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Error reading file: %v", err)
+	}
+	data[sstHeaderSize+2] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Error writing file: %v", err)
+	}
+	check := checkSST(path, s.keys)
+	if len(check.Problems) != 1 || !strings.Contains(check.Problems[0], errBadChecksum.Error()) {
+		t.Errorf("Expected a checksum problem, got %+v", check)
+	}
+	if _, err := dumpSST(path, s.keys, dumpFormat{}); err == nil {
+		t.Errorf("Expected dumping a corrupt file to fail")
+	}
+
+	// A file left with a zero header
+	zero := filepath.Join(t.TempDir(), "sst_9.sst")
+	if err := os.WriteFile(zero, make([]byte, 64), 0644); err != nil {
+		t.Fatalf("Error writing file: %v", err)
+	}
+	if check := checkSST(zero, s.keys); len(check.Problems) != 1 || !strings.Contains(check.Problems[0], "unknown magic number") {
+		t.Errorf("Expected an unknown magic number, got %+v", check)
+	}
+}
+
+func TestInspect_WAL(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openStore(dir)
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	mem := s.namespaces[defaultNamespace]
+	if err := mem.Set([]byte("k"), []byte("v")); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+	b := &writeBatch{}
+	b.Put(defaultNamespace, []byte("x"), []byte("1"))
+	b.Delete(defaultNamespace, []byte("k"))
+	if err := s.Write(b); err != nil {
+		t.Fatalf("Error writing batch: %v", err)
+	}
+
+	// Half of a record, as left by a crash
+	walPath := filepath.Join(dir, walFileName)
+	f, err := os.OpenFile(walPath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("Error opening WAL: %v", err)
+	}
+	f.Write([]byte{1, 2, 3, 4, 100, 0, 0, 0, 9})
+	f.Close()
+
+	dump, err := dumpWAL(walPath, s.keys, dumpFormat{})
+	if err != nil {
+		t.Fatalf("Error dumping WAL: %v", err)
+	}
+	if len(dump.Records) != 2 {
+		t.Fatalf("Expected 2 records, got %+v", dump.Records)
+	}
+	second := dump.Records[1]
+	if second.Seq != 2 || len(second.Ops) != 2 || second.Ops[0] != (entryDump{Op: "set", Namespace: defaultNamespace, Key: "x", Value: "1"}) || second.Ops[1].Op != "del" {
+		t.Errorf("Unexpected second record: %+v", second)
+	}
+	if !strings.Contains(dump.Tail, "truncated") {
+		t.Errorf("Expected a truncated tail, got %q", dump.Tail)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// entryIterator walks the entries of a memtable or an SST file in key order.
+type entryIterator interface {
+	valid() bool
+	entry() memEntry
+	next() error
+}
+
+type sliceIterator struct {
+	entries []memEntry
+	pos     int
+}
+
+func newSliceIterator(entries []memEntry, start string) *sliceIterator {
+	pos := sort.Search(len(entries), func(i int) bool {
+		return entries[i].key >= start
+	})
+	return &sliceIterator{entries: entries, pos: pos}
+}
+
+func (it *sliceIterator) valid() bool     { return it.pos < len(it.entries) }
+func (it *sliceIterator) entry() memEntry { return it.entries[it.pos] }
+func (it *sliceIterator) next() error {
+	it.pos++
+	return nil
+}
+
+// sstIterator reads the data blocks of an SST file one at a time, through
+// the block cache.
+type sstIterator struct {
+	r       *sstReader
+	blocks  *blockCache
+	block   int
+	entries []memEntry
+	pos     int
+}
+
+// seek returns an iterator positioned at the first entry >= start.
+func (r *sstReader) seek(start string, blocks *blockCache) (entryIterator, error) {
+	if r.legacy != nil {
+		entries := make([]memEntry, 0, len(r.legacy))
+		for _, entry := range r.legacy {
+			entries = append(entries, entry)
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].key < entries[j].key
+		})
+		return newSliceIterator(entries, start), nil
+	}
+
+	it := &sstIterator{r: r, blocks: blocks}
+	it.block = sort.Search(len(r.index), func(i int) bool {
+		return r.index[i].lastKey >= start
+	})
+	if err := it.load(); err != nil {
+		return nil, err
+	}
+	it.pos = sort.Search(len(it.entries), func(i int) bool {
+		return it.entries[i].key >= start
+	})
+	return it, nil
+}
+
+// keyRange returns the smallest and largest key of the file, both empty if
+// it has no entries.
+func (r *sstReader) keyRange(blocks *blockCache) (string, string, error) {
+	it, err := r.seek("", blocks)
+	if err != nil || !it.valid() {
+		return "", "", err
+	}
+	first, last := it.entry().key, it.entry().key
+	if r.legacy != nil {
+		for key := range r.legacy {
+			last = max(last, key)
+		}
+	} else {
+		last = r.index[len(r.index)-1].lastKey
+	}
+	return first, last, nil
+}
+
+func (it *sstIterator) load() error {
+	it.entries, it.pos = nil, 0
+	if it.block >= len(it.r.index) {
+		return nil
+	}
+	entries, err := it.r.readBlockEntries(it.r.index[it.block], it.blocks)
+	if err != nil {
+		return err
+	}
+	it.entries = entries
+	return nil
+}
+
+func (it *sstIterator) valid() bool     { return it.pos < len(it.entries) }
+func (it *sstIterator) entry() memEntry { return it.entries[it.pos] }
+func (it *sstIterator) next() error {
+	it.pos++
+	if it.pos < len(it.entries) {
+		return nil
+	}
+	it.block++
+	return it.load()
+}
+
+// Scan returns up to limit live entries with a key >= start, in key order
+// and with their values read from the value log if needed. A limit <= 0
+// returns every entry.
+func (mem *memDB) Scan(start string, limit int) ([]memEntry, error) {
+	mem.store.mu.RLock()
+	defer mem.store.mu.RUnlock()
+
+	var entries []memEntry
+	err := mem.scanLocked(start, func(entry memEntry) (bool, error) {
+		entries = append(entries, entry)
+		return limit <= 0 || len(entries) < limit, nil
+	})
+	return entries, err
+}
+
+// scanLocked calls fn with every live entry with a key >= start, in key
+// order, until fn returns false. It merges the memtable and the SST files,
+// newest first, so the newest entry of a key wins.
+func (mem *memDB) scanLocked(start string, fn func(entry memEntry) (bool, error)) error {
+	sources := []entryIterator{newSliceIterator(mem.parseMemTableEntries(), start)}
+	for fileIndex := mem.file.noFiles; fileIndex > 0; fileIndex-- {
+		reader, release, err := mem.store.tables.get(mem.file.sstPath(fileIndex))
+		if err != nil {
+			return err
+		}
+		defer release()
+		it, err := reader.seek(start, mem.store.blocks)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, it)
+	}
+
+	now := time.Now().UnixNano()
+	for {
+		// The smallest key wins, and among equal keys the newest source
+		newest := -1
+		for i, it := range sources {
+			if it.valid() && (newest < 0 || it.entry().key < sources[newest].entry().key) {
+				newest = i
+			}
+		}
+		if newest < 0 {
+			return nil
+		}
+		entry := sources[newest].entry()
+		for _, it := range sources {
+			for it.valid() && it.entry().key == entry.key {
+				if err := it.next(); err != nil {
+					return err
+				}
+			}
+		}
+
+		if entry.op == opDel || entry.expired(now) {
+			continue
+		}
+		value, err := mem.resolveValue(entry)
+		if err != nil {
+			return err
+		}
+		entry.op = opSet
+		entry.value = string(value)
+		more, err := fn(entry)
+		if err != nil || !more {
+			return err
+		}
+	}
+}
+
+// scanPrefix returns the live entries of a namespace whose keys start with
+// prefix, read a page at a time.
+func scanPrefix(mem *memDB, prefix string) ([]memEntry, error) {
+	var list []memEntry
+	start := prefix
+	for {
+		entries, err := mem.Scan(start, exportPageSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !strings.HasPrefix(entry.key, prefix) {
+				return list, nil
+			}
+			list = append(list, entry)
+		}
+		if len(entries) < exportPageSize {
+			return list, nil
+		}
+		start = entries[len(entries)-1].key + "\x00"
+	}
+}
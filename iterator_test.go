@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestScan_MergesMemtableAndSSTFiles(t *testing.T) {
+	s, err := openStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	mem, _ := s.CreateNamespace("scan", nsOptions{FlushSize: 30, ValueThreshold: 8})
+
+	for i := 0; i < 20; i++ {
+		mem.Set([]byte(fmt.Sprintf("key-%02d", i)), []byte(fmt.Sprintf("v%d", i)))
+	}
+	mem.Set([]byte("key-05"), []byte("overwritten and long"))
+	mem.Del("key-10")
+	mem.Set([]byte("key-10"), []byte("back"))
+	mem.Del("key-11")
+	if mem.file.noFiles < 2 || len(mem.memValues) == 0 {
+		t.Fatalf("Expected entries both in SST files and the memtable")
+	}
+
+	entries, err := mem.Scan("key-04", 0)
+	if err != nil {
+		t.Fatalf("Error scanning: %v", err)
+	}
+	if len(entries) != 15 {
+		t.Fatalf("Expected 15 entries from key-04, got %d", len(entries))
+	}
+	want := map[string]string{"key-04": "v4", "key-05": "overwritten and long", "key-10": "back", "key-19": "v19"}
+	for _, entry := range entries {
+		if entry.key == "key-11" {
+			t.Errorf("Expected deleted key-11 to be skipped")
+		}
+		if v, ok := want[entry.key]; ok && entry.value != v {
+			t.Errorf("Expected %s=%s, got %s", entry.key, v, entry.value)
+		}
+	}
+
+	if entries, _ := mem.Scan("", 3); len(entries) != 3 || entries[2].key != "key-02" {
+		t.Errorf("Expected the first 3 keys, got %v", entries)
+	}
+}
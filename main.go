@@ -1,104 +1,15 @@
-// package main
-
-// import (
-// 	"os"
-// )
-
-// func main() {
-
-// 	db := NewInMem()
-
-// 	repl := &Repl{
-// 		db:  db,
-// 		in:  os.Stdin,
-// 		out: os.Stdout,
-// 	}
-// 	repl.Start()
-
-// }
-
-// import (
-// 	"encoding/json"
-// 	"fmt"
-// 	"net/http"
-// )
-
-// func handleGet(w http.ResponseWriter, r *http.Request) {
-// 	key := r.URL.Query().Get("key")
-// 	if key == "" {
-// 		http.Error(w, "Missing key parameter", http.StatusBadRequest)
-// 		return
-// 	}
-// 	fmt.Println("value is", string(key))
-// 	value, err := db.Get([]byte(key))
-// 	fmt.Println("value is", string(value))
-// 	if err != nil {
-// 		http.Error(w, err.Error(), http.StatusNotFound)
-// 		return
-// 	}
-
-// 	w.Write([]byte(value))
-// }
-
-// func handleSet(w http.ResponseWriter, r *http.Request) {
-// 	var data map[string]string
-// 	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-// 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
-// 		return
-// 	}
-
-// 	key, ok := data["key"]
-// 	if !ok {
-// 		http.Error(w, "Missing key in JSON", http.StatusBadRequest)
-// 		return
-// 	}
-
-// 	value, ok := data["value"]
-// 	if !ok {
-// 		http.Error(w, "Missing value in JSON", http.StatusBadRequest)
-// 		return
-// 	}
-
-// 	db.Set([]byte(key), []byte(value))
-// 	w.WriteHeader(http.StatusNoContent)
-// }
-
-// func handleDelete(w http.ResponseWriter, r *http.Request) {
-// 	key := r.URL.Query().Get("key")
-// 	if key == "" {
-// 		http.Error(w, "Missing key parameter", http.StatusBadRequest)
-// 		return
-// 	}
-
-// 	value, err := db.Del(key)
-// 	if err != nil {
-// 		http.Error(w, err.Error(), http.StatusNotFound)
-// 		return
-// 	}
-
-// 	w.Write([]byte(value))
-// }
-
-// var db *memDB
-
-// func main() {
-// 	db = NewInMem()
-
-// 	http.HandleFunc("/get", handleGet)
-// 	http.HandleFunc("/set", handleSet)
-// 	http.HandleFunc("/del", handleDelete)
-
-//		// Start HTTP server on port 8080
-//		if err := http.ListenAndServe(":8080", nil); err != nil {
-//			fmt.Printf("Error starting HTTP server: %s\n", err)
-//		}
-//	}
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"html/template"
+	"log/slog"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/gorilla/mux"
 )
@@ -226,10 +137,209 @@ func renderTemplate(w http.ResponseWriter, tmpl string, data PageVariables) {
 	}
 }
 
-var db *memDB
+var (
+	st *store
+	db *memDB
+
+	// follower replicates the primary the server was started with
+	// -replica-of, nil otherwise.
+	follower *replica
+
+	// cluster is the raft node of the server started with -raft-id, nil
+	// otherwise.
+	cluster *raftNode
+
+	// hooks sends the webhooks of the server started with -webhooks, nil
+	// otherwise.
+	hooks *webhooks
+)
+
+// storeFlags are the flags of every subcommand that opens a data
+// directory.
+type storeFlags struct {
+	dir      string
+	keyFile  string
+	logLevel string
+}
+
+func (f *storeFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.dir, "dir", ".", "data directory")
+	fs.StringVar(&f.keyFile, "encryption-key-file", "", "file of hex encoded AES keys, the first one encrypts new data")
+	fs.StringVar(&f.logLevel, "log-level", "info", "level of the logs written to stderr: debug, info, warn or error")
+}
+
+func (f *storeFlags) options() (storeOptions, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(f.logLevel)); err != nil {
+		return storeOptions{}, err
+	}
+	opts := defaultStoreOptions()
+	opts.EncryptionKeyFile = f.keyFile
+	opts.Logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	return opts, nil
+}
+
+func (f *storeFlags) open() (*store, error) {
+	opts, err := f.options()
+	if err != nil {
+		return nil, err
+	}
+	return openStoreWith(f.dir, opts)
+}
+
+const usage = `usage: kv <command> [flags]
+
+commands:
+  serve              run the HTTP server and the other enabled front ends (default)
+  repl               run the command prompt against a local data directory
+  cli <host:port>    run the command prompt against a server started with -repl-addr
+  exec [script]      run the commands of a script, or of stdin, without prompts
+  sst dump <file>    decode the header, footer, index, filter and entries of SST files
+  sst check <file>   verify the checksums, key order and metadata of SST files
+  wal dump <file>    decode the records of a WAL file
+  check <dir>        check every file of a data directory
+  repair <dir>       make a damaged data directory usable, keeping what it drops in lost+found
+  export             write the keys of a namespace as JSON Lines or CSV
+  import [file]      load JSON Lines or CSV into a namespace
+  ingest <file>...   add SST files built offline to a namespace
+  backup create      back a data directory up, sharing unchanged files with earlier backups
+  backup list        list the backups of a backup directory
+  backup restore     write a backup to a new data directory
+  backup purge       delete all backups but the most recent ones
+  proxy              spread keys over several servers with a consistent hash ring
+
+Run kv <command> -h for the flags of a command.
+`
 
 func main() {
-	db = NewInMem()
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+
+	var err error
+	switch cmd {
+	case "serve":
+		err = runServe(args)
+	case "repl":
+		err = runRepl(args)
+	case "cli":
+		err = runCLI(args)
+	case "exec":
+		err = runExec(args)
+	case "sst":
+		err = runSST(args)
+	case "wal":
+		err = runWAL(args)
+	case "check":
+		err = runCheck(args)
+	case "repair":
+		err = runRepair(args)
+	case "export":
+		err = runExport(args)
+	case "import":
+		err = runImport(args)
+	case "ingest":
+		err = runIngest(args)
+	case "backup":
+		err = runBackup(args)
+	case "proxy":
+		err = runProxy(args)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kv %s: %s\n", cmd, err)
+		os.Exit(1)
+	}
+}
+
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	var sf storeFlags
+	sf.register(fs)
+	var tf tlsFlags
+	tf.register(fs)
+	addr := fs.String("addr", ":8080", "address of the HTTP server")
+	respAddr := fs.String("resp-addr", "", "address to serve the Redis protocol on, e.g. :6379")
+	memcachedAddr := fs.String("memcached-addr", "", "address to serve the memcached text protocol on, e.g. :11211")
+	memcachedNS := fs.String("memcached-ns", "memcached", "namespace holding the memcached items, created if missing")
+	replAddr := fs.String("repl-addr", "", "address to serve the command prompt on, for kv cli")
+	backupDir := fs.String("backup-dir", "", "directory of the backups taken through /admin/backup")
+	replicaOf := fs.String("replica-of", "", "URL of the primary to replicate, e.g. http://primary:8080; the store is then read-only")
+	replicaToken := fs.String("replica-token", "", "token sent to a primary started with -auth, of an identity with admin on every namespace")
+	replLogSize := fs.Int("replication-log-size", 16<<20, "bytes of recent writes kept for replicas to stream, 0 to not serve replicas")
+	watchLogSize := fs.Int("watch-log-size", defaultStoreOptions().WatchLogSize, "bytes of recent writes kept for watchers to resume from, on top of the WAL")
+	raftID := fs.String("raft-id", "", "URL other raft nodes reach this server at, e.g. http://node1:8080; enables raft")
+	raftPeers := fs.String("raft-peers", "", "comma separated URLs of the initial raft voters, including -raft-id; empty to join an existing cluster")
+	raftDir := fs.String("raft-dir", "", "directory of the raft log and snapshots (default: the data directory followed by -raft)")
+	authOn := fs.Bool("auth", false, "require a token with the permissions of each request, managed through /admin/auth/identities")
+	webhooksOn := fs.Bool("webhooks", false, "send the webhooks configured through /admin/webhooks, queued in the "+webhookNamespace+" namespace")
+	webhookAttempts := fs.Int("webhook-max-attempts", defaultWebhookConfig().MaxAttempts, "attempts of a webhook delivery before it is dead-lettered")
+	fs.Parse(args)
+
+	opts, err := sf.options()
+	if err != nil {
+		return err
+	}
+	opts.WatchLogSize = *watchLogSize
+	st, err = openStoreWith(sf.dir, opts)
+	if err != nil {
+		return fmt.Errorf("error opening store: %s", err)
+	}
+	db = st.namespaces[defaultNamespace]
+
+	certs, err := tf.load(opts.Logger)
+	if err != nil {
+		return err
+	}
+	if certs != nil {
+		certs.reloadOnSIGHUP()
+	}
+	clientConfig, err := tf.clientConfig(certs)
+	if err != nil {
+		return err
+	}
+
+	if *backupDir != "" {
+		if backups, err = openBackupEngine(*backupDir); err != nil {
+			return fmt.Errorf("error opening backup directory: %s", err)
+		}
+	}
+
+	if *respAddr != "" {
+		l, err := certs.listen(*respAddr)
+		if err != nil {
+			return fmt.Errorf("error starting Redis server: %s", err)
+		}
+		go serveRESP(l, st)
+	}
+
+	if *memcachedAddr != "" {
+		mem, err := st.Namespace(*memcachedNS)
+		if errors.Is(err, errNamespaceNotFound) {
+			mem, err = st.CreateNamespace(*memcachedNS, nsOptions{})
+		}
+		if err != nil {
+			return fmt.Errorf("error opening memcached namespace: %s", err)
+		}
+		l, err := certs.listen(*memcachedAddr)
+		if err != nil {
+			return fmt.Errorf("error starting memcached server: %s", err)
+		}
+		go serveMemcached(l, mem)
+	}
+
+	if *replAddr != "" {
+		l, err := certs.listen(*replAddr)
+		if err != nil {
+			return fmt.Errorf("error starting REPL server: %s", err)
+		}
+		go serveRepl(l, db)
+	}
 
 	r := mux.NewRouter()
 	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -238,11 +348,74 @@ func main() {
 	r.HandleFunc("/set", handleSet).Methods("POST")
 	r.HandleFunc("/get", handleGet).Methods("GET")
 	r.HandleFunc("/del", handleDelete).Methods("POST")
+	registerV1Routes(r)
+	r.HandleFunc("/metrics", handleMetrics).Methods("GET")
+	r.HandleFunc("/admin/backup", handleCreateBackup).Methods("POST")
+	r.HandleFunc("/admin/backups", handleListBackups).Methods("GET")
+	r.HandleFunc("/admin/export", handleExport).Methods("GET")
+	r.HandleFunc("/admin/import", handleImport).Methods("POST")
+	if *replicaOf != "" {
+		follower = startReplica(st, *replicaOf, opts, replicaConfig{Token: *replicaToken, TLS: clientConfig})
+		r.HandleFunc("/replication/status", follower.handleStatus).Methods("GET")
+	} else if *replLogSize > 0 && *raftID == "" {
+		newReplicationServer(st, *replLogSize).register(r)
+	}
+	registerWebhookRoutes(r)
+	if *webhooksOn {
+		if *replicaOf != "" || *raftID != "" {
+			return errors.New("-webhooks cannot be used with -replica-of or -raft-id")
+		}
+		config := defaultWebhookConfig()
+		config.MaxAttempts = *webhookAttempts
+		if hooks, err = startWebhooks(st, config); err != nil {
+			return fmt.Errorf("error starting webhooks: %s", err)
+		}
+	}
+	r.Use(httpStats.instrument)
+	if *authOn {
+		if *replicaOf != "" || *raftID != "" {
+			return errors.New("-auth cannot be used with -replica-of or -raft-id")
+		}
+		auth, rootToken, err := newAuthenticator(st)
+		if err != nil {
+			return fmt.Errorf("error starting authentication: %s", err)
+		}
+		if rootToken != "" {
+			fmt.Fprintf(os.Stderr, "Created identity root, with admin on every namespace, and token %s\nStore it now, it is not shown again.\n", rootToken)
+		}
+		auth.register(r)
+		r.Use(auth.middleware)
+	}
+	if *raftID != "" {
+		if *replicaOf != "" {
+			return errors.New("-raft-id and -replica-of cannot be used together")
+		}
+		dir := *raftDir
+		if dir == "" {
+			// Not inside the data directory, which snapshots replace
+			abs, err := filepath.Abs(sf.dir)
+			if err != nil {
+				return err
+			}
+			dir = abs + "-raft"
+		}
+		var peers []string
+		if *raftPeers != "" {
+			peers = strings.Split(*raftPeers, ",")
+		}
+		cluster, err = startRaft(st, opts, *raftID, dir, peers, newHTTPRaftTransport(clientConfig), defaultRaftConfig())
+		if err != nil {
+			return fmt.Errorf("error starting raft: %s", err)
+		}
+		cluster.register(r)
+		r.Use(cluster.redirectToLeader)
+	}
 
 	http.Handle("/", r)
 
-	// Start HTTP server on port 8080
-	if err := http.ListenAndServe(":8080", nil); err != nil {
-		fmt.Printf("Error starting HTTP server: %s\n", err)
+	// Start HTTP server
+	if err := certs.serveHTTP(*addr, nil); err != nil {
+		return fmt.Errorf("error starting HTTP server: %s", err)
 	}
+	return nil
 }
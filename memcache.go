@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The memcached front end speaks the memcached text protocol on top of one
+// namespace of the store. Memcached items carry 32 bits of client flags, so
+// values are stored as flags(4) data. CAS unique values are the sequence
+// number of the last write of a key, and exptimes become per-key expiries.
+
+const (
+	memcachedMaxKeySize  = 250
+	memcachedMaxItemSize = 64 << 20
+	memcachedFlagsSize   = 4
+
+	// exptimes up to 30 days are relative to now, larger ones are unix times
+	memcachedMaxRelativeExptime = 30 * 24 * 3600
+)
+
+var (
+	errMemcachedBadFormat = errors.New("CLIENT_ERROR bad command line format")
+	errMemcachedBadChunk  = errors.New("CLIENT_ERROR bad data chunk")
+	errMemcachedNotNumber = errors.New("CLIENT_ERROR cannot increment or decrement non-numeric value")
+	errMemcachedTooLarge  = errors.New("SERVER_ERROR object too large for cache")
+)
+
+// memcachedServer serves the memcached text protocol for a namespace.
+type memcachedServer struct {
+	mem     *memDB
+	started time.Time
+
+	currConns  atomic.Int64
+	totalConns atomic.Uint64
+	cmdGet     atomic.Uint64
+	cmdSet     atomic.Uint64
+	getHits    atomic.Uint64
+	getMisses  atomic.Uint64
+}
+
+// serveMemcached accepts connections on l until it is closed.
+func serveMemcached(l net.Listener, mem *memDB) error {
+	srv := &memcachedServer{mem: mem, started: time.Now()}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go srv.serveConn(conn)
+	}
+}
+
+// memcachedItem is a value as stored by the memcached front end.
+type memcachedItem struct {
+	flags   uint32
+	data    []byte
+	expires int64
+	cas     uint64
+}
+
+func encodeMemcachedValue(flags uint32, data []byte) []byte {
+	value := make([]byte, memcachedFlagsSize, memcachedFlagsSize+len(data))
+	binary.BigEndian.PutUint32(value, flags)
+	return append(value, data...)
+}
+
+// decodeMemcachedItem splits a stored value in flags and data. Values too
+// short to hold flags were not written by the memcached front end and are
+// returned whole.
+func decodeMemcachedItem(entry memEntry) memcachedItem {
+	item := memcachedItem{expires: entry.expires, cas: entry.seq}
+	if len(entry.value) < memcachedFlagsSize {
+		item.data = []byte(entry.value)
+		return item
+	}
+	item.flags = binary.BigEndian.Uint32([]byte(entry.value[:memcachedFlagsSize]))
+	item.data = []byte(entry.value[memcachedFlagsSize:])
+	return item
+}
+
+// memcachedExpiry converts an exptime to unix nanoseconds. Negative and
+// past exptimes give an expiry that has already passed.
+func memcachedExpiry(exptime int64, now time.Time) int64 {
+	switch {
+	case exptime == 0:
+		return 0
+	case exptime < 0:
+		return 1
+	case exptime <= memcachedMaxRelativeExptime:
+		return now.Add(time.Duration(exptime) * time.Second).UnixNano()
+	case exptime <= now.Unix():
+		return 1
+	default:
+		return time.Unix(exptime, 0).UnixNano()
+	}
+}
+
+type memcachedConn struct {
+	srv *memcachedServer
+	r   *bufio.Reader
+	w   *bufio.Writer
+}
+
+func (srv *memcachedServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	srv.currConns.Add(1)
+	defer srv.currConns.Add(-1)
+	srv.totalConns.Add(1)
+
+	c := &memcachedConn{srv: srv, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			c.w.WriteString("ERROR\r\n")
+		} else if fields[0] == "quit" {
+			c.w.Flush()
+			return
+		} else if err := c.execute(fields); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return
+			}
+			msg := err.Error()
+			if !strings.HasPrefix(msg, "CLIENT_ERROR") && !strings.HasPrefix(msg, "SERVER_ERROR") {
+				msg = "SERVER_ERROR " + msg
+			}
+			fmt.Fprintf(c.w, "%s\r\n", msg)
+		}
+
+		// Answer every pipelined command before flushing
+		if c.r.Buffered() == 0 {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// reply writes msg unless the client asked for no reply.
+func (c *memcachedConn) reply(noreply bool, msg string) {
+	if !noreply {
+		fmt.Fprintf(c.w, "%s\r\n", msg)
+	}
+}
+
+func (c *memcachedConn) execute(fields []string) error {
+	switch cmd := fields[0]; cmd {
+	case "get", "gets":
+		return c.get(fields[1:], cmd == "gets")
+	case "set", "add", "replace", "append", "prepend", "cas":
+		return c.store(cmd, fields[1:])
+	case "delete":
+		return c.delete(fields[1:])
+	case "incr", "decr":
+		return c.incr(fields[1:], cmd == "decr")
+	case "touch":
+		return c.touch(fields[1:])
+	case "stats":
+		return c.stats()
+	case "version":
+		c.w.WriteString("VERSION 1.6.0-kv\r\n")
+	default:
+		c.w.WriteString("ERROR\r\n")
+	}
+	return nil
+}
+
+func validMemcachedKey(key string) bool {
+	if len(key) == 0 || len(key) > memcachedMaxKeySize {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// noreply strips a trailing "noreply" from the arguments of a command.
+func noreply(args []string, n int) ([]string, bool, error) {
+	switch {
+	case len(args) == n:
+		return args, false, nil
+	case len(args) == n+1 && args[n] == "noreply":
+		return args[:n], true, nil
+	default:
+		return nil, false, errMemcachedBadFormat
+	}
+}
+
+func (c *memcachedConn) get(keys []string, withCAS bool) error {
+	if len(keys) == 0 {
+		return errMemcachedBadFormat
+	}
+	for _, key := range keys {
+		if !validMemcachedKey(key) {
+			return errMemcachedBadFormat
+		}
+	}
+
+	for _, key := range keys {
+		c.srv.cmdGet.Add(1)
+		entry, found, err := c.srv.mem.Lookup(key)
+		if err != nil {
+			return err
+		}
+		if !found {
+			c.srv.getMisses.Add(1)
+			continue
+		}
+		c.srv.getHits.Add(1)
+
+		item := decodeMemcachedItem(entry)
+		if withCAS {
+			fmt.Fprintf(c.w, "VALUE %s %d %d %d\r\n", key, item.flags, len(item.data), item.cas)
+		} else {
+			fmt.Fprintf(c.w, "VALUE %s %d %d\r\n", key, item.flags, len(item.data))
+		}
+		c.w.Write(item.data)
+		c.w.WriteString("\r\n")
+	}
+	c.w.WriteString("END\r\n")
+	return nil
+}
+
+// store implements the storage commands:
+//
+//	<cmd> <key> <flags> <exptime> <bytes> [noreply]
+//	cas <key> <flags> <exptime> <bytes> <cas unique> [noreply]
+func (c *memcachedConn) store(cmd string, args []string) error {
+	n := 4
+	if cmd == "cas" {
+		n = 5
+	}
+	args, quiet, err := noreply(args, n)
+	if err != nil {
+		return err
+	}
+	key := args[0]
+	flags, err1 := strconv.ParseUint(args[1], 10, 32)
+	exptime, err2 := strconv.ParseInt(args[2], 10, 64)
+	size, err3 := strconv.Atoi(args[3])
+	if err1 != nil || err2 != nil || err3 != nil || size < 0 || !validMemcachedKey(key) {
+		return errMemcachedBadFormat
+	}
+	var casUnique uint64
+	if cmd == "cas" {
+		if casUnique, err = strconv.ParseUint(args[4], 10, 64); err != nil {
+			return errMemcachedBadFormat
+		}
+	}
+
+	if size > memcachedMaxItemSize {
+		// Skip the data so the connection stays in sync
+		if _, err := c.r.Discard(size + 2); err != nil {
+			return err
+		}
+		return errMemcachedTooLarge
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return err
+	}
+	if data[size] != '\r' || data[size+1] != '\n' {
+		// Drop the rest of the line, it is not a command
+		if data[size+1] != '\n' {
+			c.r.ReadString('\n')
+		}
+		return errMemcachedBadChunk
+	}
+	data = data[:size]
+	c.srv.cmdSet.Add(1)
+
+	result := "STORED"
+	err = c.srv.mem.Update(func(tx *memTxn) error {
+		cur, found, err := tx.Get(key)
+		if err != nil {
+			return err
+		}
+		old := decodeMemcachedItem(cur)
+		expires := memcachedExpiry(exptime, time.Now())
+
+		switch cmd {
+		case "add":
+			if found {
+				result = "NOT_STORED"
+				return nil
+			}
+		case "replace":
+			if !found {
+				result = "NOT_STORED"
+				return nil
+			}
+		case "append", "prepend":
+			// Both keep the flags and expiry of the item
+			if !found {
+				result = "NOT_STORED"
+				return nil
+			}
+			flags, expires = uint64(old.flags), old.expires
+			if cmd == "append" {
+				data = append(old.data, data...)
+			} else {
+				data = append(data, old.data...)
+			}
+		case "cas":
+			if !found {
+				result = "NOT_FOUND"
+				return nil
+			}
+			if old.cas != casUnique {
+				result = "EXISTS"
+				return nil
+			}
+		}
+		tx.Put([]byte(key), encodeMemcachedValue(uint32(flags), data), expires)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	c.reply(quiet, result)
+	return nil
+}
+
+func (c *memcachedConn) delete(args []string) error {
+	// Old clients send a time argument, which must be 0
+	if len(args) >= 2 && args[1] == "0" {
+		args = append(args[:1], args[2:]...)
+	}
+	args, quiet, err := noreply(args, 1)
+	if err != nil || !validMemcachedKey(args[0]) {
+		return errMemcachedBadFormat
+	}
+
+	result := "DELETED"
+	err = c.srv.mem.Update(func(tx *memTxn) error {
+		_, found, err := tx.Get(args[0])
+		if err != nil {
+			return err
+		}
+		if !found {
+			result = "NOT_FOUND"
+			return nil
+		}
+		tx.Delete([]byte(args[0]))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	c.reply(quiet, result)
+	return nil
+}
+
+// incr adds to or subtracts from a 64 bit unsigned decimal value. incr
+// wraps around, decr stops at 0.
+func (c *memcachedConn) incr(args []string, decr bool) error {
+	args, quiet, err := noreply(args, 2)
+	if err != nil || !validMemcachedKey(args[0]) {
+		return errMemcachedBadFormat
+	}
+	delta, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return errors.New("CLIENT_ERROR invalid numeric delta argument")
+	}
+
+	result := "NOT_FOUND"
+	err = c.srv.mem.Update(func(tx *memTxn) error {
+		cur, found, err := tx.Get(args[0])
+		if err != nil || !found {
+			return err
+		}
+		item := decodeMemcachedItem(cur)
+		n, err := strconv.ParseUint(strings.TrimSpace(string(item.data)), 10, 64)
+		if err != nil {
+			return errMemcachedNotNumber
+		}
+		switch {
+		case !decr:
+			n += delta
+		case delta > n:
+			n = 0
+		default:
+			n -= delta
+		}
+		result = strconv.FormatUint(n, 10)
+		tx.Put([]byte(args[0]), encodeMemcachedValue(item.flags, []byte(result)), item.expires)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	c.reply(quiet, result)
+	return nil
+}
+
+func (c *memcachedConn) touch(args []string) error {
+	args, quiet, err := noreply(args, 2)
+	if err != nil || !validMemcachedKey(args[0]) {
+		return errMemcachedBadFormat
+	}
+	exptime, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return errors.New("CLIENT_ERROR invalid exptime argument")
+	}
+
+	result := "TOUCHED"
+	err = c.srv.mem.Update(func(tx *memTxn) error {
+		cur, found, err := tx.Get(args[0])
+		if err != nil {
+			return err
+		}
+		if !found {
+			result = "NOT_FOUND"
+			return nil
+		}
+		tx.Put([]byte(args[0]), []byte(cur.value), memcachedExpiry(exptime, time.Now()))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	c.reply(quiet, result)
+	return nil
+}
+
+func (c *memcachedConn) stats() error {
+	stats, err := c.srv.mem.Stats()
+	if err != nil {
+		return err
+	}
+
+	srv := c.srv
+	stat := func(name string, value interface{}) {
+		fmt.Fprintf(c.w, "STAT %s %v\r\n", name, value)
+	}
+	stat("pid", os.Getpid())
+	stat("uptime", int64(time.Since(srv.started).Seconds()))
+	stat("time", time.Now().Unix())
+	stat("version", "1.6.0-kv")
+	stat("curr_connections", srv.currConns.Load())
+	stat("total_connections", srv.totalConns.Load())
+	stat("cmd_get", srv.cmdGet.Load())
+	stat("cmd_set", srv.cmdSet.Load())
+	stat("get_hits", srv.getHits.Load())
+	stat("get_misses", srv.getMisses.Load())
+	stat("bytes", int64(stats.MemtableBytes)+stats.StoredBytes+stats.VlogBytes)
+	stat("limit_maxbytes", 0)
+	c.w.WriteString("END\r\n")
+	return nil
+}
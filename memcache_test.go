@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type memcachedClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newMemcachedClient(t *testing.T) (*memcachedClient, *memDB) {
+	s, err := openStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	mem, _ := s.CreateNamespace("memcached", nsOptions{})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go serveMemcached(l, mem)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return &memcachedClient{conn: conn, r: bufio.NewReader(conn)}, mem
+}
+
+// do sends a request and reads reply lines up to one that is not a VALUE
+// header or data line.
+func (c *memcachedClient) do(t *testing.T, request string) []string {
+	t.Helper()
+	if _, err := c.conn.Write([]byte(request)); err != nil {
+		t.Fatalf("Error sending %q: %v", request, err)
+	}
+	return c.read(t)
+}
+
+func (c *memcachedClient) read(t *testing.T) []string {
+	t.Helper()
+	var lines []string
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Error reading reply: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\r\n")
+		lines = append(lines, line)
+		if strings.HasPrefix(line, "VALUE ") {
+			data, _ := c.r.ReadString('\n')
+			lines = append(lines, strings.TrimSuffix(data, "\r\n"))
+			continue
+		}
+		if !strings.HasPrefix(line, "STAT ") {
+			return lines
+		}
+	}
+}
+
+func expectReply(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+func TestMemcached_StorageCommands(t *testing.T) {
+	c, _ := newMemcachedClient(t)
+
+	expectReply(t, c.do(t, "set a 42 0 5\r\nhello\r\n"), "STORED")
+	expectReply(t, c.do(t, "get a missing\r\n"), "VALUE a 42 5", "hello", "END")
+	expectReply(t, c.do(t, "add a 0 0 1\r\nx\r\n"), "NOT_STORED")
+	expectReply(t, c.do(t, "replace b 0 0 1\r\nx\r\n"), "NOT_STORED")
+	expectReply(t, c.do(t, "append a 0 0 6\r\n world\r\n"), "STORED")
+	expectReply(t, c.do(t, "prepend a 0 0 1\r\n>\r\n"), "STORED")
+	expectReply(t, c.do(t, "get a\r\n"), "VALUE a 42 12", ">hello world", "END")
+
+	expectReply(t, c.do(t, "set n 0 0 2\r\n10\r\n"), "STORED")
+	expectReply(t, c.do(t, "incr n 5\r\n"), "15")
+	expectReply(t, c.do(t, "decr n 100\r\n"), "0")
+	expectReply(t, c.do(t, "incr a 1\r\n"), "CLIENT_ERROR cannot increment or decrement non-numeric value")
+	expectReply(t, c.do(t, "incr missing 1\r\n"), "NOT_FOUND")
+
+	expectReply(t, c.do(t, "delete n\r\n"), "DELETED")
+	expectReply(t, c.do(t, "delete n\r\n"), "NOT_FOUND")
+
+	// noreply commands are pipelined with the next one
+	expectReply(t, c.do(t, "set q 0 0 1 noreply\r\nq\r\nget q\r\n"), "VALUE q 0 1", "q", "END")
+
+	expectReply(t, c.do(t, "bogus\r\n"), "ERROR")
+	expectReply(t, c.do(t, "set a 0 0 2\r\nabc\r\n"), "CLIENT_ERROR bad data chunk")
+	stats := c.do(t, "stats\r\n")
+	if stats[len(stats)-1] != "END" || !strings.HasPrefix(stats[0], "STAT pid ") {
+		t.Errorf("Expected a list of stats, got %q", stats)
+	}
+}
+
+func TestMemcached_CASAndExpiry(t *testing.T) {
+	c, mem := newMemcachedClient(t)
+
+	expectReply(t, c.do(t, "set k 0 0 2\r\nv1\r\n"), "STORED")
+	reply := c.do(t, "gets k\r\n")
+	fields := strings.Fields(reply[0])
+	if len(fields) != 5 {
+		t.Fatalf("Expected a CAS unique value, got %q", reply)
+	}
+	unique := fields[4]
+
+	expectReply(t, c.do(t, "cas k 0 0 2 "+unique+"\r\nv2\r\n"), "STORED")
+	expectReply(t, c.do(t, "cas k 0 0 2 "+unique+"\r\nv3\r\n"), "EXISTS")
+	expectReply(t, c.do(t, "cas nope 0 0 2 1\r\nv3\r\n"), "NOT_FOUND")
+	expectReply(t, c.do(t, "get k\r\n"), "VALUE k 0 2", "v2", "END")
+
+	// The version survives a flush to an SST file
+	if err := mem.FlushMemToSSTFile(); err != nil {
+		t.Fatalf("Error flushing: %v", err)
+	}
+	fields = strings.Fields(c.do(t, "gets k\r\n")[0])
+	expectReply(t, c.do(t, "cas k 0 0 2 "+fields[4]+"\r\nv4\r\n"), "STORED")
+
+	expectReply(t, c.do(t, "set ttl 0 100 1\r\nx\r\n"), "STORED")
+	if entry, _, _ := mem.Lookup("ttl"); entry.expires == 0 {
+		t.Errorf("Expected a relative exptime to set an expiry")
+	}
+	expectReply(t, c.do(t, "touch ttl -1\r\n"), "TOUCHED")
+	expectReply(t, c.do(t, "get ttl\r\n"), "END")
+	expectReply(t, c.do(t, "set gone 0 -1 1\r\nx\r\n"), "STORED")
+	expectReply(t, c.do(t, "get gone\r\n"), "END")
+}
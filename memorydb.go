@@ -1,54 +1,50 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
-	"encoding/binary"
 	"errors"
-	"fmt"
-	"io"
+	"log/slog"
 	"os"
-	"strings"
+	"sort"
+	"time"
 )
 
-type Cmd int
-
-const (
-	Get Cmd = iota
-	Set
-	Del
-	Ext
-	Unk
-	Flush
-	Init
-	Test
-)
 const (
 	magicNumberSize = 4
 	entryCountSize  = 4
 	keyLengthSize   = 4
 	valueLengthSize = 4
+	expiresSize     = 8
 )
 
-type Error int
-
-func (e Error) Error() string {
-	return "Empty command"
+// memEntry is a single write held in the memtable.
+type memEntry struct {
+	op      byte
+	key     string
+	value   string
+	expires int64  // unix nanoseconds, 0 means the entry never expires
+	seq     uint64 // sequence number of the batch that wrote it, 0 if unknown
 }
 
-const (
-	Empty Error = iota
-)
+func (e memEntry) expired(now int64) bool {
+	return e.expires != 0 && e.expires <= now
+}
 
+// memDB is one namespace of a store: its memtable, its SST files and its
+// options. The WAL is shared with the other namespaces of the store.
 type memDB struct {
-	memValues []byte
+	name      string
+	opts      nsOptions
+	memValues []memEntry
+	memSize   int
+	store     *store
 	wal       *walDB
 	file      *fileDB
+	vlog      *valueLog
 }
 
 func (mem *memDB) updateMemDisk() error {
-	if len(mem.memValues) > 20 {
-		err := mem.FlushMemToSSTFile()
+	if mem.memSize > mem.opts.FlushSize {
+		err := mem.flushLocked()
 		if err != nil {
 			return err
 		}
@@ -58,18 +54,19 @@ func (mem *memDB) updateMemDisk() error {
 }
 
 func (mem *memDB) Set(key, value []byte) error {
+	b := &writeBatch{}
+	b.Put(mem.name, key, value)
+	return mem.store.Write(b)
+}
 
-	mem.SetMem(key, value)
-	mem.wal.SetWal(key, value)
-	err := mem.updateMemDisk()
-	if err != nil {
-		return err
-	}
+func (mem *memDB) Get(key []byte) ([]byte, error) {
+	mem.store.mu.RLock()
+	defer mem.store.mu.RUnlock()
 
-	return nil
+	return mem.get(key)
 }
 
-func (mem *memDB) Get(key []byte) ([]byte, error) {
+func (mem *memDB) get(key []byte) ([]byte, error) {
 	// First, try to get from memory
 	value, err := mem.GetMem(key)
 	if err != nil {
@@ -85,275 +82,151 @@ func (mem *memDB) Get(key []byte) ([]byte, error) {
 }
 
 func (mem *memDB) Del(key string) (string, error) {
-	// Check if the key is in the memTable
-	if mem.keyExists(key) {
-		// Add "del key" entry to memTable
-		delEntry := fmt.Sprintf("del %s\n", key)
-		mem.memValues = append(mem.memValues, []byte(delEntry)...)
-		err := mem.updateMemDisk()
-		if err != nil {
-			return "", err
-		}
-		// Return the value associated with the key
-		return mem.getValue(key), nil
-	} else {
-		val, err := mem.GetSST([]byte(key))
-		if err != nil {
-			return "", errors.New("key not found")
-		}
-		delEntry := fmt.Sprintf("del %s\n", key)
-		mem.memValues = append(mem.memValues, []byte(delEntry)...)
-		err = mem.updateMemDisk()
-		if err != nil {
-			return "", err
-		}
-		// Return the value associated with the key
-		return string(val), nil
+	if mem.store.raft != nil {
+		// The delete only applies if the key is still the one read
+		var val string
+		err := mem.Update(func(tx *memTxn) error {
+			entry, found, err := tx.Get(key)
+			if err != nil {
+				return err
+			}
+			if !found {
+				return errors.New("key not found")
+			}
+			val = entry.value
+			tx.Delete([]byte(key))
+			return nil
+		})
+		return val, err
+	}
+
+	mem.store.mu.Lock()
+	defer mem.store.mu.Unlock()
 
+	// The key has to exist, either in the memTable or in an SST file
+	val, err := mem.get([]byte(key))
+	if err != nil {
+		return "", errors.New("key not found")
 	}
 
-}
+	b := &writeBatch{}
+	b.Delete(mem.name, []byte(key))
+	if err := mem.store.writeLocked(b); err != nil {
+		return "", err
+	}
 
-func (mem *memDB) keyExists(key string) bool {
-	// Check if the key exists in the memTable
-	keySearch := fmt.Sprintf("set %s", key)
-	return strings.Contains(string(mem.memValues), keySearch)
+	// Return the value associated with the key
+	return string(val), nil
 }
 
-func (mem *memDB) getValue(key string) string {
-	// Get the value associated with the key from the memValues
-	lines := strings.Split(string(mem.memValues), "\n")
-	for _, line := range lines {
-		if strings.HasPrefix(line, "set "+key+" ") {
-			parts := strings.Fields(line)
-			if len(parts) == 3 {
-				return parts[2]
-			}
-		}
+// apply adds an operation of the batch logged with seq to the memTable.
+func (mem *memDB) apply(op batchOp, seq uint64) {
+	switch op.op {
+	case opSet:
+		mem.SetMem(op.key, op.value, op.expires, seq)
+	case opDel:
+		mem.DelMem(op.key, seq)
 	}
-	return ""
 }
 
-func (mem *memDB) SetMem(key, value []byte) error {
-
-	entry := make([]byte, 0)
+func (mem *memDB) SetMem(key, value []byte, expires int64, seq uint64) error {
 
-	entry = append(entry, []byte("set ")...)
-	entry = append(entry, key...)
-	entry = append(entry, []byte(" ")...)
-	entry = append(entry, value...)
-	entry = append(entry, []byte("\n")...)
+	entry := memEntry{
+		op:      opSet,
+		key:     string(key),
+		value:   string(value),
+		expires: expires,
+		seq:     seq,
+	}
 
-	mem.memValues = append(mem.memValues, entry...)
+	mem.memValues = append(mem.memValues, entry)
+	mem.memSize += len(key) + len(value)
 
 	return nil
 }
 
 func (mem *memDB) GetMem(key []byte) ([]byte, error) {
-	entries := strings.Split(string(mem.memValues), "\n")
-	for i := len(entries) - 1; i >= 0; i-- {
-		entry := entries[i]
-		if strings.HasPrefix(entry, "del "+string(key)) {
+	now := time.Now().UnixNano()
+	for i := len(mem.memValues) - 1; i >= 0; i-- {
+		entry := mem.memValues[i]
+		if entry.key != string(key) {
+			continue
+		}
+		if entry.op == opDel || entry.expired(now) {
 			// Key is deleted, return an error
 			return nil, errors.New("key not found")
-		} else if strings.HasPrefix(entry, "set "+string(key)+" ") {
-			// Extract the value from the entry and return it
-			parts := strings.Fields(entry)
-			if len(parts) == 3 {
-				return []byte(parts[2]), nil
-			}
 		}
+		return []byte(entry.value), nil
 	}
 
 	// Key not found
 	return nil, nil
 }
 
-func (mem *memDB) DelMem(key []byte) ([]byte, error) {
-	// Use the Get method to check if the key exists
-	v, err := mem.GetMem(key)
-	if err != nil {
-		return nil, err // Key not found
+func (mem *memDB) DelMem(key []byte, seq uint64) error {
+	entry := memEntry{
+		op:  opDel,
+		key: string(key),
+		seq: seq,
 	}
+	mem.memValues = append(mem.memValues, entry)
+	mem.memSize += len(key)
 
-	// Key exists, create a "del" entry
-	entry := []byte("del " + string(key) + "\n")
-	mem.memValues = append(mem.memValues, entry...)
-
-	return v, nil
+	return nil
 }
 
+// NewInMem opens the store in the current directory and returns its
+// default namespace.
 func NewInMem() *memDB {
 
-	f, err := os.OpenFile("wal.txt", os.O_CREATE, 0755)
+	st, err := openStore(".")
 	if err != nil {
-		fmt.Println(err)
+		slog.Error("opening store", "err", err)
 		return nil
 	}
-	wal := NewwalDB(f)
-	memValues := make([]byte, 0)
-
-	maxFileSize := 100
 
-	flDB, _ := newFileDB(maxFileSize)
-
-	return &memDB{
-		memValues,
-		wal,
-		flDB,
-	}
+	return st.namespaces[defaultNamespace]
 }
 
 func (mem *memDB) GetSST(key []byte) ([]byte, error) {
 	// Iterate over SST files in reverse order
+	now := time.Now().UnixNano()
 
 	for fileIndex := mem.file.noFiles; fileIndex > 0; fileIndex-- {
 
-		// Open the SST file
-		sstFileName := fmt.Sprintf("sst_%d.sst", fileIndex)
-
-		file, err := os.Open(sstFileName)
+		// Get the reader of the SST file from the table cache
+		reader, release, err := mem.store.tables.get(mem.file.sstPath(fileIndex))
 		if err != nil {
 			return nil, err
 		}
-		defer file.Close()
-
-		// Read the header of the SST file
-		header := make([]byte, magicNumberSize+entryCountSize+keyLengthSize+keyLengthSize)
-		_, err = file.Read(header)
+		entry, found, err := reader.get(key, mem.store.blocks)
+		release()
 		if err != nil {
 			return nil, err
 		}
+		if !found {
+			continue
+		}
 
-		fileInfo, err := os.Stat(sstFileName)
-
-		idx := fileInfo.Size()
-		for idx > 16 {
-			// Read operation type
-
-			idx -= 1
-			if idx < 16 {
-				break
-			}
-
-			if _, err := file.Seek(idx, io.SeekStart); err != nil {
-
-				return nil, err
-			}
-
-			opTypeBuf := make([]byte, 1)
-
-			_, err := file.Read(opTypeBuf)
-			if err != nil {
-				return nil, err
-			}
-
-			// Read key length and key
-			idx -= int64(keyLengthSize)
-			if idx < 16 {
-				break
-			}
-
-			if _, err := file.Seek(idx, io.SeekStart); err != nil {
-				return nil, err
-			}
-			keyLenBuf := make([]byte, keyLengthSize)
-			_, err = file.Read(keyLenBuf)
-			if err != nil {
-				return nil, err
-			}
-			keyLen := binary.BigEndian.Uint32(keyLenBuf)
-			idx -= int64(keyLen)
-			if idx < 16 {
-				break
-			}
-			if _, err := file.Seek(idx, io.SeekStart); err != nil {
-				return nil, err
-			}
-			keyBuf := make([]byte, keyLen)
-			_, err = file.Read(keyBuf)
-			if err != nil {
-				return nil, err
-			}
-
-			// Check if the key matches
-			if bytes.Equal(key, keyBuf) {
-				if opTypeBuf[0] == 1 {
-					// Set operation
-					idx -= int64(valueLengthSize)
-					if idx < 16 {
-						break
-					}
-					valueLenBuf := make([]byte, valueLengthSize)
-					if _, err := file.Seek(idx, io.SeekStart); err != nil {
-						return nil, err
-					}
-					_, err := file.Read(valueLenBuf)
-					if err != nil {
-						return nil, err
-					}
-
-					valueLen := binary.BigEndian.Uint32(valueLenBuf)
-					idx -= int64(valueLen)
-					if idx < 16 {
-						break
-					}
-					valueBuf := make([]byte, valueLen)
-					if _, err := file.Seek(idx, io.SeekStart); err != nil {
-						return nil, err
-					}
-					_, err = file.Read(valueBuf)
-					if err != nil {
-						return nil, err
-					}
-
-					return valueBuf, nil
-				} else {
-					// Delete operation
-					fmt.Println("Delete Operation")
-					return nil, errors.New("key not found")
-				}
-			} else {
-				// Set operation
-				idx -= int64(valueLengthSize)
-				if idx < 16 {
-					break
-				}
-				valueLenBuf := make([]byte, valueLengthSize)
-				if _, err := file.Seek(idx, io.SeekStart); err != nil {
-					return nil, err
-				}
-				_, err := file.Read(valueLenBuf)
-				if err != nil {
-					return nil, err
-				}
-
-				valueLen := binary.BigEndian.Uint32(valueLenBuf)
-				idx -= int64(valueLen)
-				if idx < 16 {
-					break
-				}
-				valueBuf := make([]byte, valueLen)
-				if _, err := file.Seek(idx, io.SeekStart); err != nil {
-					return nil, err
-				}
-				_, err = file.Read(valueBuf)
-				if err != nil {
-					return nil, err
-				}
-
-			}
+		if entry.op == opDel {
+			return nil, errors.New("key not found")
 		}
+		if entry.expired(now) {
+			return nil, errors.New("key not found")
+		}
+		return mem.resolveValue(entry)
 	}
 
-	// Key not found in SST filesgetSS
-	fmt.Println("Key not found in SST files")
 	return nil, errors.New("key not found")
 }
 
-func (mem *memDB) appendEntriesToSST(entries map[string]string) error {
+func (mem *memDB) appendEntriesToSST(entries []memEntry) error {
 	// Append entries to the current SST file
-	err := mem.file.createSST(entries)
+	codec, err := codecByName(mem.opts.Compression)
+	if err != nil {
+		return err
+	}
+	err = mem.file.createSST(entries, codec, mem.store.keys)
 	if err != nil {
 		return err
 	}
@@ -361,31 +234,98 @@ func (mem *memDB) appendEntriesToSST(entries map[string]string) error {
 }
 
 func (mem *memDB) FlushMemToSSTFile() error {
+	mem.store.mu.Lock()
+	defer mem.store.mu.Unlock()
+
+	return mem.flushLocked()
+}
+
+// Flush writes the memtable to a new SST file and returns its path, or ""
+// if the memtable was empty.
+func (mem *memDB) Flush() (string, error) {
+	mem.store.mu.Lock()
+	defer mem.store.mu.Unlock()
+
+	if len(mem.memValues) == 0 {
+		return "", nil
+	}
+	if err := mem.flushLocked(); err != nil {
+		return "", err
+	}
+	// A compaction may have merged the new file with older ones
+	return mem.file.sstPath(mem.file.noFiles), nil
+}
+
+func (mem *memDB) flushLocked() error {
 
 	entries := mem.parseMemTableEntries()
+	if len(entries) == 0 {
+		return nil
+	}
+	start := time.Now()
+	info := FlushInfo{Namespace: mem.name, Entries: len(entries)}
+	mem.store.events.OnFlushBegin(info)
+	flushEnd := func(err error) error {
+		info.Duration, info.Err = time.Since(start), err
+		if err != nil {
+			mem.store.logger.Error("flush failed", "namespace", mem.name, "err", err)
+		} else {
+			mem.store.logger.Debug("flushed memtable", "namespace", mem.name, "entries", info.Entries, "path", info.Path, "duration", info.Duration)
+		}
+		mem.store.events.OnFlushEnd(info)
+		return err
+	}
+
+	if err := mem.separateValues(entries); err != nil {
+		return flushEnd(err)
+	}
 
 	if err := mem.createNewSSTFile(); err != nil {
-		return err
+		return flushEnd(err)
 	}
+	info.Path = mem.file.sstPath(mem.file.noFiles)
 
 	if err := mem.appendEntriesToSST(entries); err != nil {
-		return err
+		return flushEnd(err)
+	}
+	// The WAL may be reset below, the values and the table must be on disk
+	// first
+	if err := mem.vlog.Sync(); err != nil {
+		return flushEnd(err)
+	}
+	if err := mem.file.syncFile(); err != nil {
+		return flushEnd(err)
+	}
+	mem.file.closeFile()
+	if err := syncDir(mem.file.dir); err != nil {
+		return flushEnd(err)
 	}
 
 	mem.memValues = nil
+	mem.memSize = 0
+	mem.store.metrics.flushes.observe(time.Since(start))
+	mem.store.events.OnTableCreated(TableInfo{Namespace: mem.name, Path: info.Path, Reason: "flush"})
+	flushEnd(nil)
 
-	return nil
+	if err := mem.maybeCompact(); err != nil {
+		return err
+	}
+
+	return mem.store.maybeResetWAL()
 }
 
 // Calculate the total size of the new entries
-func calculateEntriesSize(entries map[string]string) int64 {
+func calculateEntriesSize(entries []memEntry) int64 {
 	var totalSize int64
 
-	for key, value := range entries {
+	for _, entry := range entries {
 		// Key length + value length + operation type size
-		totalSize += int64(len(key)) + int64(len(value)) + 1
+		totalSize += int64(len(entry.key)) + int64(len(entry.value)) + 1
 		// Key length size + value length size
 		totalSize += 8
+		if entry.expires != 0 {
+			totalSize += expiresSize
+		}
 	}
 
 	return totalSize
@@ -393,140 +333,27 @@ func calculateEntriesSize(entries map[string]string) int64 {
 
 func (mem *memDB) getFileSize() (int64, error) {
 	// Get the size of the current SST file
-	fileInfo, err := os.Stat(fmt.Sprintf("sst_%d.sst", mem.file.noFiles))
+	fileInfo, err := os.Stat(mem.file.sstPath(mem.file.noFiles))
 	if err != nil {
 		return 0, err
 	}
 	return fileInfo.Size(), nil
 }
 
-func (mem *memDB) parseMemTableEntries() map[string]string {
-	// Parse entries from the memTable
-	entries := make(map[string]string)
-	lines := strings.Split(string(mem.memValues), "\n")
-	for _, line := range lines {
-		if line != "" {
-			parts := strings.Fields(line)
-			if len(parts) >= 2 {
-				key := parts[0] + " " + parts[1]
-				switch parts[0] {
-				case "set":
-					if len(parts) >= 3 {
-						entries[key] = parts[2]
-					}
-				case "del":
-					// For simplicity, assume a deleted key has an empty value
-					entries[key] = ""
-				}
-			}
-		}
-	}
-	return entries
-}
-
-type Repl struct {
-	db  *memDB
-	in  io.Reader
-	out io.Writer
-}
-
-func (re *Repl) parseCmd(buf []byte) (Cmd, []string, error) {
-	line := string(buf)
-	elements := strings.Fields(line)
-	if len(elements) < 1 {
-		return Unk, nil, Empty
+// parseMemTableEntries returns the latest entry of every key in the memTable,
+// sorted by key.
+func (mem *memDB) parseMemTableEntries() []memEntry {
+	latest := make(map[string]memEntry)
+	for _, entry := range mem.memValues {
+		latest[entry.key] = entry
 	}
 
-	switch elements[0] {
-	case "get":
-		return Get, elements[1:], nil
-	case "set":
-		return Set, elements[1:], nil
-	case "del":
-		return Del, elements[1:], nil
-	case "flush":
-		return Flush, nil, nil
-	case "exit":
-		return Ext, nil, nil
-	case "init":
-		return Init, nil, nil
-	case "test":
-		return Test, nil, nil
-	default:
-		return Unk, nil, nil
+	entries := make([]memEntry, 0, len(latest))
+	for _, entry := range latest {
+		entries = append(entries, entry)
 	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+	return entries
 }
-
-func (re *Repl) Start() {
-	scanner := bufio.NewScanner(re.in)
-
-	for {
-		fmt.Fprint(re.out, "> ")
-		if !scanner.Scan() {
-			break
-		}
-		buf := scanner.Bytes()
-		cmd, elements, err := re.parseCmd(buf)
-		if err != nil {
-			fmt.Fprintf(re.out, "%s\n", err.Error())
-			continue
-		}
-		switch cmd {
-		case Get:
-			if len(elements) != 1 {
-				fmt.Fprintf(re.out, "Expected 1 arguments, received: %d\n", len(elements))
-				continue
-			}
-			v, err := re.db.Get([]byte(elements[0]))
-			if err != nil {
-				fmt.Fprintln(re.out, err.Error())
-				continue
-			}
-			fmt.Fprintln(re.out, string(v))
-		case Set:
-			if len(elements) != 2 {
-				fmt.Printf("Expected 2 arguments, received: %d\n", len(elements))
-				continue
-			}
-			err := re.db.Set([]byte(elements[0]), []byte(elements[1]))
-			if err != nil {
-				fmt.Fprintln(re.out, err.Error())
-				continue
-			}
-		case Del:
-			if len(elements) != 1 {
-				fmt.Printf("Expected 1 arguments, received: %d\n", len(elements))
-				continue
-			}
-			v, err := re.db.Del(elements[0])
-			if err != nil {
-				fmt.Fprintln(re.out, err.Error())
-				continue
-			}
-			fmt.Fprintln(re.out, string(v))
-		case Flush:
-			if elements != nil {
-				fmt.Fprintf(re.out, "Can only use flush alone (command : flush)")
-				continue
-			}
-
-			fmt.Println("WAL flushed to disk !")
-		case Init:
-			fmt.Println("Init")
-		case Test:
-			fmt.Println("Testing !")
-			re.db.FlushMemToSSTFile()
-		case Ext:
-			fmt.Fprintln(re.out, "Bye!")
-			return
-		case Unk:
-			fmt.Fprintln(re.out, "Unkown command")
-		}
-	}
-
-	if err := scanner.Err(); err != nil {
-		fmt.Fprintln(re.out, err.Error())
-	} else {
-		fmt.Fprintln(re.out, "Bye!")
-	}
-}
\ No newline at end of file
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// durationBuckets are the upper bounds, in seconds, of the buckets of every
+// duration histogram.
+var durationBuckets = []float64{.0005, .001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// histogram counts durations in durationBuckets, for the Prometheus text
+// format.
+type histogram struct {
+	mu     sync.Mutex
+	counts []uint64 // one per bucket, not cumulative, then one for +Inf
+	sum    float64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(durationBuckets)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	i := sort.SearchFloat64s(durationBuckets, seconds)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[i]++
+	h.sum += seconds
+}
+
+// write writes the samples of the histogram, labels being "" or a list such
+// as `handler="/v1/stats"`.
+func (h *histogram) write(w io.Writer, name, labels string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var cumulative uint64
+	for i, count := range h.counts {
+		cumulative += count
+		le := "+Inf"
+		if i < len(durationBuckets) {
+			le = strconv.FormatFloat(durationBuckets[i], 'g', -1, 64)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, joinLabels(labels, `le="`+le+`"`), cumulative)
+	}
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, joinLabels(labels), h.sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, joinLabels(labels), cumulative)
+}
+
+// engineMetrics are the timings of a store's background work. Its other
+// metrics are counted by the WAL, the caches and the filters themselves.
+type engineMetrics struct {
+	flushes     *histogram
+	compactions *histogram
+}
+
+func newEngineMetrics() *engineMetrics {
+	return &engineMetrics{
+		flushes:     newHistogram(),
+		compactions: newHistogram(),
+	}
+}
+
+type httpRequestKey struct {
+	handler string
+	method  string
+	code    int
+}
+
+// httpMetrics count the requests served by the HTTP router, by route.
+type httpMetrics struct {
+	mu       sync.Mutex
+	requests map[httpRequestKey]uint64
+	latency  map[string]*histogram
+}
+
+var httpStats = &httpMetrics{
+	requests: make(map[httpRequestKey]uint64),
+	latency:  make(map[string]*histogram),
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (rec *statusRecorder) WriteHeader(code int) {
+	rec.code = code
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+// Flush lets streaming handlers flush through the recorder.
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// instrument is a mux middleware counting requests and their latency under
+// the path template of the route they matched.
+func (m *httpMetrics) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler := r.URL.Path
+		if route := mux.CurrentRoute(r); route != nil {
+			if tpl, err := route.GetPathTemplate(); err == nil {
+				handler = tpl
+			}
+		}
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		elapsed := time.Since(start)
+
+		m.mu.Lock()
+		m.requests[httpRequestKey{handler: handler, method: r.Method, code: rec.code}]++
+		h, ok := m.latency[handler]
+		if !ok {
+			h = newHistogram()
+			m.latency[handler] = h
+		}
+		m.mu.Unlock()
+		h.observe(elapsed)
+	})
+}
+
+func (m *httpMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	keys := make([]httpRequestKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	counts := make(map[httpRequestKey]uint64, len(m.requests))
+	for key, count := range m.requests {
+		counts[key] = count
+	}
+	handlers := make([]string, 0, len(m.latency))
+	for handler := range m.latency {
+		handlers = append(handlers, handler)
+	}
+	latency := make(map[string]*histogram, len(m.latency))
+	for handler, h := range m.latency {
+		latency[handler] = h
+	}
+	m.mu.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].handler != keys[j].handler {
+			return keys[i].handler < keys[j].handler
+		}
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].code < keys[j].code
+	})
+	sort.Strings(handlers)
+
+	writeHeader(w, "kv_http_requests_total", "counter", "HTTP requests served, by route, method and status code.")
+	for _, key := range keys {
+		labels := joinLabels(label("handler", key.handler), label("method", key.method), label("code", strconv.Itoa(key.code)))
+		fmt.Fprintf(w, "kv_http_requests_total%s %d\n", labels, counts[key])
+	}
+	writeHeader(w, "kv_http_request_duration_seconds", "histogram", "Latency of the HTTP requests, by route.")
+	for _, handler := range handlers {
+		latency[handler].write(w, "kv_http_request_duration_seconds", label("handler", handler))
+	}
+}
+
+// writeMetrics writes the metrics of s and of the HTTP server in the
+// Prometheus text exposition format.
+func writeMetrics(w io.Writer, s *store) error {
+	stats, err := s.Stats()
+	if err != nil {
+		return err
+	}
+
+	writeHeader(w, "kv_memtable_bytes", "gauge", "Size of the memtable, by namespace.")
+	for _, ns := range stats.Namespaces {
+		fmt.Fprintf(w, "kv_memtable_bytes%s %d\n", joinLabels(label("namespace", ns.Name)), ns.MemtableBytes)
+	}
+	// SST files are not organised in levels: a namespace's files form a
+	// single level, searched newest first
+	writeHeader(w, "kv_sst_files", "gauge", "Number of SST files, by namespace.")
+	for _, ns := range stats.Namespaces {
+		fmt.Fprintf(w, "kv_sst_files%s %d\n", joinLabels(label("namespace", ns.Name)), ns.SSTFiles)
+	}
+	writeHeader(w, "kv_sst_bytes", "gauge", "Size of the SST files on disk, by namespace.")
+	for _, ns := range stats.Namespaces {
+		fmt.Fprintf(w, "kv_sst_bytes%s %d\n", joinLabels(label("namespace", ns.Name)), ns.StoredBytes)
+	}
+	writeHeader(w, "kv_vlog_bytes", "gauge", "Size of the value log segments, by namespace.")
+	for _, ns := range stats.Namespaces {
+		fmt.Fprintf(w, "kv_vlog_bytes%s %d\n", joinLabels(label("namespace", ns.Name)), ns.VlogBytes)
+	}
+
+	var walSize int64
+	if info, err := os.Stat(filepath.Join(s.dir, walFileName)); err == nil {
+		walSize = info.Size()
+	}
+	writeHeader(w, "kv_wal_size_bytes", "gauge", "Size of the WAL file.")
+	fmt.Fprintf(w, "kv_wal_size_bytes %d\n", walSize)
+	writeHeader(w, "kv_wal_written_bytes_total", "counter", "Bytes appended to the WAL.")
+	fmt.Fprintf(w, "kv_wal_written_bytes_total %d\n", s.wal.written.Load())
+	writeHeader(w, "kv_wal_syncs_total", "counter", "Fsyncs of the WAL.")
+	fmt.Fprintf(w, "kv_wal_syncs_total %d\n", s.wal.syncs.Load())
+
+	writeHeader(w, "kv_flush_duration_seconds", "histogram", "Time taken to write memtables to SST files.")
+	s.metrics.flushes.write(w, "kv_flush_duration_seconds", "")
+	writeHeader(w, "kv_compaction_duration_seconds", "histogram", "Time taken by compactions.")
+	s.metrics.compactions.write(w, "kv_compaction_duration_seconds", "")
+
+	bloom := &s.tables.bloom
+	writeHeader(w, "kv_bloom_filter_checks_total", "counter", "SST lookups that consulted a bloom filter.")
+	fmt.Fprintf(w, "kv_bloom_filter_checks_total %d\n", bloom.checks.Load())
+	writeHeader(w, "kv_bloom_filter_negatives_total", "counter", "SST lookups a bloom filter answered without reading a block.")
+	fmt.Fprintf(w, "kv_bloom_filter_negatives_total %d\n", bloom.negatives.Load())
+	writeHeader(w, "kv_bloom_filter_false_positives_total", "counter", "SST lookups a bloom filter let through for a key the file does not hold.")
+	fmt.Fprintf(w, "kv_bloom_filter_false_positives_total %d\n", bloom.falsePositives.Load())
+
+	caches := []struct {
+		name  string
+		stats cacheStats
+	}{{"block", stats.BlockCache}, {"table", stats.TableCache}}
+	writeHeader(w, "kv_cache_hits_total", "counter", "Cache hits, by cache.")
+	for _, c := range caches {
+		fmt.Fprintf(w, "kv_cache_hits_total%s %d\n", joinLabels(label("cache", c.name)), c.stats.Hits)
+	}
+	writeHeader(w, "kv_cache_misses_total", "counter", "Cache misses, by cache.")
+	for _, c := range caches {
+		fmt.Fprintf(w, "kv_cache_misses_total%s %d\n", joinLabels(label("cache", c.name)), c.stats.Misses)
+	}
+	writeHeader(w, "kv_cache_used", "gauge", "Bytes held by the block cache, open files held by the table cache.")
+	for _, c := range caches {
+		fmt.Fprintf(w, "kv_cache_used%s %d\n", joinLabels(label("cache", c.name)), c.stats.Used)
+	}
+	writeHeader(w, "kv_cache_capacity", "gauge", "Capacity of the caches, in the unit of kv_cache_used.")
+	for _, c := range caches {
+		fmt.Fprintf(w, "kv_cache_capacity%s %d\n", joinLabels(label("cache", c.name)), c.stats.Capacity)
+	}
+
+	httpStats.write(w)
+	return nil
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func label(name, value string) string {
+	return name + `="` + labelEscaper.Replace(value) + `"`
+}
+
+// joinLabels returns the label set of a sample, "" if there are none.
+func joinLabels(labels ...string) string {
+	var nonEmpty []string
+	for _, l := range labels {
+		if l != "" {
+			nonEmpty = append(nonEmpty, l)
+		}
+	}
+	if len(nonEmpty) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(nonEmpty, ",") + "}"
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	if err := writeMetrics(&buf, st); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if follower != nil {
+		follower.writeMetrics(&buf)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	buf.WriteTo(w)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestMetrics(t *testing.T) {
+	s, err := openStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	mem, err := s.CreateNamespace("metrics", nsOptions{FlushSize: 1 << 20})
+	if err != nil {
+		t.Fatalf("Error creating namespace: %v", err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if err := mem.Set([]byte(key), []byte("v")); err != nil {
+			t.Fatalf("Error setting %s: %v", key, err)
+		}
+		if _, err := mem.Flush(); err != nil {
+			t.Fatalf("Error flushing: %v", err)
+		}
+	}
+	if err := mem.Compact(); err != nil {
+		t.Fatalf("Error compacting: %v", err)
+	}
+	if err := s.SyncWAL(); err != nil {
+		t.Fatalf("Error syncing WAL: %v", err)
+	}
+	mem.Get([]byte("a"))
+	mem.Get([]byte("missing"))
+
+	// Requests are counted under the template of their route
+	r := mux.NewRouter()
+	r.HandleFunc("/v1/ns/{ns}", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no such namespace", http.StatusNotFound)
+	})
+	r.Use(httpStats.instrument)
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v1/ns/nope", nil))
+
+	var buf bytes.Buffer
+	if err := writeMetrics(&buf, s); err != nil {
+		t.Fatalf("Error writing metrics: %v", err)
+	}
+	got := buf.String()
+	for _, line := range []string{
+		"# TYPE kv_sst_files gauge",
+		`kv_sst_files{namespace="metrics"} 1`,
+		"kv_wal_syncs_total 1",
+		"kv_flush_duration_seconds_count 2",
+		`kv_flush_duration_seconds_bucket{le="+Inf"} 2`,
+		"kv_compaction_duration_seconds_count 1",
+		"kv_bloom_filter_checks_total 2",
+		"kv_bloom_filter_negatives_total 1",
+		`kv_cache_hits_total{cache="table"}`,
+		`kv_http_requests_total{handler="/v1/ns/{ns}",method="GET",code="404"} 1`,
+		`kv_http_request_duration_seconds_count{handler="/v1/ns/{ns}"} 1`,
+	} {
+		if !strings.Contains(got, line) {
+			t.Errorf("Expected %q in the metrics", line)
+		}
+	}
+	if !strings.Contains(got, "kv_wal_written_bytes_total ") || strings.Contains(got, "kv_wal_written_bytes_total 0\n") {
+		t.Errorf("Expected WAL bytes to be counted")
+	}
+}
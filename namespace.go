@@ -0,0 +1,554 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultNamespace = "default"
+	nsDirPrefix      = "ns_"
+	optionsFileName  = "OPTIONS"
+	walFileName      = "wal.log"
+)
+
+// Compaction styles a namespace can be configured with.
+const (
+	compactionNone = "none" // SST files are never merged
+	compactionFull = "full" // all SST files are merged once there are too many
+)
+
+var (
+	errNamespaceExists   = errors.New("namespace already exists")
+	errNamespaceNotFound = errors.New("namespace not found")
+	errBadNamespaceName  = errors.New("namespace names may only contain letters, digits, '-' and '_'")
+	errReadOnly          = errors.New("read-only replica, write to the primary")
+
+	validNamespaceName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+)
+
+// nsOptions are the per-namespace settings, stored as JSON in the OPTIONS
+// file of the namespace directory.
+type nsOptions struct {
+	FlushSize  int    `json:"flush_size"`  // memtable size in bytes that triggers a flush
+	Compaction string `json:"compaction"`  // one of compactionNone, compactionFull
+	TTL        int64  `json:"ttl_seconds"` // lifetime of every key, 0 means forever
+
+	// Compression is the codec of SST files written by flushes, and
+	// BottomCompression the one of files written by full compactions, which
+	// hold the bulk of the data.
+	Compression       string `json:"compression"`
+	BottomCompression string `json:"bottom_compression"`
+
+	// Values of at least ValueThreshold bytes are moved to the value log when
+	// flushed, 0 keeps every value in the SST files. The value log is split
+	// in segments of about VlogSegmentSize bytes.
+	ValueThreshold  int   `json:"value_threshold"`
+	VlogSegmentSize int64 `json:"vlog_segment_size"`
+}
+
+func defaultNSOptions() nsOptions {
+	return nsOptions{
+		FlushSize:       20,
+		Compaction:      compactionNone,
+		Compression:     "snappy",
+		VlogSegmentSize: 64 << 20,
+	}
+}
+
+// withDefaults fills the zero fields of opts and checks the others.
+func (opts nsOptions) withDefaults() (nsOptions, error) {
+	def := defaultNSOptions()
+	if opts.FlushSize == 0 {
+		opts.FlushSize = def.FlushSize
+	}
+	if opts.Compaction == "" {
+		opts.Compaction = def.Compaction
+	}
+	if opts.Compression == "" {
+		opts.Compression = def.Compression
+	}
+	if opts.BottomCompression == "" {
+		opts.BottomCompression = opts.Compression
+	}
+	if opts.VlogSegmentSize == 0 {
+		opts.VlogSegmentSize = def.VlogSegmentSize
+	}
+	if opts.ValueThreshold < 0 || opts.VlogSegmentSize < 0 {
+		return opts, errors.New("value_threshold and vlog_segment_size must be positive")
+	}
+	if opts.FlushSize < 0 {
+		return opts, errors.New("flush_size must be positive")
+	}
+	if opts.TTL < 0 {
+		return opts, errors.New("ttl_seconds must be positive")
+	}
+	if opts.Compaction != compactionNone && opts.Compaction != compactionFull {
+		return opts, fmt.Errorf("unknown compaction style %q", opts.Compaction)
+	}
+	if _, err := codecByName(opts.Compression); err != nil {
+		return opts, err
+	}
+	if _, err := codecByName(opts.BottomCompression); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+// storeOptions are the settings of a whole store, as opposed to the
+// per-namespace nsOptions.
+type storeOptions struct {
+	MaxOpenFiles   int   // SST files kept open by the table cache
+	BlockCacheSize int64 // bytes of uncompressed blocks kept by the block cache
+	WatchLogSize   int   // bytes of the latest batches kept for WatchFrom
+
+	// EncryptionKey is the AES key (16, 24 or 32 bytes) new files are
+	// encrypted with, nil keeps them in plaintext. OldEncryptionKeys are only
+	// used to read files written before the key was rotated.
+	// EncryptionKeyFile, if set, is read with loadKeyFile and overrides both.
+	EncryptionKey     []byte
+	OldEncryptionKeys [][]byte
+	EncryptionKeyFile string
+
+	// Logger receives the engine's logs, slog.Default() if nil. Flushes,
+	// compactions and WAL rotations are logged at debug level, failures at
+	// error level.
+	Logger *slog.Logger
+	// EventListener, if set, is told about flushes, compactions and the
+	// other work done by the engine.
+	EventListener EventListener
+}
+
+func defaultStoreOptions() storeOptions {
+	return storeOptions{
+		MaxOpenFiles:   64,
+		BlockCacheSize: 8 << 20,
+		WatchLogSize:   4 << 20,
+	}
+}
+
+// store holds every namespace (column family) of a data directory. Each
+// namespace has its own memtable, SST files and options, and all of them log
+// to one shared WAL so that a batch touching several namespaces is atomic.
+type store struct {
+	mu         sync.RWMutex
+	dir        string
+	seq        uint64
+	wal        *walDB
+	namespaces map[string]*memDB
+	tables     *tableCache
+	blocks     *blockCache
+	keys       *keyring
+	metrics    *engineMetrics
+	logger     *slog.Logger
+	events     EventListener
+
+	// repl keeps the recent writes for replicas to stream, nil unless the
+	// store serves replicas. readOnly is set on replicas, which only apply
+	// the writes of their primary.
+	repl     *replLog
+	readOnly bool
+	// raft, if set, replicates every write through consensus; the store
+	// is then read-only except for the entries raft applies.
+	raft *raftNode
+	// watchers receive the puts and deletes of every committed batch
+	watchers *watchHub
+	// webhooks, if set, queues a delivery with every write its rules match
+	webhooks *webhooks
+}
+
+// openStore opens the store in dir with the default options.
+func openStore(dir string) (*store, error) {
+	return openStoreWith(dir, defaultStoreOptions())
+}
+
+// openStoreWith opens the store in dir, creating it if needed, and replays
+// the WAL into the memtables.
+func openStoreWith(dir string, opts storeOptions) (*store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	if opts.EncryptionKeyFile != "" {
+		var err error
+		opts.EncryptionKey, opts.OldEncryptionKeys, err = loadKeyFile(opts.EncryptionKeyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	keys, err := newKeyring(opts.EncryptionKey, opts.OldEncryptionKeys)
+	if err != nil {
+		return nil, err
+	}
+	return openStoreKeys(dir, opts, keys)
+}
+
+// openStoreKeys opens the store in dir, which must exist, with a keyring
+// already built.
+func openStoreKeys(dir string, opts storeOptions, keys *keyring) (*store, error) {
+	// Absolute, since restores and bootstraps rename the directory and make
+	// siblings of it, which "." does not allow
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	wal, err := NewwalDB(f, keys)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	s := &store{
+		dir:        dir,
+		wal:        wal,
+		namespaces: make(map[string]*memDB),
+		tables:     newTableCache(opts.MaxOpenFiles, keys),
+		blocks:     newBlockCache(opts.BlockCacheSize),
+		keys:       keys,
+		metrics:    newEngineMetrics(),
+		logger:     opts.Logger,
+		events:     opts.EventListener,
+		watchers:   newWatchHub(opts.WatchLogSize),
+	}
+	if s.logger == nil {
+		s.logger = slog.Default()
+	}
+	if s.events == nil {
+		s.events = NoopEventListener{}
+	}
+
+	names := []string{defaultNamespace}
+	dirs, err := filepath.Glob(filepath.Join(dir, nsDirPrefix+"*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dirs {
+		names = append(names, strings.TrimPrefix(filepath.Base(d), nsDirPrefix))
+	}
+
+	for _, name := range names {
+		opts, err := readNSOptions(s.nsDir(name))
+		if err != nil {
+			return nil, err
+		}
+		mem, err := s.newNamespace(name, opts)
+		if err != nil {
+			return nil, err
+		}
+		s.namespaces[name] = mem
+	}
+
+	end, err := s.wal.Replay(func(b *writeBatch) error {
+		s.seq = b.seq
+		for _, op := range b.ops {
+			mem, ok := s.namespaces[op.ns]
+			if !ok {
+				continue
+			}
+			if op.op == opDropNS || op.op == opIngest {
+				mem.memValues = nil
+				mem.memSize = 0
+				continue
+			}
+			mem.apply(op, b.seq)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := s.wal.truncateTail(end); err != nil {
+		return nil, err
+	}
+	s.watchers.reset(s.seq)
+
+	return s, nil
+}
+
+// nsDir returns the directory holding the SST files of a namespace. The
+// default namespace lives at the root of the store.
+func (s *store) nsDir(name string) string {
+	if name == defaultNamespace {
+		return s.dir
+	}
+	return filepath.Join(s.dir, nsDirPrefix+name)
+}
+
+func (s *store) newNamespace(name string, opts nsOptions) (*memDB, error) {
+	if err := recoverIngest(s.nsDir(name)); err != nil {
+		return nil, err
+	}
+	flDB, err := newFileDB(s.nsDir(name), opts.FlushSize)
+	if err != nil {
+		return nil, err
+	}
+	vlog, err := openValueLog(s.nsDir(name), opts.VlogSegmentSize, s.keys)
+	if err != nil {
+		return nil, err
+	}
+
+	return &memDB{
+		name:  name,
+		opts:  opts,
+		store: s,
+		wal:   s.wal,
+		file:  flDB,
+		vlog:  vlog,
+	}, nil
+}
+
+func readNSOptions(dir string) (nsOptions, error) {
+	var opts nsOptions
+	data, err := os.ReadFile(filepath.Join(dir, optionsFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return opts, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &opts); err != nil {
+			return opts, fmt.Errorf("%s: %v", filepath.Join(dir, optionsFileName), err)
+		}
+	}
+	return opts.withDefaults()
+}
+
+func writeNSOptions(dir string, opts nsOptions) error {
+	data, err := json.MarshalIndent(opts, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, optionsFileName), data, 0644)
+}
+
+// Namespace returns the namespace called name.
+func (s *store) Namespace(name string) (*memDB, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	mem, ok := s.namespaces[name]
+	if !ok {
+		return nil, errNamespaceNotFound
+	}
+	return mem, nil
+}
+
+// ListNamespaces returns the names of every namespace, sorted.
+func (s *store) ListNamespaces() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names := make([]string, 0, len(s.namespaces))
+	for name := range s.namespaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CreateNamespace adds a new, empty namespace with the given options.
+func (s *store) CreateNamespace(name string, opts nsOptions) (*memDB, error) {
+	if !validNamespaceName.MatchString(name) {
+		return nil, errBadNamespaceName
+	}
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	if s.raft != nil {
+		if err := s.raft.propose(raftCommand{CreateNamespace: name, Options: &opts}); err != nil {
+			return nil, err
+		}
+		return s.Namespace(name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.readOnly {
+		return nil, errReadOnly
+	}
+	return s.createNamespaceLocked(name, opts)
+}
+
+func (s *store) createNamespaceLocked(name string, opts nsOptions) (*memDB, error) {
+	if _, ok := s.namespaces[name]; ok {
+		return nil, errNamespaceExists
+	}
+
+	dir := s.nsDir(name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := writeNSOptions(dir, opts); err != nil {
+		return nil, err
+	}
+
+	mem, err := s.newNamespace(name, opts)
+	if err != nil {
+		return nil, err
+	}
+	s.namespaces[name] = mem
+	s.repl.appendNamespace(s.seq, name, opts)
+	return mem, nil
+}
+
+// DropNamespace deletes a namespace and all of its data. The drop is logged
+// so that WAL records written before it are not replayed into a namespace
+// later created with the same name.
+func (s *store) DropNamespace(name string) error {
+	if name == defaultNamespace {
+		return errors.New("the default namespace cannot be dropped")
+	}
+	if s.raft != nil {
+		return s.raft.propose(raftCommand{DropNamespace: name})
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.readOnly {
+		return errReadOnly
+	}
+	if _, ok := s.namespaces[name]; !ok {
+		return errNamespaceNotFound
+	}
+	s.seq++
+	return s.dropNamespaceLocked(name, s.seq)
+}
+
+// dropNamespaceLocked logs the drop of an existing namespace with seq and
+// deletes it.
+func (s *store) dropNamespaceLocked(name string, seq uint64) error {
+	mem := s.namespaces[name]
+	b := &writeBatch{seq: seq, ops: []batchOp{{op: opDropNS, ns: name}}}
+	if err := s.wal.AppendBatch(b); err != nil {
+		return err
+	}
+	s.repl.appendBatch(b)
+
+	mem.file.closeFile()
+	mem.vlog.Close()
+	s.tables.evictDir(s.nsDir(name))
+	if err := os.RemoveAll(s.nsDir(name)); err != nil {
+		return err
+	}
+	delete(s.namespaces, name)
+	for i := 1; i <= mem.file.noFiles; i++ {
+		s.events.OnTableDeleted(TableInfo{Namespace: name, Path: mem.file.sstPath(i), Reason: "drop namespace"})
+	}
+
+	return s.maybeResetWAL()
+}
+
+// Write applies a batch atomically: it is logged as one WAL record and then
+// added to the memtables of the namespaces it touches.
+func (s *store) Write(b *writeBatch) error {
+	if s.raft != nil {
+		return s.raft.proposeBatch(b)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.writeLocked(b)
+}
+
+func (s *store) writeLocked(b *writeBatch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+	if s.readOnly {
+		return errReadOnly
+	}
+	if err := s.prepareLocked(b); err != nil {
+		return err
+	}
+
+	s.seq++
+	b.seq = s.seq
+	return s.commitLocked(s.webhooks.enqueueLocked(b))
+}
+
+// prepareLocked checks every namespace of the batch exists before anything
+// is logged, and sets the expiry of keys written to namespaces with a TTL.
+func (s *store) prepareLocked(b *writeBatch) error {
+	now := time.Now()
+	for i, op := range b.ops {
+		mem, ok := s.namespaces[op.ns]
+		if !ok {
+			return fmt.Errorf("%s: %w", op.ns, errNamespaceNotFound)
+		}
+		if op.op == opSet && op.expires == 0 && mem.opts.TTL > 0 {
+			b.ops[i].expires = now.Add(time.Duration(mem.opts.TTL) * time.Second).UnixNano()
+		}
+	}
+	return nil
+}
+
+// commitLocked logs a batch that already has its sequence number and
+// applies it to the memtables.
+func (s *store) commitLocked(b *writeBatch) error {
+	if err := s.wal.AppendBatch(b); err != nil {
+		return err
+	}
+	s.repl.appendBatch(b)
+	s.watchers.publish(b)
+
+	touched := make(map[string]*memDB)
+	for _, op := range b.ops {
+		mem := s.namespaces[op.ns]
+		mem.apply(op, b.seq)
+		touched[op.ns] = mem
+	}
+
+	for _, mem := range touched {
+		if err := mem.updateMemDisk(); err != nil {
+			s.logger.Error("flush or compaction failed", "namespace", mem.name, "err", err)
+			s.events.OnBackgroundError(err)
+			return err
+		}
+	}
+	return nil
+}
+
+// SyncWAL flushes the WAL to stable storage, so every write made so far
+// survives a power loss.
+func (s *store) SyncWAL() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.wal.Sync()
+}
+
+// maybeResetWAL empties the WAL once every memtable has been flushed. The
+// current sequence number is logged again so that it survives a restart.
+func (s *store) maybeResetWAL() error {
+	for _, mem := range s.namespaces {
+		if len(mem.memValues) > 0 {
+			return nil
+		}
+	}
+
+	if err := s.wal.Reset(); err != nil {
+		return err
+	}
+	if err := s.wal.AppendBatch(&writeBatch{seq: s.seq}); err != nil {
+		return err
+	}
+	info := WALInfo{Path: s.wal.file.Name(), Seq: s.seq}
+	s.logger.Debug("WAL rotated", "path", info.Path, "seq", info.Seq)
+	s.events.OnWALRotated(info)
+	return nil
+}
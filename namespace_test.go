@@ -0,0 +1,209 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStore_NamespacesAreIsolated(t *testing.T) {
+	s, err := openStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+
+	sessions, err := s.CreateNamespace("sessions", nsOptions{})
+	if err != nil {
+		t.Fatalf("Error creating namespace: %v", err)
+	}
+	flags, err := s.CreateNamespace("flags", nsOptions{FlushSize: 1 << 20})
+	if err != nil {
+		t.Fatalf("Error creating namespace: %v", err)
+	}
+
+	sessions.Set([]byte("key"), []byte("session"))
+	flags.Set([]byte("key"), []byte("flag"))
+
+	if v, err := sessions.Get([]byte("key")); err != nil || string(v) != "session" {
+		t.Errorf("Expected value session, got %s (%v)", v, err)
+	}
+	if v, err := flags.Get([]byte("key")); err != nil || string(v) != "flag" {
+		t.Errorf("Expected value flag, got %s (%v)", v, err)
+	}
+	if _, err := s.namespaces[defaultNamespace].Get([]byte("key")); err == nil {
+		t.Errorf("Expected key to be missing from the default namespace")
+	}
+
+	names := s.ListNamespaces()
+	if len(names) != 3 || names[0] != "default" || names[1] != "flags" || names[2] != "sessions" {
+		t.Errorf("Unexpected namespaces %v", names)
+	}
+}
+
+func TestStore_BatchAcrossNamespacesSurvivesReopen(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openStore(dir)
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	// A large flush size keeps everything in the memtables and the WAL
+	if _, err := s.CreateNamespace("a", nsOptions{FlushSize: 1 << 20}); err != nil {
+		t.Fatalf("Error creating namespace: %v", err)
+	}
+	if _, err := s.CreateNamespace("b", nsOptions{FlushSize: 1 << 20}); err != nil {
+		t.Fatalf("Error creating namespace: %v", err)
+	}
+
+	b := &writeBatch{}
+	b.Put("a", []byte("k1"), []byte("v1"))
+	b.Put("b", []byte("k2"), []byte("v2"))
+	if err := s.Write(b); err != nil {
+		t.Fatalf("Error writing batch: %v", err)
+	}
+
+	// A batch naming an unknown namespace must not be applied at all
+	bad := &writeBatch{}
+	bad.Put("a", []byte("k3"), []byte("v3"))
+	bad.Put("missing", []byte("k4"), []byte("v4"))
+	if err := s.Write(bad); err == nil {
+		t.Fatalf("Expected batch with unknown namespace to fail")
+	}
+
+	reopened, err := openStore(dir)
+	if err != nil {
+		t.Fatalf("Error reopening store: %v", err)
+	}
+	a, _ := reopened.Namespace("a")
+	bns, _ := reopened.Namespace("b")
+	if v, err := a.Get([]byte("k1")); err != nil || string(v) != "v1" {
+		t.Errorf("Expected value v1, got %s (%v)", v, err)
+	}
+	if v, err := bns.Get([]byte("k2")); err != nil || string(v) != "v2" {
+		t.Errorf("Expected value v2, got %s (%v)", v, err)
+	}
+	if _, err := a.Get([]byte("k3")); err == nil {
+		t.Errorf("Expected k3 from the failed batch to be missing")
+	}
+	if reopened.seq != s.seq {
+		t.Errorf("Expected sequence %d after reopen, got %d", s.seq, reopened.seq)
+	}
+}
+
+func TestStore_DropNamespace(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openStore(dir)
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	mem, err := s.CreateNamespace("tmp", nsOptions{FlushSize: 1 << 20})
+	if err != nil {
+		t.Fatalf("Error creating namespace: %v", err)
+	}
+	mem.Set([]byte("k"), []byte("v"))
+
+	if err := s.DropNamespace("tmp"); err != nil {
+		t.Fatalf("Error dropping namespace: %v", err)
+	}
+	if _, err := s.Namespace("tmp"); err == nil {
+		t.Errorf("Expected dropped namespace to be gone")
+	}
+	if err := s.DropNamespace(defaultNamespace); err == nil {
+		t.Errorf("Expected dropping the default namespace to fail")
+	}
+
+	// Recreating the namespace must not bring back the old WAL records
+	if _, err := s.CreateNamespace("tmp", nsOptions{FlushSize: 1 << 20}); err != nil {
+		t.Fatalf("Error recreating namespace: %v", err)
+	}
+	reopened, err := openStore(dir)
+	if err != nil {
+		t.Fatalf("Error reopening store: %v", err)
+	}
+	mem, _ = reopened.Namespace("tmp")
+	if _, err := mem.Get([]byte("k")); err == nil {
+		t.Errorf("Expected key of the dropped namespace to be gone")
+	}
+}
+
+func TestStore_TTLAndFullCompaction(t *testing.T) {
+	s, err := openStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	mem, err := s.CreateNamespace("cache", nsOptions{FlushSize: 1, Compaction: compactionFull})
+	if err != nil {
+		t.Fatalf("Error creating namespace: %v", err)
+	}
+
+	for _, k := range []string{"a", "b", "c", "d", "e", "f"} {
+		if err := mem.Set([]byte(k), []byte("value-"+k)); err != nil {
+			t.Fatalf("Error setting %s: %v", k, err)
+		}
+	}
+	if _, err := mem.Del("c"); err != nil {
+		t.Fatalf("Error deleting c: %v", err)
+	}
+	if mem.file.noFiles > fullCompactionTrigger {
+		t.Errorf("Expected at most %d SST files, got %d", fullCompactionTrigger, mem.file.noFiles)
+	}
+	if v, err := mem.Get([]byte("a")); err != nil || string(v) != "value-a" {
+		t.Errorf("Expected value-a, got %s (%v)", v, err)
+	}
+	if _, err := mem.Get([]byte("c")); err == nil {
+		t.Errorf("Expected c to be deleted")
+	}
+
+	// An entry whose expiry has passed is not returned, from memory or disk
+	mem.SetMem([]byte("old"), []byte("v"), 1, 0)
+	if _, err := mem.Get([]byte("old")); err == nil {
+		t.Errorf("Expected expired key to be missing from the memtable")
+	}
+	if err := mem.FlushMemToSSTFile(); err != nil {
+		t.Fatalf("Error flushing: %v", err)
+	}
+	if _, err := mem.Get([]byte("old")); err == nil {
+		t.Errorf("Expected expired key to be missing from the SST files")
+	}
+}
+
+func TestStore_WritesAfterTornWALTail(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openStore(dir)
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	mem, err := s.CreateNamespace("torn", nsOptions{FlushSize: 1 << 20})
+	if err != nil {
+		t.Fatalf("Error creating namespace: %v", err)
+	}
+	mem.Set([]byte("a"), []byte("1"))
+	mem.Set([]byte("torn"), []byte("x"))
+
+	// Cut the last record, as a crash mid-write would
+	walPath := filepath.Join(dir, walFileName)
+	info, _ := os.Stat(walPath)
+	os.Truncate(walPath, info.Size()-3)
+
+	s, err = openStore(dir)
+	if err != nil {
+		t.Fatalf("Error reopening store: %v", err)
+	}
+	mem, _ = s.Namespace("torn")
+	if err := mem.Set([]byte("b"), []byte("2")); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+
+	s, err = openStore(dir)
+	if err != nil {
+		t.Fatalf("Error reopening store: %v", err)
+	}
+	mem, _ = s.Namespace("torn")
+	for key, want := range map[string]string{"a": "1", "b": "2"} {
+		if got, err := mem.Get([]byte(key)); err != nil || string(got) != want {
+			t.Errorf("Expected %s=%s after the second reopen, got %q, %v", key, want, got, err)
+		}
+	}
+	if _, err := mem.Get([]byte("torn")); err == nil {
+		t.Errorf("Expected the torn write to be lost")
+	}
+}
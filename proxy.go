@@ -0,0 +1,878 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// The proxy spreads the keys of every namespace over several store
+// servers, the backends, with a consistent hash ring: adding or removing a
+// backend only moves the keys between it and its neighbours on the ring.
+// It serves the /v1 API and /admin/export in front of them, and moves keys
+// between backends online when the set of backends changes.
+
+// proxyMoveChunk is the number of keys moved at a time during a migration.
+// Writes through the proxy wait while a chunk is moved.
+const proxyMoveChunk = 500
+
+var errUnknownBackend = errors.New("unknown backend")
+
+// hashRing maps keys to nodes. Each node is placed on the ring at several
+// points, its virtual nodes, so keys spread evenly; a key belongs to the
+// node of the first point at or after its hash.
+type hashRing struct {
+	vnodes int
+	nodes  []string
+	points []ringPoint
+}
+
+type ringPoint struct {
+	hash uint64
+	node string
+}
+
+func newHashRing(vnodes int, nodes ...string) *hashRing {
+	r := &hashRing{vnodes: vnodes}
+	for _, node := range nodes {
+		r = r.with(node)
+	}
+	return r
+}
+
+func ringHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	// FNV barely mixes the last bytes, which differ the most between the
+	// virtual nodes of a node, so finish like murmur3
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// with returns a copy of the ring with node added.
+func (r *hashRing) with(node string) *hashRing {
+	n := &hashRing{vnodes: r.vnodes, nodes: append(append([]string(nil), r.nodes...), node)}
+	n.points = append([]ringPoint(nil), r.points...)
+	for i := 0; i < r.vnodes; i++ {
+		n.points = append(n.points, ringPoint{hash: ringHash(node + "#" + strconv.Itoa(i)), node: node})
+	}
+	sort.Slice(n.points, func(i, j int) bool {
+		if n.points[i].hash != n.points[j].hash {
+			return n.points[i].hash < n.points[j].hash
+		}
+		return n.points[i].node < n.points[j].node
+	})
+	sort.Strings(n.nodes)
+	return n
+}
+
+// without returns a copy of the ring with node removed.
+func (r *hashRing) without(node string) *hashRing {
+	n := &hashRing{vnodes: r.vnodes}
+	for _, other := range r.nodes {
+		if other != node {
+			n.nodes = append(n.nodes, other)
+		}
+	}
+	for _, p := range r.points {
+		if p.node != node {
+			n.points = append(n.points, p)
+		}
+	}
+	return n
+}
+
+func (r *hashRing) has(node string) bool {
+	for _, other := range r.nodes {
+		if other == node {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the node key belongs to, "" if the ring is empty.
+func (r *hashRing) lookup(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].node
+}
+
+// A proxy routes requests to the backends, given by their base URLs such
+// as http://localhost:8081.
+type proxy struct {
+	// mu is read-locked by every request and write-locked while a chunk
+	// of keys moves, so no write races with the move
+	mu   sync.RWMutex
+	ring *hashRing
+	// prev is the ring before the membership change being migrated, nil
+	// when none is; keys that moved may still be on their owner in prev
+	prev *hashRing
+	// moved is the number of keys the current or last migration moved
+	moved int
+
+	// changing is held during a membership change, one at a time
+	changing sync.Mutex
+
+	client *http.Client
+	// token is sent to the backends for the requests of the proxy itself,
+	// those of callers carry their own credentials
+	token  string
+	logger *slog.Logger
+}
+
+// newProxy returns a proxy to backends, connecting to them with config,
+// the default TLS configuration when nil.
+func newProxy(backends []string, vnodes int, config *tls.Config, logger *slog.Logger) *proxy {
+	return &proxy{
+		ring:   newHashRing(vnodes, backends...),
+		client: httpClient(config, time.Minute),
+		logger: logger,
+	}
+}
+
+// owners returns the backend key belongs to, and the one it belonged to
+// before the change being migrated, "" if none is or it did not move. p.mu
+// must be read-locked.
+func (p *proxy) owners(key string) (owner, prev string) {
+	owner = p.ring.lookup(key)
+	if p.prev != nil {
+		if prev = p.prev.lookup(key); prev == owner {
+			prev = ""
+		}
+	}
+	return owner, prev
+}
+
+// register adds the routes of the proxy:
+//
+//	GET    /proxy/nodes              the backends, and the migration in progress
+//	POST   /proxy/nodes?addr=URL     add a backend, moving the keys it now owns to it
+//	DELETE /proxy/nodes?addr=URL     move the keys of a backend to the others and remove it
+//
+// and the ones of the /v1 API, routed by key, with namespace changes sent to
+// every backend, and /admin/export, merging the keys of every backend.
+func (p *proxy) register(r *mux.Router) {
+	r.HandleFunc("/proxy/nodes", p.handleNodes).Methods("GET")
+	r.HandleFunc("/proxy/nodes", p.handleAddNode).Methods("POST")
+	r.HandleFunc("/proxy/nodes", p.handleRemoveNode).Methods("DELETE")
+
+	r.HandleFunc("/v1/ns", p.handleFirst).Methods("GET")
+	r.HandleFunc("/v1/ns/{ns}", p.handleFirst).Methods("GET")
+	r.HandleFunc("/v1/ns/{ns}", p.handleEvery).Methods("PUT", "POST", "DELETE")
+	r.HandleFunc("/v1/ns/{ns}/keys/{key:.+}", p.handleGet).Methods("GET")
+	r.HandleFunc("/v1/ns/{ns}/keys/{key:.+}", p.handleSet).Methods("PUT", "POST")
+	r.HandleFunc("/v1/ns/{ns}/keys/{key:.+}", p.handleDelete).Methods("DELETE")
+	r.HandleFunc("/v1/ns/{ns}/vlog/gc", p.handleEvery).Methods("POST")
+	r.HandleFunc("/v1/batch", p.handleBatch).Methods("POST")
+	r.HandleFunc("/v1/stats", p.handleStats).Methods("GET")
+	r.HandleFunc("/admin/export", p.handleExport).Methods("GET")
+}
+
+// backendResponse is a response of a backend, read in full.
+type backendResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// do sends a request to a backend on behalf of the caller of from, with its
+// credentials, or of the proxy itself when from is nil.
+func (p *proxy) do(from *http.Request, method, backend, path string, body []byte) (backendResponse, error) {
+	req, err := http.NewRequest(method, backend+path, bytes.NewReader(body))
+	if err != nil {
+		return backendResponse{}, err
+	}
+	p.authorize(req, from)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return backendResponse{}, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return backendResponse{}, err
+	}
+	return backendResponse{status: resp.StatusCode, header: resp.Header, body: data}, nil
+}
+
+// authorize copies the token or API key of from to req, or sets the token
+// of the proxy when from is nil.
+func (p *proxy) authorize(req, from *http.Request) {
+	if from == nil {
+		if p.token != "" {
+			req.Header.Set("Authorization", "Bearer "+p.token)
+		}
+		return
+	}
+	for _, h := range []string{"Authorization", "X-API-Key"} {
+		if v := from.Header.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+}
+
+// check returns an error for the responses that are not a success.
+func (resp backendResponse) check(backend string) error {
+	if resp.status >= 300 {
+		return fmt.Errorf("%s answered %d: %s", backend, resp.status, strings.TrimSpace(string(resp.body)))
+	}
+	return nil
+}
+
+func (resp backendResponse) write(w http.ResponseWriter) {
+	if ct := resp.header.Get("Content-Type"); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	w.WriteHeader(resp.status)
+	w.Write(resp.body)
+}
+
+func keyPath(ns, key string) string {
+	return "/v1/ns/" + url.PathEscape(ns) + "/keys/" + url.PathEscape(key)
+}
+
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return body, true
+}
+
+// handleFirst answers with the first backend, for what every backend has.
+func (p *proxy) handleFirst(w http.ResponseWriter, r *http.Request) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if len(p.ring.nodes) == 0 {
+		http.Error(w, "no backends", http.StatusServiceUnavailable)
+		return
+	}
+	resp, err := p.do(r, r.Method, p.ring.nodes[0], r.URL.RequestURI(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	resp.write(w)
+}
+
+// handleEvery sends the request to every backend, and answers with the
+// first failure, or the response of the first backend.
+func (p *proxy) handleEvery(w http.ResponseWriter, r *http.Request) {
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	resps := make([]backendResponse, len(p.ring.nodes))
+	errs := make([]error, len(p.ring.nodes))
+	var wg sync.WaitGroup
+	for i, backend := range p.ring.nodes {
+		wg.Add(1)
+		go func(i int, backend string) {
+			defer wg.Done()
+			resps[i], errs[i] = p.do(r, r.Method, backend, r.URL.RequestURI(), body)
+		}(i, backend)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		if resps[i].status >= 300 {
+			resps[i].write(w)
+			return
+		}
+	}
+	if len(resps) == 0 {
+		http.Error(w, "no backends", http.StatusServiceUnavailable)
+		return
+	}
+	resps[0].write(w)
+}
+
+func (p *proxy) handleGet(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	owner, prev := p.owners(vars["key"])
+	resp, err := p.do(r, "GET", owner, keyPath(vars["ns"], vars["key"]), nil)
+	if err == nil && resp.status == http.StatusNotFound && prev != "" {
+		// Not moved yet
+		resp, err = p.do(r, "GET", prev, keyPath(vars["ns"], vars["key"]), nil)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	resp.write(w)
+}
+
+func (p *proxy) handleSet(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	owner, prev := p.owners(vars["key"])
+	resp, err := p.do(r, "PUT", owner, keyPath(vars["ns"], vars["key"]), body)
+	if err == nil && resp.status < 300 && prev != "" {
+		// The key must not be moved over the new value later
+		var old backendResponse
+		old, err = p.do(r, "DELETE", prev, keyPath(vars["ns"], vars["key"]), nil)
+		if err == nil && old.status != http.StatusNotFound {
+			err = old.check(prev)
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	resp.write(w)
+}
+
+func (p *proxy) handleDelete(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	owner, prev := p.owners(vars["key"])
+	resp, err := p.do(r, "DELETE", owner, keyPath(vars["ns"], vars["key"]), nil)
+	if err == nil && prev != "" {
+		// A key left on prev would be moved back over the delete
+		var old backendResponse
+		old, err = p.do(r, "DELETE", prev, keyPath(vars["ns"], vars["key"]), nil)
+		if err == nil && old.status != http.StatusNotFound {
+			err = old.check(prev)
+		}
+		if err == nil && resp.status == http.StatusNotFound {
+			resp = old
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	resp.write(w)
+}
+
+// handleBatch splits a batch by backend. Each backend applies its part
+// atomically, but the parts are applied independently of each other: when
+// one fails, the others may still be applied.
+func (p *proxy) handleBatch(w http.ResponseWriter, r *http.Request) {
+	var ops []batchRequestOp
+	if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	parts := make(map[string][]batchRequestOp)
+	for _, op := range ops {
+		if op.Op != "set" && op.Op != "del" {
+			http.Error(w, "Unknown op "+op.Op, http.StatusBadRequest)
+			return
+		}
+		owner, prev := p.owners(op.Key)
+		parts[owner] = append(parts[owner], op)
+		if prev != "" {
+			parts[prev] = append(parts[prev], batchRequestOp{Op: "del", NS: op.NS, Key: op.Key})
+		}
+	}
+
+	var (
+		mu     sync.Mutex
+		failed []string
+		wg     sync.WaitGroup
+	)
+	for backend, part := range parts {
+		wg.Add(1)
+		go func(backend string, part []batchRequestOp) {
+			defer wg.Done()
+			body, _ := json.Marshal(part)
+			resp, err := p.do(r, "POST", backend, "/v1/batch", body)
+			if err == nil {
+				err = resp.check(backend)
+			}
+			if err != nil {
+				mu.Lock()
+				failed = append(failed, err.Error())
+				mu.Unlock()
+			}
+		}(backend, part)
+	}
+	wg.Wait()
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		http.Error(w, strings.Join(failed, "\n"), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleStats returns the stats of every backend, by backend.
+func (p *proxy) handleStats(w http.ResponseWriter, r *http.Request) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	stats := make(map[string]json.RawMessage)
+	for _, backend := range p.ring.nodes {
+		resp, err := p.do(r, "GET", backend, "/v1/stats", nil)
+		if err == nil {
+			err = resp.check(backend)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		stats[backend] = resp.body
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// exportStream reads the JSON Lines export of a backend one record at a
+// time, keeping the next one.
+type exportStream struct {
+	backend string
+	body    io.ReadCloser
+	read    func() (exportRecord, error)
+	rec     exportRecord
+	key     string // decoded key of rec
+	done    bool
+}
+
+// openExport reads the export of a backend on behalf of the caller of from,
+// or of the proxy itself when from is nil.
+func (p *proxy) openExport(from *http.Request, backend string, query url.Values) (*exportStream, error) {
+	query.Set("format", "json")
+	req, err := http.NewRequest("GET", backend+"/admin/export?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	p.authorize(req, from)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s answered %s: %s", backend, resp.Status, strings.TrimSpace(string(body)))
+	}
+	read, _ := recordReader(resp.Body, "json")
+	s := &exportStream{backend: backend, body: resp.Body, read: read}
+	return s, s.next()
+}
+
+func (s *exportStream) next() error {
+	rec, err := s.read()
+	if err == io.EOF {
+		s.done = true
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", s.backend, err)
+	}
+	key, _, err := rec.decode()
+	if err != nil {
+		return fmt.Errorf("%s: %v", s.backend, err)
+	}
+	s.rec, s.key = rec, string(key)
+	return nil
+}
+
+// handleExport merges the exports of every backend in key order. A key
+// found on two backends while it moves is taken from its owner.
+func (p *proxy) handleExport(w http.ResponseWriter, r *http.Request) {
+	if format := r.URL.Query().Get("format"); format != "" && format != "json" {
+		http.Error(w, "the proxy only exports JSON Lines", http.StatusBadRequest)
+		return
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var streams []*exportStream
+	defer func() {
+		for _, s := range streams {
+			s.body.Close()
+		}
+	}()
+	for _, backend := range p.ring.nodes {
+		s, err := p.openExport(r, backend, r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		streams = append(streams, s)
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	for {
+		var key string
+		found := false
+		for _, s := range streams {
+			if !s.done && (!found || s.key < key) {
+				key, found = s.key, true
+			}
+		}
+		if !found {
+			return
+		}
+		var rec *exportRecord
+		owner, _ := p.owners(key)
+		for _, s := range streams {
+			if s.done || s.key != key {
+				continue
+			}
+			if rec == nil || s.backend == owner {
+				cur := s.rec
+				rec = &cur
+			}
+			if err := s.next(); err != nil {
+				p.logger.Error("proxy export failed", "err", err)
+				panic(http.ErrAbortHandler)
+			}
+		}
+		if err := enc.Encode(rec); err != nil {
+			return
+		}
+	}
+}
+
+// proxyNodes describes the backends, for GET /proxy/nodes.
+type proxyNodes struct {
+	Nodes     []string `json:"nodes"`
+	Migrating bool     `json:"migrating"`
+	Moved     int      `json:"moved"` // keys moved by the current or last migration
+}
+
+func (p *proxy) Nodes() proxyNodes {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return proxyNodes{Nodes: append([]string(nil), p.ring.nodes...), Migrating: p.prev != nil, Moved: p.moved}
+}
+
+func (p *proxy) handleNodes(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, p.Nodes())
+}
+
+func (p *proxy) handleAddNode(w http.ResponseWriter, r *http.Request) {
+	p.handleChange(w, r, p.AddNode)
+}
+
+func (p *proxy) handleRemoveNode(w http.ResponseWriter, r *http.Request) {
+	p.handleChange(w, r, p.RemoveNode)
+}
+
+func (p *proxy) handleChange(w http.ResponseWriter, r *http.Request, change func(string) error) {
+	addr := strings.TrimRight(r.URL.Query().Get("addr"), "/")
+	if addr == "" {
+		http.Error(w, "missing addr", http.StatusBadRequest)
+		return
+	}
+	if err := change(addr); err != nil {
+		status := http.StatusBadGateway
+		if errors.Is(err, errUnknownBackend) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	writeJSON(w, http.StatusOK, p.Nodes())
+}
+
+// AddNode adds a backend, then moves the keys it now owns from the other
+// backends to it. Requests are served meanwhile. If the migration fails,
+// calling AddNode again resumes it.
+func (p *proxy) AddNode(addr string) error {
+	p.changing.Lock()
+	defer p.changing.Unlock()
+
+	p.mu.Lock()
+	switch {
+	case !p.ring.has(addr):
+		p.prev, p.ring, p.moved = p.ring, p.ring.with(addr), 0
+	case p.prev == nil:
+		p.mu.Unlock()
+		return nil
+	}
+	sources := p.prev.nodes
+	p.mu.Unlock()
+
+	p.logger.Info("adding backend", "addr", addr)
+	return p.migrate(sources)
+}
+
+// RemoveNode moves the keys of a backend to the others, then removes it.
+// Requests are served meanwhile. If the migration fails, calling RemoveNode
+// again resumes it.
+func (p *proxy) RemoveNode(addr string) error {
+	p.changing.Lock()
+	defer p.changing.Unlock()
+
+	p.mu.Lock()
+	switch {
+	case p.ring.has(addr):
+		if len(p.ring.nodes) == 1 {
+			p.mu.Unlock()
+			return errors.New("cannot remove the last backend")
+		}
+		p.prev, p.ring, p.moved = p.ring, p.ring.without(addr), 0
+	case p.prev == nil || !p.prev.has(addr):
+		p.mu.Unlock()
+		return fmt.Errorf("%w %s", errUnknownBackend, addr)
+	}
+	p.mu.Unlock()
+
+	p.logger.Info("removing backend", "addr", addr)
+	return p.migrate([]string{addr})
+}
+
+// migrate moves the keys of sources that belong to another backend in the
+// new ring to it, then ends the migration.
+func (p *proxy) migrate(sources []string) error {
+	for _, src := range sources {
+		resp, err := p.do(nil, "GET", src, "/v1/ns", nil)
+		if err == nil {
+			err = resp.check(src)
+		}
+		if err != nil {
+			return err
+		}
+		var names []string
+		if err := json.Unmarshal(resp.body, &names); err != nil {
+			return fmt.Errorf("%s: %v", src, err)
+		}
+		for _, ns := range names {
+			if err := p.ensureNamespace(src, ns); err != nil {
+				return err
+			}
+			if err := p.migrateNamespace(src, ns); err != nil {
+				return err
+			}
+		}
+	}
+
+	p.mu.Lock()
+	p.prev = nil
+	moved := p.moved
+	p.mu.Unlock()
+	p.logger.Info("migration done", "moved", moved)
+	return nil
+}
+
+// ensureNamespace creates ns on every backend of the ring that misses it,
+// with the options it has on src.
+func (p *proxy) ensureNamespace(src, ns string) error {
+	resp, err := p.do(nil, "GET", src, "/v1/ns/"+url.PathEscape(ns), nil)
+	if err == nil {
+		err = resp.check(src)
+	}
+	if err != nil {
+		return err
+	}
+	p.mu.RLock()
+	nodes := p.ring.nodes
+	p.mu.RUnlock()
+	for _, backend := range nodes {
+		created, err := p.do(nil, "PUT", backend, "/v1/ns/"+url.PathEscape(ns), resp.body)
+		if err == nil && created.status != http.StatusConflict {
+			err = created.check(backend)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateNamespace finds the keys of ns on src that moved, and moves them
+// in chunks.
+func (p *proxy) migrateNamespace(src, ns string) error {
+	s, err := p.openExport(nil, src, url.Values{"ns": {ns}})
+	if err != nil {
+		return err
+	}
+	defer s.body.Close()
+
+	var chunk []string
+	for !s.done {
+		p.mu.RLock()
+		owner := p.ring.lookup(s.key)
+		p.mu.RUnlock()
+		if owner != src {
+			chunk = append(chunk, s.key)
+		}
+		if err := s.next(); err != nil {
+			return err
+		}
+		if len(chunk) == proxyMoveChunk || (s.done && len(chunk) > 0) {
+			if err := p.moveChunk(src, ns, chunk); err != nil {
+				return err
+			}
+			chunk = nil
+		}
+	}
+	return nil
+}
+
+// moveChunk moves keys, sorted, from src to their owners. Requests wait
+// meanwhile, so the keys are read again from src as they are now, and
+// none is written between being copied and being deleted from src.
+func (p *proxy) moveChunk(src, ns string, keys []string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s, err := p.openExport(nil, src, url.Values{"ns": {ns}, "start": {keys[0]}, "end": {keys[len(keys)-1] + "\x00"}})
+	if err != nil {
+		return err
+	}
+	defer s.body.Close()
+
+	wanted := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		wanted[key] = true
+	}
+	var (
+		parts = make(map[string]*bytes.Buffer)
+		moved []string
+	)
+	for !s.done {
+		if owner := p.ring.lookup(s.key); wanted[s.key] && owner != src {
+			if parts[owner] == nil {
+				parts[owner] = &bytes.Buffer{}
+			}
+			if err := json.NewEncoder(parts[owner]).Encode(s.rec); err != nil {
+				return err
+			}
+			moved = append(moved, s.key)
+		}
+		if err := s.next(); err != nil {
+			return err
+		}
+	}
+
+	for owner, part := range parts {
+		resp, err := p.do(nil, "POST", owner, "/admin/import?ns="+url.QueryEscape(ns), part.Bytes())
+		if err == nil {
+			err = resp.check(owner)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	var dels []batchRequestOp
+	for _, key := range moved {
+		if !utf8.ValidString(key) {
+			// JSON cannot carry it as is
+			resp, err := p.do(nil, "DELETE", src, keyPath(ns, key), nil)
+			if err == nil && resp.status != http.StatusNotFound {
+				err = resp.check(src)
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		dels = append(dels, batchRequestOp{Op: "del", NS: ns, Key: key})
+	}
+	if len(dels) > 0 {
+		body, _ := json.Marshal(dels)
+		resp, err := p.do(nil, "POST", src, "/v1/batch", body)
+		if err == nil {
+			err = resp.check(src)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	p.moved += len(moved)
+	p.logger.Debug("moved keys", "namespace", ns, "from", src, "keys", len(moved))
+	return nil
+}
+
+// runProxy serves the proxy in front of the backends.
+func runProxy(args []string) error {
+	fs := flag.NewFlagSet("proxy", flag.ExitOnError)
+	addr := fs.String("addr", ":8090", "address of the HTTP server")
+	backends := fs.String("backends", "", "comma separated base URLs of the store servers, e.g. http://host1:8080,http://host2:8080")
+	vnodes := fs.Int("vnodes", 128, "points of each backend on the hash ring")
+	backendToken := fs.String("backend-token", "", "token sent to backends started with -auth for migrations, of an identity with admin on every namespace")
+	logLevel := fs.String("log-level", "info", "level of the logs written to stderr: debug, info, warn or error")
+	var tf tlsFlags
+	tf.register(fs)
+	fs.Parse(args)
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		return err
+	}
+	if *backends == "" {
+		return errors.New("-backends is required")
+	}
+	var nodes []string
+	for _, backend := range strings.Split(*backends, ",") {
+		nodes = append(nodes, strings.TrimRight(backend, "/"))
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	certs, err := tf.load(logger)
+	if err != nil {
+		return err
+	}
+	if certs != nil {
+		certs.reloadOnSIGHUP()
+	}
+	clientConfig, err := tf.clientConfig(certs)
+	if err != nil {
+		return err
+	}
+	p := newProxy(nodes, *vnodes, clientConfig, logger)
+	p.token = *backendToken
+	r := mux.NewRouter()
+	p.register(r)
+	if err := certs.serveHTTP(*addr, r); err != nil {
+		return fmt.Errorf("error starting HTTP server: %s", err)
+	}
+	return nil
+}
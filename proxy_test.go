@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// TestMain runs kv serve instead of the tests when KV_TEST_SERVE holds its
+// flags, so tests can start store servers as separate processes.
+func TestMain(m *testing.M) {
+	if args := os.Getenv("KV_TEST_SERVE"); args != "" {
+		if err := runServe(strings.Fields(args)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// startServer runs kv serve on dir in a new process and returns its URL.
+func startServer(t *testing.T, dir string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error finding a free port: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), "KV_TEST_SERVE=-dir "+dir+" -addr "+addr+" -log-level error")
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Error starting server: %v", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	url := "http://" + addr
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		resp, err := http.Get(url + "/v1/ns")
+		if err == nil {
+			resp.Body.Close()
+			return url
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Server on %s did not start: %v", addr, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func request(t *testing.T, method, url, body string) (int, string) {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error requesting %s %s: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(data)
+}
+
+func TestHashRing(t *testing.T) {
+	r := newHashRing(128, "a", "b", "c")
+	counts := make(map[string]int)
+	owners := make(map[string]string)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		owners[key] = r.lookup(key)
+		counts[owners[key]]++
+	}
+	for _, node := range []string{"a", "b", "c"} {
+		if counts[node] < 700 || counts[node] > 1300 {
+			t.Errorf("Uneven spread: %v", counts)
+		}
+	}
+
+	// Only keys moving to the new node change owner
+	r2 := r.with("d")
+	for key, owner := range owners {
+		if got := r2.lookup(key); got != owner && got != "d" {
+			t.Fatalf("Key %s moved from %s to %s", key, owner, got)
+		}
+	}
+	if r2.without("d").lookup("key-1") != owners["key-1"] {
+		t.Errorf("Expected removing the node to restore the owners")
+	}
+}
+
+func TestProxy(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts store servers")
+	}
+	dir := t.TempDir()
+	var backends []string
+	for i := 0; i < 3; i++ {
+		backends = append(backends, startServer(t, filepath.Join(dir, fmt.Sprint("node", i))))
+	}
+	p := newProxy(backends[:2], 64, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	r := mux.NewRouter()
+	p.register(r)
+	url := serveLoopback(t, r)
+
+	if status, body := request(t, "PUT", url+"/v1/ns/users", `{"ttl_seconds": 3600}`); status != http.StatusCreated {
+		t.Fatalf("Error creating namespace: %d %s", status, body)
+	}
+	for i := 0; i < 200; i++ {
+		if status, body := request(t, "PUT", fmt.Sprintf("%s/v1/ns/users/keys/u%03d", url, i), fmt.Sprint("v", i)); status != http.StatusNoContent {
+			t.Fatalf("Error setting u%03d: %d %s", i, status, body)
+		}
+	}
+	batch := `[{"op":"set","ns":"users","key":"x","value":"1"},{"op":"set","ns":"users","key":"y","value":"2"},{"op":"del","ns":"users","key":"u000"}]`
+	if status, body := request(t, "POST", url+"/v1/batch", batch); status != http.StatusNoContent {
+		t.Fatalf("Error applying batch: %d %s", status, body)
+	}
+
+	check := func() {
+		t.Helper()
+		if status, _ := request(t, "GET", url+"/v1/ns/users/keys/u000", ""); status != http.StatusNotFound {
+			t.Errorf("Expected u000 to be deleted, got %d", status)
+		}
+		for i := 1; i < 200; i++ {
+			if status, body := request(t, "GET", fmt.Sprintf("%s/v1/ns/users/keys/u%03d", url, i), ""); status != http.StatusOK || body != fmt.Sprint("v", i) {
+				t.Fatalf("Expected u%03d=v%d, got %d %q", i, i, status, body)
+			}
+		}
+		status, body := request(t, "GET", url+"/admin/export?ns=users&start=u100&end=u110", "")
+		if lines := strings.Count(body, "\n"); status != http.StatusOK || lines != 10 || !strings.HasPrefix(body, `{"key":"u100"`) {
+			t.Errorf("Expected 10 merged keys from u100, got %d %q", status, body)
+		}
+	}
+	check()
+
+	// Keys are spread over both backends
+	for _, backend := range backends[:2] {
+		status, body := request(t, "GET", backend+"/admin/export?ns=users", "")
+		if n := strings.Count(body, "\n"); status != http.StatusOK || n < 50 {
+			t.Errorf("Expected %s to hold a share of the keys, got %d", backend, n)
+		}
+	}
+
+	if err := p.AddNode(backends[2]); err != nil {
+		t.Fatalf("Error adding backend: %v", err)
+	}
+	if nodes := p.Nodes(); len(nodes.Nodes) != 3 || nodes.Moved == 0 || nodes.Migrating {
+		t.Errorf("Unexpected nodes after adding one: %+v", nodes)
+	}
+	check()
+	status, body := request(t, "GET", backends[2]+"/v1/ns/users", "")
+	if status != http.StatusOK || !strings.Contains(body, `"ttl_seconds":3600`) {
+		t.Errorf("Expected the namespace options on the new backend, got %d %s", status, body)
+	}
+
+	if status, body := request(t, "DELETE", url+"/proxy/nodes?addr="+backends[0], ""); status != http.StatusOK {
+		t.Fatalf("Error removing backend: %d %s", status, body)
+	}
+	check()
+	if _, body := request(t, "GET", backends[0]+"/admin/export?ns=users", ""); body != "" {
+		t.Errorf("Expected the removed backend to hold no keys, got %q", body)
+	}
+}
+
+func TestProxyCredentials(t *testing.T) {
+	// Backends recording the credentials of every request
+	var (
+		mu  sync.Mutex
+		got []string
+	)
+	backend := func() string {
+		r := mux.NewRouter()
+		r.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			got = append(got, r.URL.Path+" "+r.Header.Get("Authorization")+r.Header.Get("X-API-Key"))
+			mu.Unlock()
+			if r.URL.Path == "/v1/ns" {
+				w.Write([]byte("[]"))
+			}
+		})
+		return serveLoopback(t, r)
+	}
+	first, second := backend(), backend()
+	p := newProxy([]string{first}, 64, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	p.token = "kv_proxy"
+	r := mux.NewRouter()
+	p.register(r)
+	url := serveLoopback(t, r)
+
+	req, _ := http.NewRequest("GET", url+"/v1/ns/default/keys/a", nil)
+	req.Header.Set("Authorization", "Bearer kv_alice")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error getting key: %v", err)
+	}
+	resp.Body.Close()
+	req, _ = http.NewRequest("GET", url+"/admin/export?ns=default", nil)
+	req.Header.Set("X-API-Key", "kv_bob")
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatalf("Error exporting: %v", err)
+	}
+	resp.Body.Close()
+	// Migrations are the proxy's own requests
+	if err := p.AddNode(second); err != nil {
+		t.Fatalf("Error adding backend: %v", err)
+	}
+
+	want := []string{
+		"/v1/ns/default/keys/a Bearer kv_alice",
+		"/admin/export kv_bob",
+		"/v1/ns Bearer kv_proxy",
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestProxyMigratingWriteFailures(t *testing.T) {
+	owner := mux.NewRouter()
+	owner.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "DELETE" {
+			http.Error(w, "Key not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	prev := mux.NewRouter()
+	prev.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "disk full", http.StatusInternalServerError)
+	})
+	p := newProxy([]string{serveLoopback(t, owner)}, 64, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	// Migrating from prev, where the key still is
+	p.prev = newHashRing(64, serveLoopback(t, prev))
+	r := mux.NewRouter()
+	p.register(r)
+	url := serveLoopback(t, r)
+
+	// Left on prev, the key would be moved back over the write
+	if status, body := request(t, "DELETE", url+"/v1/ns/default/keys/a", ""); status != http.StatusBadGateway || !strings.Contains(body, "disk full") {
+		t.Errorf("Expected the delete on the previous backend to fail, got %d %s", status, body)
+	}
+	if status, body := request(t, "PUT", url+"/v1/ns/default/keys/a", "x"); status != http.StatusBadGateway || !strings.Contains(body, "disk full") {
+		t.Errorf("Expected the set to fail with the previous backend, got %d %s", status, body)
+	}
+}
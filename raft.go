@@ -0,0 +1,1305 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A raftNode replicates the writes of a store to a cluster of stores with
+// the Raft consensus algorithm: writes are proposed to the leader, appended
+// to its log, and applied to every store in log order once a majority of the
+// voters logged them. Each applied batch gets its log index as sequence
+// number, so the sequence number of a store tells which entries it already
+// holds.
+//
+// Membership changes add or remove one voter at a time, and take effect as
+// soon as they are logged. The log is compacted by taking a checkpoint of
+// the store, which is also what a node too far behind is sent.
+
+// Kinds of log entries.
+const (
+	raftEntryCommand byte = iota + 1 // a raftCommand for the store
+	raftEntryConfig                  // the new list of voters, as JSON
+	raftEntryNoop                    // appended by a new leader to commit earlier entries
+)
+
+type raftState int
+
+const (
+	raftFollower raftState = iota
+	raftCandidate
+	raftLeader
+)
+
+func (st raftState) String() string {
+	switch st {
+	case raftCandidate:
+		return "candidate"
+	case raftLeader:
+		return "leader"
+	}
+	return "follower"
+}
+
+var (
+	errNotLeader       = errors.New("not the raft leader")
+	errTxnConflict     = errors.New("transaction conflict, the keys it read changed")
+	errProposalTimeout = errors.New("proposal timed out")
+	errConfigChange    = errors.New("a membership change is already in progress")
+	errRaftStopped     = errors.New("raft node stopped")
+)
+
+type raftEntry struct {
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+	Kind  byte   `json:"kind"`
+	Data  []byte `json:"data,omitempty"`
+}
+
+// raftCommand is a write to the store: a batch, the creation or the drop of
+// a namespace. Transactions also carry the keys they read, which must not
+// have changed when the batch is applied, and the time keys expire against.
+type raftCommand struct {
+	Batch           []byte     `json:"batch,omitempty"`
+	Reads           []txnRead  `json:"reads,omitempty"`
+	ReadNamespace   string     `json:"read_namespace,omitempty"`
+	Now             int64      `json:"now,omitempty"`
+	CreateNamespace string     `json:"create_namespace,omitempty"`
+	Options         *nsOptions `json:"options,omitempty"`
+	DropNamespace   string     `json:"drop_namespace,omitempty"`
+}
+
+// RPCs between nodes.
+type (
+	voteRequest struct {
+		Term         uint64 `json:"term"`
+		Candidate    string `json:"candidate"`
+		LastLogIndex uint64 `json:"last_log_index"`
+		LastLogTerm  uint64 `json:"last_log_term"`
+	}
+	voteResponse struct {
+		Term    uint64 `json:"term"`
+		Granted bool   `json:"granted"`
+	}
+	appendRequest struct {
+		Term         uint64      `json:"term"`
+		Leader       string      `json:"leader"`
+		PrevLogIndex uint64      `json:"prev_log_index"`
+		PrevLogTerm  uint64      `json:"prev_log_term"`
+		Entries      []raftEntry `json:"entries,omitempty"`
+		LeaderCommit uint64      `json:"leader_commit"`
+	}
+	appendResponse struct {
+		Term    uint64 `json:"term"`
+		Success bool   `json:"success"`
+		// LastIndex is the last index of the follower's log on failure, so
+		// the leader can skip back faster
+		LastIndex uint64 `json:"last_index"`
+	}
+	snapshotRequest struct {
+		Term      uint64   `json:"term"`
+		Leader    string   `json:"leader"`
+		LastIndex uint64   `json:"last_index"`
+		LastTerm  uint64   `json:"last_term"`
+		Peers     []string `json:"peers"`
+		Data      []byte   `json:"data"` // the checkpoint, as a tar file
+	}
+	snapshotResponse struct {
+		Term    uint64 `json:"term"`
+		Success bool   `json:"success"`
+	}
+)
+
+// raftTransport carries RPCs to the other nodes, named by their ID.
+type raftTransport interface {
+	RequestVote(peer string, req voteRequest) (voteResponse, error)
+	AppendEntries(peer string, req appendRequest) (appendResponse, error)
+	InstallSnapshot(peer string, req snapshotRequest) (snapshotResponse, error)
+}
+
+// raftConfig holds the timings of a node. Elections start after
+// ElectionTimeout to twice that without hearing from a leader.
+type raftConfig struct {
+	HeartbeatInterval time.Duration
+	ElectionTimeout   time.Duration
+	ProposalTimeout   time.Duration
+	// SnapshotEntries is the number of applied entries above which the log
+	// is compacted.
+	SnapshotEntries  int
+	MaxAppendEntries int
+}
+
+func defaultRaftConfig() raftConfig {
+	return raftConfig{
+		HeartbeatInterval: 100 * time.Millisecond,
+		ElectionTimeout:   time.Second,
+		ProposalTimeout:   5 * time.Second,
+		SnapshotEntries:   10000,
+		MaxAppendEntries:  256,
+	}
+}
+
+// raftSnapshotMeta describes the snapshot in the raft directory, the
+// checkpoint of the store after the entry Index.
+type raftSnapshotMeta struct {
+	Index uint64   `json:"index"`
+	Term  uint64   `json:"term"`
+	Peers []string `json:"peers"`
+}
+
+type raftWaiter struct {
+	term uint64
+	ch   chan error
+}
+
+type raftNode struct {
+	mu        sync.Mutex
+	id        string
+	s         *store
+	opts      storeOptions
+	dir       string
+	transport raftTransport
+	config    raftConfig
+	logger    *slog.Logger
+
+	// Persisted in dir
+	term     uint64
+	votedFor string
+	log      []raftEntry // entries after the snapshot
+	snap     raftSnapshotMeta
+	logFile  *os.File
+
+	peers       []string // voters, from the latest config entry
+	state       raftState
+	leader      string
+	commitIndex uint64
+	lastApplied uint64
+	nextIndex   map[string]uint64
+	matchIndex  map[string]uint64
+	inflight    map[string]bool
+	heardAt     time.Time // of the last message from a leader, or vote granted
+	timeout     time.Duration
+	waiters     map[uint64]raftWaiter
+
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+// startRaft makes s a node of a raft cluster, keeping the raft state in dir.
+// peers, the IDs of the voters including id, are only used the first time
+// dir is used; a node joining an existing cluster starts with none, and is
+// added by the leader. opts are used to reopen the store when it is replaced
+// by a snapshot.
+func startRaft(s *store, opts storeOptions, id, dir string, peers []string, transport raftTransport, config raftConfig) (*raftNode, error) {
+	n := &raftNode{
+		id:        id,
+		s:         s,
+		opts:      opts,
+		dir:       dir,
+		transport: transport,
+		config:    config,
+		logger:    s.logger.With("raft", id),
+		inflight:  make(map[string]bool),
+		waiters:   make(map[uint64]raftWaiter),
+		stop:      make(chan struct{}),
+	}
+	if err := n.load(peers); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	if s.seq > n.lastIndex() {
+		s.mu.Unlock()
+		n.logFile.Close()
+		return nil, fmt.Errorf("the store holds writes up to %d, past the raft log, raft nodes start from empty data directories", s.seq)
+	}
+	// Entries up to the sequence number of the store are in it already
+	n.lastApplied = n.snap.Index
+	if s.seq > n.lastApplied {
+		n.lastApplied = s.seq
+	}
+	s.readOnly = true
+	s.raft = n
+	s.mu.Unlock()
+	n.commitIndex = n.lastApplied
+
+	n.heardAt = time.Now()
+	n.timeout = n.randomTimeout()
+	n.done.Add(1)
+	go n.run()
+	return n, nil
+}
+
+// Stop stops the node. Its store stays read-only.
+func (n *raftNode) Stop() {
+	close(n.stop)
+	n.done.Wait()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for index, w := range n.waiters {
+		w.ch <- errRaftStopped
+		delete(n.waiters, index)
+	}
+	n.logFile.Close()
+}
+
+func (n *raftNode) randomTimeout() time.Duration {
+	return n.config.ElectionTimeout + time.Duration(rand.Int63n(int64(n.config.ElectionTimeout)))
+}
+
+func (n *raftNode) run() {
+	defer n.done.Done()
+	ticker := time.NewTicker(n.config.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+		}
+
+		n.mu.Lock()
+		switch {
+		case n.state == raftLeader:
+			n.broadcastLocked()
+		case time.Since(n.heardAt) > n.timeout && n.isVoterLocked(n.id):
+			n.startElectionLocked()
+		}
+		n.mu.Unlock()
+	}
+}
+
+func (n *raftNode) isVoterLocked(id string) bool {
+	for _, p := range n.peers {
+		if p == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *raftNode) quorum() int {
+	return len(n.peers)/2 + 1
+}
+
+func (n *raftNode) lastIndex() uint64 {
+	if len(n.log) == 0 {
+		return n.snap.Index
+	}
+	return n.log[len(n.log)-1].Index
+}
+
+func (n *raftNode) lastTerm() uint64 {
+	if len(n.log) == 0 {
+		return n.snap.Term
+	}
+	return n.log[len(n.log)-1].Term
+}
+
+// entry returns the entry at index, which must be after the snapshot.
+func (n *raftNode) entry(index uint64) raftEntry {
+	return n.log[index-n.snap.Index-1]
+}
+
+// termAt returns the term of the entry at index, 0 if it is not known.
+func (n *raftNode) termAt(index uint64) uint64 {
+	switch {
+	case index == n.snap.Index:
+		return n.snap.Term
+	case index < n.snap.Index || index > n.lastIndex():
+		return 0
+	}
+	return n.entry(index).Term
+}
+
+// configAt returns the voters as of index.
+func (n *raftNode) configAt(index uint64) []string {
+	for i := len(n.log) - 1; i >= 0; i-- {
+		e := n.log[i]
+		if e.Index <= index && e.Kind == raftEntryConfig {
+			var peers []string
+			json.Unmarshal(e.Data, &peers)
+			return peers
+		}
+	}
+	return n.snap.Peers
+}
+
+// setStateLocked moves to term, having voted for votedFor in it. Nothing
+// changes unless that is persisted first, so a restart cannot forget a
+// term or a vote the node acted on.
+func (n *raftNode) setStateLocked(term uint64, votedFor string) error {
+	prevTerm, prevVotedFor := n.term, n.votedFor
+	n.term, n.votedFor = term, votedFor
+	if err := n.persistStateLocked(); err != nil {
+		n.term, n.votedFor = prevTerm, prevVotedFor
+		return err
+	}
+	return nil
+}
+
+// stepDownLocked moves to term as a follower. It fails, changing nothing,
+// when the new term cannot be persisted.
+func (n *raftNode) stepDownLocked(term uint64) error {
+	if term > n.term {
+		if err := n.setStateLocked(term, ""); err != nil {
+			return err
+		}
+	}
+	if n.state != raftFollower {
+		n.logger.Info("stepping down", "term", n.term)
+	}
+	n.state = raftFollower
+	n.heardAt = time.Now()
+	return nil
+}
+
+func (n *raftNode) startElectionLocked() {
+	n.heardAt = time.Now()
+	n.timeout = n.randomTimeout()
+	if err := n.setStateLocked(n.term+1, n.id); err != nil {
+		return
+	}
+	n.state = raftCandidate
+	n.leader = ""
+	n.logger.Info("starting election", "term", n.term)
+
+	term := n.term
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeaderLocked()
+		return
+	}
+	req := voteRequest{Term: term, Candidate: n.id, LastLogIndex: n.lastIndex(), LastLogTerm: n.lastTerm()}
+	for _, peer := range n.peers {
+		if peer == n.id {
+			continue
+		}
+		go func(peer string) {
+			resp, err := n.transport.RequestVote(peer, req)
+			if err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if resp.Term > n.term {
+				n.stepDownLocked(resp.Term)
+				return
+			}
+			if n.state != raftCandidate || n.term != term || !resp.Granted {
+				return
+			}
+			votes++
+			if votes >= n.quorum() {
+				n.becomeLeaderLocked()
+			}
+		}(peer)
+	}
+}
+
+func (n *raftNode) becomeLeaderLocked() {
+	n.state = raftLeader
+	n.leader = n.id
+	n.nextIndex = make(map[string]uint64)
+	n.matchIndex = make(map[string]uint64)
+	for _, peer := range n.peers {
+		n.nextIndex[peer] = n.lastIndex() + 1
+	}
+	n.logger.Info("became leader", "term", n.term)
+	// Entries of earlier terms only commit along with one of this term
+	n.appendLocked(raftEntry{Kind: raftEntryNoop})
+	n.broadcastLocked()
+}
+
+// appendLocked adds an entry of the current term to the leader's log and
+// returns its index.
+func (n *raftNode) appendLocked(e raftEntry) (uint64, error) {
+	e.Term = n.term
+	e.Index = n.lastIndex() + 1
+	if err := n.persistEntriesLocked([]raftEntry{e}); err != nil {
+		return 0, err
+	}
+	n.log = append(n.log, e)
+	if e.Kind == raftEntryConfig {
+		n.peers = n.configAt(e.Index)
+		for _, peer := range n.peers {
+			if _, ok := n.nextIndex[peer]; !ok {
+				n.nextIndex[peer] = e.Index
+			}
+		}
+	}
+	n.matchIndex[n.id] = e.Index
+	n.advanceCommitLocked()
+	return e.Index, nil
+}
+
+func (n *raftNode) broadcastLocked() {
+	for _, peer := range n.peers {
+		if peer != n.id && !n.inflight[peer] {
+			n.inflight[peer] = true
+			go n.replicate(peer)
+		}
+	}
+}
+
+// replicate sends peer the entries it misses, or the snapshot if they were
+// compacted away, until it is up to date.
+func (n *raftNode) replicate(peer string) {
+	n.mu.Lock()
+	defer func() {
+		n.inflight[peer] = false
+		n.mu.Unlock()
+	}()
+
+	for n.state == raftLeader {
+		term := n.term
+		next := n.nextIndex[peer]
+		if next == 0 {
+			next = 1
+		}
+		if next <= n.snap.Index {
+			req, err := n.snapshotRequestLocked()
+			if err != nil {
+				n.logger.Error("reading snapshot failed", "err", err)
+				return
+			}
+			n.mu.Unlock()
+			resp, err := n.transport.InstallSnapshot(peer, req)
+			n.mu.Lock()
+			if err != nil {
+				return
+			}
+			if resp.Term > n.term {
+				n.stepDownLocked(resp.Term)
+				return
+			}
+			// A follower that failed to install it gets it again on
+			// the next heartbeat
+			if n.state != raftLeader || n.term != term || !resp.Success {
+				return
+			}
+			n.matchIndex[peer] = req.LastIndex
+			n.nextIndex[peer] = req.LastIndex + 1
+			continue
+		}
+
+		prev := next - 1
+		req := appendRequest{
+			Term:         term,
+			Leader:       n.id,
+			PrevLogIndex: prev,
+			PrevLogTerm:  n.termAt(prev),
+			LeaderCommit: n.commitIndex,
+		}
+		for i := next; i <= n.lastIndex() && len(req.Entries) < n.config.MaxAppendEntries; i++ {
+			req.Entries = append(req.Entries, n.entry(i))
+		}
+		n.mu.Unlock()
+		resp, err := n.transport.AppendEntries(peer, req)
+		n.mu.Lock()
+		if err != nil {
+			return
+		}
+		if resp.Term > n.term {
+			n.stepDownLocked(resp.Term)
+			return
+		}
+		if n.state != raftLeader || n.term != term {
+			return
+		}
+		if !resp.Success {
+			next := prev
+			if resp.LastIndex+1 < next {
+				next = resp.LastIndex + 1
+			}
+			n.nextIndex[peer] = next
+			continue
+		}
+		match := prev + uint64(len(req.Entries))
+		if match > n.matchIndex[peer] {
+			n.matchIndex[peer] = match
+		}
+		n.nextIndex[peer] = match + 1
+		n.advanceCommitLocked()
+		if match >= n.lastIndex() {
+			return
+		}
+	}
+}
+
+// advanceCommitLocked commits the entries of the current term a quorum of
+// voters logged, with those before them, and applies them.
+func (n *raftNode) advanceCommitLocked() {
+	for index := n.lastIndex(); index > n.commitIndex && index > n.snap.Index; index-- {
+		if n.entry(index).Term != n.term {
+			break
+		}
+		count := 0
+		for _, peer := range n.peers {
+			if n.matchIndex[peer] >= index {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.commitIndex = index
+			break
+		}
+	}
+	n.applyLocked()
+
+	// A leader that removed itself steps down once the change is committed
+	if n.state == raftLeader && !n.isVoterLocked(n.id) && n.commitIndex >= n.lastConfigIndexLocked() {
+		n.logger.Info("removed from the cluster, stepping down")
+		n.state = raftFollower
+		n.leader = ""
+	}
+}
+
+func (n *raftNode) lastConfigIndexLocked() uint64 {
+	for i := len(n.log) - 1; i >= 0; i-- {
+		if n.log[i].Kind == raftEntryConfig {
+			return n.log[i].Index
+		}
+	}
+	return n.snap.Index
+}
+
+// applyLocked applies the committed entries to the store, and compacts the
+// log once enough of them were.
+func (n *raftNode) applyLocked() {
+	for n.lastApplied < n.commitIndex {
+		e := n.entry(n.lastApplied + 1)
+		var err error
+		if e.Kind == raftEntryCommand {
+			err = n.applyCommand(e)
+		}
+		n.lastApplied = e.Index
+		if w, ok := n.waiters[e.Index]; ok {
+			if w.term != e.Term {
+				err = errNotLeader
+			}
+			w.ch <- err
+			delete(n.waiters, e.Index)
+		}
+	}
+
+	if int(n.lastApplied-n.snap.Index) > n.config.SnapshotEntries {
+		if err := n.snapshotLocked(); err != nil {
+			n.logger.Error("compacting the raft log failed", "err", err)
+		}
+	}
+}
+
+// applyCommand applies a command to the store. Whether it fails only
+// depends on the store, so it fails the same way on every node.
+func (n *raftNode) applyCommand(e raftEntry) error {
+	var cmd raftCommand
+	if err := json.Unmarshal(e.Data, &cmd); err != nil {
+		return err
+	}
+
+	s := n.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case cmd.CreateNamespace != "":
+		if _, ok := s.namespaces[cmd.CreateNamespace]; ok {
+			// Entries are applied again after a restart
+			if e.Index <= s.seq {
+				return nil
+			}
+			return errNamespaceExists
+		}
+		_, err := s.createNamespaceLocked(cmd.CreateNamespace, *cmd.Options)
+		return err
+
+	case cmd.DropNamespace != "":
+		if e.Index <= s.seq {
+			return nil
+		}
+		if _, ok := s.namespaces[cmd.DropNamespace]; !ok {
+			return errNamespaceNotFound
+		}
+		s.seq = e.Index
+		return s.dropNamespaceLocked(cmd.DropNamespace, e.Index)
+	}
+
+	if e.Index <= s.seq {
+		return nil
+	}
+	b, err := decodeBatch(cmd.Batch)
+	if err != nil {
+		return err
+	}
+	for _, op := range b.ops {
+		if _, ok := s.namespaces[op.ns]; !ok {
+			return fmt.Errorf("%s: %w", op.ns, errNamespaceNotFound)
+		}
+	}
+	if len(cmd.Reads) > 0 {
+		mem, ok := s.namespaces[cmd.ReadNamespace]
+		if !ok {
+			return fmt.Errorf("%s: %w", cmd.ReadNamespace, errNamespaceNotFound)
+		}
+		for _, read := range cmd.Reads {
+			entry, found, err := mem.lookupAt(read.Key, cmd.Now)
+			if err != nil {
+				return err
+			}
+			if found != read.Found || (found && entry.seq != read.Seq) {
+				return errTxnConflict
+			}
+		}
+	}
+	b.seq = e.Index
+	s.seq = e.Index
+	return s.commitLocked(b)
+}
+
+// propose appends a command to the log of the leader and waits until it is
+// applied, returning the error applying it returned.
+func (n *raftNode) propose(cmd raftCommand) error {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	return n.proposeEntry(raftEntry{Kind: raftEntryCommand, Data: data})
+}
+
+func (n *raftNode) proposeEntry(e raftEntry) error {
+	n.mu.Lock()
+	if n.state != raftLeader {
+		leader := n.leader
+		n.mu.Unlock()
+		if leader == "" {
+			return fmt.Errorf("%w, no leader is known", errNotLeader)
+		}
+		return fmt.Errorf("%w, the leader is %s", errNotLeader, leader)
+	}
+	if e.Kind == raftEntryConfig && n.lastConfigIndexLocked() > n.commitIndex {
+		n.mu.Unlock()
+		return errConfigChange
+	}
+	ch := make(chan error, 1)
+	n.waiters[n.lastIndex()+1] = raftWaiter{term: n.term, ch: ch}
+	index, err := n.appendLocked(e)
+	if err != nil {
+		delete(n.waiters, n.lastIndex()+1)
+		n.mu.Unlock()
+		return err
+	}
+	n.broadcastLocked()
+	n.mu.Unlock()
+
+	select {
+	case err := <-ch:
+		return err
+	case <-time.After(n.config.ProposalTimeout):
+		n.mu.Lock()
+		delete(n.waiters, index)
+		n.mu.Unlock()
+		return errProposalTimeout
+	case <-n.stop:
+		return errRaftStopped
+	}
+}
+
+// proposeBatch proposes a batch, with the expiry of its keys set by the
+// leader so every node applies the same.
+func (n *raftNode) proposeBatch(b *writeBatch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+	n.s.mu.RLock()
+	err := n.s.prepareLocked(b)
+	n.s.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	return n.propose(raftCommand{Batch: b.encode()})
+}
+
+// update runs a transaction: fn runs against the local store, then its
+// writes are proposed along with the keys it read, and only applied if
+// none of them changed in between. Otherwise it fails with errTxnConflict.
+func (n *raftNode) update(mem *memDB, fn func(tx *memTxn) error) error {
+	s := n.s
+	s.mu.RLock()
+	tx := &memTxn{mem: mem, now: time.Now().UnixNano()}
+	err := fn(tx)
+	if err == nil {
+		err = s.prepareLocked(&tx.batch)
+	}
+	s.mu.RUnlock()
+	if err != nil || tx.batch.Len() == 0 {
+		return err
+	}
+	return n.propose(raftCommand{Batch: tx.batch.encode(), Reads: tx.reads, ReadNamespace: mem.name, Now: tx.now})
+}
+
+// AddPeer adds a voter to the cluster. Its node should be started with no
+// peers; the leader then sends it the snapshot and the log.
+func (n *raftNode) AddPeer(id string) error {
+	n.mu.Lock()
+	peers := append([]string(nil), n.peers...)
+	n.mu.Unlock()
+	for _, p := range peers {
+		if p == id {
+			return nil
+		}
+	}
+	return n.proposeConfig(append(peers, id))
+}
+
+// RemovePeer removes a voter from the cluster. A leader removing itself
+// steps down once the change is committed.
+func (n *raftNode) RemovePeer(id string) error {
+	n.mu.Lock()
+	var peers []string
+	for _, p := range n.peers {
+		if p != id {
+			peers = append(peers, p)
+		}
+	}
+	n.mu.Unlock()
+	return n.proposeConfig(peers)
+}
+
+func (n *raftNode) proposeConfig(peers []string) error {
+	if len(peers) == 0 {
+		return errors.New("a cluster needs at least one voter")
+	}
+	sort.Strings(peers)
+	data, err := json.Marshal(peers)
+	if err != nil {
+		return err
+	}
+	return n.proposeEntry(raftEntry{Kind: raftEntryConfig, Data: data})
+}
+
+func (n *raftNode) handleVote(req voteRequest) voteResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if req.Term > n.term {
+		// Only a granted vote holds our own election back, or a candidate
+		// whose log is behind could keep the others from ever starting one
+		heardAt := n.heardAt
+		err := n.stepDownLocked(req.Term)
+		n.heardAt = heardAt
+		if err != nil {
+			return voteResponse{Term: n.term}
+		}
+	}
+	resp := voteResponse{Term: n.term}
+	if req.Term < n.term {
+		return resp
+	}
+	upToDate := req.LastLogTerm > n.lastTerm() || (req.LastLogTerm == n.lastTerm() && req.LastLogIndex >= n.lastIndex())
+	if (n.votedFor == "" || n.votedFor == req.Candidate) && upToDate {
+		if err := n.setStateLocked(n.term, req.Candidate); err != nil {
+			return resp
+		}
+		n.heardAt = time.Now()
+		resp.Granted = true
+	}
+	return resp
+}
+
+func (n *raftNode) handleAppend(req appendRequest) appendResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if req.Term < n.term {
+		return appendResponse{Term: n.term}
+	}
+	if req.Term > n.term || n.state != raftFollower {
+		if err := n.stepDownLocked(req.Term); err != nil {
+			return appendResponse{Term: n.term, LastIndex: n.lastIndex()}
+		}
+	}
+	n.leader = req.Leader
+	n.heardAt = time.Now()
+
+	fail := appendResponse{Term: n.term, LastIndex: n.lastIndex()}
+	if req.PrevLogIndex > n.lastIndex() {
+		return fail
+	}
+	if req.PrevLogIndex > n.snap.Index && n.termAt(req.PrevLogIndex) != req.PrevLogTerm {
+		fail.LastIndex = req.PrevLogIndex - 1
+		return fail
+	}
+
+	var added []raftEntry
+	for i, e := range req.Entries {
+		if e.Index <= n.snap.Index {
+			continue
+		}
+		if e.Index <= n.lastIndex() {
+			if n.termAt(e.Index) == e.Term {
+				continue
+			}
+			// A conflicting entry and everything after it go
+			n.truncateLocked(e.Index)
+		}
+		added = req.Entries[i:]
+		break
+	}
+	if len(added) > 0 {
+		if err := n.persistEntriesLocked(added); err != nil {
+			n.logger.Error("persisting raft log failed", "err", err)
+			return fail
+		}
+		n.log = append(n.log, added...)
+		n.peers = n.configAt(n.lastIndex())
+	}
+
+	if req.LeaderCommit > n.commitIndex {
+		// Only what this request vouches for, and never lowered: a late
+		// heartbeat can carry an older PrevLogIndex
+		last := req.PrevLogIndex + uint64(len(req.Entries))
+		n.commitIndex = max(n.commitIndex, min(req.LeaderCommit, last))
+		n.applyLocked()
+	}
+	return appendResponse{Term: n.term, Success: true}
+}
+
+// truncateLocked drops the entries from index on, failing the proposals
+// waiting for them.
+func (n *raftNode) truncateLocked(index uint64) {
+	for i := index; i <= n.lastIndex(); i++ {
+		if w, ok := n.waiters[i]; ok {
+			w.ch <- errNotLeader
+			delete(n.waiters, i)
+		}
+	}
+	n.log = n.log[:index-n.snap.Index-1]
+	if err := n.rewriteLogLocked(); err != nil {
+		n.logger.Error("rewriting raft log failed", "err", err)
+	}
+	n.peers = n.configAt(n.lastIndex())
+}
+
+func (n *raftNode) handleSnapshot(req snapshotRequest) snapshotResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if req.Term < n.term {
+		return snapshotResponse{Term: n.term}
+	}
+	if req.Term > n.term || n.state != raftFollower {
+		if err := n.stepDownLocked(req.Term); err != nil {
+			return snapshotResponse{Term: n.term}
+		}
+	}
+	n.leader = req.Leader
+	n.heardAt = time.Now()
+	if req.LastIndex <= n.lastApplied {
+		return snapshotResponse{Term: n.term, Success: true}
+	}
+
+	if err := n.installSnapshotLocked(req); err != nil {
+		n.logger.Error("installing snapshot failed", "err", err)
+		return snapshotResponse{Term: n.term}
+	}
+	return snapshotResponse{Term: n.term, Success: true}
+}
+
+// installSnapshotLocked replaces the store with the leader's snapshot, and
+// keeps it as the snapshot of this node too, once the store was restored
+// from it; until then the previous snapshot stays.
+func (n *raftNode) installSnapshotLocked(req snapshotRequest) error {
+	tmp := filepath.Join(n.dir, "snapshot.tmp")
+	os.RemoveAll(tmp)
+	if err := extractTar(bytes.NewReader(req.Data), tmp); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	restore := n.s.dir + ".restore"
+	os.RemoveAll(restore)
+	if err := copyDir(tmp, restore); err != nil {
+		os.RemoveAll(tmp)
+		os.RemoveAll(restore)
+		return err
+	}
+	if err := n.s.restoreFrom(restore, n.opts); err != nil {
+		os.RemoveAll(tmp)
+		os.RemoveAll(restore)
+		return err
+	}
+	snapDir := filepath.Join(n.dir, "snapshot")
+	os.RemoveAll(snapDir)
+	if err := os.Rename(tmp, snapDir); err != nil {
+		return err
+	}
+
+	// Keep the entries after the snapshot if they match it
+	if n.termAt(req.LastIndex) == req.LastTerm && req.LastIndex < n.lastIndex() {
+		n.log = append([]raftEntry(nil), n.log[req.LastIndex-n.snap.Index:]...)
+	} else {
+		n.log = nil
+	}
+	n.snap = raftSnapshotMeta{Index: req.LastIndex, Term: req.LastTerm, Peers: req.Peers}
+	if err := n.persistSnapshotMetaLocked(); err != nil {
+		return err
+	}
+	if err := n.rewriteLogLocked(); err != nil {
+		return err
+	}
+	n.peers = n.configAt(n.lastIndex())
+	n.lastApplied = req.LastIndex
+	if n.commitIndex < req.LastIndex {
+		n.commitIndex = req.LastIndex
+	}
+	n.logger.Info("installed snapshot", "index", req.LastIndex, "term", req.LastTerm)
+	return nil
+}
+
+// snapshotLocked compacts the log: it takes a checkpoint of the store,
+// which holds every entry applied, and drops those entries.
+func (n *raftNode) snapshotLocked() error {
+	tmp := filepath.Join(n.dir, "snapshot.tmp")
+	os.RemoveAll(tmp)
+	if err := n.s.Checkpoint(tmp); err != nil {
+		return err
+	}
+	snapDir := filepath.Join(n.dir, "snapshot")
+	os.RemoveAll(snapDir)
+	if err := os.Rename(tmp, snapDir); err != nil {
+		return err
+	}
+
+	index := n.lastApplied
+	meta := raftSnapshotMeta{Index: index, Term: n.termAt(index), Peers: n.configAt(index)}
+	n.log = append([]raftEntry(nil), n.log[index-n.snap.Index:]...)
+	n.snap = meta
+	if err := n.persistSnapshotMetaLocked(); err != nil {
+		return err
+	}
+	n.logger.Debug("compacted raft log", "index", index)
+	return n.rewriteLogLocked()
+}
+
+func (n *raftNode) snapshotRequestLocked() (snapshotRequest, error) {
+	var buf bytes.Buffer
+	if err := writeTar(&buf, filepath.Join(n.dir, "snapshot")); err != nil {
+		return snapshotRequest{}, err
+	}
+	return snapshotRequest{
+		Term:      n.term,
+		Leader:    n.id,
+		LastIndex: n.snap.Index,
+		LastTerm:  n.snap.Term,
+		Peers:     n.snap.Peers,
+		Data:      buf.Bytes(),
+	}, nil
+}
+
+// raftStatus describes a node, for GET /raft/status.
+type raftStatus struct {
+	ID            string   `json:"id"`
+	State         string   `json:"state"`
+	Term          uint64   `json:"term"`
+	Leader        string   `json:"leader"`
+	Peers         []string `json:"peers"`
+	LastIndex     uint64   `json:"last_index"`
+	CommitIndex   uint64   `json:"commit_index"`
+	LastApplied   uint64   `json:"last_applied"`
+	SnapshotIndex uint64   `json:"snapshot_index"`
+}
+
+func (n *raftNode) Status() raftStatus {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return raftStatus{
+		ID:            n.id,
+		State:         n.state.String(),
+		Term:          n.term,
+		Leader:        n.leader,
+		Peers:         append([]string(nil), n.peers...),
+		LastIndex:     n.lastIndex(),
+		CommitIndex:   n.commitIndex,
+		LastApplied:   n.lastApplied,
+		SnapshotIndex: n.snap.Index,
+	}
+}
+
+// The raft directory holds
+//
+//	state.json     the current term and vote
+//	log.jsonl      the entries after the snapshot, one JSON object per line
+//	snapshot.json  the index, term and voters of the snapshot
+//	snapshot/      the checkpoint of the store at that index
+type raftPersistentState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"voted_for"`
+}
+
+func (n *raftNode) load(peers []string) error {
+	if err := os.MkdirAll(n.dir, 0755); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(filepath.Join(n.dir, "snapshot.json"))
+	switch {
+	case os.IsNotExist(err):
+		// First start, the initial voters act as the snapshot of an empty log
+		n.snap = raftSnapshotMeta{Peers: append([]string(nil), peers...)}
+		sort.Strings(n.snap.Peers)
+		if err := n.persistSnapshotMetaLocked(); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	default:
+		if err := json.Unmarshal(data, &n.snap); err != nil {
+			return fmt.Errorf("snapshot.json: %v", err)
+		}
+	}
+
+	data, err = os.ReadFile(filepath.Join(n.dir, "state.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		var state raftPersistentState
+		if err := json.Unmarshal(data, &state); err != nil {
+			return fmt.Errorf("state.json: %v", err)
+		}
+		n.term, n.votedFor = state.Term, state.VotedFor
+	}
+
+	f, err := os.OpenFile(filepath.Join(n.dir, "log.jsonl"), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	n.logFile = f
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<30)
+	for scanner.Scan() {
+		var e raftEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// A torn write at the end of the log, from a crash
+			n.logger.Warn("dropping unreadable raft log tail", "after", n.lastIndex(), "err", err)
+			break
+		}
+		if e.Index != n.lastIndex()+1 {
+			continue
+		}
+		n.log = append(n.log, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	n.peers = n.configAt(n.lastIndex())
+	return n.rewriteLogLocked()
+}
+
+func (n *raftNode) persistStateLocked() error {
+	data, _ := json.Marshal(raftPersistentState{Term: n.term, VotedFor: n.votedFor})
+	if err := writeFileSync(filepath.Join(n.dir, "state.json"), data); err != nil {
+		n.logger.Error("persisting raft state failed", "err", err)
+		return err
+	}
+	return nil
+}
+
+func (n *raftNode) persistSnapshotMetaLocked() error {
+	data, err := json.Marshal(n.snap)
+	if err != nil {
+		return err
+	}
+	return writeFileSync(filepath.Join(n.dir, "snapshot.json"), data)
+}
+
+// persistEntriesLocked appends entries to the log file and syncs it.
+func (n *raftNode) persistEntriesLocked(entries []raftEntry) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	if _, err := n.logFile.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return n.logFile.Sync()
+}
+
+// rewriteLogLocked writes the log file anew with the entries in memory.
+func (n *raftNode) rewriteLogLocked() error {
+	path := filepath.Join(n.dir, "log.jsonl")
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range n.log {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	if err := writeFileSync(path, buf.Bytes()); err != nil {
+		return err
+	}
+	if n.logFile != nil {
+		n.logFile.Close()
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	n.logFile = f
+	return nil
+}
+
+// writeFileSync replaces the file at path with data, through a synced
+// temporary file.
+func writeFileSync(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// httpRaftTransport sends RPCs as JSON to the /raft routes of the other
+// nodes, whose IDs are their base URLs.
+type httpRaftTransport struct {
+	client *http.Client
+}
+
+// newHTTPRaftTransport returns a transport connecting to peers with
+// config, the default TLS configuration when nil.
+func newHTTPRaftTransport(config *tls.Config) *httpRaftTransport {
+	return &httpRaftTransport{client: httpClient(config, 10*time.Second)}
+}
+
+func (t *httpRaftTransport) call(peer, route string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	r, err := t.client.Post(peer+route, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(r.Body, 512))
+		return fmt.Errorf("%s answered %s: %s", peer, r.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(r.Body).Decode(resp)
+}
+
+func (t *httpRaftTransport) RequestVote(peer string, req voteRequest) (resp voteResponse, err error) {
+	err = t.call(peer, "/raft/vote", req, &resp)
+	return resp, err
+}
+
+func (t *httpRaftTransport) AppendEntries(peer string, req appendRequest) (resp appendResponse, err error) {
+	err = t.call(peer, "/raft/append", req, &resp)
+	return resp, err
+}
+
+func (t *httpRaftTransport) InstallSnapshot(peer string, req snapshotRequest) (resp snapshotResponse, err error) {
+	err = t.call(peer, "/raft/snapshot", req, &resp)
+	return resp, err
+}
+
+// register adds the routes other nodes and operators call.
+func (n *raftNode) register(r *mux.Router) {
+	r.HandleFunc("/raft/vote", raftHandler(n.handleVote)).Methods("POST")
+	r.HandleFunc("/raft/append", raftHandler(n.handleAppend)).Methods("POST")
+	r.HandleFunc("/raft/snapshot", raftHandler(n.handleSnapshot)).Methods("POST")
+	r.HandleFunc("/raft/status", n.handleStatus).Methods("GET")
+	r.HandleFunc("/raft/peers", n.handlePeers).Methods("POST", "DELETE")
+}
+
+func raftHandler[Req, Resp any](handle func(Req) Resp) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req Req
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, handle(req))
+	}
+}
+
+func (n *raftNode) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, n.Status())
+}
+
+// handlePeers adds (POST) or removes (DELETE) the voter given by the id
+// query parameter.
+func (n *raftNode) handlePeers(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "missing id", http.StatusBadRequest)
+		return
+	}
+	var err error
+	if r.Method == "POST" {
+		err = n.AddPeer(id)
+	} else {
+		err = n.RemovePeer(id)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, http.StatusOK, n.Status())
+}
+
+// redirectToLeader sends the requests that write, anything but GET and
+// HEAD, to the leader with a 307 so they are sent again with their body.
+// It answers 503 while no leader is known.
+func (n *raftNode) redirectToLeader(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "HEAD" || strings.HasPrefix(r.URL.Path, "/raft/") && r.URL.Path != "/raft/peers" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		n.mu.Lock()
+		state, leader := n.state, n.leader
+		n.mu.Unlock()
+		switch {
+		case state == raftLeader:
+			next.ServeHTTP(w, r)
+		case leader == "":
+			http.Error(w, "no raft leader is known, try again", http.StatusServiceUnavailable)
+		default:
+			http.Redirect(w, r, leader+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+		}
+	})
+}
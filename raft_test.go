@@ -0,0 +1,342 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memRaftNetwork connects raft nodes of the same process, and can cut them
+// off from each other.
+type memRaftNetwork struct {
+	mu    sync.Mutex
+	nodes map[string]*raftNode
+	cut   map[string]bool // nodes that can reach no other node
+}
+
+func newMemRaftNetwork() *memRaftNetwork {
+	return &memRaftNetwork{nodes: make(map[string]*raftNode), cut: make(map[string]bool)}
+}
+
+func (net *memRaftNetwork) node(from, to string) (*raftNode, error) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	n, ok := net.nodes[to]
+	if !ok || net.cut[from] || net.cut[to] {
+		return nil, fmt.Errorf("%s cannot reach %s", from, to)
+	}
+	return n, nil
+}
+
+func (net *memRaftNetwork) setCut(id string, cut bool) {
+	net.mu.Lock()
+	net.cut[id] = cut
+	net.mu.Unlock()
+}
+
+// transport returns the transport of the node id.
+func (net *memRaftNetwork) transport(id string) raftTransport {
+	return &memRaftTransport{net: net, from: id}
+}
+
+type memRaftTransport struct {
+	net  *memRaftNetwork
+	from string
+}
+
+func (t *memRaftTransport) RequestVote(peer string, req voteRequest) (voteResponse, error) {
+	n, err := t.net.node(t.from, peer)
+	if err != nil {
+		return voteResponse{}, err
+	}
+	return n.handleVote(req), nil
+}
+
+func (t *memRaftTransport) AppendEntries(peer string, req appendRequest) (appendResponse, error) {
+	n, err := t.net.node(t.from, peer)
+	if err != nil {
+		return appendResponse{}, err
+	}
+	return n.handleAppend(req), nil
+}
+
+func (t *memRaftTransport) InstallSnapshot(peer string, req snapshotRequest) (snapshotResponse, error) {
+	n, err := t.net.node(t.from, peer)
+	if err != nil {
+		return snapshotResponse{}, err
+	}
+	return n.handleSnapshot(req), nil
+}
+
+func testRaftConfig() raftConfig {
+	config := defaultRaftConfig()
+	config.HeartbeatInterval = 10 * time.Millisecond
+	config.ElectionTimeout = 100 * time.Millisecond
+	config.ProposalTimeout = time.Second
+	config.SnapshotEntries = 20
+	return config
+}
+
+// startTestRaft opens the store of id under dir and starts its node,
+// replacing a node of the same ID on the network.
+func startTestRaft(t *testing.T, net *memRaftNetwork, dir, id string, peers []string) *raftNode {
+	t.Helper()
+	s, err := openStore(filepath.Join(dir, id))
+	if err != nil {
+		t.Fatalf("Error opening store of %s: %v", id, err)
+	}
+	n, err := startRaft(s, defaultStoreOptions(), id, filepath.Join(dir, id+"-raft"), peers, net.transport(id), testRaftConfig())
+	if err != nil {
+		t.Fatalf("Error starting %s: %v", id, err)
+	}
+	net.mu.Lock()
+	net.nodes[id] = n
+	net.mu.Unlock()
+	return n
+}
+
+// waitForLeader returns the leader elected among nodes.
+func waitForLeader(t *testing.T, nodes ...*raftNode) *raftNode {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, n := range nodes {
+			if n.Status().State == "leader" {
+				return n
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("No leader elected")
+	return nil
+}
+
+// waitForValue waits until key holds want in the default namespace of
+// every node.
+func waitForValue(t *testing.T, key, want string, nodes ...*raftNode) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for _, n := range nodes {
+		for {
+			mem, _ := n.s.Namespace(defaultNamespace)
+			got, err := mem.Get([]byte(key))
+			if err == nil && string(got) == want {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %s=%s on %s, got %q, %v", key, want, n.id, got, err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestRaftElectionAndPartition(t *testing.T) {
+	dir := t.TempDir()
+	net := newMemRaftNetwork()
+	peers := []string{"n1", "n2", "n3"}
+	var nodes []*raftNode
+	for _, id := range peers {
+		n := startTestRaft(t, net, dir, id, peers)
+		defer n.Stop()
+		nodes = append(nodes, n)
+	}
+
+	leader := waitForLeader(t, nodes...)
+	if err := leader.s.namespaces[defaultNamespace].Set([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Error writing to the leader: %v", err)
+	}
+	users, err := leader.s.CreateNamespace("users", nsOptions{})
+	if err != nil {
+		t.Fatalf("Error creating namespace: %v", err)
+	}
+	users.Set([]byte("u1"), []byte("alice"))
+	waitForValue(t, "a", "1", nodes...)
+
+	var follower *raftNode
+	for _, n := range nodes {
+		if n != leader {
+			follower = n
+		}
+	}
+	if err := follower.s.namespaces[defaultNamespace].Set([]byte("b"), []byte("2")); !errors.Is(err, errNotLeader) {
+		t.Errorf("Expected %v writing to a follower, got %v", errNotLeader, err)
+	}
+
+	// A late heartbeat does not lower what the follower committed
+	follower.mu.Lock()
+	committed, term, prevTerm := follower.commitIndex, follower.term, follower.termAt(1)
+	follower.mu.Unlock()
+	follower.handleAppend(appendRequest{Term: term, Leader: leader.id, PrevLogIndex: 1, PrevLogTerm: prevTerm, LeaderCommit: committed + 1})
+	follower.mu.Lock()
+	if follower.commitIndex < committed {
+		t.Errorf("Expected the commit index to stay at %d at least, got %d", committed, follower.commitIndex)
+	}
+	follower.mu.Unlock()
+
+	// Transactions conflict when a key they read changed
+	b := &writeBatch{}
+	b.Put(defaultNamespace, []byte("a"), []byte("2"))
+	err = leader.propose(raftCommand{
+		Batch:         b.encode(),
+		Reads:         []txnRead{{Key: "a", Found: false}},
+		ReadNamespace: defaultNamespace,
+		Now:           time.Now().UnixNano(),
+	})
+	if !errors.Is(err, errTxnConflict) {
+		t.Errorf("Expected %v, got %v", errTxnConflict, err)
+	}
+
+	// The majority elects a new leader and goes on without the old one
+	net.setCut(leader.id, true)
+	var rest []*raftNode
+	for _, n := range nodes {
+		if n != leader {
+			rest = append(rest, n)
+		}
+	}
+	newLeader := waitForLeader(t, rest...)
+	if err := newLeader.s.namespaces[defaultNamespace].Set([]byte("c"), []byte("3")); err != nil {
+		t.Fatalf("Error writing to the new leader: %v", err)
+	}
+	if err := leader.s.namespaces[defaultNamespace].Set([]byte("lost"), []byte("x")); err == nil {
+		t.Errorf("Expected a write to the cut off leader to fail")
+	}
+
+	net.setCut(leader.id, false)
+	waitForValue(t, "c", "3", nodes...)
+	for _, n := range nodes {
+		mem, _ := n.s.Namespace(defaultNamespace)
+		if _, err := mem.Get([]byte("lost")); err == nil {
+			t.Errorf("Expected the uncommitted write to be dropped on %s", n.id)
+		}
+		users, err := n.s.Namespace("users")
+		if err != nil {
+			t.Fatalf("Expected the namespace on %s: %v", n.id, err)
+		}
+		if got, err := users.Get([]byte("u1")); err != nil || string(got) != "alice" {
+			t.Errorf("Expected u1=alice on %s, got %q, %v", n.id, got, err)
+		}
+	}
+}
+
+func TestRaftSnapshotAndMembership(t *testing.T) {
+	dir := t.TempDir()
+	net := newMemRaftNetwork()
+	peers := []string{"n1", "n2", "n3"}
+	nodes := make(map[string]*raftNode)
+	for _, id := range peers {
+		nodes[id] = startTestRaft(t, net, dir, id, peers)
+	}
+	defer func() {
+		for _, n := range nodes {
+			n.Stop()
+		}
+	}()
+
+	leader := waitForLeader(t, nodes["n1"], nodes["n2"], nodes["n3"])
+	var crashed string
+	for _, id := range peers {
+		if id != leader.id {
+			crashed = id
+		}
+	}
+	nodes[crashed].Stop()
+	net.setCut(crashed, true)
+
+	// Enough writes for the leader to compact its log past the crashed node
+	mem := leader.s.namespaces[defaultNamespace]
+	for i := 0; i < 50; i++ {
+		if err := mem.Set([]byte(fmt.Sprintf("k%02d", i)), []byte("v")); err != nil {
+			t.Fatalf("Error writing: %v", err)
+		}
+	}
+	if status := leader.Status(); status.SnapshotIndex == 0 {
+		t.Fatalf("Expected the log to be compacted, got %+v", status)
+	}
+
+	net.setCut(crashed, false)
+	nodes[crashed] = startTestRaft(t, net, dir, crashed, nil)
+	waitForValue(t, "k49", "v", nodes[crashed])
+	if status := nodes[crashed].Status(); status.SnapshotIndex == 0 {
+		t.Errorf("Expected %s to catch up from a snapshot, got %+v", crashed, status)
+	}
+
+	// A new node joins, then the crashed one leaves
+	nodes["n4"] = startTestRaft(t, net, dir, "n4", nil)
+	if err := leader.AddPeer("n4"); err != nil {
+		t.Fatalf("Error adding n4: %v", err)
+	}
+	mem.Set([]byte("after"), []byte("join"))
+	waitForValue(t, "after", "join", nodes["n4"])
+	if err := leader.RemovePeer(crashed); err != nil {
+		t.Fatalf("Error removing %s: %v", crashed, err)
+	}
+	if status := leader.Status(); len(status.Peers) != 3 {
+		t.Errorf("Expected 3 voters, got %v", status.Peers)
+	}
+}
+
+func TestRaftSnapshotInstallFailure(t *testing.T) {
+	dir := t.TempDir()
+	net := newMemRaftNetwork()
+	n := startTestRaft(t, net, dir, "n1", []string{"n1"})
+	defer n.Stop()
+	waitForLeader(t, n)
+	if err := n.s.namespaces[defaultNamespace].Set([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+
+	// A directory in place of the WAL fails to open
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: walFileName + "/x", Mode: 0644, Typeflag: tar.TypeReg})
+	tw.Close()
+	status := n.Status()
+	resp := n.handleSnapshot(snapshotRequest{Term: status.Term + 1, Leader: "n0", LastIndex: status.LastIndex + 100, LastTerm: status.Term + 1, Peers: []string{"n1"}, Data: buf.Bytes()})
+	if resp.Success {
+		t.Errorf("Expected the failed install to be reported")
+	}
+	if got := n.Status(); got.SnapshotIndex != status.SnapshotIndex || got.LastApplied != status.LastApplied {
+		t.Errorf("Expected the node to keep its state, got %+v, was %+v", got, status)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "n1-raft", "snapshot", walFileName)); err == nil {
+		t.Errorf("Expected the failed snapshot not to be kept")
+	}
+	if got, err := n.s.namespaces[defaultNamespace].Get([]byte("a")); err != nil || string(got) != "1" {
+		t.Errorf("Expected a=1 after the failed install, got %q, %v", got, err)
+	}
+}
+
+func TestRaftVoteNeedsPersistedState(t *testing.T) {
+	dir := t.TempDir()
+	net := newMemRaftNetwork()
+	n := startTestRaft(t, net, dir, "n1", []string{"n1"})
+	defer n.Stop()
+	waitForLeader(t, n)
+
+	// A directory in the way of the state file fails every write of it
+	blocker := filepath.Join(dir, "n1-raft", "state.json.tmp")
+	if err := os.Mkdir(blocker, 0755); err != nil {
+		t.Fatal(err)
+	}
+	term := n.Status().Term
+	req := voteRequest{Term: term + 1, Candidate: "n2", LastLogIndex: 1 << 20, LastLogTerm: term + 1}
+	if resp := n.handleVote(req); resp.Granted || resp.Term != term {
+		t.Errorf("Expected no vote while the state cannot be persisted, got %+v", resp)
+	}
+	if resp := n.handleAppend(appendRequest{Term: term + 1, Leader: "n2"}); resp.Success {
+		t.Errorf("Expected appends to fail while the state cannot be persisted, got %+v", resp)
+	}
+
+	os.Remove(blocker)
+	if resp := n.handleVote(req); !resp.Granted || resp.Term != term+1 {
+		t.Errorf("Expected the vote once the state is persisted, got %+v", resp)
+	}
+}
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const lostAndFoundDir = "lost+found"
+
+// storeCheck is the result of checking a whole data directory.
+type storeCheck struct {
+	Dir        string    `json:"dir"`
+	Namespaces []nsCheck `json:"namespaces"`
+	WAL        walCheck  `json:"wal"`
+}
+
+// nsCheck is the result of checking the files of one namespace. Problems
+// are those of the namespace itself, such as gaps in the SST numbering,
+// each SST file has its own.
+type nsCheck struct {
+	Name     string     `json:"name"`
+	Dir      string     `json:"dir"`
+	SSTs     []sstCheck `json:"ssts"`
+	Problems []string   `json:"problems,omitempty"`
+}
+
+type walCheck struct {
+	Path     string   `json:"path"`
+	Records  int      `json:"records"`
+	LastSeq  uint64   `json:"last_seq"`
+	Problems []string `json:"problems,omitempty"`
+}
+
+// problems returns the number of problems found in the directory.
+func (c storeCheck) problems() int {
+	n := len(c.WAL.Problems)
+	for _, ns := range c.Namespaces {
+		n += len(ns.Problems)
+		for _, sst := range ns.SSTs {
+			n += len(sst.Problems)
+		}
+	}
+	return n
+}
+
+// namespaceDirs returns the directory of every namespace of the store in
+// dir, by name.
+func namespaceDirs(dir string) (map[string]string, error) {
+	dirs := map[string]string{defaultNamespace: dir}
+	matches, err := filepath.Glob(filepath.Join(dir, nsDirPrefix+"*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range matches {
+		dirs[strings.TrimPrefix(filepath.Base(d), nsDirPrefix)] = d
+	}
+	return dirs, nil
+}
+
+// sstNumbers returns the numbers of the sst_N.sst files in dir, sorted, and
+// the names of the files that look like SST files but are not numbered.
+func sstNumbers(dir string) ([]int, []string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "sst_*.sst"))
+	if err != nil {
+		return nil, nil, err
+	}
+	var (
+		numbers []int
+		odd     []string
+	)
+	for _, f := range files {
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(f), "sst_"), ".sst"))
+		if err != nil || n < 1 {
+			odd = append(odd, filepath.Base(f))
+			continue
+		}
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+	return numbers, odd, nil
+}
+
+// checkStore checks the store in dir without opening it: the OPTIONS file
+// and SST files of every namespace and the WAL. The store finds its SST
+// files by counting them, so they must be numbered from 1 without gaps.
+func checkStore(dir string, keys *keyring) (storeCheck, error) {
+	check := storeCheck{Dir: dir}
+	if _, err := os.Stat(dir); err != nil {
+		return check, err
+	}
+	dirs, err := namespaceDirs(dir)
+	if err != nil {
+		return check, err
+	}
+	names := make([]string, 0, len(dirs))
+	for name := range dirs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		ns := nsCheck{Name: name, Dir: dirs[name]}
+		if opts, err := readNSOptions(ns.Dir); err != nil {
+			ns.Problems = append(ns.Problems, err.Error())
+		} else if _, err := opts.withDefaults(); err != nil {
+			ns.Problems = append(ns.Problems, fmt.Sprintf("%s: %v", optionsFileName, err))
+		}
+
+		numbers, odd, err := sstNumbers(ns.Dir)
+		if err != nil {
+			return check, err
+		}
+		for _, name := range odd {
+			ns.Problems = append(ns.Problems, fmt.Sprintf("%s is not a numbered SST file", name))
+		}
+		if _, err := os.Stat(filepath.Join(ns.Dir, "sst_compact.tmp")); err == nil {
+			ns.Problems = append(ns.Problems, "sst_compact.tmp was left by an interrupted compaction")
+		}
+		for i, n := range numbers {
+			if n != i+1 {
+				ns.Problems = append(ns.Problems, fmt.Sprintf("sst_%d.sst is missing, so the files after it are not all found", i+1))
+				break
+			}
+		}
+		for _, n := range numbers {
+			ns.SSTs = append(ns.SSTs, checkSST(filepath.Join(ns.Dir, fmt.Sprintf("sst_%d.sst", n)), keys))
+		}
+		check.Namespaces = append(check.Namespaces, ns)
+	}
+
+	check.WAL = checkWAL(filepath.Join(dir, walFileName), keys)
+	return check, nil
+}
+
+// checkWAL checks that every record of the WAL can be read and that their
+// sequence numbers increase. Anything after the last complete record is
+// reported, although opening the store ignores it.
+func checkWAL(path string, keys *keyring) walCheck {
+	check := walCheck{Path: path}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return check
+	}
+	dump, err := dumpWAL(path, keys, dumpFormat{})
+	check.Records = len(dump.Records)
+	for i, record := range dump.Records {
+		if i > 0 && record.Seq <= check.LastSeq {
+			check.Problems = append(check.Problems, fmt.Sprintf("record at offset %d has seq %d, after seq %d", record.Offset, record.Seq, check.LastSeq))
+		}
+		check.LastSeq = record.Seq
+	}
+	if err != nil {
+		check.Problems = append(check.Problems, err.Error())
+	}
+	if dump.Tail != "" {
+		check.Problems = append(check.Problems, dump.Tail)
+	}
+	return check
+}
+
+// repairStore makes the store in dir usable again, moving what it cannot
+// use to dir/lost+found:
+//
+//   - corrupt SST files are rewritten with the entries of their intact
+//     blocks, or moved away if none can be read;
+//   - SST files are renumbered so there are no gaps;
+//   - unreadable OPTIONS files and leftover compaction files are moved away;
+//   - the WAL is cut after its last readable record.
+//
+// Originals of the files it changes are kept in lost+found. It returns what
+// it did; the store must not be open.
+func repairStore(dir string, keys *keyring) ([]string, error) {
+	check, err := checkStore(dir, keys)
+	if err != nil {
+		return nil, err
+	}
+	r := &repairer{dir: dir, keys: keys}
+
+	for _, ns := range check.Namespaces {
+		if err := r.repairNamespace(ns); err != nil {
+			return r.actions, err
+		}
+	}
+	if len(check.WAL.Problems) > 0 {
+		if err := r.repairWAL(check.WAL.Path); err != nil {
+			return r.actions, err
+		}
+	}
+	return r.actions, nil
+}
+
+type repairer struct {
+	dir     string
+	keys    *keyring
+	actions []string
+}
+
+func (r *repairer) did(format string, args ...interface{}) {
+	r.actions = append(r.actions, fmt.Sprintf(format, args...))
+}
+
+// lostPath returns where to keep path in lost+found, as
+// <namespace>_<file name>, with a suffix if that name is taken.
+func (r *repairer) lostPath(ns, path string) (string, error) {
+	lost := filepath.Join(r.dir, lostAndFoundDir)
+	if err := os.MkdirAll(lost, 0755); err != nil {
+		return "", err
+	}
+	base := filepath.Join(lost, ns+"_"+filepath.Base(path))
+	dst := base
+	for i := 1; ; i++ {
+		if _, err := os.Stat(dst); os.IsNotExist(err) {
+			return dst, nil
+		}
+		dst = fmt.Sprintf("%s.%d", base, i)
+	}
+}
+
+func (r *repairer) moveToLost(ns, path string) error {
+	dst, err := r.lostPath(ns, path)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(path, dst); err != nil {
+		return err
+	}
+	r.did("moved %s to %s", path, dst)
+	return nil
+}
+
+func (r *repairer) copyToLost(ns, path string) error {
+	dst, err := r.lostPath(ns, path)
+	if err != nil {
+		return err
+	}
+	if err := copyFile(path, dst); err != nil {
+		return err
+	}
+	r.did("copied %s to %s", path, dst)
+	return nil
+}
+
+func (r *repairer) repairNamespace(ns nsCheck) error {
+	opts, err := readNSOptions(ns.Dir)
+	if err == nil {
+		opts, err = opts.withDefaults()
+	}
+	if err != nil {
+		if err := r.moveToLost(ns.Name, filepath.Join(ns.Dir, optionsFileName)); err != nil {
+			return err
+		}
+		opts = defaultNSOptions()
+	}
+	codec, err := codecByName(opts.BottomCompression)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(ns.Dir, "sst_compact.tmp")
+	if _, err := os.Stat(tmp); err == nil {
+		if err := r.moveToLost(ns.Name, tmp); err != nil {
+			return err
+		}
+	}
+	_, odd, err := sstNumbers(ns.Dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range odd {
+		if err := r.moveToLost(ns.Name, filepath.Join(ns.Dir, name)); err != nil {
+			return err
+		}
+	}
+
+	for _, sst := range ns.SSTs {
+		if len(sst.Problems) == 0 {
+			continue
+		}
+		entries, lost := salvageSST(sst.Path, r.keys)
+		if err := r.moveToLost(ns.Name, sst.Path); err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			continue
+		}
+		if err := writeSSTFile(sst.Path, entries, codec, r.keys); err != nil {
+			return err
+		}
+		r.did("rewrote %s with the %d entries of its intact blocks, %d blocks lost", sst.Path, len(entries), lost)
+	}
+
+	// Close the gaps left by missing or moved files, keeping the order
+	numbers, _, err := sstNumbers(ns.Dir)
+	if err != nil {
+		return err
+	}
+	for i, n := range numbers {
+		if n == i+1 {
+			continue
+		}
+		from := filepath.Join(ns.Dir, fmt.Sprintf("sst_%d.sst", n))
+		to := filepath.Join(ns.Dir, fmt.Sprintf("sst_%d.sst", i+1))
+		if err := os.Rename(from, to); err != nil {
+			return err
+		}
+		r.did("renamed %s to %s", from, to)
+	}
+	return nil
+}
+
+// salvageSST returns the entries of the data blocks of a block based SST
+// file that are intact, in order, and the number of blocks it could not
+// read. Nothing can be salvaged without a readable footer and index.
+func salvageSST(path string, keys *keyring) ([]memEntry, int) {
+	data, err := os.ReadFile(path)
+	if err != nil || len(data) < sstHeaderSize || !isBlockSST(data) {
+		return nil, 0
+	}
+	r := bytes.NewReader(data)
+	aead, err := sstAEAD(data, keys)
+	if err != nil {
+		return nil, 0
+	}
+	footer, err := readSSTFooter(r, int64(len(data)))
+	if err != nil {
+		return nil, 0
+	}
+	index, err := readSSTIndex(r, footer, aead)
+	if err != nil {
+		return nil, 0
+	}
+
+	var (
+		entries []memEntry
+		lost    int
+	)
+	for _, h := range index {
+		block, err := readBlock(r, h, aead)
+		if err != nil {
+			lost++
+			continue
+		}
+		blockEntries, err := decodeBlockEntries(block)
+		if err != nil {
+			lost++
+			continue
+		}
+		for _, entry := range blockEntries {
+			if len(entries) > 0 && entry.key <= entries[len(entries)-1].key {
+				continue
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries, lost
+}
+
+// writeSSTFile writes entries to a new SST file at path, through a
+// temporary file so a crash leaves no partial file.
+func writeSSTFile(path string, entries []memEntry, codec byte, keys *keyring) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := writeBlockSST(f, entries, codec, keys); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// repairWAL cuts the WAL after its last readable record, keeping a copy of
+// the original. A WAL whose header cannot be used is moved away whole, and
+// the store starts a new one.
+func (r *repairer) repairWAL(path string) error {
+	dump, err := dumpWAL(path, r.keys, dumpFormat{})
+	if err != nil && len(dump.Records) == 0 && errors.Is(err, errUnknownKey) {
+		return r.moveToLost(defaultNamespace, path)
+	}
+
+	end := int64(0)
+	if len(dump.Records) > 0 {
+		last := dump.Records[len(dump.Records)-1]
+		end = last.Offset + walHeaderSize + int64(last.Length)
+	} else if header, err := readFileHead(path, walFileHeaderSize); err == nil && binary.BigEndian.Uint32(header[:4]) == walMagic {
+		end = walFileHeaderSize
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if end == info.Size() {
+		return nil
+	}
+	if err := r.copyToLost(defaultNamespace, path); err != nil {
+		return err
+	}
+	if err := os.Truncate(path, end); err != nil {
+		return err
+	}
+	r.did("cut %s after its last readable record, at %d bytes", path, end)
+	return nil
+}
+
+func readFileHead(path string, n int) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	head := make([]byte, n)
+	_, err = io.ReadFull(f, head)
+	return head, err
+}
+
+// runCheck runs kv check.
+func runCheck(args []string) error {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	inf := inspectFlags{}
+	fs.StringVar(&inf.keyFile, "encryption-key-file", "", "file of hex encoded AES keys the store is encrypted with")
+	fs.BoolVar(&inf.json, "json", false, "write JSON instead of text")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: kv check [flags] <dir>")
+	}
+	keys, err := inf.keys()
+	if err != nil {
+		return err
+	}
+
+	check, err := checkStore(fs.Arg(0), keys)
+	if err != nil {
+		return err
+	}
+	if inf.json {
+		if err := json.NewEncoder(os.Stdout).Encode(check); err != nil {
+			return err
+		}
+	} else {
+		printStoreCheck(os.Stdout, check)
+	}
+	if n := check.problems(); n > 0 {
+		return fmt.Errorf("%d problems found, run kv repair to fix them", n)
+	}
+	return nil
+}
+
+// runRepair runs kv repair.
+func runRepair(args []string) error {
+	fs := flag.NewFlagSet("repair", flag.ExitOnError)
+	inf := inspectFlags{}
+	fs.StringVar(&inf.keyFile, "encryption-key-file", "", "file of hex encoded AES keys the store is encrypted with")
+	fs.BoolVar(&inf.json, "json", false, "write JSON instead of text")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: kv repair [flags] <dir>")
+	}
+	keys, err := inf.keys()
+	if err != nil {
+		return err
+	}
+
+	actions, err := repairStore(fs.Arg(0), keys)
+	if inf.json {
+		if err := json.NewEncoder(os.Stdout).Encode(actions); err != nil {
+			return err
+		}
+	} else {
+		for _, action := range actions {
+			fmt.Println(action)
+		}
+		if err == nil && len(actions) == 0 {
+			fmt.Println("nothing to repair")
+		}
+	}
+	return err
+}
+
+func printStoreCheck(w io.Writer, check storeCheck) {
+	for _, ns := range check.Namespaces {
+		fmt.Fprintf(w, "namespace %s: %d SST files\n", ns.Name, len(ns.SSTs))
+		for _, p := range ns.Problems {
+			fmt.Fprintf(w, "  %s\n", p)
+		}
+		for _, sst := range ns.SSTs {
+			if len(sst.Problems) == 0 {
+				fmt.Fprintf(w, "  %s: OK, %d entries from %s to %s\n", filepath.Base(sst.Path), sst.Entries, sst.FirstKey, sst.LastKey)
+				continue
+			}
+			fmt.Fprintf(w, "  %s:\n", filepath.Base(sst.Path))
+			for _, p := range sst.Problems {
+				fmt.Fprintf(w, "    %s\n", p)
+			}
+		}
+	}
+	fmt.Fprintf(w, "wal: %d records, last seq %d\n", check.WAL.Records, check.WAL.LastSeq)
+	for _, p := range check.WAL.Problems {
+		fmt.Fprintf(w, "  %s\n", p)
+	}
+}
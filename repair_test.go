@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckAndRepair(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openStore(dir)
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	mem, err := s.CreateNamespace("repair", nsOptions{FlushSize: 1 << 20, Compression: "none"})
+	if err != nil {
+		t.Fatalf("Error creating namespace: %v", err)
+	}
+	// sst_1 holds several blocks, sst_2 and sst_3 one key each
+	value := strings.Repeat("v", 100)
+	for i := 0; i < 100; i++ {
+		if err := mem.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte(value)); err != nil {
+			t.Fatalf("Error setting: %v", err)
+		}
+	}
+	for _, key := range []string{"", "mid", "last"} {
+		if key != "" {
+			if err := mem.Set([]byte(key), []byte("x")); err != nil {
+				t.Fatalf("Error setting: %v", err)
+			}
+		}
+		if _, err := mem.Flush(); err != nil {
+			t.Fatalf("Error flushing: %v", err)
+		}
+	}
+	if err := mem.Set([]byte("pending"), []byte("x")); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+
+	// Damage the first block of sst_1, zero sst_2 and cut the WAL mid-record
+	nsDir := s.nsDir("repair")
+	sst1 := filepath.Join(nsDir, "sst_1.sst")
+	data, err := os.ReadFile(sst1)
+	if err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	data[sstHeaderSize+10] ^= 0xff
+	os.WriteFile(sst1, data, 0644)
+	os.WriteFile(filepath.Join(nsDir, "sst_2.sst"), make([]byte, sstHeaderSize), 0644)
+	walPath := filepath.Join(dir, walFileName)
+	info, _ := os.Stat(walPath)
+	os.Truncate(walPath, info.Size()-3)
+
+	check, err := checkStore(dir, s.keys)
+	if err != nil {
+		t.Fatalf("Error checking: %v", err)
+	}
+	if n := check.problems(); n != 3 {
+		t.Errorf("Expected 3 problems, got %d: %+v", n, check)
+	}
+
+	actions, err := repairStore(dir, s.keys)
+	if err != nil {
+		t.Fatalf("Error repairing: %v", err)
+	}
+	got := strings.Join(actions, "\n")
+	for _, want := range []string{
+		"rewrote " + sst1 + " with the",
+		"moved " + filepath.Join(nsDir, "sst_2.sst") + " to " + filepath.Join(dir, lostAndFoundDir, "repair_sst_2.sst"),
+		"renamed " + filepath.Join(nsDir, "sst_3.sst") + " to " + filepath.Join(nsDir, "sst_2.sst"),
+		"cut " + walPath,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Expected %q in the actions, got\n%s", want, got)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, lostAndFoundDir, "repair_sst_1.sst")); err != nil {
+		t.Errorf("Expected the original of sst_1 in lost+found: %v", err)
+	}
+
+	if check, err := checkStore(dir, s.keys); err != nil || check.problems() != 0 {
+		t.Errorf("Expected a sound store after the repair, got %+v, %v", check, err)
+	}
+	s, err = openStore(dir)
+	if err != nil {
+		t.Fatalf("Error reopening store: %v", err)
+	}
+	mem, _ = s.Namespace("repair")
+	if v, err := mem.Get([]byte("key-099")); err != nil || string(v) != value {
+		t.Errorf("Expected keys of the intact blocks to survive, got %q, %v", v, err)
+	}
+	if _, err := mem.Get([]byte("key-000")); err == nil {
+		t.Errorf("Expected keys of the damaged block to be lost")
+	}
+	if v, err := mem.Get([]byte("last")); err != nil || string(v) != "x" {
+		t.Errorf("Expected the renumbered file to be read, got %q, %v", v, err)
+	}
+	if _, err := mem.Get([]byte("pending")); err == nil {
+		t.Errorf("Expected the cut WAL record to be dropped")
+	}
+}
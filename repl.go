@@ -0,0 +1,548 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+type Cmd int
+
+const (
+	Get Cmd = iota
+	Set
+	Del
+	Ext
+	Unk
+	Flush
+	Mget
+	Mset
+	Scan
+	Exists
+	TTL
+	Stats
+	Compact
+	Sync
+	Checkpoint
+	Begin
+	Commit
+	Rollback
+)
+
+type Error int
+
+func (e Error) Error() string {
+	return "Empty command"
+}
+
+const (
+	Empty Error = iota
+)
+
+var (
+	errUnknownCommand   = errors.New("Unkown command")
+	errUnbalancedQuotes = errors.New("unbalanced quotes in command")
+	errQuoteNotClosed   = errors.New("closing quote must be followed by a space")
+	errBadHexLiteral    = errors.New("invalid hex literal")
+)
+
+// tokenize splits a command line in arguments. Arguments are separated by
+// spaces and may be written
+//
+//	"double quoted" with Go escapes such as \n, \" or \x00
+//	'single quoted' where only \' and \\ are escapes
+//	x'00ff'         as hex, for binary data
+//
+// and outside quotes a backslash escapes the next character.
+func tokenize(line string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(line); {
+		if line[i] == ' ' || line[i] == '\t' || line[i] == '\r' || line[i] == '\n' {
+			i++
+			continue
+		}
+
+		var (
+			token string
+			end   int
+		)
+		switch {
+		case line[i] == '"':
+			end = i + 1
+			for end < len(line) && line[end] != '"' {
+				if line[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(line) {
+				return nil, errUnbalancedQuotes
+			}
+			end++
+			var err error
+			token, err = strconv.Unquote(line[i:end])
+			if err != nil {
+				return nil, fmt.Errorf("bad escape in %s", line[i:end])
+			}
+		case line[i] == '\'':
+			var b strings.Builder
+			end = i + 1
+			for ; end < len(line) && line[end] != '\''; end++ {
+				if line[end] == '\\' && end+1 < len(line) && (line[end+1] == '\'' || line[end+1] == '\\') {
+					end++
+				}
+				b.WriteByte(line[end])
+			}
+			if end >= len(line) {
+				return nil, errUnbalancedQuotes
+			}
+			end++
+			token = b.String()
+		case (line[i] == 'x' || line[i] == 'X') && i+1 < len(line) && line[i+1] == '\'':
+			closing := strings.IndexByte(line[i+2:], '\'')
+			if closing < 0 {
+				return nil, errUnbalancedQuotes
+			}
+			end = i + 2 + closing + 1
+			decoded, err := hex.DecodeString(line[i+2 : end-1])
+			if err != nil {
+				return nil, errBadHexLiteral
+			}
+			token = string(decoded)
+		default:
+			var b strings.Builder
+			for end = i; end < len(line) && !strings.ContainsRune(" \t\r\n", rune(line[end])); end++ {
+				if line[end] == '\\' && end+1 < len(line) {
+					end++
+				}
+				b.WriteByte(line[end])
+			}
+			tokens = append(tokens, b.String())
+			i = end
+			continue
+		}
+
+		if end < len(line) && !strings.ContainsRune(" \t\r\n", rune(line[end])) {
+			return nil, errQuoteNotClosed
+		}
+		tokens = append(tokens, token)
+		i = end
+	}
+	return tokens, nil
+}
+
+// formatValue returns v as is if it is printable text, or else double quoted
+// with the escapes tokenize understands.
+func formatValue(v string) string {
+	if v == "" || v[0] == '"' || v[0] == '\'' || !utf8.ValidString(v) {
+		return strconv.Quote(v)
+	}
+	for _, r := range v {
+		if !unicode.IsPrint(r) {
+			return strconv.Quote(v)
+		}
+	}
+	return v
+}
+
+type Repl struct {
+	db  *memDB
+	in  io.Reader
+	out io.Writer
+	txn *replTxn
+}
+
+func (re *Repl) parseCmd(buf []byte) (Cmd, []string, error) {
+	line := string(buf)
+	elements, err := tokenize(line)
+	if err != nil {
+		return Unk, nil, err
+	}
+	if len(elements) < 1 {
+		return Unk, nil, Empty
+	}
+
+	switch elements[0] {
+	case "get":
+		return Get, elements[1:], nil
+	case "set":
+		return Set, elements[1:], nil
+	case "del":
+		return Del, elements[1:], nil
+	case "flush":
+		return Flush, elements[1:], nil
+	case "exit":
+		return Ext, nil, nil
+	case "mget":
+		return Mget, elements[1:], nil
+	case "mset":
+		return Mset, elements[1:], nil
+	case "scan":
+		return Scan, elements[1:], nil
+	case "exists":
+		return Exists, elements[1:], nil
+	case "ttl":
+		return TTL, elements[1:], nil
+	case "stats":
+		return Stats, elements[1:], nil
+	case "compact":
+		return Compact, elements[1:], nil
+	case "sync":
+		return Sync, elements[1:], nil
+	case "checkpoint":
+		return Checkpoint, elements[1:], nil
+	case "begin":
+		return Begin, elements[1:], nil
+	case "commit":
+		return Commit, elements[1:], nil
+	case "rollback":
+		return Rollback, elements[1:], nil
+	default:
+		return Unk, nil, nil
+	}
+}
+
+func (re *Repl) Start() {
+	scanner := bufio.NewScanner(re.in)
+
+	for {
+		fmt.Fprint(re.out, "> ")
+		if !scanner.Scan() {
+			break
+		}
+		buf := scanner.Bytes()
+		cmd, elements, err := re.parseCmd(buf)
+		if err != nil {
+			fmt.Fprintf(re.out, "%s\n", err.Error())
+			continue
+		}
+		if cmd == Ext {
+			fmt.Fprintln(re.out, "Bye!")
+			return
+		}
+		if err := re.run(cmd, elements); err != nil {
+			fmt.Fprintln(re.out, err.Error())
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintln(re.out, err.Error())
+	} else {
+		fmt.Fprintln(re.out, "Bye!")
+	}
+}
+
+func expectArgs(elements []string, min, max int) error {
+	if len(elements) < min || (max >= 0 && len(elements) > max) {
+		return fmt.Errorf("Expected %d arguments, received: %d", min, len(elements))
+	}
+	return nil
+}
+
+// runCmd runs every command but exit, writing its output to re.out.
+func (re *Repl) runCmd(cmd Cmd, elements []string) error {
+	switch cmd {
+	case Get:
+		if err := expectArgs(elements, 1, 1); err != nil {
+			return err
+		}
+		v, err := re.db.Get([]byte(elements[0]))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(re.out, formatValue(string(v)))
+	case Set:
+		if err := expectArgs(elements, 2, 2); err != nil {
+			return err
+		}
+		return re.db.Set([]byte(elements[0]), []byte(elements[1]))
+	case Del:
+		if err := expectArgs(elements, 1, 1); err != nil {
+			return err
+		}
+		v, err := re.db.Del(elements[0])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(re.out, formatValue(v))
+	case Mget:
+		if err := expectArgs(elements, 1, -1); err != nil {
+			return err
+		}
+		for _, key := range elements {
+			entry, found, err := re.db.Lookup(key)
+			if err != nil {
+				return err
+			}
+			if !found {
+				fmt.Fprintln(re.out, "(nil)")
+				continue
+			}
+			fmt.Fprintln(re.out, formatValue(entry.value))
+		}
+	case Mset:
+		if len(elements) == 0 || len(elements)%2 != 0 {
+			return fmt.Errorf("Expected key value pairs, received %d arguments", len(elements))
+		}
+		return re.db.Update(func(tx *memTxn) error {
+			for i := 0; i < len(elements); i += 2 {
+				tx.Put([]byte(elements[i]), []byte(elements[i+1]), 0)
+			}
+			return nil
+		})
+	case Scan:
+		// scan [start] [count] lists keys from start on, 10 by default
+		if err := expectArgs(elements, 0, 2); err != nil {
+			return err
+		}
+		var start string
+		count := 10
+		if len(elements) > 0 {
+			start = elements[0]
+		}
+		if len(elements) > 1 {
+			n, err := strconv.Atoi(elements[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid count %q", elements[1])
+			}
+			count = n
+		}
+		entries, err := re.db.Scan(start, count)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			fmt.Fprintf(re.out, "%s %s\n", formatValue(entry.key), formatValue(entry.value))
+		}
+	case Exists:
+		if err := expectArgs(elements, 1, -1); err != nil {
+			return err
+		}
+		count := 0
+		for _, key := range elements {
+			_, found, err := re.db.Lookup(key)
+			if err != nil {
+				return err
+			}
+			if found {
+				count++
+			}
+		}
+		fmt.Fprintln(re.out, count)
+	case TTL:
+		// Seconds left to live, -1 if the key never expires, -2 if it is missing
+		if err := expectArgs(elements, 1, 1); err != nil {
+			return err
+		}
+		entry, found, err := re.db.Lookup(elements[0])
+		if err != nil {
+			return err
+		}
+		switch {
+		case !found:
+			fmt.Fprintln(re.out, -2)
+		case entry.expires == 0:
+			fmt.Fprintln(re.out, -1)
+		default:
+			fmt.Fprintln(re.out, int64(time.Until(time.Unix(0, entry.expires)).Round(time.Second)/time.Second))
+		}
+	case Stats:
+		if err := expectArgs(elements, 0, 0); err != nil {
+			return err
+		}
+		stats, err := re.db.Stats()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(re.out, "namespace: %s\n", stats.Name)
+		fmt.Fprintf(re.out, "memtable_bytes: %d\n", stats.MemtableBytes)
+		fmt.Fprintf(re.out, "sst_files: %d\n", stats.SSTFiles)
+		for _, file := range stats.Files {
+			fmt.Fprintf(re.out, "  %s: %d bytes, %d bytes of data\n", file.Name, file.Size, file.DataBytes)
+		}
+		fmt.Fprintf(re.out, "data_bytes: %d\n", stats.DataBytes)
+		fmt.Fprintf(re.out, "stored_bytes: %d\n", stats.StoredBytes)
+		fmt.Fprintf(re.out, "compression_ratio: %.2f\n", stats.CompressionRatio)
+		fmt.Fprintf(re.out, "vlog_segments: %d\n", stats.VlogSegments)
+		fmt.Fprintf(re.out, "vlog_bytes: %d\n", stats.VlogBytes)
+	case Compact:
+		// compact [start [end]] merges the files holding the range, all of
+		// them without a range
+		if err := expectArgs(elements, 0, 2); err != nil {
+			return err
+		}
+		if len(elements) == 0 {
+			if err := re.db.Compact(); err != nil {
+				return err
+			}
+			fmt.Fprintln(re.out, "OK")
+			return nil
+		}
+		var end string
+		if len(elements) == 2 {
+			end = elements[1]
+		}
+		merged, err := re.db.CompactRange(elements[0], end)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(re.out, "merged %d files\n", merged)
+	case Flush:
+		if err := expectArgs(elements, 0, 0); err != nil {
+			return err
+		}
+		path, err := re.db.Flush()
+		if err != nil {
+			return err
+		}
+		if path == "" {
+			fmt.Fprintln(re.out, "memtable is empty")
+			return nil
+		}
+		fmt.Fprintf(re.out, "flushed to %s\n", path)
+	case Sync:
+		if err := expectArgs(elements, 0, 0); err != nil {
+			return err
+		}
+		if err := re.db.store.SyncWAL(); err != nil {
+			return err
+		}
+		fmt.Fprintln(re.out, "OK")
+	case Checkpoint:
+		if err := expectArgs(elements, 1, 1); err != nil {
+			return err
+		}
+		if err := re.db.store.Checkpoint(elements[0]); err != nil {
+			return err
+		}
+		fmt.Fprintf(re.out, "checkpoint written to %s\n", elements[0])
+	case Begin:
+		if err := expectArgs(elements, 0, 0); err != nil {
+			return err
+		}
+		return re.begin()
+	case Commit:
+		if err := expectArgs(elements, 0, 0); err != nil {
+			return err
+		}
+		if err := re.commit(); err != nil {
+			return err
+		}
+		fmt.Fprintln(re.out, "OK")
+	case Rollback:
+		if err := expectArgs(elements, 0, 0); err != nil {
+			return err
+		}
+		if re.txn == nil {
+			return errNoTransaction
+		}
+		re.txn = nil
+		fmt.Fprintln(re.out, "OK")
+	case Unk:
+		return errUnknownCommand
+	}
+	return nil
+}
+
+// serveRepl accepts connections on l until it is closed, running a Repl
+// against mem for each of them.
+func serveRepl(l net.Listener, mem *memDB) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			repl := &Repl{
+				db:  mem,
+				in:  conn,
+				out: conn,
+			}
+			repl.Start()
+		}()
+	}
+}
+
+// runRepl runs the command prompt on stdin against a local data directory.
+func runRepl(args []string) error {
+	fs := flag.NewFlagSet("repl", flag.ExitOnError)
+	var sf storeFlags
+	sf.register(fs)
+	fs.Parse(args)
+
+	s, err := sf.open()
+	if err != nil {
+		return err
+	}
+	repl := &Repl{
+		db:  s.namespaces[defaultNamespace],
+		in:  os.Stdin,
+		out: os.Stdout,
+	}
+	repl.Start()
+	return nil
+}
+
+// runCLI connects the terminal to the command prompt of a server started
+// with -repl-addr.
+func runCLI(args []string) error {
+	fs := flag.NewFlagSet("cli", flag.ExitOnError)
+	useTLS := fs.Bool("tls", false, "connect with TLS, verifying the server against the system CAs or -tls-ca")
+	caFile := fs.String("tls-ca", "", "PEM CA certificates to verify the server with; implies -tls")
+	certFile := fs.String("tls-cert", "", "PEM client certificate, for servers started with -tls-client-ca; implies -tls")
+	keyFile := fs.String("tls-key", "", "PEM private key of -tls-cert")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: kv cli [flags] <host:port>")
+	}
+	var config *tls.Config
+	if *useTLS || *caFile != "" || *certFile != "" {
+		var err error
+		if config, err = clientTLSConfig(*caFile, *certFile, *keyFile); err != nil {
+			return err
+		}
+	}
+	return dialRepl(fs.Arg(0), config, os.Stdin, os.Stdout)
+}
+
+// dialRepl sends every line of in to the Repl served at addr and copies what
+// it answers to out, until the server closes the connection. It connects
+// with TLS when config is not nil.
+func dialRepl(addr string, config *tls.Config, in io.Reader, out io.Writer) error {
+	var (
+		conn net.Conn
+		err  error
+	)
+	if config != nil {
+		conn, err = tls.Dial("tcp", addr, config)
+	} else {
+		conn, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	go func() {
+		io.Copy(conn, in)
+		// Let the server see the end of the input, it then says bye and closes
+		if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+	}()
+
+	_, err = io.Copy(out, conn)
+	return err
+}
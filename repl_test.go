@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRepl_OverTCP(t *testing.T) {
+	s, err := openStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer l.Close()
+	go serveRepl(l, s.namespaces[defaultNamespace])
+
+	// Two clients, each with its own Repl, see the same data
+	var out bytes.Buffer
+	if err := dialRepl(l.Addr().String(), nil, strings.NewReader("set greeting hello\nget greeting\n"), &out); err != nil {
+		t.Fatalf("Error running the first client: %v", err)
+	}
+	if !strings.Contains(out.String(), "hello\n") || !strings.HasSuffix(out.String(), "Bye!\n") {
+		t.Errorf("Expected the value and a goodbye, got %q", out.String())
+	}
+
+	out.Reset()
+	if err := dialRepl(l.Addr().String(), nil, strings.NewReader("get greeting\nexit\n"), &out); err != nil {
+		t.Fatalf("Error running the second client: %v", err)
+	}
+	if out.String() != "> hello\n> Bye!\n" {
+		t.Errorf("Expected the session to end at exit, got %q", out.String())
+	}
+}
+
+func TestRepl_Tokenize(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+		err  bool
+	}{
+		{`set greeting "hello world"`, []string{"set", "greeting", "hello world"}, false},
+		{`set k 'it\'s'`, []string{"set", "k", "it's"}, false},
+		{`set k "tab\there\n"`, []string{"set", "k", "tab\there\n"}, false},
+		{`set bin x'00ff'`, []string{"set", "bin", "\x00\xff"}, false},
+		{`set k a\ b`, []string{"set", "k", "a b"}, false},
+		{`set k ""`, []string{"set", "k", ""}, false},
+		{"  get   k  ", []string{"get", "k"}, false},
+		{`set k "open`, nil, true},
+		{`set k "a"b`, nil, true},
+		{`set k x'0g'`, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := tokenize(tt.line)
+		if (err != nil) != tt.err {
+			t.Errorf("tokenize(%q): unexpected error %v", tt.line, err)
+			continue
+		}
+		if !tt.err && strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("tokenize(%q) = %q, expected %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestRepl_Commands(t *testing.T) {
+	s, err := openStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	script := strings.Join([]string{
+		`set greeting "hello world"`,
+		`get greeting`,
+		`set bin x'00ff'`,
+		`get bin`,
+		`mset a 1 b 2`,
+		`mget a missing b`,
+		`exists a b missing`,
+		`ttl a`,
+		`ttl missing`,
+		`scan a 2`,
+		`compact`,
+		`get a`,
+		`stats`,
+	}, "\n")
+
+	var out bytes.Buffer
+	repl := &Repl{db: s.namespaces[defaultNamespace], in: strings.NewReader(script), out: &out}
+	repl.Start()
+
+	want := []string{
+		"hello world",
+		`"\x00\xff"`,
+		"1", "(nil)", "2",
+		"2",
+		"-1",
+		"-2",
+		"a 1", "b 2",
+		"OK",
+		"1",
+		"sst_files: 1",
+	}
+	got := out.String()
+	for _, line := range want {
+		if !strings.Contains(got, line+"\n") {
+			t.Errorf("Expected %q in the output, got %q", line, got)
+		}
+	}
+}
+
+func TestRepl_AdminCommands(t *testing.T) {
+	s, err := openStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	mem, err := s.CreateNamespace("admin", nsOptions{FlushSize: 1 << 20})
+	if err != nil {
+		t.Fatalf("Error creating namespace: %v", err)
+	}
+	checkpoint := filepath.Join(t.TempDir(), "snap")
+	script := strings.Join([]string{
+		`set a 1`,
+		`set b 2`,
+		`flush`,
+		`flush`,
+		`set c 3`,
+		`flush`,
+		`set d 4`,
+		`flush`,
+		`compact c`,
+		`compact a b extra`,
+		`sync`,
+		`checkpoint ` + checkpoint,
+		`checkpoint ` + checkpoint,
+	}, "\n")
+
+	var out bytes.Buffer
+	repl := &Repl{db: mem, in: strings.NewReader(script), out: &out}
+	repl.Start()
+
+	want := []string{
+		"flushed to " + mem.file.sstPath(1),
+		"memtable is empty",
+		"merged 2 files",
+		"received: 3",
+		"OK",
+		"checkpoint written to " + checkpoint,
+		errCheckpointExists.Error(),
+	}
+	got := out.String()
+	for _, line := range want {
+		if !strings.Contains(got, line) {
+			t.Errorf("Expected %q in the output, got %q", line, got)
+		}
+	}
+
+	// The checkpoint opens as a store of its own
+	snap, err := openStore(checkpoint)
+	if err != nil {
+		t.Fatalf("Error opening checkpoint: %v", err)
+	}
+	snapMem, err := snap.Namespace("admin")
+	if err != nil {
+		t.Fatalf("Error opening checkpoint namespace: %v", err)
+	}
+	for key, value := range map[string]string{"a": "1", "b": "2", "c": "3", "d": "4"} {
+		v, err := snapMem.Get([]byte(key))
+		if err != nil || string(v) != value {
+			t.Errorf("Expected %s=%s in the checkpoint, got %q, %v", key, value, v, err)
+		}
+	}
+}
+
+func TestRepl_Exec(t *testing.T) {
+	s, err := openStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	mem := s.namespaces[defaultNamespace]
+	script := strings.Join([]string{
+		`# seed the accounts`,
+		`set alice 10`,
+		``,
+		`get alice`,
+		`get nobody`,
+		`begin`,
+		`set bob 5`,
+		`del alice`,
+		`commit`,
+		`begin`,
+		`set carol 1`,
+		`del nobody`,
+		`commit`,
+		`begin`,
+		`set dave 1`,
+	}, "\n")
+
+	var out bytes.Buffer
+	repl := &Repl{db: mem, in: strings.NewReader(script), out: &out}
+	err = repl.Exec(execOptions{})
+	if err != errNotCommitted {
+		t.Errorf("Expected the open transaction to be reported, got %v", err)
+	}
+	want := "10\nERR line 5: key not found\nOK\nQUEUED\nQUEUED\nOK\nOK\nQUEUED\nQUEUED\nERR line 13: del nobody: key not found\nOK\nQUEUED\n"
+	if out.String() != want {
+		t.Errorf("Expected output %q, got %q", want, out.String())
+	}
+
+	// Only the first transaction was applied, all at once
+	for key, want := range map[string]bool{"alice": false, "bob": true, "carol": false, "dave": false} {
+		if _, found, _ := mem.Lookup(key); found != want {
+			t.Errorf("Expected %s to exist: %v", key, want)
+		}
+	}
+
+	// JSON lines, stopping at the first error
+	out.Reset()
+	repl = &Repl{db: mem, in: strings.NewReader("get bob\nbogus\nget bob\n"), out: &out}
+	if err := repl.Exec(execOptions{JSON: true, StopOnError: true}); err == nil {
+		t.Errorf("Expected the failing command to be reported")
+	}
+	want = `{"line":1,"command":"get","output":["5"]}` + "\n" + `{"line":2,"command":"bogus","error":"Unkown command"}` + "\n"
+	if out.String() != want {
+		t.Errorf("Expected output %q, got %q", want, out.String())
+	}
+}
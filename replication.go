@@ -0,0 +1,792 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Replication is asynchronous: the primary keeps its recent writes in a
+// replLog, and replicas stream them over HTTP from the sequence number they
+// are at, applying them to their own store in order. A replica whose
+// sequence number is no longer in the log bootstraps from a checkpoint of
+// the primary, then streams from there.
+//
+// The stream is a series of frames laid out as kind(1) len(4 LE) payload:
+//
+//	frameBatch      an encoded writeBatch, as logged in the WAL
+//	frameNamespace  seq(8 LE) nameLen(2 LE) name options (JSON)
+//	frameHeartbeat  seq(8 LE), the primary's latest sequence number
+const (
+	frameBatch     byte = 'b'
+	frameNamespace byte = 'n'
+	frameHeartbeat byte = 'h'
+
+	replHeartbeatInterval = time.Second
+	replRetryInterval     = time.Second
+)
+
+var errNeedBootstrap = errors.New("replica must bootstrap from a checkpoint")
+
+type replEntry struct {
+	seq  uint64
+	kind byte
+	data []byte // frame payload
+}
+
+// replLog holds the writes made after the batch numbered base, for replicas
+// to stream: every batch, and the namespaces created in between, which the
+// WAL does not log. The oldest entries are dropped once they take more than
+// maxBytes. Entries are numbered by their position among all entries ever
+// logged, so readers can tell when the entries they need were dropped.
+type replLog struct {
+	mu       sync.Mutex
+	maxBytes int
+	base     uint64
+	last     uint64 // sequence number of the latest batch
+	first    int    // position of entries[0]
+	entries  []replEntry
+	size     int
+	notify   chan struct{} // closed when entries are added
+}
+
+func newReplLog(seq uint64, maxBytes int) *replLog {
+	return &replLog{maxBytes: maxBytes, base: seq, last: seq, notify: make(chan struct{})}
+}
+
+// appendBatch logs a batch; a nil replLog logs nothing.
+func (l *replLog) appendBatch(b *writeBatch) {
+	if l == nil {
+		return
+	}
+	l.append(replEntry{seq: b.seq, kind: frameBatch, data: b.encode()})
+}
+
+// appendNamespace logs the creation of a namespace after the batch seq.
+func (l *replLog) appendNamespace(seq uint64, name string, opts nsOptions) {
+	if l == nil {
+		return
+	}
+	data, _ := json.Marshal(opts)
+	buf := binary.LittleEndian.AppendUint64(nil, seq)
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(len(name)))
+	buf = append(buf, name...)
+	l.append(replEntry{seq: seq, kind: frameNamespace, data: append(buf, data...)})
+}
+
+func (l *replLog) append(e replEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.entries = append(l.entries, e)
+	l.size += len(e.data)
+	if e.kind == frameBatch {
+		l.last = e.seq
+	}
+
+	// Drop the oldest batches, with the namespaces created before them
+	for l.size > l.maxBytes {
+		i := 0
+		for i < len(l.entries) && l.entries[i].kind != frameBatch {
+			i++
+		}
+		if i == len(l.entries) {
+			break
+		}
+		for _, dropped := range l.entries[:i+1] {
+			l.size -= len(dropped.data)
+		}
+		l.base = l.entries[i].seq
+		l.entries = l.entries[i+1:]
+		l.first += i + 1
+	}
+
+	close(l.notify)
+	l.notify = make(chan struct{})
+}
+
+// reset empties the log, for writes that cannot be streamed, like ingested
+// files: replicas before seq have to bootstrap.
+func (l *replLog) reset(seq uint64) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.first += len(l.entries)
+	l.entries = nil
+	l.size = 0
+	l.base, l.last = seq, seq
+	close(l.notify)
+	l.notify = make(chan struct{})
+}
+
+// position returns the position of the first entry a replica at seq has
+// not applied yet.
+func (l *replLog) position(seq uint64) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if seq < l.base || seq > l.last {
+		return 0, errNeedBootstrap
+	}
+	for i, e := range l.entries {
+		if e.seq > seq || (e.seq == seq && e.kind == frameNamespace) {
+			return l.first + i, nil
+		}
+	}
+	return l.first + len(l.entries), nil
+}
+
+// read returns the entries from position pos on, the latest sequence number
+// and a channel closed once there are more.
+func (l *replLog) read(pos int) ([]replEntry, uint64, <-chan struct{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if pos < l.first {
+		return nil, 0, nil, errNeedBootstrap
+	}
+	entries := append([]replEntry(nil), l.entries[pos-l.first:]...)
+	return entries, l.last, l.notify, nil
+}
+
+func writeFrame(w io.Writer, kind byte, payload []byte) error {
+	header := []byte{kind, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(header[1:], uint32(len(payload)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func readFrame(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, binary.LittleEndian.Uint32(header[1:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// replicationServer serves the replLog of a primary and checkpoints to
+// bootstrap from.
+type replicationServer struct {
+	s *store
+
+	mu      sync.Mutex
+	streams map[*replicaStream]bool
+}
+
+// replicaStream is a replica connected to the primary.
+type replicaStream struct {
+	Addr  string    `json:"addr"`
+	Since time.Time `json:"connected_since"`
+	Seq   uint64    `json:"seq"` // of the latest batch sent
+	Lag   uint64    `json:"lag"` // batches not sent yet
+}
+
+// newReplicationServer starts logging the writes of s, keeping about
+// logSize bytes of them for replicas.
+func newReplicationServer(s *store, logSize int) *replicationServer {
+	s.mu.Lock()
+	s.repl = newReplLog(s.seq, logSize)
+	s.mu.Unlock()
+	return &replicationServer{s: s, streams: make(map[*replicaStream]bool)}
+}
+
+// register adds the replication routes to the router:
+//
+//	GET /replication/stream?from=N   stream the writes after the batch N
+//	GET /replication/checkpoint      a checkpoint of the store, as a tar file
+//	GET /replication/status          the replicas connected and their lag
+func (rs *replicationServer) register(r *mux.Router) {
+	r.HandleFunc("/replication/stream", rs.handleStream).Methods("GET")
+	r.HandleFunc("/replication/checkpoint", rs.handleCheckpoint).Methods("GET")
+	r.HandleFunc("/replication/status", rs.handleStatus).Methods("GET")
+}
+
+func (rs *replicationServer) handleStream(w http.ResponseWriter, r *http.Request) {
+	from, err := strconv.ParseUint(r.URL.Query().Get("from"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid from", http.StatusBadRequest)
+		return
+	}
+	log := rs.s.repl
+	pos, err := log.position(from)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+
+	stream := &replicaStream{Addr: r.RemoteAddr, Since: time.Now().UTC(), Seq: from}
+	rs.mu.Lock()
+	rs.streams[stream] = true
+	rs.mu.Unlock()
+	defer func() {
+		rs.mu.Lock()
+		delete(rs.streams, stream)
+		rs.mu.Unlock()
+	}()
+	rs.s.logger.Info("replica connected", "addr", r.RemoteAddr, "from", from)
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	bw := bufio.NewWriter(w)
+	flusher, _ := w.(http.Flusher)
+	ticker := time.NewTicker(replHeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		entries, last, notify, err := log.read(pos)
+		if err != nil {
+			// The replica fell behind, it reconnects and bootstraps
+			rs.s.logger.Warn("replica fell behind the replication log", "addr", r.RemoteAddr)
+			return
+		}
+		for _, e := range entries {
+			if err := writeFrame(bw, e.kind, e.data); err != nil {
+				return
+			}
+			pos++
+			rs.mu.Lock()
+			stream.Seq = e.seq
+			stream.Lag = last - e.seq
+			rs.mu.Unlock()
+		}
+		if err := bw.Flush(); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		select {
+		case <-notify:
+		case <-ticker.C:
+			if err := writeFrame(bw, frameHeartbeat, binary.LittleEndian.AppendUint64(nil, last)); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			rs.s.logger.Info("replica disconnected", "addr", r.RemoteAddr)
+			return
+		}
+	}
+}
+
+func (rs *replicationServer) handleCheckpoint(w http.ResponseWriter, r *http.Request) {
+	// Next to the data directory, so SST files can be hard linked
+	tmp, err := os.MkdirTemp(filepath.Dir(rs.s.dir), "."+filepath.Base(rs.s.dir)+"-checkpoint-")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, "data")
+	if err := rs.s.Checkpoint(dir); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	if err := writeTar(w, dir); err != nil {
+		rs.s.logger.Error("sending checkpoint failed", "addr", r.RemoteAddr, "err", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// writeTar writes the regular files under dir as a tar stream.
+func writeTar(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		hdr := &tar.Header{Name: filepath.ToSlash(rel), Mode: 0644, Size: fi.Size(), ModTime: fi.ModTime()}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// primaryStatus is the replication status of a primary.
+type primaryStatus struct {
+	Role     string          `json:"role"`
+	Seq      uint64          `json:"seq"`
+	LogBase  uint64          `json:"log_base"` // replicas before it have to bootstrap
+	Replicas []replicaStream `json:"replicas"`
+}
+
+func (rs *replicationServer) Status() primaryStatus {
+	rs.s.repl.mu.Lock()
+	status := primaryStatus{Role: "primary", Seq: rs.s.repl.last, LogBase: rs.s.repl.base, Replicas: []replicaStream{}}
+	rs.s.repl.mu.Unlock()
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for stream := range rs.streams {
+		status.Replicas = append(status.Replicas, *stream)
+	}
+	return status
+}
+
+func (rs *replicationServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, rs.Status())
+}
+
+// replica follows a primary, applying its writes to a store that is
+// read-only otherwise.
+type replica struct {
+	s       *store
+	primary string // base URL of the primary
+	opts    storeOptions
+	client  *http.Client
+	token   string // sent to primaries started with -auth
+	cancel  context.CancelFunc
+	done    chan struct{}
+
+	mu         sync.Mutex
+	primarySeq uint64
+	applied    uint64
+	caughtUp   time.Time // when applied last reached primarySeq
+	connected  bool
+	bootstraps int
+	lastErr    string
+}
+
+// replicaConfig is how a replica connects to its primary.
+type replicaConfig struct {
+	// Token authenticates the replica to a primary started with -auth,
+	// where it needs admin on every namespace
+	Token string
+	// TLS, if set, is the TLS configuration of the connections to https
+	// primaries
+	TLS *tls.Config
+}
+
+// startReplica makes s a read-only replica of the primary served at the
+// given URL, reopening it with opts when it bootstraps.
+func startReplica(s *store, primary string, opts storeOptions, config replicaConfig) *replica {
+	s.mu.Lock()
+	s.readOnly = true
+	seq := s.seq
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &replica{
+		s:        s,
+		primary:  strings.TrimSuffix(primary, "/"),
+		opts:     opts,
+		client:   httpClient(config.TLS, 0),
+		token:    config.Token,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		applied:  seq,
+		caughtUp: time.Now(),
+	}
+	go r.run(ctx)
+	return r
+}
+
+// Close stops following the primary. The store stays read-only.
+func (r *replica) Close() {
+	r.cancel()
+	<-r.done
+}
+
+func (r *replica) run(ctx context.Context) {
+	defer close(r.done)
+	for ctx.Err() == nil {
+		err := r.follow(ctx)
+		if errors.Is(err, errNeedBootstrap) {
+			r.s.logger.Info("bootstrapping replica from a checkpoint", "primary", r.primary, "reason", err)
+			if err = r.bootstrap(ctx); err == nil {
+				continue
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			r.s.logger.Warn("replication failed, retrying", "primary", r.primary, "err", err)
+			r.mu.Lock()
+			r.lastErr = err.Error()
+			r.mu.Unlock()
+		}
+		select {
+		case <-time.After(replRetryInterval):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// get requests a path of the primary, with the token of the replica.
+func (r *replica) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", r.primary+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	return r.client.Do(req)
+}
+
+// follow streams the writes of the primary until the connection ends.
+func (r *replica) follow(ctx context.Context) error {
+	r.s.mu.RLock()
+	from := r.s.seq
+	r.s.mu.RUnlock()
+
+	resp, err := r.get(ctx, fmt.Sprintf("/replication/stream?from=%d", from))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusGone:
+		return errNeedBootstrap
+	default:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("primary answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	r.setConnected(true)
+	defer r.setConnected(false)
+	br := bufio.NewReader(resp.Body)
+	for {
+		kind, payload, err := readFrame(br)
+		if err != nil {
+			if err == io.EOF || ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		var primarySeq uint64
+		switch kind {
+		case frameBatch:
+			b, err := decodeBatch(payload)
+			if err != nil {
+				return err
+			}
+			if err := r.applyBatch(b); err != nil {
+				return err
+			}
+			primarySeq = b.seq
+		case frameNamespace:
+			if err := r.createNamespace(payload); err != nil {
+				return err
+			}
+		case frameHeartbeat:
+			if len(payload) != 8 {
+				return errors.New("corrupt heartbeat")
+			}
+			primarySeq = binary.LittleEndian.Uint64(payload)
+		default:
+			return fmt.Errorf("unknown replication frame %q", kind)
+		}
+		r.progress(primarySeq)
+	}
+}
+
+// applyBatch logs and applies a batch of the primary with its sequence
+// number. Batches already applied are skipped.
+func (r *replica) applyBatch(b *writeBatch) error {
+	s := r.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if b.seq <= s.seq {
+		return nil
+	}
+	for _, op := range b.ops {
+		if _, ok := s.namespaces[op.ns]; !ok {
+			return fmt.Errorf("%w: %s: %v", errNeedBootstrap, op.ns, errNamespaceNotFound)
+		}
+	}
+	s.seq = b.seq
+	if len(b.ops) == 1 && b.ops[0].op == opDropNS {
+		return s.dropNamespaceLocked(b.ops[0].ns, b.seq)
+	}
+	return s.commitLocked(b)
+}
+
+func (r *replica) createNamespace(payload []byte) error {
+	if len(payload) < 10 {
+		return errors.New("corrupt namespace frame")
+	}
+	n := int(binary.LittleEndian.Uint16(payload[8:10]))
+	if len(payload) < 10+n {
+		return errors.New("corrupt namespace frame")
+	}
+	name := string(payload[10 : 10+n])
+	var opts nsOptions
+	if err := json.Unmarshal(payload[10+n:], &opts); err != nil {
+		return err
+	}
+
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	if _, ok := r.s.namespaces[name]; ok {
+		return nil
+	}
+	_, err := r.s.createNamespaceLocked(name, opts)
+	return err
+}
+
+// bootstrap replaces the data of the store with a checkpoint of the primary.
+func (r *replica) bootstrap(ctx context.Context) error {
+	resp, err := r.get(ctx, "/replication/checkpoint")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("primary answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	s := r.s
+	tmp := s.dir + ".bootstrap"
+	os.RemoveAll(tmp)
+	defer os.RemoveAll(tmp)
+	if err := extractTar(resp.Body, tmp); err != nil {
+		return err
+	}
+	if err := s.restoreFrom(tmp, r.opts); err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	seq := s.seq
+	s.mu.RUnlock()
+	r.mu.Lock()
+	r.bootstraps++
+	r.applied = seq
+	r.mu.Unlock()
+	s.logger.Info("replica bootstrapped", "primary", r.primary, "seq", seq)
+	return nil
+}
+
+// restoreFrom replaces the data of the store with the store in dir, such as
+// a checkpoint, moving dir in place of the data directory. The previous
+// data is kept until dir opens, and reopened if anything fails, with dir
+// moved back where it was.
+func (s *store) restoreFrom(dir string, opts storeOptions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name, mem := range s.namespaces {
+		mem.file.closeFile()
+		mem.vlog.Close()
+		s.tables.evictDir(s.nsDir(name))
+	}
+	s.wal.file.Close()
+	// reopen opens the previous data again after err
+	reopen := func(err error) error {
+		o, rerr := openStoreKeys(s.dir, opts, s.keys)
+		if rerr != nil {
+			return fmt.Errorf("%v, and reopening the previous data failed: %v", err, rerr)
+		}
+		s.replaceLocked(o)
+		return err
+	}
+
+	old := s.dir + ".old"
+	os.RemoveAll(old)
+	if err := os.Rename(s.dir, old); err != nil {
+		return reopen(err)
+	}
+	if err := os.Rename(dir, s.dir); err != nil {
+		if rerr := os.Rename(old, s.dir); rerr != nil {
+			return fmt.Errorf("%v, and restoring the previous data failed: %v, it is in %s", err, rerr, old)
+		}
+		return reopen(err)
+	}
+	o, err := openStoreKeys(s.dir, opts, s.keys)
+	if err != nil {
+		err = fmt.Errorf("error opening %s: %w", dir, err)
+		if rerr := os.Rename(s.dir, dir); rerr != nil {
+			return fmt.Errorf("%v, and moving it back failed: %v, the previous data is in %s", err, rerr, old)
+		}
+		if rerr := os.Rename(old, s.dir); rerr != nil {
+			return fmt.Errorf("%v, and restoring the previous data failed: %v, it is in %s", err, rerr, old)
+		}
+		return reopen(err)
+	}
+	os.RemoveAll(old)
+	s.replaceLocked(o)
+	// The writes in between are not known
+	s.watchers.closeAll(errWatchRestored)
+	s.watchers.reset(s.seq)
+	return nil
+}
+
+// replaceLocked takes over the data of o, a store freshly opened on the
+// same directory. Namespaces that exist in both keep their memDB, so
+// references to them stay valid.
+func (s *store) replaceLocked(o *store) {
+	for name, mem := range o.namespaces {
+		if cur, ok := s.namespaces[name]; ok {
+			*cur = *mem
+			mem = cur
+			o.namespaces[name] = cur
+		}
+		mem.store = s
+	}
+	s.seq = o.seq
+	s.wal = o.wal
+	s.namespaces = o.namespaces
+	s.tables = o.tables
+	s.blocks = o.blocks
+}
+
+// extractTar writes the regular files of a tar stream under dir.
+func extractTar(r io.Reader, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.FromSlash(hdr.Name)
+		if hdr.Typeflag != tar.TypeReg || !filepath.IsLocal(name) {
+			return fmt.Errorf("unexpected entry %q in checkpoint", hdr.Name)
+		}
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, tr); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+}
+
+func (r *replica) setConnected(connected bool) {
+	r.mu.Lock()
+	r.connected = connected
+	r.mu.Unlock()
+}
+
+// progress records the sequence number applied and the primary's latest
+// one, if known.
+func (r *replica) progress(primarySeq uint64) {
+	r.s.mu.RLock()
+	applied := r.s.seq
+	r.s.mu.RUnlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.applied = applied
+	if primarySeq > r.primarySeq {
+		r.primarySeq = primarySeq
+	}
+	if r.applied >= r.primarySeq {
+		r.caughtUp = time.Now()
+		r.lastErr = ""
+	}
+}
+
+// replicaStatus is the replication status of a replica. Lag is the number
+// of batches of the primary not applied yet, LagSeconds the time since the
+// replica last had all of them.
+type replicaStatus struct {
+	Role       string  `json:"role"`
+	Primary    string  `json:"primary"`
+	Connected  bool    `json:"connected"`
+	Seq        uint64  `json:"seq"`
+	PrimarySeq uint64  `json:"primary_seq"`
+	Lag        uint64  `json:"lag"`
+	LagSeconds float64 `json:"lag_seconds"`
+	Bootstraps int     `json:"bootstraps"`
+	LastError  string  `json:"last_error,omitempty"`
+}
+
+func (r *replica) Status() replicaStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := replicaStatus{
+		Role:       "replica",
+		Primary:    r.primary,
+		Connected:  r.connected,
+		Seq:        r.applied,
+		PrimarySeq: r.primarySeq,
+		Bootstraps: r.bootstraps,
+		LastError:  r.lastErr,
+	}
+	if r.primarySeq > r.applied {
+		status.Lag = r.primarySeq - r.applied
+		status.LagSeconds = time.Since(r.caughtUp).Seconds()
+	}
+	return status
+}
+
+func (r *replica) handleStatus(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, r.Status())
+}
+
+func (r *replica) writeMetrics(w io.Writer) {
+	status := r.Status()
+	writeHeader(w, "kv_replication_lag", "gauge", "Batches of the primary the replica has not applied yet.")
+	fmt.Fprintf(w, "kv_replication_lag %d\n", status.Lag)
+	writeHeader(w, "kv_replication_lag_seconds", "gauge", "Time since the replica last had every batch of the primary.")
+	fmt.Fprintf(w, "kv_replication_lag_seconds %g\n", status.LagSeconds)
+	connected := 0
+	if status.Connected {
+		connected = 1
+	}
+	writeHeader(w, "kv_replication_connected", "gauge", "Whether the replica is streaming from its primary.")
+	fmt.Fprintf(w, "kv_replication_connected %d\n", connected)
+}
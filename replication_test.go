@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func serveLoopback(t *testing.T, h http.Handler) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	srv := &http.Server{Handler: h}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return "http://" + l.Addr().String()
+}
+
+func storeSeq(s *store) uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.seq
+}
+
+func waitForSeq(t *testing.T, replica, primary *store) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for storeSeq(replica) != storeSeq(primary) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Replica stuck at seq %d, primary at %d", storeSeq(replica), storeSeq(primary))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	dir := t.TempDir()
+	primary, err := openStore(filepath.Join(dir, "primary"))
+	if err != nil {
+		t.Fatalf("Error opening primary: %v", err)
+	}
+	rs := newReplicationServer(primary, 1<<20)
+	r := mux.NewRouter()
+	rs.register(r)
+	url := serveLoopback(t, r)
+
+	pdb := primary.namespaces[defaultNamespace]
+	pdb.Set([]byte("a"), []byte("1"))
+	users, err := primary.CreateNamespace("users", nsOptions{})
+	if err != nil {
+		t.Fatalf("Error creating namespace: %v", err)
+	}
+	users.Set([]byte("u1"), []byte("alice"))
+
+	s, err := openStore(filepath.Join(dir, "replica"))
+	if err != nil {
+		t.Fatalf("Error opening replica: %v", err)
+	}
+	rdb := s.namespaces[defaultNamespace]
+	rep := startReplica(s, url, defaultStoreOptions(), replicaConfig{})
+	waitForSeq(t, s, primary)
+
+	if got, err := rdb.Get([]byte("a")); err != nil || string(got) != "1" {
+		t.Errorf("Expected a=1 on the replica, got %q, %v", got, err)
+	}
+	rusers, err := s.Namespace("users")
+	if err != nil {
+		t.Fatalf("Expected the namespace to be replicated: %v", err)
+	}
+	if got, err := rusers.Get([]byte("u1")); err != nil || string(got) != "alice" {
+		t.Errorf("Expected u1=alice on the replica, got %q, %v", got, err)
+	}
+	if err := rdb.Set([]byte("x"), []byte("y")); !errors.Is(err, errReadOnly) {
+		t.Errorf("Expected %v writing to the replica, got %v", errReadOnly, err)
+	}
+
+	// Writes made while streaming
+	if err := primary.DropNamespace("users"); err != nil {
+		t.Fatalf("Error dropping namespace: %v", err)
+	}
+	pdb.Set([]byte("b"), []byte("2"))
+	waitForSeq(t, s, primary)
+	if _, err := s.Namespace("users"); err == nil {
+		t.Errorf("Expected the drop to be replicated")
+	}
+	if status := rep.Status(); status.Lag != 0 || status.Bootstraps != 0 {
+		t.Errorf("Unexpected replica status %+v", status)
+	}
+	if status := rs.Status(); len(status.Replicas) != 1 || status.Replicas[0].Seq != status.Seq {
+		t.Errorf("Unexpected primary status %+v", status)
+	}
+	rep.Close()
+
+	// The replica falls behind what the primary keeps and bootstraps
+	primary.repl.mu.Lock()
+	primary.repl.maxBytes = 1
+	primary.repl.mu.Unlock()
+	pdb.Set([]byte("c"), []byte("3"))
+	primary.repl.mu.Lock()
+	primary.repl.maxBytes = 1 << 20
+	primary.repl.mu.Unlock()
+
+	rep = startReplica(s, url, defaultStoreOptions(), replicaConfig{})
+	defer rep.Close()
+	waitForSeq(t, s, primary)
+	pdb.Set([]byte("d"), []byte("4"))
+	waitForSeq(t, s, primary)
+
+	if status := rep.Status(); status.Bootstraps != 1 {
+		t.Errorf("Expected 1 bootstrap, got %+v", status)
+	}
+	for key, want := range map[string]string{"a": "1", "b": "2", "c": "3", "d": "4"} {
+		// rdb was opened before the bootstrap and must still work
+		if got, err := rdb.Get([]byte(key)); err != nil || string(got) != want {
+			t.Errorf("Expected %s=%s on the replica, got %q, %v", key, want, got, err)
+		}
+	}
+}
+
+func TestRestoreFromFailure(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openStore(filepath.Join(dir, "data"))
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	db := s.namespaces[defaultNamespace]
+	db.Set([]byte("a"), []byte("1"))
+
+	// A directory in place of the WAL fails to open
+	bad := filepath.Join(dir, "bad")
+	if err := os.MkdirAll(filepath.Join(bad, walFileName), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.restoreFrom(bad, defaultStoreOptions()); err == nil {
+		t.Fatalf("Expected restoring a broken store to fail")
+	}
+	if _, err := os.Stat(filepath.Join(bad, walFileName)); err != nil {
+		t.Errorf("Expected the restored directory to be moved back: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "data.old")); !os.IsNotExist(err) {
+		t.Errorf("Expected no previous data left aside, got %v", err)
+	}
+	if got, err := db.Get([]byte("a")); err != nil || string(got) != "1" {
+		t.Errorf("Expected a=1 after the failed restore, got %q, %v", got, err)
+	}
+	if err := db.Set([]byte("b"), []byte("2")); err != nil {
+		t.Fatalf("Error writing after the failed restore: %v", err)
+	}
+	s2, err := openStore(filepath.Join(dir, "data"))
+	if err != nil {
+		t.Fatalf("Error reopening store: %v", err)
+	}
+	for key, want := range map[string]string{"a": "1", "b": "2"} {
+		if got, err := s2.namespaces[defaultNamespace].Get([]byte(key)); err != nil || string(got) != want {
+			t.Errorf("Expected %s=%s after reopening, got %q, %v", key, want, got, err)
+		}
+	}
+}
+
+func TestReplicaBootstrapsInRelativeDir(t *testing.T) {
+	dir := t.TempDir()
+	primary, err := openStore(filepath.Join(dir, "primary"))
+	if err != nil {
+		t.Fatalf("Error opening primary: %v", err)
+	}
+	// A log too small to keep any batch makes replicas bootstrap
+	r := mux.NewRouter()
+	newReplicationServer(primary, 1).register(r)
+	url := serveLoopback(t, r)
+	primary.namespaces[defaultNamespace].Set([]byte("a"), []byte("1"))
+
+	// The replica runs on ".", the default -dir
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Mkdir(filepath.Join(dir, "replica"), 0755)
+	if err := os.Chdir(filepath.Join(dir, "replica")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	s, err := openStore(".")
+	if err != nil {
+		t.Fatalf("Error opening replica: %v", err)
+	}
+	rep := startReplica(s, url, defaultStoreOptions(), replicaConfig{})
+	defer rep.Close()
+	waitForSeq(t, s, primary)
+	if got, err := s.namespaces[defaultNamespace].Get([]byte("a")); err != nil || string(got) != "1" {
+		t.Errorf("Expected a=1 on the replica, got %q, %v", got, err)
+	}
+	if status := rep.Status(); status.Bootstraps == 0 {
+		t.Errorf("Expected the replica to bootstrap, got %+v", status)
+	}
+}
@@ -0,0 +1,722 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The Redis front end speaks RESP2, or RESP3 once a client sends HELLO 3,
+// and maps a subset of the Redis commands onto one namespace of the store,
+// the default one unless the client SELECTs another. Every connection is
+// served by its own goroutine; replies are buffered and only flushed once
+// every pipelined command already received has been answered.
+
+const maxRESPBulkSize = 512 << 20
+
+// respMaxCursors is the number of SCAN cursors a connection keeps; older
+// ones, such as those of abandoned scans, become invalid.
+const respMaxCursors = 64
+
+var (
+	errRESPProtocol = errors.New("ERR Protocol error")
+	errRESPSyntax   = errors.New("ERR syntax error")
+	errRESPNotInt   = errors.New("ERR value is not an integer or out of range")
+)
+
+// respServer serves the Redis protocol for a store.
+type respServer struct {
+	store    *store
+	clients  atomic.Int64
+	commands atomic.Uint64
+}
+
+// serveRESP accepts connections on l until it is closed.
+func serveRESP(l net.Listener, s *store) error {
+	srv := &respServer{store: s}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go srv.serveConn(conn)
+	}
+}
+
+// respConn is the state of one client connection.
+type respConn struct {
+	srv   *respServer
+	r     *bufio.Reader
+	w     *bufio.Writer
+	proto int
+	mem   *memDB
+
+	// SCAN cursors handed out to the client, mapped to the key to resume at;
+	// only the latest respMaxCursors are kept
+	cursors    map[uint64]string
+	nextCursor uint64
+}
+
+func (srv *respServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	srv.clients.Add(1)
+	defer srv.clients.Add(-1)
+
+	mem, err := srv.store.Namespace(defaultNamespace)
+	if err != nil {
+		return
+	}
+	c := &respConn{
+		srv:     srv,
+		r:       bufio.NewReader(conn),
+		w:       bufio.NewWriter(conn),
+		proto:   2,
+		mem:     mem,
+		cursors: make(map[uint64]string),
+	}
+
+	for {
+		args, err := c.readCommand()
+		if err != nil {
+			if errors.Is(err, errRESPProtocol) {
+				c.writeError(err)
+				c.w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		srv.commands.Add(1)
+		quit := c.execute(args)
+		if quit || c.r.Buffered() == 0 {
+			if err := c.w.Flush(); err != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// readCommand reads either a RESP array of bulk strings or an inline
+// command, as sent by telnet.
+func (c *respConn) readCommand() ([][]byte, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		var args [][]byte
+		for _, field := range strings.Fields(line) {
+			args = append(args, []byte(field))
+		}
+		return args, nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > 1<<20 {
+		return nil, errRESPProtocol
+	}
+	args := make([][]byte, 0, max(n, 0))
+	for i := 0; i < n; i++ {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errRESPProtocol
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > maxRESPBulkSize {
+			return nil, errRESPProtocol
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		if buf[size] != '\r' || buf[size+1] != '\n' {
+			return nil, errRESPProtocol
+		}
+		args = append(args, buf[:size])
+	}
+	return args, nil
+}
+
+func (c *respConn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (c *respConn) writeSimple(s string) {
+	fmt.Fprintf(c.w, "+%s\r\n", s)
+}
+
+func (c *respConn) writeError(err error) {
+	msg := err.Error()
+	if !strings.HasPrefix(msg, "ERR ") && !strings.HasPrefix(msg, "NOPROTO ") {
+		msg = "ERR " + msg
+	}
+	fmt.Fprintf(c.w, "-%s\r\n", strings.ReplaceAll(msg, "\r\n", " "))
+}
+
+func (c *respConn) writeInt(n int64) {
+	fmt.Fprintf(c.w, ":%d\r\n", n)
+}
+
+func (c *respConn) writeBulk(b []byte) {
+	fmt.Fprintf(c.w, "$%d\r\n", len(b))
+	c.w.Write(b)
+	c.w.WriteString("\r\n")
+}
+
+func (c *respConn) writeNull() {
+	if c.proto == 3 {
+		c.w.WriteString("_\r\n")
+		return
+	}
+	c.w.WriteString("$-1\r\n")
+}
+
+func (c *respConn) writeArray(n int) {
+	fmt.Fprintf(c.w, "*%d\r\n", n)
+}
+
+// writeMap starts a map of n pairs, sent as a flat array to RESP2 clients.
+func (c *respConn) writeMap(n int) {
+	if c.proto == 3 {
+		fmt.Fprintf(c.w, "%%%d\r\n", n)
+		return
+	}
+	c.writeArray(2 * n)
+}
+
+func wrongArgs(name string) error {
+	return fmt.Errorf("ERR wrong number of arguments for '%s' command", strings.ToLower(name))
+}
+
+// execute runs one command and writes its reply. It returns true if the
+// connection must be closed.
+func (c *respConn) execute(args [][]byte) bool {
+	name := strings.ToUpper(string(args[0]))
+	var err error
+	switch name {
+	case "PING":
+		err = c.ping(args[1:])
+	case "HELLO":
+		err = c.hello(args[1:])
+	case "SELECT":
+		err = c.selectNS(args[1:])
+	case "GET":
+		err = c.get(args[1:])
+	case "SET":
+		err = c.set(args[1:])
+	case "DEL":
+		err = c.del(args[1:])
+	case "EXISTS":
+		err = c.exists(args[1:])
+	case "MGET":
+		err = c.mget(args[1:])
+	case "MSET":
+		err = c.mset(args[1:])
+	case "SCAN":
+		err = c.scan(args[1:])
+	case "INCR":
+		err = c.incrBy(name, args[1:], 1)
+	case "DECR":
+		err = c.incrBy(name, args[1:], -1)
+	case "INCRBY", "DECRBY":
+		if len(args) != 3 {
+			err = wrongArgs(name)
+			break
+		}
+		delta, perr := strconv.ParseInt(string(args[2]), 10, 64)
+		if perr != nil || (name == "DECRBY" && delta == math.MinInt64) {
+			err = errRESPNotInt
+			break
+		}
+		if name == "DECRBY" {
+			delta = -delta
+		}
+		err = c.incrBy(name, args[1:2], delta)
+	case "TTL":
+		err = c.ttl(name, args[1:], time.Second)
+	case "PTTL":
+		err = c.ttl(name, args[1:], time.Millisecond)
+	case "INFO":
+		err = c.info()
+	case "COMMAND":
+		c.writeArray(0)
+	case "CLIENT":
+		c.writeSimple("OK")
+	case "QUIT":
+		c.writeSimple("OK")
+		return true
+	default:
+		err = fmt.Errorf("ERR unknown command '%s'", strings.ToLower(name))
+	}
+	if err != nil {
+		c.writeError(err)
+	}
+	return false
+}
+
+func (c *respConn) ping(args [][]byte) error {
+	switch len(args) {
+	case 0:
+		c.writeSimple("PONG")
+	case 1:
+		c.writeBulk(args[0])
+	default:
+		return wrongArgs("ping")
+	}
+	return nil
+}
+
+// hello switches the protocol version and describes the server.
+func (c *respConn) hello(args [][]byte) error {
+	if len(args) > 0 {
+		proto, err := strconv.Atoi(string(args[0]))
+		if err != nil || proto < 2 || proto > 3 {
+			return errors.New("NOPROTO unsupported protocol version")
+		}
+		c.proto = proto
+	}
+
+	c.writeMap(5)
+	c.writeBulk([]byte("server"))
+	c.writeBulk([]byte("kv"))
+	c.writeBulk([]byte("version"))
+	c.writeBulk([]byte("7.0.0"))
+	c.writeBulk([]byte("proto"))
+	c.writeInt(int64(c.proto))
+	c.writeBulk([]byte("mode"))
+	c.writeBulk([]byte("standalone"))
+	c.writeBulk([]byte("role"))
+	c.writeBulk([]byte("master"))
+	return nil
+}
+
+// selectNS switches the connection to another namespace. Database 0 is the
+// default namespace.
+func (c *respConn) selectNS(args [][]byte) error {
+	if len(args) != 1 {
+		return wrongArgs("select")
+	}
+	name := string(args[0])
+	if name == "0" {
+		name = defaultNamespace
+	}
+	mem, err := c.srv.store.Namespace(name)
+	if err != nil {
+		return err
+	}
+	c.mem = mem
+	c.writeSimple("OK")
+	return nil
+}
+
+func (c *respConn) get(args [][]byte) error {
+	if len(args) != 1 {
+		return wrongArgs("get")
+	}
+	entry, found, err := c.mem.Lookup(string(args[0]))
+	if err != nil {
+		return err
+	}
+	if !found {
+		c.writeNull()
+		return nil
+	}
+	c.writeBulk([]byte(entry.value))
+	return nil
+}
+
+// set implements SET key value [EX seconds|PX milliseconds|KEEPTTL] [NX|XX] [GET].
+func (c *respConn) set(args [][]byte) error {
+	if len(args) < 2 {
+		return wrongArgs("set")
+	}
+	key, value := args[0], args[1]
+
+	var (
+		ttl                  time.Duration
+		nx, xx, keepTTL, get bool
+	)
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToUpper(string(args[i])); opt {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "KEEPTTL":
+			keepTTL = true
+		case "GET":
+			get = true
+		case "EX", "PX":
+			if i+1 >= len(args) || ttl != 0 {
+				return errRESPSyntax
+			}
+			i++
+			n, err := strconv.ParseInt(string(args[i]), 10, 64)
+			if err != nil {
+				return errRESPNotInt
+			}
+			if n <= 0 || n > math.MaxInt64/int64(time.Second) {
+				return errors.New("ERR invalid expire time in 'set' command")
+			}
+			ttl = time.Duration(n) * time.Millisecond
+			if opt == "EX" {
+				ttl = time.Duration(n) * time.Second
+			}
+		default:
+			return errRESPSyntax
+		}
+	}
+	if (nx && xx) || (keepTTL && ttl != 0) {
+		return errRESPSyntax
+	}
+
+	var (
+		old     memEntry
+		found   bool
+		written bool
+	)
+	err := c.mem.Update(func(tx *memTxn) error {
+		var err error
+		old, found, err = tx.Get(string(key))
+		if err != nil {
+			return err
+		}
+		if (nx && found) || (xx && !found) {
+			return nil
+		}
+
+		var expires int64
+		if ttl != 0 {
+			expires = time.Now().Add(ttl).UnixNano()
+		} else if keepTTL && found {
+			expires = old.expires
+		}
+		tx.Put(key, value, expires)
+		written = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case get && found:
+		c.writeBulk([]byte(old.value))
+	case get || !written:
+		c.writeNull()
+	default:
+		c.writeSimple("OK")
+	}
+	return nil
+}
+
+func (c *respConn) del(args [][]byte) error {
+	if len(args) == 0 {
+		return wrongArgs("del")
+	}
+	var deleted int64
+	err := c.mem.Update(func(tx *memTxn) error {
+		for _, key := range args {
+			_, found, err := tx.Get(string(key))
+			if err != nil {
+				return err
+			}
+			if found {
+				tx.Delete(key)
+				deleted++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	c.writeInt(deleted)
+	return nil
+}
+
+func (c *respConn) exists(args [][]byte) error {
+	if len(args) == 0 {
+		return wrongArgs("exists")
+	}
+	var count int64
+	for _, key := range args {
+		_, found, err := c.mem.Lookup(string(key))
+		if err != nil {
+			return err
+		}
+		if found {
+			count++
+		}
+	}
+	c.writeInt(count)
+	return nil
+}
+
+func (c *respConn) mget(args [][]byte) error {
+	if len(args) == 0 {
+		return wrongArgs("mget")
+	}
+	entries := make([]*memEntry, len(args))
+	for i, key := range args {
+		entry, found, err := c.mem.Lookup(string(key))
+		if err != nil {
+			return err
+		}
+		if found {
+			entries[i] = &entry
+		}
+	}
+
+	c.writeArray(len(entries))
+	for _, entry := range entries {
+		if entry == nil {
+			c.writeNull()
+			continue
+		}
+		c.writeBulk([]byte(entry.value))
+	}
+	return nil
+}
+
+func (c *respConn) mset(args [][]byte) error {
+	if len(args) == 0 || len(args)%2 != 0 {
+		return wrongArgs("mset")
+	}
+	err := c.mem.Update(func(tx *memTxn) error {
+		for i := 0; i < len(args); i += 2 {
+			tx.Put(args[i], args[i+1], 0)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	c.writeSimple("OK")
+	return nil
+}
+
+// scan implements SCAN cursor [MATCH pattern] [COUNT count]. Keys are
+// walked in order; the cursor handed back to the client stands for the key
+// the next call resumes at.
+func (c *respConn) scan(args [][]byte) error {
+	if len(args) == 0 {
+		return wrongArgs("scan")
+	}
+	cursor, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil {
+		return errors.New("ERR invalid cursor")
+	}
+	pattern, count := "*", 10
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return errRESPSyntax
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern = string(args[i+1])
+		case "COUNT":
+			count, err = strconv.Atoi(string(args[i+1]))
+			if err != nil || count < 1 {
+				return errRESPSyntax
+			}
+		default:
+			return errRESPSyntax
+		}
+	}
+
+	var start string
+	if cursor != 0 {
+		var ok bool
+		start, ok = c.cursors[cursor]
+		if !ok {
+			return errors.New("ERR invalid cursor")
+		}
+		delete(c.cursors, cursor)
+	}
+
+	entries, err := c.mem.Scan(start, count+1)
+	if err != nil {
+		return err
+	}
+	var next uint64
+	if len(entries) > count {
+		c.nextCursor++
+		next = c.nextCursor
+		c.cursors[next] = entries[count].key
+		delete(c.cursors, next-respMaxCursors)
+		entries = entries[:count]
+	}
+
+	var keys []string
+	for _, entry := range entries {
+		if globMatch(pattern, entry.key) {
+			keys = append(keys, entry.key)
+		}
+	}
+	c.writeArray(2)
+	c.writeBulk([]byte(strconv.FormatUint(next, 10)))
+	c.writeArray(len(keys))
+	for _, key := range keys {
+		c.writeBulk([]byte(key))
+	}
+	return nil
+}
+
+// incrBy adds delta to the integer stored at key, keeping its expiry. A
+// missing key counts as 0.
+func (c *respConn) incrBy(name string, args [][]byte, delta int64) error {
+	if len(args) != 1 {
+		return wrongArgs(name)
+	}
+	var n int64
+	err := c.mem.Update(func(tx *memTxn) error {
+		cur, found, err := tx.Get(string(args[0]))
+		if err != nil {
+			return err
+		}
+		if found {
+			n, err = strconv.ParseInt(cur.value, 10, 64)
+			if err != nil {
+				return errRESPNotInt
+			}
+		}
+		if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+			return errors.New("ERR increment or decrement would overflow")
+		}
+		n += delta
+		tx.Put(args[0], []byte(strconv.FormatInt(n, 10)), cur.expires)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	c.writeInt(n)
+	return nil
+}
+
+// ttl replies with the time key has left to live in units, -1 if it never
+// expires and -2 if it does not exist.
+func (c *respConn) ttl(name string, args [][]byte, unit time.Duration) error {
+	if len(args) != 1 {
+		return wrongArgs(name)
+	}
+	entry, found, err := c.mem.Lookup(string(args[0]))
+	if err != nil {
+		return err
+	}
+	switch {
+	case !found:
+		c.writeInt(-2)
+	case entry.expires == 0:
+		c.writeInt(-1)
+	default:
+		left := time.Until(time.Unix(0, entry.expires))
+		c.writeInt(int64((left + unit/2) / unit))
+	}
+	return nil
+}
+
+func (c *respConn) info() error {
+	stats, err := c.srv.store.Stats()
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Server\r\nredis_version:7.0.0\r\nkv_mode:standalone\r\n")
+	fmt.Fprintf(&b, "\r\n# Clients\r\nconnected_clients:%d\r\n", c.srv.clients.Load())
+	fmt.Fprintf(&b, "\r\n# Stats\r\ntotal_commands_processed:%d\r\n", c.srv.commands.Load())
+	fmt.Fprintf(&b, "block_cache_hits:%d\r\nblock_cache_misses:%d\r\n", stats.BlockCache.Hits, stats.BlockCache.Misses)
+	fmt.Fprintf(&b, "\r\n# Keyspace\r\n")
+	for _, ns := range stats.Namespaces {
+		fmt.Fprintf(&b, "%s:memtable_bytes=%d,sst_files=%d,data_bytes=%d,stored_bytes=%d,vlog_bytes=%d\r\n",
+			ns.Name, ns.MemtableBytes, ns.SSTFiles, ns.DataBytes, ns.StoredBytes, ns.VlogBytes)
+	}
+	c.writeBulk([]byte(b.String()))
+	return nil
+}
+
+// globMatch reports whether s matches a Redis style glob pattern: '*', '?',
+// character classes such as [a-z] or [^0-9], and '\' to escape. Unlike
+// path.Match, '*' also matches '/'. On a mismatch only the latest '*' takes
+// one more byte, so patterns like *a*a*b take linear time per '*'.
+func globMatch(pattern, s string) bool {
+	p, i := 0, 0
+	star, starI := -1, 0
+	for i < len(s) {
+		if p < len(pattern) && pattern[p] == '*' {
+			star, starI = p, i
+			p++
+			continue
+		}
+		if p < len(pattern) {
+			if n, ok := globMatchByte(pattern[p:], s[i]); ok {
+				p += n
+				i++
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		starI++
+		p, i = star+1, starI
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// globMatchByte matches c against the first element of pattern, which is
+// not '*', returning the length of the element.
+func globMatchByte(pattern string, c byte) (int, bool) {
+	switch pattern[0] {
+	case '?':
+		return 1, true
+	case '[':
+		end := strings.IndexByte(pattern[1:], ']')
+		if end < 0 {
+			return 0, false
+		}
+		class := pattern[1 : end+1]
+		negate := len(class) > 0 && class[0] == '^'
+		if negate {
+			class = class[1:]
+		}
+		matched := false
+		for i := 0; i < len(class); i++ {
+			if i+2 < len(class) && class[i+1] == '-' {
+				if class[i] <= c && c <= class[i+2] {
+					matched = true
+				}
+				i += 2
+			} else if class[i] == c {
+				matched = true
+			}
+		}
+		return end + 2, matched != negate
+	case '\\':
+		if len(pattern) > 1 {
+			return 2, pattern[1] == c
+		}
+	}
+	return 1, pattern[0] == c
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// respClient is a minimal RESP client: it sends commands as arrays of bulk
+// strings and decodes replies into strings, int64s, nil and slices.
+type respClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newRESPClient(t *testing.T) (*respClient, *store) {
+	s, err := openStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go serveRESP(l, s)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return &respClient{conn: conn, r: bufio.NewReader(conn)}, s
+}
+
+func encodeRESPCommand(args ...string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return b.String()
+}
+
+func (c *respClient) do(t *testing.T, args ...string) interface{} {
+	t.Helper()
+	if _, err := c.conn.Write([]byte(encodeRESPCommand(args...))); err != nil {
+		t.Fatalf("Error sending %v: %v", args, err)
+	}
+	return c.read(t)
+}
+
+func (c *respClient) read(t *testing.T) interface{} {
+	t.Helper()
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Error reading reply: %v", err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '+':
+		return line[1:]
+	case '-':
+		return fmt.Errorf("%s", line[1:])
+	case ':':
+		n, _ := strconv.ParseInt(line[1:], 10, 64)
+		return n
+	case '_':
+		return nil
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			t.Fatalf("Error reading bulk: %v", err)
+		}
+		return string(buf[:n])
+	case '*', '%':
+		n, _ := strconv.Atoi(line[1:])
+		if line[0] == '%' {
+			n *= 2
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			items[i] = c.read(t)
+		}
+		return items
+	}
+	t.Fatalf("Unexpected reply %q", line)
+	return nil
+}
+
+func TestRESP_Commands(t *testing.T) {
+	c, _ := newRESPClient(t)
+
+	tests := []struct {
+		args []string
+		want interface{}
+	}{
+		{[]string{"PING"}, "PONG"},
+		{[]string{"SET", "a", "1"}, "OK"},
+		{[]string{"GET", "a"}, "1"},
+		{[]string{"GET", "missing"}, nil},
+		{[]string{"SET", "a", "2", "NX"}, nil},
+		{[]string{"SET", "b", "2", "XX"}, nil},
+		{[]string{"SET", "a", "3", "XX", "GET"}, "1"},
+		{[]string{"INCR", "a"}, int64(4)},
+		{[]string{"INCR", "counter"}, int64(1)},
+		{[]string{"MSET", "k1", "v1", "k2", "v2"}, "OK"},
+		{[]string{"MGET", "k1", "nope", "k2"}, []interface{}{"v1", nil, "v2"}},
+		{[]string{"EXISTS", "k1", "k2", "nope"}, int64(2)},
+		{[]string{"DEL", "k1", "nope"}, int64(1)},
+		{[]string{"EXISTS", "k1"}, int64(0)},
+		{[]string{"TTL", "a"}, int64(-1)},
+		{[]string{"TTL", "nope"}, int64(-2)},
+		{[]string{"SET", "session", "x", "EX", "100"}, "OK"},
+		{[]string{"TTL", "session"}, int64(100)},
+		{[]string{"SET", "short", "x", "PX", "1"}, "OK"},
+	}
+	for _, tt := range tests {
+		if got := c.do(t, tt.args...); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: expected %#v, got %#v", tt.args, tt.want, got)
+		}
+	}
+
+	if err, ok := c.do(t, "INCR", "session").(error); !ok || !strings.Contains(err.Error(), "not an integer") {
+		t.Errorf("Expected INCR of a non integer to fail, got %v", err)
+	}
+	if err, ok := c.do(t, "SET", "a", "1", "EX").(error); !ok || !strings.HasPrefix(err.Error(), "ERR syntax") {
+		t.Errorf("Expected a syntax error, got %v", err)
+	}
+	if _, ok := c.do(t, "NOSUCH").(error); !ok {
+		t.Errorf("Expected unknown commands to fail")
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	if got := c.do(t, "GET", "short"); got != nil {
+		t.Errorf("Expected short to have expired, got %v", got)
+	}
+}
+
+func TestRESP_PipelineAndScan(t *testing.T) {
+	c, _ := newRESPClient(t)
+
+	// Send every command before reading any reply
+	var pipeline strings.Builder
+	for i := 0; i < 25; i++ {
+		pipeline.WriteString(encodeRESPCommand("SET", fmt.Sprintf("user:%02d", i), strconv.Itoa(i)))
+	}
+	pipeline.WriteString(encodeRESPCommand("SET", "other", "x"))
+	pipeline.WriteString(encodeRESPCommand("GET", "user:07"))
+	if _, err := c.conn.Write([]byte(pipeline.String())); err != nil {
+		t.Fatalf("Error writing pipeline: %v", err)
+	}
+	for i := 0; i < 26; i++ {
+		if got := c.read(t); got != "OK" {
+			t.Fatalf("Expected OK for command %d, got %v", i, got)
+		}
+	}
+	if got := c.read(t); got != "7" {
+		t.Fatalf("Expected 7, got %v", got)
+	}
+
+	var keys []string
+	cursor := "0"
+	for {
+		reply := c.do(t, "SCAN", cursor, "MATCH", "user:*", "COUNT", "10").([]interface{})
+		for _, key := range reply[1].([]interface{}) {
+			keys = append(keys, key.(string))
+		}
+		cursor = reply[0].(string)
+		if cursor == "0" {
+			break
+		}
+	}
+	if len(keys) != 25 || keys[0] != "user:00" || keys[24] != "user:24" {
+		t.Errorf("Expected the 25 user keys in order, got %v", keys)
+	}
+
+	// Only the latest cursors are kept
+	first := c.do(t, "SCAN", "0", "COUNT", "1").([]interface{})[0].(string)
+	for i := 0; i < respMaxCursors; i++ {
+		c.do(t, "SCAN", "0", "COUNT", "1")
+	}
+	if got, ok := c.do(t, "SCAN", first).(error); !ok || !strings.Contains(got.Error(), "invalid cursor") {
+		t.Errorf("Expected the oldest cursor to be dropped, got %v", got)
+	}
+}
+
+func TestRESP_HelloAndInline(t *testing.T) {
+	c, s := newRESPClient(t)
+	s.CreateNamespace("cache", nsOptions{})
+
+	hello := c.do(t, "HELLO", "3").([]interface{})
+	if len(hello) != 10 || hello[5] != int64(3) {
+		t.Errorf("Expected a RESP3 map with proto 3, got %v", hello)
+	}
+	if got := c.do(t, "GET", "missing"); got != nil {
+		t.Errorf("Expected a RESP3 null, got %v", got)
+	}
+
+	if got := c.do(t, "SELECT", "cache"); got != "OK" {
+		t.Fatalf("Expected to select the cache namespace, got %v", got)
+	}
+	c.conn.Write([]byte("SET inline value\r\nGET inline\r\n"))
+	if got := c.read(t); got != "OK" {
+		t.Errorf("Expected OK, got %v", got)
+	}
+	if got := c.read(t); got != "value" {
+		t.Errorf("Expected value, got %v", got)
+	}
+	mem, _ := s.Namespace("cache")
+	if v, err := mem.Get([]byte("inline")); err != nil || string(v) != "value" {
+		t.Errorf("Expected the key in the cache namespace, got %s (%v)", v, err)
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*", "a/b", true},
+		{"user:*", "user:1", true},
+		{"user:*", "users", false},
+		{"h?llo", "hello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"k[0-9]", "k5", true},
+		{`a\*`, "a*", true},
+		{`a\*`, "ab", false},
+		{"*a*b", "xaxxb", true},
+		{"*a*a*a*b", "aaaa", false},
+		{"a*", "a", true},
+		{"*?", "", false},
+		{"[a", "a", false},
+		{strings.Repeat("*a", 30) + "*b", strings.Repeat("a", 100), false},
+	}
+	for _, tt := range tests {
+		if got := globMatch(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("globMatch(%q, %q) = %v, expected %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+var (
+	errTransactionOpen    = errors.New("a transaction is already open")
+	errNoTransaction      = errors.New("no transaction is open")
+	errNotInTransaction   = errors.New("only set, mset and del can be used in a transaction")
+	errTransactionAborted = errors.New("transaction discarded because of an earlier error")
+	errNotCommitted       = errors.New("transaction not committed before the end of the script")
+)
+
+// replTxn holds the writes queued between begin and commit.
+type replTxn struct {
+	cmds    []Cmd
+	args    [][]string
+	aborted bool
+}
+
+// run runs cmd, or queues it when a transaction is open.
+func (re *Repl) run(cmd Cmd, elements []string) error {
+	if re.txn == nil || cmd == Begin || cmd == Commit || cmd == Rollback {
+		return re.runCmd(cmd, elements)
+	}
+
+	// A bad command discards the whole transaction, so that commit cannot
+	// apply only part of it
+	var err error
+	switch cmd {
+	case Set:
+		err = expectArgs(elements, 2, 2)
+	case Del:
+		err = expectArgs(elements, 1, 1)
+	case Mset:
+		if len(elements) == 0 || len(elements)%2 != 0 {
+			err = fmt.Errorf("Expected key value pairs, received %d arguments", len(elements))
+		}
+	default:
+		err = errNotInTransaction
+	}
+	if err != nil {
+		re.txn.aborted = true
+		return err
+	}
+	re.txn.cmds = append(re.txn.cmds, cmd)
+	re.txn.args = append(re.txn.args, elements)
+	fmt.Fprintln(re.out, "QUEUED")
+	return nil
+}
+
+func (re *Repl) begin() error {
+	if re.txn != nil {
+		return errTransactionOpen
+	}
+	re.txn = &replTxn{}
+	fmt.Fprintln(re.out, "OK")
+	return nil
+}
+
+// commit applies the queued writes as one batch, or none of them if one
+// fails, such as a del of a missing key.
+func (re *Repl) commit() error {
+	txn := re.txn
+	if txn == nil {
+		return errNoTransaction
+	}
+	re.txn = nil
+	if txn.aborted {
+		return errTransactionAborted
+	}
+
+	return re.db.Update(func(tx *memTxn) error {
+		for i, cmd := range txn.cmds {
+			args := txn.args[i]
+			switch cmd {
+			case Set, Mset:
+				for j := 0; j < len(args); j += 2 {
+					tx.Put([]byte(args[j]), []byte(args[j+1]), 0)
+				}
+			case Del:
+				_, found, err := tx.Get(args[0])
+				if err != nil {
+					return err
+				}
+				if !found {
+					return fmt.Errorf("del %s: key not found", args[0])
+				}
+				tx.Delete([]byte(args[0]))
+			}
+		}
+		return nil
+	})
+}
+
+// execOptions control how Exec runs a script.
+type execOptions struct {
+	JSON        bool // write one JSON object per command instead of plain text
+	StopOnError bool // stop at the first failing command
+}
+
+// execResult is the JSON line Exec writes for each command.
+type execResult struct {
+	Line    int      `json:"line"`
+	Command string   `json:"command"`
+	Output  []string `json:"output,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// Exec runs the commands read from re.in without prompts, for scripts.
+// Blank lines and lines starting with # are skipped. In plain output, what
+// the commands print is written as is and errors as "ERR line N: message".
+// It returns an error if any command failed, or if a transaction is left
+// open at the end of the script, in which case none of its writes are
+// applied.
+func (re *Repl) Exec(opts execOptions) error {
+	scanner := bufio.NewScanner(re.in)
+	out := re.out
+	defer func() { re.out = out }()
+
+	var (
+		lineNo int
+		failed int
+	)
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var buf bytes.Buffer
+		if opts.JSON {
+			re.out = &buf
+		}
+		cmd, elements, err := re.parseCmd([]byte(line))
+		if err == nil {
+			if cmd == Ext {
+				break
+			}
+			err = re.run(cmd, elements)
+		}
+		re.out = out
+
+		if opts.JSON {
+			result := execResult{Line: lineNo, Command: strings.Fields(line)[0]}
+			if buf.Len() > 0 {
+				result.Output = strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+			}
+			if err != nil {
+				result.Error = err.Error()
+			}
+			if err := json.NewEncoder(out).Encode(result); err != nil {
+				return err
+			}
+		} else if err != nil {
+			fmt.Fprintf(out, "ERR line %d: %s\n", lineNo, err)
+		}
+
+		if err != nil {
+			failed++
+			if opts.StopOnError {
+				re.txn = nil
+				return fmt.Errorf("line %d: %s", lineNo, err)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if re.txn != nil {
+		re.txn = nil
+		return errNotCommitted
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d commands failed", failed)
+	}
+	return nil
+}
+
+// runExec runs a script file, or stdin, against a local data directory.
+func runExec(args []string) error {
+	fs := flag.NewFlagSet("exec", flag.ExitOnError)
+	var sf storeFlags
+	sf.register(fs)
+	ns := fs.String("ns", defaultNamespace, "namespace the commands apply to")
+	jsonOut := fs.Bool("json", false, "write one JSON object per command")
+	stopOnError := fs.Bool("stop-on-error", false, "stop at the first failing command")
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		return errors.New("usage: kv exec [flags] [script]")
+	}
+
+	var in io.Reader = os.Stdin
+	if path := fs.Arg(0); path != "" && path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	s, err := sf.open()
+	if err != nil {
+		return err
+	}
+	mem, err := s.Namespace(*ns)
+	if err != nil {
+		return err
+	}
+	repl := &Repl{db: mem, in: in, out: os.Stdout}
+	return repl.Exec(execOptions{JSON: *jsonOut, StopOnError: *stopOnError})
+}
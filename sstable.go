@@ -0,0 +1,551 @@
+package main
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+)
+
+// Block based SST files are laid out as
+//
+//	header(16) data blocks... filter block index block footer(32)
+//
+// Every block is followed by a trailer holding the codec it is stored with
+// and a checksum of the stored bytes and the codec. The filter block is a
+// bloom filter of every key in the file, its size is recorded in the header
+// (files written before filters existed have 0 there). The index block is
+// never compressed and lists, for every data block, its last key and
+// location. The last 4 bytes of the header hold the ID of the key blocks are
+// encrypted with, 0 when they are not; encrypted blocks use their offset as
+// associated data, so they cannot be moved around.
+// Files written before blocks existed start with legacySSTMagic and are
+// decoded whole by readSSTEntries.
+const (
+	legacySSTMagic   = 12345
+	sstBlockMagic    = 0x4b565332 // "KVS2"
+	sstHeaderSize    = magicNumberSize + entryCountSize + keyLengthSize + keyLengthSize
+	sstFooterSize    = 32
+	blockTrailerSize = 5 // codec(1) + crc32(4)
+	sstBlockSize     = 4096
+
+	// entryHasSeq is set on the op of block entries followed by the sequence
+	// number they were written with. Entries written before sequence numbers
+	// were kept do not have it.
+	entryHasSeq = 0x80
+)
+
+var (
+	errCorruptSST  = errors.New("corrupt sst file")
+	errBadChecksum = errors.New("sst block checksum mismatch")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// blockHandle locates a block in an SST file. size does not include the
+// block trailer.
+type blockHandle struct {
+	lastKey string
+	offset  int64
+	size    int
+}
+
+type sstFooter struct {
+	indexOffset int64
+	indexSize   int
+	rawBytes    int64 // size of the data blocks before compression
+	storedBytes int64 // size of the data blocks on disk
+}
+
+// countingWriter keeps track of the offset blocks are written at.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// writeBlockSST writes entries, which must be sorted by key, as a block
+// based SST file compressed with codec and encrypted with the current key of
+// keys.
+func writeBlockSST(w io.Writer, entries []memEntry, codec byte, keys *keyring) error {
+	b, err := newSSTBuilder(w, len(entries), codec, keys)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := b.add(entry); err != nil {
+			return err
+		}
+	}
+	return b.finish()
+}
+
+// sstBuilder writes a block based SST file as its entries are added, in key
+// order. The header, written first, holds the number of entries, so writers
+// that do not know it upfront rewrite the header once done.
+type sstBuilder struct {
+	cw     *countingWriter
+	codec  byte
+	aead   cipher.AEAD
+	keyID  uint32
+	footer sstFooter
+	index  []blockHandle
+	block  []byte
+	last   string
+	hashes []uint32 // of every key, for the filter
+}
+
+func newSSTBuilder(w io.Writer, n int, codec byte, keys *keyring) (*sstBuilder, error) {
+	aead, err := keys.aead(keys.current)
+	if err != nil {
+		return nil, err
+	}
+	b := &sstBuilder{cw: &countingWriter{w: w}, codec: codec, aead: aead, keyID: keys.current}
+	if _, err := b.cw.Write(b.header(n)); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// header returns the header of a file of n entries.
+func (b *sstBuilder) header(n int) []byte {
+	header := make([]byte, sstHeaderSize)
+	binary.BigEndian.PutUint32(header[:magicNumberSize], sstBlockMagic)
+	binary.BigEndian.PutUint32(header[magicNumberSize:magicNumberSize+entryCountSize], uint32(n))
+	binary.BigEndian.PutUint32(header[8:12], uint32(bloomFilterSize(n)+sealOverhead(b.aead)))
+	binary.BigEndian.PutUint32(header[12:16], b.keyID)
+	return header
+}
+
+func (b *sstBuilder) add(entry memEntry) error {
+	b.block = appendBlockEntry(b.block, entry)
+	b.last = entry.key
+	b.hashes = append(b.hashes, bloomHash(entry.key))
+	if len(b.block) >= sstBlockSize {
+		return b.flushBlock()
+	}
+	return nil
+}
+
+func (b *sstBuilder) flushBlock() error {
+	stored, used, err := compressBlock(b.codec, b.block)
+	if err != nil {
+		return err
+	}
+	h, err := writeBlock(b.cw, stored, used, b.aead)
+	if err != nil {
+		return err
+	}
+	h.lastKey = b.last
+	b.index = append(b.index, h)
+	b.footer.rawBytes += int64(len(b.block))
+	b.footer.storedBytes += int64(h.size)
+	b.block = b.block[:0]
+	return nil
+}
+
+// finish writes the last data block, the filter, the index and the footer.
+func (b *sstBuilder) finish() error {
+	if len(b.block) > 0 {
+		if err := b.flushBlock(); err != nil {
+			return err
+		}
+	}
+
+	// Write filter block
+	if _, err := writeBlock(b.cw, newBloomFilterFromHashes(b.hashes), codecNone, b.aead); err != nil {
+		return err
+	}
+
+	// Write index block
+	var indexBlock []byte
+	for _, h := range b.index {
+		indexBlock = binary.BigEndian.AppendUint32(indexBlock, uint32(len(h.lastKey)))
+		indexBlock = append(indexBlock, h.lastKey...)
+		indexBlock = binary.BigEndian.AppendUint64(indexBlock, uint64(h.offset))
+		indexBlock = binary.BigEndian.AppendUint32(indexBlock, uint32(h.size))
+	}
+	indexHandle, err := writeBlock(b.cw, indexBlock, codecNone, b.aead)
+	if err != nil {
+		return err
+	}
+	b.footer.indexOffset = indexHandle.offset
+	b.footer.indexSize = indexHandle.size
+
+	// Write footer
+	buf := make([]byte, sstFooterSize)
+	binary.BigEndian.PutUint64(buf[0:8], uint64(b.footer.indexOffset))
+	binary.BigEndian.PutUint32(buf[8:12], uint32(b.footer.indexSize))
+	binary.BigEndian.PutUint64(buf[12:20], uint64(b.footer.rawBytes))
+	binary.BigEndian.PutUint64(buf[20:28], uint64(b.footer.storedBytes))
+	binary.BigEndian.PutUint32(buf[28:32], sstBlockMagic)
+	_, err = b.cw.Write(buf)
+	return err
+}
+
+// writeBlock seals a block, already compressed with codec, and writes it
+// with its trailer. It returns where the block ended up.
+func writeBlock(cw *countingWriter, stored []byte, codec byte, aead cipher.AEAD) (blockHandle, error) {
+	h := blockHandle{offset: cw.n}
+	sealed, err := seal(aead, stored, blockAD(h.offset))
+	if err != nil {
+		return h, err
+	}
+	h.size = len(sealed)
+
+	trailer := make([]byte, blockTrailerSize)
+	trailer[0] = codec
+	crc := crc32.Update(crc32.Checksum(sealed, crcTable), crcTable, trailer[:1])
+	binary.BigEndian.PutUint32(trailer[1:], crc)
+
+	if _, err := cw.Write(sealed); err != nil {
+		return h, err
+	}
+	_, err = cw.Write(trailer)
+	return h, err
+}
+
+// blockAD is the associated data an encrypted block is sealed with.
+func blockAD(offset int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(offset))
+}
+
+// appendBlockEntry encodes an entry as
+// op(1) expires(8) [seq(8)] keyLen(4) valueLen(4) key value
+func appendBlockEntry(block []byte, entry memEntry) []byte {
+	if entry.seq == 0 {
+		block = append(block, entry.op)
+		block = binary.BigEndian.AppendUint64(block, uint64(entry.expires))
+	} else {
+		block = append(block, entry.op|entryHasSeq)
+		block = binary.BigEndian.AppendUint64(block, uint64(entry.expires))
+		block = binary.BigEndian.AppendUint64(block, entry.seq)
+	}
+	block = binary.BigEndian.AppendUint32(block, uint32(len(entry.key)))
+	block = binary.BigEndian.AppendUint32(block, uint32(len(entry.value)))
+	block = append(block, entry.key...)
+	return append(block, entry.value...)
+}
+
+func decodeBlockEntries(block []byte) ([]memEntry, error) {
+	var entries []memEntry
+	for len(block) > 0 {
+		if len(block) < 17 {
+			return nil, errCorruptSST
+		}
+		entry := memEntry{
+			op:      block[0] &^ entryHasSeq,
+			expires: int64(binary.BigEndian.Uint64(block[1:9])),
+		}
+		if block[0]&entryHasSeq != 0 {
+			if len(block) < 25 {
+				return nil, errCorruptSST
+			}
+			entry.seq = binary.BigEndian.Uint64(block[9:17])
+			block = block[8:]
+		}
+		keyLen := int(binary.BigEndian.Uint32(block[9:13]))
+		valueLen := int(binary.BigEndian.Uint32(block[13:17]))
+		block = block[17:]
+		if keyLen < 0 || valueLen < 0 || len(block) < keyLen+valueLen {
+			return nil, errCorruptSST
+		}
+		entry.key = string(block[:keyLen])
+		entry.value = string(block[keyLen : keyLen+valueLen])
+		block = block[keyLen+valueLen:]
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func isBlockSST(header []byte) bool {
+	return len(header) >= magicNumberSize && binary.BigEndian.Uint32(header[:magicNumberSize]) == sstBlockMagic
+}
+
+func readSSTFooter(r io.ReaderAt, size int64) (sstFooter, error) {
+	var footer sstFooter
+	if size < sstHeaderSize+sstFooterSize {
+		return footer, errCorruptSST
+	}
+	buf := make([]byte, sstFooterSize)
+	if _, err := r.ReadAt(buf, size-sstFooterSize); err != nil {
+		return footer, err
+	}
+	if binary.BigEndian.Uint32(buf[28:32]) != sstBlockMagic {
+		return footer, errCorruptSST
+	}
+	footer.indexOffset = int64(binary.BigEndian.Uint64(buf[0:8]))
+	footer.indexSize = int(binary.BigEndian.Uint32(buf[8:12]))
+	footer.rawBytes = int64(binary.BigEndian.Uint64(buf[12:20]))
+	footer.storedBytes = int64(binary.BigEndian.Uint64(buf[20:28]))
+	if footer.indexOffset < sstHeaderSize || footer.indexOffset+int64(footer.indexSize)+blockTrailerSize > size-sstFooterSize {
+		return footer, errCorruptSST
+	}
+	return footer, nil
+}
+
+// readBlock reads the block at h, checks its checksum, decrypts it and
+// decompresses it.
+func readBlock(r io.ReaderAt, h blockHandle, aead cipher.AEAD) ([]byte, error) {
+	buf := make([]byte, h.size+blockTrailerSize)
+	if _, err := r.ReadAt(buf, h.offset); err != nil {
+		return nil, err
+	}
+	stored, trailer := buf[:h.size], buf[h.size:]
+	crc := crc32.Update(crc32.Checksum(stored, crcTable), crcTable, trailer[:1])
+	if crc != binary.BigEndian.Uint32(trailer[1:]) {
+		return nil, errBadChecksum
+	}
+	stored, err := unseal(aead, stored, blockAD(h.offset))
+	if err != nil {
+		return nil, err
+	}
+	return decompressBlock(trailer[0], stored)
+}
+
+// sstAEAD returns the cipher the blocks of an SST file with this header are
+// encrypted with.
+func sstAEAD(header []byte, keys *keyring) (cipher.AEAD, error) {
+	return keys.aead(binary.BigEndian.Uint32(header[12:16]))
+}
+
+func readSSTIndex(r io.ReaderAt, footer sstFooter, aead cipher.AEAD) ([]blockHandle, error) {
+	block, err := readBlock(r, blockHandle{offset: footer.indexOffset, size: footer.indexSize}, aead)
+	if err != nil {
+		return nil, err
+	}
+
+	var index []blockHandle
+	for len(block) > 0 {
+		if len(block) < 4 {
+			return nil, errCorruptSST
+		}
+		keyLen := int(binary.BigEndian.Uint32(block[:4]))
+		block = block[4:]
+		if keyLen < 0 || len(block) < keyLen+12 {
+			return nil, errCorruptSST
+		}
+		h := blockHandle{lastKey: string(block[:keyLen])}
+		block = block[keyLen:]
+		h.offset = int64(binary.BigEndian.Uint64(block[:8]))
+		h.size = int(binary.BigEndian.Uint32(block[8:12]))
+		block = block[12:]
+		if h.offset < sstHeaderSize || h.offset+int64(h.size) > footer.indexOffset {
+			return nil, errCorruptSST
+		}
+		index = append(index, h)
+	}
+	return index, nil
+}
+
+// readSSTFilter reads the bloom filter block, nil for files written before
+// filters existed.
+func readSSTFilter(r io.ReaderAt, header []byte, footer sstFooter, aead cipher.AEAD) (bloomFilter, error) {
+	filterSize := int(binary.BigEndian.Uint32(header[8:12]))
+	if filterSize == 0 {
+		return nil, nil
+	}
+	h := blockHandle{
+		offset: footer.indexOffset - blockTrailerSize - int64(filterSize),
+		size:   filterSize,
+	}
+	if h.offset < sstHeaderSize {
+		return nil, errCorruptSST
+	}
+	return readBlock(r, h, aead)
+}
+
+// readBlockSSTEntries decodes every entry of a block based SST file, in key
+// order.
+func readBlockSSTEntries(r io.ReaderAt, size int64, keys *keyring) ([]memEntry, error) {
+	header := make([]byte, sstHeaderSize)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	aead, err := sstAEAD(header, keys)
+	if err != nil {
+		return nil, err
+	}
+	footer, err := readSSTFooter(r, size)
+	if err != nil {
+		return nil, err
+	}
+	index, err := readSSTIndex(r, footer, aead)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []memEntry
+	for _, h := range index {
+		block, err := readBlock(r, h, aead)
+		if err != nil {
+			return nil, err
+		}
+		blockEntries, err := decodeBlockEntries(block)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, blockEntries...)
+	}
+	return entries, nil
+}
+
+// sstSizes returns the uncompressed and on-disk size of the data held in an
+// SST file. Legacy files are never compressed.
+func sstSizes(path string) (raw, stored int64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	header := make([]byte, sstHeaderSize)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return 0, 0, fmt.Errorf("%s: %v", path, err)
+	}
+	if !isBlockSST(header) {
+		return info.Size() - sstHeaderSize, info.Size() - sstHeaderSize, nil
+	}
+
+	footer, err := readSSTFooter(f, info.Size())
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s: %v", path, err)
+	}
+	return footer.rawBytes, footer.storedBytes, nil
+}
+
+// sstReader is an open SST file with its index and filter already parsed,
+// as kept by the table cache.
+type sstReader struct {
+	id     uint64 // identifies the reader in the block cache
+	path   string
+	file   *os.File
+	footer sstFooter
+	index  []blockHandle
+	filter bloomFilter
+	aead   cipher.AEAD
+	bloom  *bloomStats // shared by the readers of a table cache, may be nil
+
+	// Legacy files have no index, their entries are all loaded instead.
+	legacy map[string]memEntry
+}
+
+func openSSTReader(path string, id uint64, keys *keyring) (*sstReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &sstReader{id: id, path: path, file: f}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	header := make([]byte, sstHeaderSize)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	if !isBlockSST(header) {
+		f.Close()
+		r.file = nil
+		entries, err := readSSTEntries(path, keys)
+		if err != nil {
+			return nil, err
+		}
+		r.legacy = make(map[string]memEntry, len(entries))
+		for _, entry := range entries {
+			r.legacy[entry.key] = entry
+		}
+		return r, nil
+	}
+
+	if r.aead, err = sstAEAD(header, keys); err == nil {
+		r.footer, err = readSSTFooter(f, info.Size())
+	}
+	if err == nil {
+		r.index, err = readSSTIndex(f, r.footer, r.aead)
+	}
+	if err == nil {
+		r.filter, err = readSSTFilter(f, header, r.footer, r.aead)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return r, nil
+}
+
+func (r *sstReader) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	return r.file.Close()
+}
+
+// get looks key up, reading at most the one data block that may hold it.
+func (r *sstReader) get(key []byte, blocks *blockCache) (memEntry, bool, error) {
+	if r.legacy != nil {
+		entry, ok := r.legacy[string(key)]
+		return entry, ok, nil
+	}
+	if !r.filter.mayContain(string(key)) {
+		r.bloom.record(true, false)
+		return memEntry{}, false, nil
+	}
+
+	i := sort.Search(len(r.index), func(i int) bool {
+		return r.index[i].lastKey >= string(key)
+	})
+	if i == len(r.index) {
+		r.bloom.record(false, false)
+		return memEntry{}, false, nil
+	}
+
+	entries, err := r.readBlockEntries(r.index[i], blocks)
+	if err != nil {
+		return memEntry{}, false, err
+	}
+	j := sort.Search(len(entries), func(j int) bool {
+		return entries[j].key >= string(key)
+	})
+	found := j < len(entries) && entries[j].key == string(key)
+	r.bloom.record(false, found)
+	if found {
+		return entries[j], true, nil
+	}
+	return memEntry{}, false, nil
+}
+
+func (r *sstReader) readBlockEntries(h blockHandle, blocks *blockCache) ([]memEntry, error) {
+	cacheKey := blockCacheKey{table: r.id, offset: h.offset}
+	if entries, ok := blocks.get(cacheKey); ok {
+		return entries, nil
+	}
+
+	block, err := readBlock(r.file, h, r.aead)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", r.path, err)
+	}
+	entries, err := decodeBlockEntries(block)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", r.path, err)
+	}
+	blocks.add(cacheKey, entries, int64(len(block)))
+	return entries, nil
+}
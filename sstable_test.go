@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestSnappyRoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	random := make([]byte, 10000)
+	rnd.Read(random)
+
+	inputs := [][]byte{
+		nil,
+		[]byte("a"),
+		[]byte(strings.Repeat("abcd", 1000)),
+		[]byte(strings.Repeat(`{"user": "someone", "active": true}`, 200)),
+		random,
+	}
+	for i, in := range inputs {
+		out, err := snappyDecode(snappyEncode(in))
+		if err != nil {
+			t.Fatalf("Input %d: error decoding: %v", i, err)
+		}
+		if !bytes.Equal(in, out) {
+			t.Errorf("Input %d: round trip changed the data", i)
+		}
+	}
+
+	// A corrupt length is not allocated up front
+	corrupt := append(binary.AppendUvarint(nil, maxWALRecordSize), 0, 'a')
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := snappyDecode(corrupt); err != errCorruptSnappy {
+		t.Errorf("Expected %v, got %v", errCorruptSnappy, err)
+	}
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("Expected a small allocation for a corrupt length, got %d bytes", allocated)
+	}
+}
+
+func TestBlockSST_MixedCodecs(t *testing.T) {
+	s, err := openStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	mem, err := s.CreateNamespace("docs", nsOptions{FlushSize: 1 << 20, Compression: "snappy"})
+	if err != nil {
+		t.Fatalf("Error creating namespace: %v", err)
+	}
+
+	value := strings.Repeat(`{"name": "value", "list": [1, 2, 3]}`, 50)
+	for i, codec := range []string{"snappy", "flate", "none"} {
+		mem.opts.Compression = codec
+		for j := 0; j < 20; j++ {
+			mem.Set([]byte(fmt.Sprintf("%s-%02d", codec, j)), []byte(value))
+		}
+		if err := mem.FlushMemToSSTFile(); err != nil {
+			t.Fatalf("Error flushing with %s: %v", codec, err)
+		}
+		if mem.file.noFiles != i+1 {
+			t.Fatalf("Expected %d SST files, got %d", i+1, mem.file.noFiles)
+		}
+	}
+
+	for _, codec := range []string{"snappy", "flate", "none"} {
+		key := fmt.Sprintf("%s-%02d", codec, 7)
+		v, err := mem.Get([]byte(key))
+		if err != nil || string(v) != value {
+			t.Errorf("Expected value of %s to round trip, got %d bytes (%v)", key, len(v), err)
+		}
+	}
+
+	stats, err := mem.Stats()
+	if err != nil {
+		t.Fatalf("Error getting stats: %v", err)
+	}
+	if stats.CompressionRatio <= 1 {
+		t.Errorf("Expected compressible values to give a ratio above 1, got %f", stats.CompressionRatio)
+	}
+}
+
+func TestBlockSST_ChecksumMismatch(t *testing.T) {
+	s, err := openStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	mem := s.namespaces[defaultNamespace]
+	mem.Set([]byte("key"), []byte("a value long enough to be flushed"))
+
+	path := mem.file.sstPath(1)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Error reading SST file: %v", err)
+	}
+	data[sstHeaderSize] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Error writing SST file: %v", err)
+	}
+
+	if _, err := mem.Get([]byte("key")); err == nil || !strings.Contains(err.Error(), errBadChecksum.Error()) {
+		t.Errorf("Expected checksum error, got %v", err)
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	var entries []memEntry
+	for i := 0; i < 1000; i++ {
+		entries = append(entries, memEntry{key: fmt.Sprintf("key-%d", i)})
+	}
+	filter := newBloomFilter(entries)
+
+	for _, entry := range entries {
+		if !filter.mayContain(entry.key) {
+			t.Fatalf("Expected filter to contain %s", entry.key)
+		}
+	}
+	falsePositives := 0
+	for i := 0; i < 1000; i++ {
+		if filter.mayContain(fmt.Sprintf("other-%d", i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 50 {
+		t.Errorf("Expected about 1%% false positives, got %d in 1000", falsePositives)
+	}
+}
+
+func TestTableAndBlockCache(t *testing.T) {
+	opts := defaultStoreOptions()
+	opts.MaxOpenFiles = 2
+	s, err := openStoreWith(t.TempDir(), opts)
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	mem := s.namespaces[defaultNamespace]
+
+	// Every set is flushed to its own SST file
+	for i := 0; i < 5; i++ {
+		mem.Set([]byte(fmt.Sprintf("key-%d", i)), []byte("a value long enough to be flushed"))
+	}
+	if mem.file.noFiles != 5 {
+		t.Fatalf("Expected 5 SST files, got %d", mem.file.noFiles)
+	}
+
+	for i := 0; i < 5; i++ {
+		if _, err := mem.Get([]byte(fmt.Sprintf("key-%d", i))); err != nil {
+			t.Fatalf("Error getting key-%d: %v", i, err)
+		}
+	}
+	// The newest file stays open, so its block is now cached
+	for i := 0; i < 2; i++ {
+		if _, err := mem.Get([]byte("key-4")); err != nil {
+			t.Fatalf("Error getting key-4: %v", err)
+		}
+	}
+
+	stats, err := s.Stats()
+	if err != nil {
+		t.Fatalf("Error getting stats: %v", err)
+	}
+	if stats.TableCache.Used > 2 {
+		t.Errorf("Expected at most 2 open tables, got %d", stats.TableCache.Used)
+	}
+	if stats.BlockCache.Hits == 0 || stats.BlockCache.Misses == 0 {
+		t.Errorf("Expected both block cache hits and misses, got %+v", stats.BlockCache)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// nsStats describes the size of one namespace.
+type nsStats struct {
+	Name          string `json:"name"`
+	MemtableBytes int    `json:"memtable_bytes"`
+	SSTFiles      int    `json:"sst_files"`
+
+	// DataBytes is the size of the SST data before compression and
+	// StoredBytes its size on disk; CompressionRatio is DataBytes/StoredBytes.
+	DataBytes        int64   `json:"data_bytes"`
+	StoredBytes      int64   `json:"stored_bytes"`
+	CompressionRatio float64 `json:"compression_ratio"`
+
+	VlogSegments int   `json:"vlog_segments"`
+	VlogBytes    int64 `json:"vlog_bytes"`
+
+	Files []sstFileStats `json:"files"`
+}
+
+// sstFileStats describes one SST file, from oldest to newest.
+type sstFileStats struct {
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	DataBytes   int64  `json:"data_bytes"`
+	StoredBytes int64  `json:"stored_bytes"`
+}
+
+func (mem *memDB) Stats() (nsStats, error) {
+	mem.store.mu.RLock()
+	defer mem.store.mu.RUnlock()
+
+	return mem.statsLocked()
+}
+
+func (mem *memDB) statsLocked() (nsStats, error) {
+	stats := nsStats{
+		Name:          mem.name,
+		MemtableBytes: mem.memSize,
+		SSTFiles:      mem.file.noFiles,
+	}
+	for i := 1; i <= mem.file.noFiles; i++ {
+		path := mem.file.sstPath(i)
+		raw, stored, err := sstSizes(path)
+		if err != nil {
+			return stats, err
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return stats, err
+		}
+		stats.DataBytes += raw
+		stats.StoredBytes += stored
+		stats.Files = append(stats.Files, sstFileStats{
+			Name:        filepath.Base(path),
+			Size:        info.Size(),
+			DataBytes:   raw,
+			StoredBytes: stored,
+		})
+	}
+	if stats.StoredBytes > 0 {
+		stats.CompressionRatio = float64(stats.DataBytes) / float64(stats.StoredBytes)
+	}
+
+	stats.VlogSegments = len(mem.vlog.segments)
+	vlogBytes, err := mem.vlog.size()
+	if err != nil {
+		return stats, err
+	}
+	stats.VlogBytes = vlogBytes
+	return stats, nil
+}
+
+// storeStats are the stats of a whole store.
+type storeStats struct {
+	Namespaces []nsStats  `json:"namespaces"`
+	BlockCache cacheStats `json:"block_cache"`
+	TableCache cacheStats `json:"table_cache"`
+}
+
+// Stats returns the stats of every namespace, sorted by name, and of the
+// caches they share.
+func (s *store) Stats() (storeStats, error) {
+	names := s.ListNamespaces()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	all := storeStats{
+		BlockCache: s.blocks.Stats(),
+		TableCache: s.tables.Stats(),
+	}
+	for _, name := range names {
+		mem, ok := s.namespaces[name]
+		if !ok {
+			continue
+		}
+		stats, err := mem.statsLocked()
+		if err != nil {
+			return all, err
+		}
+		all.Namespaces = append(all.Namespaces, stats)
+	}
+	return all, nil
+}
+
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := st.Stats()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
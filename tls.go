@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// tlsFlags are the flags of the subcommands that listen on the network,
+// and connect to other servers: replicas to their primary, raft nodes to
+// their peers and the proxy to its backends.
+type tlsFlags struct {
+	certFile string
+	keyFile  string
+	clientCA string
+
+	caFile         string
+	clientCertFile string
+	clientKeyFile  string
+}
+
+func (f *tlsFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.certFile, "tls-cert", "", "PEM certificate chain to serve TLS with on every listener, reloaded on SIGHUP")
+	fs.StringVar(&f.keyFile, "tls-key", "", "PEM private key of -tls-cert")
+	fs.StringVar(&f.clientCA, "tls-client-ca", "", "PEM CA certificates client certificates must be signed by; requires one from every client (mutual TLS)")
+	fs.StringVar(&f.caFile, "tls-ca", "", "PEM CA certificates to verify the servers this one connects to with, instead of the system ones")
+	fs.StringVar(&f.clientCertFile, "tls-client-cert", "", "PEM certificate presented to the servers this one connects to (default: -tls-cert)")
+	fs.StringVar(&f.clientKeyFile, "tls-client-key", "", "PEM private key of -tls-client-cert (default: -tls-key)")
+}
+
+// clientConfig returns the TLS configuration of the connections to other
+// servers, nil to use the defaults. Without -tls-client-cert, the
+// certificate the server listens with is presented, as reloaded.
+func (f *tlsFlags) clientConfig(certs *tlsCerts) (*tls.Config, error) {
+	if f.caFile == "" && f.clientCertFile == "" && f.clientKeyFile == "" && certs == nil {
+		return nil, nil
+	}
+	config, err := clientTLSConfig(f.caFile, f.clientCertFile, f.clientKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if f.clientCertFile == "" && f.clientKeyFile == "" && certs != nil {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			certs.mu.RLock()
+			defer certs.mu.RUnlock()
+			return certs.cert, nil
+		}
+	}
+	return config, nil
+}
+
+// httpClient returns an HTTP client connecting with config, the default
+// TLS configuration when nil.
+func httpClient(config *tls.Config, timeout time.Duration) *http.Client {
+	if config == nil {
+		return &http.Client{Timeout: timeout}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return &http.Client{Transport: transport, Timeout: timeout}
+}
+
+// load returns the certificates of the flags, nil when TLS is off.
+func (f *tlsFlags) load(logger *slog.Logger) (*tlsCerts, error) {
+	if f.certFile == "" && f.keyFile == "" {
+		if f.clientCA != "" {
+			return nil, errors.New("-tls-client-ca needs -tls-cert and -tls-key")
+		}
+		return nil, nil
+	}
+	if f.certFile == "" || f.keyFile == "" {
+		return nil, errors.New("-tls-cert and -tls-key go together")
+	}
+	c := &tlsCerts{certFile: f.certFile, keyFile: f.keyFile, clientCA: f.clientCA, logger: logger}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// tlsCerts holds the certificate listeners serve and the CAs client
+// certificates are checked against. Reloading swaps them for new
+// handshakes; established connections go on with the ones they started
+// with.
+type tlsCerts struct {
+	certFile, keyFile, clientCA string
+	logger                      *slog.Logger
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	cas  *x509.CertPool
+}
+
+// reload reads the files again. On error the certificates in use are
+// kept.
+func (c *tlsCerts) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("error loading TLS certificate: %w", err)
+	}
+	var cas *x509.CertPool
+	if c.clientCA != "" {
+		data, err := os.ReadFile(c.clientCA)
+		if err != nil {
+			return fmt.Errorf("error loading client CAs: %w", err)
+		}
+		cas = x509.NewCertPool()
+		if !cas.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no PEM certificate in %s", c.clientCA)
+		}
+	}
+	c.mu.Lock()
+	c.cert, c.cas = &cert, cas
+	c.mu.Unlock()
+	return nil
+}
+
+// reloadOnSIGHUP reloads the certificates whenever the process gets a
+// SIGHUP.
+func (c *tlsCerts) reloadOnSIGHUP() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			if err := c.reload(); err != nil {
+				c.logger.Error("TLS reload failed, keeping the current certificates", "err", err)
+				continue
+			}
+			c.logger.Info("TLS certificates reloaded")
+		}
+	}()
+}
+
+// config returns the TLS configuration of listeners, which looks the
+// certificates up on every handshake.
+func (c *tlsCerts) config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c.mu.RLock()
+			defer c.mu.RUnlock()
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*c.cert},
+			}
+			if c.cas != nil {
+				config.ClientCAs = c.cas
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return config, nil
+		},
+	}
+}
+
+// listen listens on addr, with TLS when c is not nil.
+func (c *tlsCerts) listen(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil || c == nil {
+		return l, err
+	}
+	return tls.NewListener(l, c.config()), nil
+}
+
+// serveHTTP serves h on addr, with TLS when c is not nil.
+func (c *tlsCerts) serveHTTP(addr string, h http.Handler) error {
+	l, err := c.listen(addr)
+	if err != nil {
+		return err
+	}
+	return http.Serve(l, h)
+}
+
+// clientCommonName returns the common name of the verified client
+// certificate of a request, empty without one.
+func clientCommonName(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+// clientTLSConfig returns the TLS configuration of clients, verifying the
+// server against caFile, or the system CAs when empty, and presenting the
+// certificate of certFile and keyFile when set.
+func clientTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no PEM certificate in %s", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// testCert is a certificate and key, issued by parent or self-signed.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCert(t *testing.T, cn string, serial int64, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key}
+}
+
+// write writes the certificate and key as PEM files, returning their paths.
+func (c *testCert) write(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	der, _ := x509.MarshalECPrivateKey(c.key)
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCert() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "test CA", 1, nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := newTestCert(t, "server", 2, ca).write(t, dir, "server")
+
+	tf := tlsFlags{certFile: certFile, keyFile: keyFile, clientCA: caFile}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	certs, err := tf.load(logger)
+	if err != nil {
+		t.Fatalf("Error loading certificates: %v", err)
+	}
+
+	s, err := openStore(filepath.Join(dir, "data"))
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	st = s
+	auth, _, err := newAuthenticator(s)
+	if err != nil {
+		t.Fatalf("Error starting authentication: %v", err)
+	}
+	if _, _, err := auth.PutIdentity("alice", []authGrant{{Namespace: defaultNamespace, Permission: permRead}}, false); err != nil {
+		t.Fatalf("Error creating identity: %v", err)
+	}
+	r := mux.NewRouter()
+	registerV1Routes(r)
+	r.Use(auth.middleware)
+
+	l, err := certs.listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer l.Close()
+	go http.Serve(l, r)
+	url := "https://" + l.Addr().String() + "/v1/ns/default/keys/a"
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	client := func(cert *testCert) *http.Client {
+		config := &tls.Config{RootCAs: roots}
+		if cert != nil {
+			config.Certificates = []tls.Certificate{cert.tlsCert()}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	}
+	get := func(c *http.Client) (*http.Response, error) {
+		resp, err := c.Get(url)
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+
+	if _, err := get(client(nil)); err == nil {
+		t.Errorf("Expected the handshake to fail without a client certificate")
+	}
+	if _, err := get(client(newTestCert(t, "alice", 3, newTestCert(t, "other CA", 4, nil)))); err == nil {
+		t.Errorf("Expected the handshake to fail with a certificate of another CA")
+	}
+
+	// The common name of the client certificate names the identity
+	alice := client(newTestCert(t, "alice", 5, ca))
+	resp, err := get(alice)
+	if err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected alice to read the key, got %v, %v", resp, err)
+	}
+	if serial := resp.TLS.PeerCertificates[0].SerialNumber.Int64(); serial != 2 {
+		t.Errorf("Expected the server certificate 2, got %d", serial)
+	}
+	if resp, err := get(client(newTestCert(t, "bob", 6, ca))); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a certificate naming no identity, got %v, %v", resp, err)
+	}
+
+	// New handshakes get the reloaded certificate, open connections go on
+	newTestCert(t, "server", 7, ca).write(t, dir, "server")
+	if err := certs.reload(); err != nil {
+		t.Fatalf("Error reloading: %v", err)
+	}
+	resp, err = get(alice)
+	if err != nil || resp.TLS.PeerCertificates[0].SerialNumber.Int64() != 2 {
+		t.Errorf("Expected the open connection to keep the old certificate, got %v", err)
+	}
+	resp, err = get(client(newTestCert(t, "alice", 8, ca)))
+	if err != nil || resp.TLS.PeerCertificates[0].SerialNumber.Int64() != 7 {
+		t.Errorf("Expected a new connection to get the new certificate, got %v", err)
+	}
+
+	// A failed reload keeps the certificates in use
+	os.WriteFile(keyFile, []byte("garbage"), 0600)
+	if err := certs.reload(); err == nil {
+		t.Errorf("Expected reloading a bad key to fail")
+	}
+	if _, err := get(client(newTestCert(t, "alice", 9, ca))); err != nil {
+		t.Errorf("Expected the server to go on after a failed reload, got %v", err)
+	}
+}
+
+func TestReplicaOverMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "test CA", 1, nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	primary, err := openStore(filepath.Join(dir, "primary"))
+	if err != nil {
+		t.Fatalf("Error opening primary: %v", err)
+	}
+	certFile, keyFile := newTestCert(t, "primary", 2, ca).write(t, dir, "primary")
+	primaryFlags := tlsFlags{certFile: certFile, keyFile: keyFile, clientCA: caFile}
+	primaryCerts, err := primaryFlags.load(logger)
+	if err != nil {
+		t.Fatalf("Error loading certificates: %v", err)
+	}
+	r := mux.NewRouter()
+	newReplicationServer(primary, 1<<20).register(r)
+	l, err := primaryCerts.listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer l.Close()
+	go http.Serve(l, r)
+	url := "https://" + l.Addr().String()
+	primary.namespaces[defaultNamespace].Set([]byte("a"), []byte("1"))
+
+	// The replica presents the certificate it listens with
+	certFile, keyFile = newTestCert(t, "replica", 3, ca).write(t, dir, "replica")
+	replicaFlags := tlsFlags{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	replicaCerts, err := replicaFlags.load(logger)
+	if err != nil {
+		t.Fatalf("Error loading certificates: %v", err)
+	}
+	config, err := replicaFlags.clientConfig(replicaCerts)
+	if err != nil {
+		t.Fatalf("Error building the client configuration: %v", err)
+	}
+	s, err := openStore(filepath.Join(dir, "replica"))
+	if err != nil {
+		t.Fatalf("Error opening replica: %v", err)
+	}
+	rep := startReplica(s, url, defaultStoreOptions(), replicaConfig{TLS: config})
+	defer rep.Close()
+	waitForSeq(t, s, primary)
+	if got, err := s.namespaces[defaultNamespace].Get([]byte("a")); err != nil || string(got) != "1" {
+		t.Errorf("Expected a=1 on the replica, got %q, %v", got, err)
+	}
+
+	// Without a client certificate the primary refuses the replica
+	config, err = (&tlsFlags{caFile: caFile}).clientConfig(nil)
+	if err != nil {
+		t.Fatalf("Error building the client configuration: %v", err)
+	}
+	other, err := openStore(filepath.Join(dir, "other"))
+	if err != nil {
+		t.Fatalf("Error opening replica: %v", err)
+	}
+	refused := startReplica(other, url, defaultStoreOptions(), replicaConfig{TLS: config})
+	defer refused.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for refused.Status().LastError == "" {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the replica without a certificate to fail")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if storeSeq(other) != 0 {
+		t.Errorf("Expected nothing replicated without a certificate, got seq %d", storeSeq(other))
+	}
+}
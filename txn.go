@@ -0,0 +1,102 @@
+package main
+
+import (
+	"time"
+)
+
+// memTxn is a read-modify-write transaction on one namespace, see Update.
+type memTxn struct {
+	mem   *memDB
+	batch writeBatch
+	now   int64     // time keys are checked for expiry against
+	reads []txnRead // keys read from the store, checked again under raft
+}
+
+// txnRead is a key a transaction read, and the version it saw.
+type txnRead struct {
+	Key   string `json:"key"`
+	Seq   uint64 `json:"seq"`
+	Found bool   `json:"found"`
+}
+
+// Update runs fn with the store locked and then writes the batch fn built,
+// so nothing can change the keys fn read before its writes are applied.
+// Returning an error from fn discards its writes.
+func (mem *memDB) Update(fn func(tx *memTxn) error) error {
+	if mem.store.raft != nil {
+		return mem.store.raft.update(mem, fn)
+	}
+
+	mem.store.mu.Lock()
+	defer mem.store.mu.Unlock()
+
+	tx := &memTxn{mem: mem, now: time.Now().UnixNano()}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return mem.store.writeLocked(&tx.batch)
+}
+
+// Get returns the live entry of key, including the writes made earlier in
+// the transaction. Its value is read from the value log if needed, and its
+// seq is the version of the key; writes of the transaction itself have none
+// yet.
+func (tx *memTxn) Get(key string) (memEntry, bool, error) {
+	for i := len(tx.batch.ops) - 1; i >= 0; i-- {
+		op := tx.batch.ops[i]
+		if string(op.key) != key {
+			continue
+		}
+		if op.op == opDel {
+			return memEntry{}, false, nil
+		}
+		return memEntry{op: opSet, key: key, value: string(op.value), expires: op.expires}, true, nil
+	}
+	entry, found, err := tx.mem.lookupAt(key, tx.now)
+	if err == nil {
+		tx.reads = append(tx.reads, txnRead{Key: key, Seq: entry.seq, Found: found})
+	}
+	return entry, found, err
+}
+
+// Put sets key, expiring at expires (unix nanoseconds, 0 for the
+// namespace default).
+func (tx *memTxn) Put(key, value []byte, expires int64) {
+	tx.batch.ops = append(tx.batch.ops, batchOp{op: opSet, ns: tx.mem.name, key: key, value: value, expires: expires})
+}
+
+func (tx *memTxn) Delete(key []byte) {
+	tx.batch.Delete(tx.mem.name, key)
+}
+
+// lookup returns the live entry of key with its value resolved. The store
+// must be locked.
+func (mem *memDB) lookup(key string) (memEntry, bool, error) {
+	return mem.lookupAt(key, time.Now().UnixNano())
+}
+
+// lookupAt is lookup with keys expiring as of now (unix nanoseconds).
+func (mem *memDB) lookupAt(key string, now int64) (memEntry, bool, error) {
+	entry, found, err := mem.latestEntry(key)
+	if err != nil || !found {
+		return memEntry{}, false, err
+	}
+	if entry.op == opDel || entry.expired(now) {
+		return memEntry{}, false, nil
+	}
+	value, err := mem.resolveValue(entry)
+	if err != nil {
+		return memEntry{}, false, err
+	}
+	entry.op = opSet
+	entry.value = string(value)
+	return entry, true, nil
+}
+
+// Lookup returns the live entry of key, with its expiry.
+func (mem *memDB) Lookup(key string) (memEntry, bool, error) {
+	mem.store.mu.RLock()
+	defer mem.store.mu.RUnlock()
+
+	return mem.lookup(key)
+}
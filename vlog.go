@@ -0,0 +1,473 @@
+package main
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Large values are kept out of the SST files: when a memtable is flushed,
+// every value of at least ValueThreshold bytes is appended to a value log
+// segment (vlog_N.vlog next to the SST files) and the SST entry only holds a
+// pointer to it. Flushes and compactions then move pointers around instead
+// of the values themselves. A segment starts with a header naming the key
+// its records are encrypted with, then each record is laid out as
+//
+//	crc32(4) keyLen(4) valueLen(4) key value
+//
+// where key and value are sealed together when the segment is encrypted.
+// The key is kept so garbage collection can tell whether the record is
+// still the live value of its key. Segments written before the header
+// existed start directly with a record and are in plaintext.
+const (
+	vlogHeaderSize        = 12
+	vlogSegmentHeaderSize = 8          // magic(4) + key id(4)
+	vlogMagic             = 0x4b56564c // "KVVL"
+	vlogPointerSize       = 16         // segment(4) offset(8) length(4)
+)
+
+var errCorruptVlog = errors.New("corrupt value log record")
+
+type valuePointer struct {
+	segment int
+	offset  int64
+	length  int // length of the whole record
+}
+
+func (p valuePointer) encode() string {
+	buf := make([]byte, vlogPointerSize)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(p.segment))
+	binary.BigEndian.PutUint64(buf[4:12], uint64(p.offset))
+	binary.BigEndian.PutUint32(buf[12:16], uint32(p.length))
+	return string(buf)
+}
+
+func decodeValuePointer(s string) (valuePointer, error) {
+	if len(s) != vlogPointerSize {
+		return valuePointer{}, errCorruptVlog
+	}
+	return valuePointer{
+		segment: int(binary.BigEndian.Uint32([]byte(s[0:4]))),
+		offset:  int64(binary.BigEndian.Uint64([]byte(s[4:12]))),
+		length:  int(binary.BigEndian.Uint32([]byte(s[12:16]))),
+	}, nil
+}
+
+// valueLog is the set of value log segments of one namespace. Only the
+// highest numbered segment is appended to.
+type valueLog struct {
+	dir        string
+	maxSize    int64
+	keys       *keyring
+	segments   []int // sorted
+	active     *os.File
+	activeSize int64
+	activeAEAD cipher.AEAD
+
+	// readersMu guards readers, which reads open lazily while holding
+	// only the read lock of the store
+	readersMu sync.Mutex
+	readers   map[int]*vlogSegment
+}
+
+// vlogSegment is a segment open for reading.
+type vlogSegment struct {
+	file  *os.File
+	aead  cipher.AEAD
+	start int64 // offset of the first record
+}
+
+func openValueLog(dir string, maxSize int64, keys *keyring) (*valueLog, error) {
+	vl := &valueLog{
+		dir:     dir,
+		maxSize: maxSize,
+		keys:    keys,
+		readers: make(map[int]*vlogSegment),
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "vlog_*.vlog"))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(f), "vlog_"), ".vlog"))
+		if err != nil {
+			continue
+		}
+		vl.segments = append(vl.segments, n)
+	}
+	sort.Ints(vl.segments)
+	return vl, nil
+}
+
+func (vl *valueLog) segmentPath(n int) string {
+	return filepath.Join(vl.dir, fmt.Sprintf("vlog_%d.vlog", n))
+}
+
+func (vl *valueLog) activeSegment() int {
+	if len(vl.segments) == 0 {
+		return 0
+	}
+	return vl.segments[len(vl.segments)-1]
+}
+
+// append writes a record to the active segment, starting a new segment when
+// it is full, and returns a pointer to it.
+func (vl *valueLog) append(key, value string) (valuePointer, error) {
+	if vl.active == nil || vl.activeSize >= vl.maxSize {
+		if err := vl.rotate(); err != nil {
+			return valuePointer{}, err
+		}
+	}
+
+	body, err := seal(vl.activeAEAD, []byte(key+value), nil)
+	if err != nil {
+		return valuePointer{}, err
+	}
+	record := make([]byte, vlogHeaderSize, vlogHeaderSize+len(body))
+	binary.BigEndian.PutUint32(record[4:8], uint32(len(key)))
+	binary.BigEndian.PutUint32(record[8:12], uint32(len(value)))
+	record = append(record, body...)
+	binary.BigEndian.PutUint32(record[0:4], crc32.Checksum(record[4:], crcTable))
+
+	ptr := valuePointer{segment: vl.activeSegment(), offset: vl.activeSize, length: len(record)}
+	if _, err := vl.active.WriteAt(record, vl.activeSize); err != nil {
+		return valuePointer{}, err
+	}
+	vl.activeSize += int64(len(record))
+	return ptr, nil
+}
+
+func (vl *valueLog) rotate() error {
+	if vl.active != nil {
+		if err := vl.active.Sync(); err != nil {
+			return err
+		}
+		vl.active.Close()
+		vl.active = nil
+	}
+	if err := os.MkdirAll(vl.dir, 0755); err != nil {
+		return err
+	}
+
+	// New segments are always encrypted with the current key
+	aead, err := vl.keys.aead(vl.keys.current)
+	if err != nil {
+		return err
+	}
+	n := vl.activeSegment() + 1
+	f, err := os.OpenFile(vl.segmentPath(n), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, vlogSegmentHeaderSize)
+	binary.BigEndian.PutUint32(header[:4], vlogMagic)
+	binary.BigEndian.PutUint32(header[4:], vl.keys.current)
+	if _, err := f.Write(header); err != nil {
+		f.Close()
+		return err
+	}
+
+	vl.segments = append(vl.segments, n)
+	vl.active = f
+	vl.activeSize = vlogSegmentHeaderSize
+	vl.activeAEAD = aead
+	return nil
+}
+
+// Sync flushes the active segment to disk.
+func (vl *valueLog) Sync() error {
+	if vl.active == nil {
+		return nil
+	}
+	return vl.active.Sync()
+}
+
+// segment returns segment n open for reading.
+func (vl *valueLog) segment(n int) (*vlogSegment, error) {
+	vl.readersMu.Lock()
+	defer vl.readersMu.Unlock()
+	if seg, ok := vl.readers[n]; ok {
+		return seg, nil
+	}
+
+	f, err := os.Open(vl.segmentPath(n))
+	if err != nil {
+		return nil, err
+	}
+	seg := &vlogSegment{file: f}
+	header := make([]byte, vlogSegmentHeaderSize)
+	if _, err := f.ReadAt(header, 0); err == nil && binary.BigEndian.Uint32(header[:4]) == vlogMagic {
+		seg.start = vlogSegmentHeaderSize
+		seg.aead, err = vl.keys.aead(binary.BigEndian.Uint32(header[4:]))
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s: %w", vl.segmentPath(n), err)
+		}
+	}
+	vl.readers[n] = seg
+	return seg, nil
+}
+
+// read returns the key and value of the record ptr points to.
+func (vl *valueLog) read(ptr valuePointer) (string, string, error) {
+	seg, err := vl.segment(ptr.segment)
+	if err != nil {
+		return "", "", err
+	}
+
+	if ptr.length < vlogHeaderSize {
+		return "", "", errCorruptVlog
+	}
+	record := make([]byte, ptr.length)
+	if _, err := seg.file.ReadAt(record, ptr.offset); err != nil {
+		return "", "", fmt.Errorf("%s: %v", vl.segmentPath(ptr.segment), err)
+	}
+	key, value, err := decodeVlogRecord(record, seg.aead)
+	if err != nil {
+		return "", "", fmt.Errorf("%s at %d: %w", vl.segmentPath(ptr.segment), ptr.offset, err)
+	}
+	return key, value, nil
+}
+
+func decodeVlogRecord(record []byte, aead cipher.AEAD) (string, string, error) {
+	if len(record) < vlogHeaderSize {
+		return "", "", errCorruptVlog
+	}
+	if crc32.Checksum(record[4:], crcTable) != binary.BigEndian.Uint32(record[0:4]) {
+		return "", "", errCorruptVlog
+	}
+	keyLen := int(binary.BigEndian.Uint32(record[4:8]))
+	valueLen := int(binary.BigEndian.Uint32(record[8:12]))
+	if vlogHeaderSize+keyLen+valueLen+sealOverhead(aead) != len(record) {
+		return "", "", errCorruptVlog
+	}
+	body, err := unseal(aead, record[vlogHeaderSize:], nil)
+	if err != nil {
+		return "", "", err
+	}
+	return string(body[:keyLen]), string(body[keyLen:]), nil
+}
+
+// scanSegment calls fn with a pointer to every record of a segment.
+func (vl *valueLog) scanSegment(n int, fn func(ptr valuePointer, key string) error) error {
+	seg, err := vl.segment(n)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(vl.segmentPath(n))
+	if err != nil {
+		return err
+	}
+
+	offset := seg.start
+	for int(offset)+vlogHeaderSize <= len(data) {
+		keyLen := int(binary.BigEndian.Uint32(data[offset+4 : offset+8]))
+		valueLen := int(binary.BigEndian.Uint32(data[offset+8 : offset+12]))
+		length := vlogHeaderSize + keyLen + valueLen + sealOverhead(seg.aead)
+		if int(offset)+length > len(data) {
+			break
+		}
+		key, _, err := decodeVlogRecord(data[offset:offset+int64(length)], seg.aead)
+		if err != nil {
+			return fmt.Errorf("%s at %d: %v", vl.segmentPath(n), offset, err)
+		}
+		if err := fn(valuePointer{segment: n, offset: offset, length: length}, key); err != nil {
+			return err
+		}
+		offset += int64(length)
+	}
+	return nil
+}
+
+func (vl *valueLog) remove(n int) error {
+	vl.readersMu.Lock()
+	if seg, ok := vl.readers[n]; ok {
+		seg.file.Close()
+		delete(vl.readers, n)
+	}
+	vl.readersMu.Unlock()
+	for i, seg := range vl.segments {
+		if seg == n {
+			vl.segments = append(vl.segments[:i], vl.segments[i+1:]...)
+			break
+		}
+	}
+	return os.Remove(vl.segmentPath(n))
+}
+
+// size returns the number of bytes held by every segment.
+func (vl *valueLog) size() (int64, error) {
+	var total int64
+	for _, n := range vl.segments {
+		info, err := os.Stat(vl.segmentPath(n))
+		if err != nil {
+			return 0, err
+		}
+		total += info.Size()
+	}
+	return total, nil
+}
+
+func (vl *valueLog) Close() {
+	if vl.active != nil {
+		vl.active.Close()
+		vl.active = nil
+	}
+	vl.readersMu.Lock()
+	defer vl.readersMu.Unlock()
+	for n, seg := range vl.readers {
+		seg.file.Close()
+		delete(vl.readers, n)
+	}
+}
+
+// separateValues moves the large values of entries to the value log,
+// replacing them with pointers.
+func (mem *memDB) separateValues(entries []memEntry) error {
+	if mem.opts.ValueThreshold <= 0 {
+		return nil
+	}
+	for i, entry := range entries {
+		if entry.op != opSet || len(entry.value) < mem.opts.ValueThreshold {
+			continue
+		}
+		ptr, err := mem.vlog.append(entry.key, entry.value)
+		if err != nil {
+			return err
+		}
+		entries[i].op = opValuePtr
+		entries[i].value = ptr.encode()
+	}
+	return nil
+}
+
+// resolveValue returns the value of an SST entry, reading it from the value
+// log if the entry only holds a pointer.
+func (mem *memDB) resolveValue(entry memEntry) ([]byte, error) {
+	if entry.op != opValuePtr {
+		return []byte(entry.value), nil
+	}
+	ptr, err := decodeValuePointer(entry.value)
+	if err != nil {
+		return nil, err
+	}
+	_, value, err := mem.vlog.read(ptr)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(value), nil
+}
+
+// latestEntry returns the newest entry of key, from the memtable or the SST
+// files, without resolving value pointers.
+func (mem *memDB) latestEntry(key string) (memEntry, bool, error) {
+	for i := len(mem.memValues) - 1; i >= 0; i-- {
+		if mem.memValues[i].key == key {
+			return mem.memValues[i], true, nil
+		}
+	}
+
+	for fileIndex := mem.file.noFiles; fileIndex > 0; fileIndex-- {
+		reader, release, err := mem.store.tables.get(mem.file.sstPath(fileIndex))
+		if err != nil {
+			return memEntry{}, false, err
+		}
+		entry, found, err := reader.get([]byte(key), mem.store.blocks)
+		release()
+		if err != nil || found {
+			return entry, found, err
+		}
+	}
+	return memEntry{}, false, nil
+}
+
+// vlogGCResult reports what a garbage collection pass did.
+type vlogGCResult struct {
+	SegmentsRemoved int   `json:"segments_removed"`
+	ValuesRewritten int   `json:"values_rewritten"`
+	BytesReclaimed  int64 `json:"bytes_reclaimed"`
+}
+
+// GCValueLog rewrites the live values of every value log segment, except
+// the one being appended to, whose dead bytes make up at least minDeadRatio
+// of the segment, and removes the segment. Live values are put back in the
+// memtable with the sequence numbers they were written with, and flushed to
+// the active segment before the old ones are removed. They are not new
+// writes: they are not logged, replicated, watched or sent to webhooks.
+func (mem *memDB) GCValueLog(minDeadRatio float64) (vlogGCResult, error) {
+	mem.store.mu.Lock()
+	defer mem.store.mu.Unlock()
+
+	var result vlogGCResult
+	now := time.Now().UnixNano()
+	active := mem.vlog.activeSegment()
+	candidates := append([]int(nil), mem.vlog.segments...)
+	var removed []int
+
+	for _, n := range candidates {
+		if n == active {
+			continue
+		}
+
+		var (
+			live              []memEntry
+			liveBytes, segLen int64
+		)
+		err := mem.vlog.scanSegment(n, func(ptr valuePointer, key string) error {
+			segLen += int64(ptr.length)
+			entry, found, err := mem.latestEntry(key)
+			if err != nil {
+				return err
+			}
+			if !found || entry.op != opValuePtr || entry.expired(now) || entry.value != ptr.encode() {
+				return nil
+			}
+			liveBytes += int64(ptr.length)
+			live = append(live, entry)
+			return nil
+		})
+		if err != nil {
+			return result, err
+		}
+		if segLen > 0 && float64(segLen-liveBytes)/float64(segLen) < minDeadRatio {
+			continue
+		}
+
+		for _, entry := range live {
+			value, err := mem.resolveValue(entry)
+			if err != nil {
+				return result, err
+			}
+			mem.SetMem([]byte(entry.key), value, entry.expires, entry.seq)
+		}
+		removed = append(removed, n)
+		result.SegmentsRemoved++
+		result.ValuesRewritten += len(live)
+		result.BytesReclaimed += segLen - liveBytes
+	}
+	if len(removed) == 0 {
+		return result, nil
+	}
+
+	// The rewritten values are durable once flushed, only then may the
+	// segments still holding them go
+	if err := mem.flushLocked(); err != nil {
+		return result, err
+	}
+	for _, n := range removed {
+		if err := mem.vlog.remove(n); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
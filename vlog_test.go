@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestValueLog_LargeValuesAndGC(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openStore(dir)
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	mem, err := s.CreateNamespace("blobs", nsOptions{FlushSize: 1, ValueThreshold: 100, VlogSegmentSize: 1000})
+	if err != nil {
+		t.Fatalf("Error creating namespace: %v", err)
+	}
+
+	large := strings.Repeat("x", 400)
+	for i := 0; i < 6; i++ {
+		if err := mem.Set([]byte(fmt.Sprintf("big-%d", i)), []byte(large)); err != nil {
+			t.Fatalf("Error setting big-%d: %v", i, err)
+		}
+	}
+	mem.Set([]byte("small"), []byte("tiny"))
+
+	stats, err := mem.Stats()
+	if err != nil {
+		t.Fatalf("Error getting stats: %v", err)
+	}
+	if stats.VlogSegments < 2 {
+		t.Fatalf("Expected the value log to span several segments, got %d", stats.VlogSegments)
+	}
+	if stats.StoredBytes >= int64(len(large)) {
+		t.Errorf("Expected large values to stay out of the SST files, got %d stored bytes", stats.StoredBytes)
+	}
+
+	for i := 0; i < 6; i++ {
+		v, err := mem.Get([]byte(fmt.Sprintf("big-%d", i)))
+		if err != nil || string(v) != large {
+			t.Fatalf("Expected big-%d to resolve to its value, got %d bytes (%v)", i, len(v), err)
+		}
+	}
+	if v, err := mem.Get([]byte("small")); err != nil || string(v) != "tiny" {
+		t.Errorf("Expected tiny, got %s (%v)", v, err)
+	}
+
+	// Overwrite or delete the values of the first segment, keep big-1 live
+	mem.Del("big-0")
+	mem.Set([]byte("big-2"), []byte("now small"))
+
+	result, err := mem.GCValueLog(0.1)
+	if err != nil {
+		t.Fatalf("Error collecting value log: %v", err)
+	}
+	if result.SegmentsRemoved == 0 || result.BytesReclaimed == 0 {
+		t.Errorf("Expected segments to be reclaimed, got %+v", result)
+	}
+
+	reopened, err := openStore(dir)
+	if err != nil {
+		t.Fatalf("Error reopening store: %v", err)
+	}
+	mem, _ = reopened.Namespace("blobs")
+	if v, err := mem.Get([]byte("big-1")); err != nil || string(v) != large {
+		t.Errorf("Expected big-1 to survive collection, got %d bytes (%v)", len(v), err)
+	}
+	if v, err := mem.Get([]byte("big-2")); err != nil || string(v) != "now small" {
+		t.Errorf("Expected overwritten value of big-2, got %s (%v)", v, err)
+	}
+	if _, err := mem.Get([]byte("big-0")); err == nil {
+		t.Errorf("Expected big-0 to stay deleted")
+	}
+}
+
+func TestValueLog_ConcurrentGets(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openStore(dir)
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	mem, err := s.CreateNamespace("blobs", nsOptions{FlushSize: 1, ValueThreshold: 100, VlogSegmentSize: 100})
+	if err != nil {
+		t.Fatalf("Error creating namespace: %v", err)
+	}
+	const keys = 32
+	large := strings.Repeat("x", 400)
+	for i := 0; i < keys; i++ {
+		if err := mem.Set([]byte(fmt.Sprintf("big-%d", i)), []byte(large)); err != nil {
+			t.Fatalf("Error setting big-%d: %v", i, err)
+		}
+	}
+
+	// No segment is open yet after reopening, so the readers open them
+	// concurrently
+	reopened, err := openStore(dir)
+	if err != nil {
+		t.Fatalf("Error reopening store: %v", err)
+	}
+	mem, _ = reopened.Namespace("blobs")
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < keys; i++ {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			<-start
+			if v, err := mem.Get([]byte(key)); err != nil || string(v) != large {
+				t.Errorf("Expected %s to resolve to its value, got %d bytes (%v)", key, len(v), err)
+			}
+		}(fmt.Sprintf("big-%d", i))
+	}
+	close(start)
+	wg.Wait()
+}
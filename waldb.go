@@ -1,65 +1,192 @@
 package main
 
 import (
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
 	"io"
+	"os"
+	"sync/atomic"
 )
 
-type walDB struct {
-	file io.ReadWriteSeeker
+const (
+	walHeaderSize     = 8          // crc32(4) + payload length(4)
+	walFileHeaderSize = 8          // magic(4) + key id(4)
+	walMagic          = 0x4b56574c // "KVWL"
+	maxWALRecordSize  = 1 << 30
+)
 
-	Term  byte
-	Bsize int
+// walDB is the write ahead log shared by every namespace of a store. The
+// file starts with a header naming the key its records are encrypted with,
+// then each record holds one write batch:
+// crc32(4) length(4) payload(length)
+// Logs written before the header existed start directly with a record and
+// are in plaintext.
+type walDB struct {
+	file      *os.File
+	keys      *keyring
+	keyID     uint32
+	aead      cipher.AEAD
+	dataStart int64
+
+	written atomic.Uint64 // bytes appended since the store was opened
+	syncs   atomic.Uint64
 }
 
-func (fl *walDB) SetWal(key, value []byte) error {
+// AppendBatch writes the batch as a single record, so a crash either keeps
+// all of its operations or none of them.
+func (fl *walDB) AppendBatch(b *writeBatch) error {
+	payload, err := seal(fl.aead, b.encode(), nil)
+	if err != nil {
+		return err
+	}
 
-	entry := make([]byte, fl.Bsize)
+	record := make([]byte, walHeaderSize, walHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(record[:4], crc32.ChecksumIEEE(payload))
+	binary.LittleEndian.PutUint32(record[4:8], uint32(len(payload)))
+	record = append(record, payload...)
 
-	keyLen, valueLen := len(key), len(value)
+	if _, err := fl.file.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	if _, err := fl.file.Write(record); err != nil {
+		return err
+	}
+	fl.written.Add(uint64(len(record)))
+	return nil
+}
 
-	copy(entry[:4], []byte("set "))
-	copy(entry[4:keyLen+4], key)
-	copy(entry[keyLen+4:keyLen+5], []byte(" "))
-	copy(entry[keyLen+5:keyLen+valueLen+5], value)
+// Replay calls fn for every batch in the log, oldest first, and returns
+// the offset the last complete record ends at. A short or mismatching
+// record ends the replay: it is the tail of a write that never completed.
+func (fl *walDB) Replay(fn func(b *writeBatch) error) (int64, error) {
+	end := fl.dataStart
+	if _, err := fl.file.Seek(end, io.SeekStart); err != nil {
+		return end, err
+	}
 
-	// Writing padding
-	for i := keyLen + valueLen + 5; i < fl.Bsize-1; i++ {
-		entry[i] = '#'
+	header := make([]byte, walHeaderSize)
+	for {
+		if _, err := io.ReadFull(fl.file, header); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return end, nil
+			}
+			return end, err
+		}
+
+		length := binary.LittleEndian.Uint32(header[4:8])
+		if length > maxWALRecordSize {
+			return end, nil
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(fl.file, payload); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return end, nil
+			}
+			return end, err
+		}
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[:4]) {
+			return end, nil
+		}
+
+		// The record is complete, so failing to decrypt it means the key is wrong
+		payload, err := unseal(fl.aead, payload, nil)
+		if err != nil {
+			return end, fmt.Errorf("%s: %w", fl.file.Name(), err)
+		}
+		b, err := decodeBatch(payload)
+		if err != nil {
+			return end, err
+		}
+		if err := fn(b); err != nil {
+			return end, err
+		}
+		end += walHeaderSize + int64(length)
 	}
-	entry[fl.Bsize-1] = '\n'
+}
 
-	if _, err := fl.file.Seek(0, io.SeekEnd); err != nil {
+// truncateTail cuts the log at end, as returned by Replay, dropping the
+// tail of a write that never completed so that new records are not
+// appended after it, where replay would never reach them.
+func (fl *walDB) truncateTail(end int64) error {
+	info, err := fl.file.Stat()
+	if err != nil {
 		return err
 	}
-	if _, err := fl.file.Write(entry); err != nil {
+	if info.Size() <= end {
+		return nil
+	}
+	if err := fl.file.Truncate(end); err != nil {
 		return err
 	}
-	return nil
+	return fl.file.Sync()
 }
 
-func (fl *walDB) DelWal(key []byte) error {
+// Reset empties the log. It is only safe once every memtable has been
+// flushed to disk. The emptied log is encrypted with the current key.
+func (fl *walDB) Reset() error {
+	if err := fl.file.Truncate(0); err != nil {
+		return err
+	}
+	return fl.writeFileHeader()
+}
 
-	entry := make([]byte, fl.Bsize)
+func (fl *walDB) writeFileHeader() error {
+	aead, err := fl.keys.aead(fl.keys.current)
+	if err != nil {
+		return err
+	}
 
-	keyLen := len(key)
+	header := make([]byte, walFileHeaderSize)
+	binary.BigEndian.PutUint32(header[:4], walMagic)
+	binary.BigEndian.PutUint32(header[4:], fl.keys.current)
+	if _, err := fl.file.WriteAt(header, 0); err != nil {
+		return err
+	}
 
-	copy(entry[:4], []byte("del "))
-	copy(entry[4:keyLen+4], key)
+	fl.keyID = fl.keys.current
+	fl.aead = aead
+	fl.dataStart = walFileHeaderSize
+	return nil
+}
 
-	// Writing padding
-	for i := keyLen + 4; i < fl.Bsize-1; i++ {
-		entry[i] = '#'
+// readFileHeader sets up the log from its header, writing one if the file
+// is empty.
+func (fl *walDB) readFileHeader() error {
+	info, err := fl.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return fl.writeFileHeader()
 	}
-	entry[fl.Bsize-1] = '\n'
 
-	if _, err := fl.file.Seek(0, io.SeekEnd); err != nil {
-		return err
+	header := make([]byte, walFileHeaderSize)
+	if info.Size() < walFileHeaderSize {
+		return nil
 	}
-	if _, err := fl.file.Write(entry); err != nil {
+	if _, err := fl.file.ReadAt(header, 0); err != nil {
 		return err
 	}
+	if binary.BigEndian.Uint32(header[:4]) != walMagic {
+		// Log written before file headers, in plaintext
+		return nil
+	}
+
+	fl.keyID = binary.BigEndian.Uint32(header[4:])
+	fl.dataStart = walFileHeaderSize
+	fl.aead, err = fl.keys.aead(fl.keyID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", fl.file.Name(), err)
+	}
 	return nil
+}
 
+// Sync flushes the log to stable storage.
+func (fl *walDB) Sync() error {
+	fl.syncs.Add(1)
+	return fl.file.Sync()
 }
 
 func (fl *fileDB) WriteOnEnd(valueToWrite []byte) error {
@@ -72,10 +199,13 @@ func (fl *fileDB) WriteOnEnd(valueToWrite []byte) error {
 	return nil
 }
 
-func NewwalDB(f io.ReadWriteSeeker) *walDB {
-	return &walDB{
-		file:  f,
-		Term:  byte('#'),
-		Bsize: 100,
+func NewwalDB(f *os.File, keys *keyring) (*walDB, error) {
+	fl := &walDB{
+		file: f,
+		keys: keys,
+	}
+	if err := fl.readFileHeader(); err != nil {
+		return nil, err
 	}
+	return fl, nil
 }
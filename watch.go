@@ -0,0 +1,396 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// watchBuffer is the number of events a watcher can fall behind by before
+// it is dropped. Writes never wait for watchers.
+const watchBuffer = 1024
+
+var (
+	errWatchOverflow = errors.New("watcher fell too far behind, resume from the last sequence number it got")
+	errWatchTooOld   = errors.New("sequence number no longer kept")
+	errWatchRestored = errors.New("store data was replaced, watch again")
+	errWatchClosed   = errors.New("watcher closed")
+)
+
+// WatchEvent is a change of a key: a put, with its value and expiry, or a
+// delete. Seq is the sequence number of the write batch it is part of, and
+// Index its position in the batch.
+type WatchEvent struct {
+	Seq       uint64
+	Index     int
+	Type      string // "put" or "delete"
+	Namespace string
+	Key       []byte
+	Value     []byte
+	Expires   int64 // unix nanoseconds, 0 means never
+}
+
+// A Watcher receives the changes of the keys of a namespace with a given
+// prefix, in the order they are written. When it falls behind by more
+// than watchBuffer events it is dropped: Events is closed and Err tells
+// why, and a new watcher can resume from the last sequence number seen.
+type Watcher struct {
+	hub    *watchHub
+	ns     string
+	prefix string
+	events chan WatchEvent
+	err    error // set when events is closed, guarded by hub.mu
+}
+
+// Events returns the channel events are delivered on. It is closed when
+// the watcher ends.
+func (w *Watcher) Events() <-chan WatchEvent {
+	return w.events
+}
+
+// Err returns why the watcher ended, once Events is closed.
+func (w *Watcher) Err() error {
+	w.hub.mu.Lock()
+	defer w.hub.mu.Unlock()
+	return w.err
+}
+
+// Close stops the watcher.
+func (w *Watcher) Close() {
+	w.hub.mu.Lock()
+	defer w.hub.mu.Unlock()
+	w.hub.endLocked(w, errWatchClosed)
+}
+
+// watchHub holds the watchers of a store, and its latest batches for
+// watchers to resume from.
+type watchHub struct {
+	mu       sync.Mutex
+	watchers map[*Watcher]bool
+
+	// recent holds up to maxBytes of the latest batches, encoded, which
+	// follow the batch base
+	recent   []watchBatch
+	size     int
+	maxBytes int
+	base     uint64
+}
+
+type watchBatch struct {
+	seq  uint64
+	data []byte
+}
+
+func newWatchHub(maxBytes int) *watchHub {
+	return &watchHub{watchers: make(map[*Watcher]bool), maxBytes: maxBytes}
+}
+
+// reset forgets the batches kept, for a store now at seq.
+func (h *watchHub) reset(seq uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.recent = nil
+	h.size = 0
+	h.base = seq
+}
+
+// keepLocked adds b to the latest batches, dropping the oldest ones over
+// maxBytes.
+func (h *watchHub) keepLocked(b *writeBatch) {
+	if h.maxBytes <= 0 {
+		h.base = b.seq
+		return
+	}
+	data := b.encode()
+	h.recent = append(h.recent, watchBatch{seq: b.seq, data: data})
+	h.size += len(data)
+	for h.size > h.maxBytes && len(h.recent) > 0 {
+		h.size -= len(h.recent[0].data)
+		h.base = h.recent[0].seq
+		h.recent = h.recent[1:]
+	}
+}
+
+// backlog returns the events for w of the batches kept after seq, false
+// when seq is older than they are.
+func (h *watchHub) backlog(w *Watcher, seq uint64) ([]WatchEvent, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if seq < h.base {
+		return nil, false
+	}
+	var events []WatchEvent
+	for _, kept := range h.recent {
+		if kept.seq <= seq {
+			continue
+		}
+		b, err := decodeBatch(kept.data)
+		if err != nil {
+			return nil, false
+		}
+		for i, op := range b.ops {
+			if ev, ok := w.match(op, b.seq, i); ok {
+				events = append(events, ev)
+			}
+		}
+	}
+	return events, true
+}
+
+func (h *watchHub) endLocked(w *Watcher, err error) {
+	if !h.watchers[w] {
+		return
+	}
+	delete(h.watchers, w)
+	w.err = err
+	close(w.events)
+}
+
+// publish sends the puts and deletes of b to the watchers interested in
+// them, dropping the ones with a full buffer. The store is locked, so
+// batches are published in order.
+func (h *watchHub) publish(b *writeBatch) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.keepLocked(b)
+
+	for w := range h.watchers {
+		for i, op := range b.ops {
+			ev, ok := w.match(op, b.seq, i)
+			if !ok {
+				continue
+			}
+			select {
+			case w.events <- ev:
+			default:
+				h.endLocked(w, errWatchOverflow)
+			}
+			if !h.watchers[w] {
+				break
+			}
+		}
+	}
+}
+
+// closeAll ends every watcher with err.
+func (h *watchHub) closeAll(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for w := range h.watchers {
+		h.endLocked(w, err)
+	}
+}
+
+func (w *Watcher) match(op batchOp, seq uint64, index int) (WatchEvent, bool) {
+	if op.ns != w.ns || !strings.HasPrefix(string(op.key), w.prefix) {
+		return WatchEvent{}, false
+	}
+	// Copied, callers may reuse the buffers of their batches
+	key := append([]byte(nil), op.key...)
+	switch op.op {
+	case opSet:
+		return WatchEvent{Seq: seq, Index: index, Type: "put", Namespace: op.ns, Key: key, Value: append([]byte(nil), op.value...), Expires: op.expires}, true
+	case opDel:
+		return WatchEvent{Seq: seq, Index: index, Type: "delete", Namespace: op.ns, Key: key}, true
+	}
+	return WatchEvent{}, false
+}
+
+// Watch returns a watcher of the keys of the namespace starting with
+// prefix, from the next write on.
+func (mem *memDB) Watch(prefix string) *Watcher {
+	s := mem.store
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	w := &Watcher{hub: s.watchers, ns: mem.name, prefix: prefix, events: make(chan WatchEvent, watchBuffer)}
+	s.watchers.mu.Lock()
+	s.watchers.watchers[w] = true
+	s.watchers.mu.Unlock()
+	return w
+}
+
+// WatchFrom is Watch, starting with the changes written after the batch
+// with sequence number seq. They are read back from the latest batches,
+// about storeOptions.WatchLogSize bytes of them kept in memory since the
+// store was opened, or else from the WAL. It fails with errWatchTooOld
+// when neither goes back to seq.
+func (mem *memDB) WatchFrom(prefix string, seq uint64) (*Watcher, error) {
+	s := mem.store
+	// Locked for writing so no batch is published until the watcher is
+	// registered with the backlog in front
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if seq > s.seq {
+		return nil, fmt.Errorf("sequence number %d is ahead of the store, at %d", seq, s.seq)
+	}
+	w := &Watcher{hub: s.watchers, ns: mem.name, prefix: prefix}
+	backlog, ok := s.watchers.backlog(w, seq)
+	if !ok {
+		var err error
+		if backlog, err = s.walBacklogLocked(w, seq); err != nil {
+			return nil, err
+		}
+	}
+
+	w.events = make(chan WatchEvent, len(backlog)+watchBuffer)
+	for _, ev := range backlog {
+		w.events <- ev
+	}
+	s.watchers.mu.Lock()
+	s.watchers.watchers[w] = true
+	s.watchers.mu.Unlock()
+	return w, nil
+}
+
+// walBacklogLocked returns the events for w of the batches after seq read
+// back from the WAL, which only holds the writes since every memtable was
+// last flushed.
+func (s *store) walBacklogLocked(w *Watcher, seq uint64) ([]WatchEvent, error) {
+	var (
+		backlog []WatchEvent
+		base    uint64
+		first   = true
+	)
+	_, err := s.wal.Replay(func(b *writeBatch) error {
+		// A rotated WAL starts with an empty batch holding the sequence
+		// number it was rotated at; one never rotated holds every write
+		if first && b.Len() == 0 {
+			base = b.seq
+		}
+		first = false
+		if b.seq <= seq {
+			return nil
+		}
+		for i, op := range b.ops {
+			if ev, ok := w.match(op, b.seq, i); ok {
+				backlog = append(backlog, ev)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if seq < base {
+		return nil, fmt.Errorf("%w: %d, the WAL starts after %d", errWatchTooOld, seq, base)
+	}
+	return backlog, nil
+}
+
+// watchEventJSON is a WatchEvent as sent over Server-Sent Events, with the
+// key and value encoded like export records.
+type watchEventJSON struct {
+	Seq       uint64 `json:"seq"`
+	Type      string `json:"type"`
+	Namespace string `json:"ns"`
+	exportRecord
+}
+
+// handleWatch streams the changes of the keys of a namespace with a prefix
+// as Server-Sent Events, one event per change, named put or delete, with
+// the sequence number of the batch and the position of the change in it
+// as ID, such as 121:0:
+//
+//	GET /v1/watch?ns=users&prefix=u&from=120
+//
+// from is a sequence number, to start after that batch, or an event ID, to
+// start after that change. Without from, or a Last-Event-ID header as sent
+// by reconnecting EventSource clients, only changes written from now on
+// are sent. Streams resume from the latest batches kept in memory,
+// -watch-log-size bytes of them since the server started, or else from the
+// WAL, which holds the writes since every memtable was last flushed; older
+// sequence numbers get 410 Gone.
+func handleWatch(w http.ResponseWriter, r *http.Request) {
+	mem, ok := namespaceFromQuery(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	from := q.Get("from")
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		from = id
+	}
+
+	var (
+		watcher *Watcher
+		// Changes up to index in the batch skip are skipped, they were sent
+		skip  uint64
+		index int
+	)
+	if from == "" {
+		watcher = mem.Watch(q.Get("prefix"))
+	} else {
+		seq, err := strconv.ParseUint(from, 10, 64)
+		if batch, i, ok := strings.Cut(from, ":"); ok {
+			seq, err = strconv.ParseUint(batch, 10, 64)
+			if err == nil {
+				index, err = strconv.Atoi(i)
+			}
+			if err == nil && seq > 0 {
+				skip, seq = seq, seq-1
+			}
+		}
+		if err != nil {
+			http.Error(w, "Invalid from", http.StatusBadRequest)
+			return
+		}
+		watcher, err = mem.WatchFrom(q.Get("prefix"), seq)
+		switch {
+		case errors.Is(err, errWatchTooOld):
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	defer watcher.Close()
+
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	// Comments keep idle connections from being closed by proxies
+	ping := time.NewTicker(15 * time.Second)
+	defer ping.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ping.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case ev, ok := <-watcher.Events():
+			if !ok {
+				data, _ := json.Marshal(map[string]string{"error": watcher.Err().Error()})
+				fmt.Fprintf(w, "event: error\ndata: %s\n\n", data)
+				if flusher != nil {
+					flusher.Flush()
+				}
+				return
+			}
+			if ev.Seq == skip && ev.Index <= index {
+				continue
+			}
+			entry := memEntry{key: string(ev.Key), value: string(ev.Value), expires: ev.Expires}
+			data, err := json.Marshal(watchEventJSON{Seq: ev.Seq, Type: ev.Type, Namespace: ev.Namespace, exportRecord: newExportRecord(entry)})
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "id: %d:%d\nevent: %s\ndata: %s\n\n", ev.Seq, ev.Index, ev.Type, data)
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func nextEvent(t *testing.T, w *Watcher) WatchEvent {
+	t.Helper()
+	select {
+	case ev, ok := <-w.Events():
+		if !ok {
+			t.Fatalf("Watcher ended: %v", w.Err())
+		}
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No event")
+	}
+	return WatchEvent{}
+}
+
+func TestWatch(t *testing.T) {
+	s, err := openStore(filepath.Join(t.TempDir(), "data"))
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	// Big enough a memtable for the WAL to keep the writes
+	mem, err := s.CreateNamespace("watch", nsOptions{FlushSize: 1 << 20})
+	if err != nil {
+		t.Fatalf("Error creating namespace: %v", err)
+	}
+	mem.Set([]byte("user:0"), []byte("before"))
+	start := storeSeq(s)
+
+	w := mem.Watch("user:")
+	defer w.Close()
+	mem.Set([]byte("user:1"), []byte("alice"))
+	mem.Set([]byte("other"), []byte("x"))
+	mem.Del("user:1")
+
+	ev := nextEvent(t, w)
+	if ev.Type != "put" || string(ev.Key) != "user:1" || string(ev.Value) != "alice" || ev.Seq != start+1 {
+		t.Errorf("Unexpected first event %+v", ev)
+	}
+	if ev := nextEvent(t, w); ev.Type != "delete" || string(ev.Key) != "user:1" || ev.Seq != start+3 {
+		t.Errorf("Unexpected second event %+v", ev)
+	}
+
+	// Resuming replays the WAL, then follows new writes
+	resumed, err := mem.WatchFrom("user:", start-1)
+	if err != nil {
+		t.Fatalf("Error resuming: %v", err)
+	}
+	defer resumed.Close()
+	mem.Set([]byte("user:2"), []byte("bob"))
+	var got []string
+	for i := 0; i < 4; i++ {
+		ev := nextEvent(t, resumed)
+		got = append(got, fmt.Sprintf("%d %s %s", ev.Seq, ev.Type, ev.Key))
+	}
+	want := []string{
+		fmt.Sprintf("%d put user:0", start),
+		fmt.Sprintf("%d put user:1", start+1),
+		fmt.Sprintf("%d delete user:1", start+3),
+		fmt.Sprintf("%d put user:2", start+4),
+	}
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	// A watcher that does not keep up is dropped without blocking writes
+	slow := mem.Watch("")
+	for i := 0; i <= watchBuffer; i++ {
+		mem.Set([]byte(fmt.Sprint("k", i)), nil)
+	}
+	for range slow.Events() {
+	}
+	if !errors.Is(slow.Err(), errWatchOverflow) {
+		t.Errorf("Expected %v, got %v", errWatchOverflow, slow.Err())
+	}
+
+	// Once every memtable is flushed the WAL no longer has the writes, the
+	// latest batches kept in memory still do
+	mem.Flush()
+	kept, err := mem.WatchFrom("user:", start)
+	if err != nil {
+		t.Fatalf("Error resuming after a flush: %v", err)
+	}
+	if ev := nextEvent(t, kept); ev.Seq != start+1 || string(ev.Key) != "user:1" {
+		t.Errorf("Unexpected event after a flush %+v", ev)
+	}
+	kept.Close()
+
+	// Past them, the WAL is read, which starts after the flush
+	s.watchers.mu.Lock()
+	s.watchers.maxBytes = 1
+	s.watchers.mu.Unlock()
+	mem.Set([]byte("user:3"), []byte("carol"))
+	if _, err := mem.WatchFrom("", start); !errors.Is(err, errWatchTooOld) {
+		t.Errorf("Expected %v, got %v", errWatchTooOld, err)
+	}
+	resumed, err = mem.WatchFrom("user:", storeSeq(s)-1)
+	if err != nil {
+		t.Fatalf("Error resuming from the WAL: %v", err)
+	}
+	if ev := nextEvent(t, resumed); string(ev.Key) != "user:3" {
+		t.Errorf("Unexpected event from the WAL %+v", ev)
+	}
+	resumed.Close()
+	if w, err := mem.WatchFrom("", storeSeq(s)); err != nil {
+		t.Errorf("Expected to resume from the current sequence number, got %v", err)
+	} else {
+		w.Close()
+	}
+}
+
+// readEvents reads n Server-Sent Events, their lines joined with |.
+func readEvents(t *testing.T, br *bufio.Reader, n int) []string {
+	t.Helper()
+	var events []string
+	for len(events) < n {
+		var event []string
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Error reading events: %v", err)
+			}
+			if line == "\n" {
+				break
+			}
+			event = append(event, strings.TrimSuffix(line, "\n"))
+		}
+		events = append(events, strings.Join(event, "|"))
+	}
+	return events
+}
+
+func TestWatchSSE(t *testing.T) {
+	s, err := openStore(filepath.Join(t.TempDir(), "data"))
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	st = s
+	mem := s.namespaces[defaultNamespace]
+	mem.Set([]byte("a"), []byte("1"))
+	from := storeSeq(s)
+	mem.Set([]byte("a"), []byte{0xff})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/v1/watch", handleWatch)
+	url := serveLoopback(t, r)
+	watch := func(lastID string) *bufio.Reader {
+		req, _ := http.NewRequest("GET", url+"/v1/watch?prefix=a", nil)
+		req.Header.Set("Last-Event-ID", lastID)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error watching: %v", err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Fatalf("Unexpected content type %q", ct)
+		}
+		return bufio.NewReader(resp.Body)
+	}
+	br := watch(fmt.Sprint(from))
+	mem.Del("a")
+
+	events := readEvents(t, br, 2)
+	want := []string{
+		fmt.Sprintf(`id: %d:0|event: put|data: {"seq":%d,"type":"put","ns":"default","key":"YQ==","value":"/w==","encoding":"base64"}`, from+1, from+1),
+		fmt.Sprintf(`id: %d:0|event: delete|data: {"seq":%d,"type":"delete","ns":"default","key":"a","value":""}`, from+2, from+2),
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Errorf("Expected event %s, got %s", want[i], events[i])
+		}
+	}
+
+	// Every change of a batch has its own ID, resuming after one sends the
+	// rest of the batch
+	b := &writeBatch{}
+	b.Put(defaultNamespace, []byte("a1"), []byte("x"))
+	b.Put(defaultNamespace, []byte("a2"), []byte("y"))
+	if err := s.Write(b); err != nil {
+		t.Fatalf("Error writing batch: %v", err)
+	}
+	events = readEvents(t, br, 2)
+	seq := storeSeq(s)
+	if !strings.HasPrefix(events[0], fmt.Sprintf("id: %d:0|", seq)) || !strings.HasPrefix(events[1], fmt.Sprintf("id: %d:1|", seq)) {
+		t.Fatalf("Unexpected IDs in %v", events)
+	}
+	mem.Set([]byte("a3"), []byte("z"))
+	events = readEvents(t, watch(fmt.Sprintf("%d:0", seq)), 2)
+	if !strings.Contains(events[0], `"key":"a2"`) || !strings.Contains(events[1], `"key":"a3"`) {
+		t.Errorf("Expected a2 then a3 when resuming mid-batch, got %v", events)
+	}
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Webhooks POST the changes of keys to URLs. Rules, the queue of pending
+// deliveries and the dead letters live in a reserved namespace:
+//
+//	rule/<id>   a webhookRule
+//	queue/<id>  a webhookDelivery waiting to be sent
+//	dead/<id>   a webhookDelivery that failed every attempt
+//
+// A delivery is queued in the same batch as the write it reports, so it
+// survives a crash whenever the write does, and is deleted once the URL
+// answered with a 2xx status: every change is delivered at least once.
+const webhookNamespace = "_webhooks"
+
+var (
+	errBadWebhookRule   = errors.New("a webhook rule needs a url, and a prefix or a glob")
+	errWebhookNotFound  = errors.New("webhook rule not found")
+	errDeliveryNotFound = errors.New("delivery not found")
+)
+
+// webhookRule sends the changes of the keys of Namespace matching Prefix,
+// or the path.Match pattern Glob, to URL. Events limits them to "put" or
+// "delete", both when empty.
+type webhookRule struct {
+	ID        string   `json:"id"`
+	Namespace string   `json:"ns"`
+	Prefix    string   `json:"prefix,omitempty"`
+	Glob      string   `json:"glob,omitempty"`
+	Events    []string `json:"events,omitempty"`
+	URL       string   `json:"url"`
+}
+
+func (rule webhookRule) match(ns, key, event string) bool {
+	if ns != rule.Namespace {
+		return false
+	}
+	if rule.Glob != "" {
+		if ok, _ := path.Match(rule.Glob, key); !ok {
+			return false
+		}
+	} else if !strings.HasPrefix(key, rule.Prefix) {
+		return false
+	}
+	if len(rule.Events) == 0 {
+		return true
+	}
+	for _, e := range rule.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookPayload is the body POSTed for a change, with the ID of the
+// delivery, the same on every attempt so receivers can drop duplicates.
+type webhookPayload struct {
+	ID   string `json:"id"`
+	Rule string `json:"rule"`
+	watchEventJSON
+}
+
+// webhookDelivery is a payload to POST and how its attempts went.
+type webhookDelivery struct {
+	ID          string          `json:"id"`
+	Rule        string          `json:"rule"`
+	URL         string          `json:"url"`
+	Payload     json.RawMessage `json:"payload"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt int64           `json:"next_attempt"` // unix nanoseconds
+	LastError   string          `json:"last_error,omitempty"`
+}
+
+// webhookConfig tells how deliveries are retried: after InitialBackoff,
+// doubling up to MaxBackoff, until MaxAttempts failed.
+type webhookConfig struct {
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	MaxAttempts    int
+	Timeout        time.Duration // of one attempt
+	PollInterval   time.Duration // how often the queue is checked for retries due
+}
+
+func defaultWebhookConfig() webhookConfig {
+	return webhookConfig{
+		InitialBackoff: time.Second,
+		MaxBackoff:     10 * time.Minute,
+		MaxAttempts:    10,
+		Timeout:        10 * time.Second,
+		PollInterval:   time.Second,
+	}
+}
+
+func (c webhookConfig) backoff(attempts int) time.Duration {
+	d := c.InitialBackoff
+	for i := 1; i < attempts && d < c.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > c.MaxBackoff {
+		d = c.MaxBackoff
+	}
+	return d
+}
+
+// webhooks queues and sends the deliveries of a store.
+type webhooks struct {
+	s      *store
+	mem    *memDB
+	config webhookConfig
+	client *http.Client
+
+	mu    sync.Mutex
+	rules map[string]webhookRule
+	// busy holds the URLs a worker is sending deliveries to
+	busy map[string]bool
+
+	wake chan struct{}
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+// startWebhooks creates the reserved namespace if needed, loads the rules
+// and starts sending the queued deliveries.
+func startWebhooks(s *store, config webhookConfig) (*webhooks, error) {
+	mem, err := s.Namespace(webhookNamespace)
+	if errors.Is(err, errNamespaceNotFound) {
+		mem, err = s.CreateNamespace(webhookNamespace, nsOptions{})
+	}
+	if err != nil {
+		return nil, err
+	}
+	h := &webhooks{
+		s:      s,
+		mem:    mem,
+		config: config,
+		client: &http.Client{Timeout: config.Timeout},
+		rules:  make(map[string]webhookRule),
+		busy:   make(map[string]bool),
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+	}
+	entries, err := scanPrefix(h.mem, "rule/")
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		var rule webhookRule
+		if err := json.Unmarshal([]byte(entry.value), &rule); err != nil {
+			return nil, fmt.Errorf("webhook %s: %v", entry.key, err)
+		}
+		h.rules[rule.ID] = rule
+	}
+
+	s.mu.Lock()
+	s.webhooks = h
+	s.mu.Unlock()
+	h.done.Add(1)
+	go h.run()
+	return h, nil
+}
+
+// Stop stops sending deliveries. Changes are still queued.
+func (h *webhooks) Stop() {
+	close(h.stop)
+	h.done.Wait()
+}
+
+// enqueueLocked returns b with a delivery for every change of b a rule
+// matches, b itself when there is none. The store is locked and b has its
+// sequence number. b is left alone, callers may reuse their batches.
+func (h *webhooks) enqueueLocked(b *writeBatch) *writeBatch {
+	if h == nil {
+		return b
+	}
+	if _, ok := h.s.namespaces[webhookNamespace]; !ok {
+		h.s.logger.Error("webhook namespace dropped, changes are not delivered")
+		return b
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.rules) == 0 {
+		return b
+	}
+
+	now := time.Now().UnixNano()
+	var queued []batchOp
+	for i, op := range b.ops {
+		if op.ns == webhookNamespace || (op.op != opSet && op.op != opDel) {
+			continue
+		}
+		event := "put"
+		if op.op == opDel {
+			event = "delete"
+		}
+		for _, rule := range h.rules {
+			if !rule.match(op.ns, string(op.key), event) {
+				continue
+			}
+			id := fmt.Sprintf("%020d-%05d-%s", b.seq, i, rule.ID)
+			entry := memEntry{key: string(op.key), value: string(op.value), expires: op.expires}
+			payload, _ := json.Marshal(webhookPayload{ID: id, Rule: rule.ID, watchEventJSON: watchEventJSON{
+				Seq: b.seq, Type: event, Namespace: op.ns, exportRecord: newExportRecord(entry),
+			}})
+			d, _ := json.Marshal(webhookDelivery{ID: id, Rule: rule.ID, URL: rule.URL, Payload: payload, NextAttempt: now})
+			queued = append(queued, batchOp{op: opSet, ns: webhookNamespace, key: []byte("queue/" + id), value: d})
+		}
+	}
+	if len(queued) == 0 {
+		return b
+	}
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+	ops := make([]batchOp, 0, len(b.ops)+len(queued))
+	return &writeBatch{seq: b.seq, ops: append(append(ops, b.ops...), queued...)}
+}
+
+func (h *webhooks) run() {
+	defer h.done.Done()
+	ticker := time.NewTicker(h.config.PollInterval)
+	defer ticker.Stop()
+	for {
+		if err := h.deliverDue(); err != nil {
+			h.s.logger.Error("webhook delivery failed", "err", err)
+		}
+		select {
+		case <-h.stop:
+			return
+		case <-h.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// deliverDue sends the queued deliveries whose attempt is due, oldest
+// first for each URL. Every URL has its own worker, so a slow one does not
+// hold up the others; the deliveries to a URL whose worker is still busy
+// are left to a later pass.
+func (h *webhooks) deliverDue() error {
+	entries, err := scanPrefix(h.mem, "queue/")
+	if err != nil {
+		return err
+	}
+	now := time.Now().UnixNano()
+	due := make(map[string][]webhookDelivery)
+	for _, entry := range entries {
+		var d webhookDelivery
+		if err := json.Unmarshal([]byte(entry.value), &d); err != nil {
+			return fmt.Errorf("%s: %v", entry.key, err)
+		}
+		if d.NextAttempt <= now {
+			due[d.URL] = append(due[d.URL], d)
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for url, list := range due {
+		if h.busy[url] {
+			continue
+		}
+		h.busy[url] = true
+		h.done.Add(1)
+		go h.deliver(url, list)
+	}
+	return nil
+}
+
+// deliver attempts the deliveries to url in order, then wakes run up for
+// the ones queued meanwhile.
+func (h *webhooks) deliver(url string, list []webhookDelivery) {
+	defer h.done.Done()
+	defer func() {
+		h.mu.Lock()
+		delete(h.busy, url)
+		h.mu.Unlock()
+		select {
+		case h.wake <- struct{}{}:
+		default:
+		}
+	}()
+	for _, d := range list {
+		select {
+		case <-h.stop:
+			return
+		default:
+		}
+		if err := h.attempt(d); err != nil {
+			h.s.logger.Error("webhook delivery failed", "id", d.ID, "url", url, "err", err)
+			return
+		}
+	}
+}
+
+// attempt POSTs a delivery, then deletes it, reschedules it or moves it to
+// the dead letters.
+func (h *webhooks) attempt(d webhookDelivery) error {
+	err := h.post(d)
+	b := &writeBatch{}
+	b.Delete(webhookNamespace, []byte("queue/"+d.ID))
+	if err != nil {
+		d.Attempts++
+		d.LastError = err.Error()
+		d.NextAttempt = time.Now().Add(h.config.backoff(d.Attempts)).UnixNano()
+		data, _ := json.Marshal(d)
+		if d.Attempts >= h.config.MaxAttempts {
+			h.s.logger.Warn("webhook delivery failed for good", "id", d.ID, "url", d.URL, "attempts", d.Attempts, "err", err)
+			b.Put(webhookNamespace, []byte("dead/"+d.ID), data)
+		} else {
+			h.s.logger.Debug("webhook delivery failed, will retry", "id", d.ID, "url", d.URL, "attempts", d.Attempts, "err", err)
+			b.ops = b.ops[:0]
+			b.Put(webhookNamespace, []byte("queue/"+d.ID), data)
+		}
+	}
+	return h.s.Write(b)
+}
+
+func (h *webhooks) post(d webhookDelivery) error {
+	resp, err := h.client.Post(d.URL, "application/json", bytes.NewReader(d.Payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s answered %s", d.URL, resp.Status)
+	}
+	return nil
+}
+
+// Rules returns the rules, sorted by ID.
+func (h *webhooks) Rules() []webhookRule {
+	entries, _ := scanPrefix(h.mem, "rule/")
+	rules := []webhookRule{}
+	for _, entry := range entries {
+		var rule webhookRule
+		if json.Unmarshal([]byte(entry.value), &rule) == nil {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// PutRule adds or replaces a rule. Changes written from then on are
+// delivered.
+func (h *webhooks) PutRule(rule webhookRule) (webhookRule, error) {
+	if rule.Namespace == "" {
+		rule.Namespace = defaultNamespace
+	}
+	if rule.URL == "" || (rule.Prefix == "" && rule.Glob == "") || rule.ID == "" {
+		return rule, errBadWebhookRule
+	}
+	if _, err := path.Match(rule.Glob, ""); err != nil {
+		return rule, fmt.Errorf("glob: %v", err)
+	}
+	for _, e := range rule.Events {
+		if e != "put" && e != "delete" {
+			return rule, fmt.Errorf("unknown event %q, expected put or delete", e)
+		}
+	}
+	data, err := json.Marshal(rule)
+	if err != nil {
+		return rule, err
+	}
+	// Under the store lock, so no write sees the rule before it is stored
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+	b := &writeBatch{}
+	b.Put(webhookNamespace, []byte("rule/"+rule.ID), data)
+	if err := h.s.writeLocked(b); err != nil {
+		return rule, err
+	}
+	h.mu.Lock()
+	h.rules[rule.ID] = rule
+	h.mu.Unlock()
+	return rule, nil
+}
+
+// DeleteRule deletes a rule. Its queued deliveries are still sent.
+func (h *webhooks) DeleteRule(id string) error {
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+	h.mu.Lock()
+	_, ok := h.rules[id]
+	h.mu.Unlock()
+	if !ok {
+		return errWebhookNotFound
+	}
+	b := &writeBatch{}
+	b.Delete(webhookNamespace, []byte("rule/"+id))
+	if err := h.s.writeLocked(b); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	delete(h.rules, id)
+	h.mu.Unlock()
+	return nil
+}
+
+// Deliveries returns the queued deliveries, or the dead letters.
+func (h *webhooks) Deliveries(dead bool) ([]webhookDelivery, error) {
+	prefix := "queue/"
+	if dead {
+		prefix = "dead/"
+	}
+	entries, err := scanPrefix(h.mem, prefix)
+	if err != nil {
+		return nil, err
+	}
+	list := []webhookDelivery{}
+	for _, entry := range entries {
+		var d webhookDelivery
+		if err := json.Unmarshal([]byte(entry.value), &d); err != nil {
+			return nil, fmt.Errorf("%s: %v", entry.key, err)
+		}
+		list = append(list, d)
+	}
+	return list, nil
+}
+
+// Retry moves a dead letter back to the queue, for MaxAttempts more
+// attempts.
+func (h *webhooks) Retry(id string) error {
+	value, err := h.mem.Get([]byte("dead/" + id))
+	if err != nil {
+		return errDeliveryNotFound
+	}
+	var d webhookDelivery
+	if err := json.Unmarshal(value, &d); err != nil {
+		return err
+	}
+	d.Attempts = 0
+	d.NextAttempt = time.Now().UnixNano()
+	data, _ := json.Marshal(d)
+	b := &writeBatch{}
+	b.Delete(webhookNamespace, []byte("dead/"+id))
+	b.Put(webhookNamespace, []byte("queue/"+id), data)
+	if err := h.s.Write(b); err != nil {
+		return err
+	}
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// registerWebhookRoutes adds the admin routes of the webhooks:
+//
+//	GET    /admin/webhooks                      list the rules
+//	PUT    /admin/webhooks/{id}                 add or replace a rule
+//	DELETE /admin/webhooks/{id}                 delete a rule
+//	GET    /admin/webhooks-queue                list the pending deliveries
+//	GET    /admin/webhooks-dead                 list the dead letters
+//	POST   /admin/webhooks-dead/{id}/retry      queue a dead letter again
+func registerWebhookRoutes(r *mux.Router) {
+	r.HandleFunc("/admin/webhooks", handleListWebhooks).Methods("GET")
+	r.HandleFunc("/admin/webhooks/{id}", handlePutWebhook).Methods("PUT")
+	r.HandleFunc("/admin/webhooks/{id}", handleDeleteWebhook).Methods("DELETE")
+	r.HandleFunc("/admin/webhooks-queue", handleListDeliveries).Methods("GET")
+	r.HandleFunc("/admin/webhooks-dead", handleListDeliveries).Methods("GET")
+	r.HandleFunc("/admin/webhooks-dead/{id}/retry", handleRetryDelivery).Methods("POST")
+}
+
+func webhooksEnabled(w http.ResponseWriter) bool {
+	if hooks == nil {
+		http.Error(w, "webhooks are not enabled, start the server with -webhooks", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+func handleListWebhooks(w http.ResponseWriter, r *http.Request) {
+	if !webhooksEnabled(w) {
+		return
+	}
+	writeJSON(w, http.StatusOK, hooks.Rules())
+}
+
+func handlePutWebhook(w http.ResponseWriter, r *http.Request) {
+	if !webhooksEnabled(w) {
+		return
+	}
+	var rule webhookRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	rule.ID = mux.Vars(r)["id"]
+	rule, err := hooks.PutRule(rule)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, rule)
+}
+
+func handleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	if !webhooksEnabled(w) {
+		return
+	}
+	err := hooks.DeleteRule(mux.Vars(r)["id"])
+	switch {
+	case errors.Is(err, errWebhookNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleListDeliveries(w http.ResponseWriter, r *http.Request) {
+	if !webhooksEnabled(w) {
+		return
+	}
+	list, err := hooks.Deliveries(strings.HasSuffix(r.URL.Path, "-dead"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func handleRetryDelivery(w http.ResponseWriter, r *http.Request) {
+	if !webhooksEnabled(w) {
+		return
+	}
+	err := hooks.Retry(mux.Vars(r)["id"])
+	switch {
+	case errors.Is(err, errDeliveryNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookBackoff(t *testing.T) {
+	c := webhookConfig{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, d := range want {
+		if got := c.backoff(i + 1); got != d {
+			t.Errorf("Expected backoff %v after %d attempts, got %v", d, i+1, got)
+		}
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	s, err := openStore(filepath.Join(t.TempDir(), "data"))
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	mem := s.namespaces[defaultNamespace]
+
+	// The receiver fails the first two attempts of every delivery
+	var (
+		mu       sync.Mutex
+		attempts = make(map[string]int)
+		received []webhookPayload
+	)
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		var p webhookPayload
+		if err := json.Unmarshal(data, &p); err != nil {
+			t.Errorf("Invalid payload %s: %v", data, err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		attempts[p.ID]++
+		if attempts[p.ID] <= 2 {
+			http.Error(w, "not yet", http.StatusServiceUnavailable)
+			return
+		}
+		received = append(received, p)
+	}))
+	defer ok.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	config := webhookConfig{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 20 * time.Millisecond, MaxAttempts: 4, Timeout: time.Second, PollInterval: 5 * time.Millisecond}
+	h, err := startWebhooks(s, config)
+	if err != nil {
+		t.Fatalf("Error starting webhooks: %v", err)
+	}
+	if _, err := h.PutRule(webhookRule{ID: "users", Prefix: "user:", URL: ok.URL}); err != nil {
+		t.Fatalf("Error adding rule: %v", err)
+	}
+	if _, err := h.PutRule(webhookRule{ID: "orders", Glob: "order/*", Events: []string{"delete"}, URL: failing.URL}); err != nil {
+		t.Fatalf("Error adding rule: %v", err)
+	}
+	if _, err := h.PutRule(webhookRule{ID: "bad", URL: ok.URL}); err != errBadWebhookRule {
+		t.Errorf("Expected %v, got %v", errBadWebhookRule, err)
+	}
+
+	mem.Set([]byte("user:1"), []byte("alice"))
+	mem.Set([]byte("other"), []byte("x"))
+	mem.Set([]byte("order/1"), []byte("x"))
+	mem.Del("order/1")
+	mem.Del("user:1")
+
+	waitFor := func(what string, done func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !done() {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for %s", what)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	waitFor("the deliveries", func() bool {
+		queued, _ := h.Deliveries(false)
+		return len(queued) == 0
+	})
+
+	mu.Lock()
+	if len(received) != 2 || received[0].Type != "put" || received[0].Key != "user:1" || received[0].Value != "alice" ||
+		received[1].Type != "delete" || received[1].Key != "user:1" || received[0].Seq >= received[1].Seq {
+		t.Errorf("Unexpected deliveries %+v", received)
+	}
+	for id, n := range attempts {
+		if n != 3 {
+			t.Errorf("Expected 3 attempts of %s, got %d", id, n)
+		}
+	}
+	mu.Unlock()
+
+	dead, err := h.Deliveries(true)
+	if err != nil || len(dead) != 1 || dead[0].Rule != "orders" || dead[0].Attempts != 4 || dead[0].LastError == "" {
+		t.Fatalf("Expected the order delete to be dead-lettered, got %+v, %v", dead, err)
+	}
+
+	// Deliveries queued while nothing sends them survive in the reserved
+	// namespace, as do the rules
+	h.Stop()
+	mem.Set([]byte("user:2"), []byte("bob"))
+	if queued, _ := h.Deliveries(false); len(queued) != 1 {
+		t.Errorf("Expected a queued delivery, got %+v", queued)
+	}
+	h, err = startWebhooks(s, config)
+	if err != nil {
+		t.Fatalf("Error restarting webhooks: %v", err)
+	}
+	defer h.Stop()
+	if rules := h.Rules(); len(rules) != 2 {
+		t.Errorf("Expected the rules to be reloaded, got %+v", rules)
+	}
+	waitFor("the queued delivery", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) == 3 && received[2].Key == "user:2"
+	})
+
+	// A dead letter can be queued again
+	if err := h.Retry(dead[0].ID); err != nil {
+		t.Fatalf("Error retrying: %v", err)
+	}
+	waitFor("the retried delivery to die again", func() bool {
+		dead, _ := h.Deliveries(true)
+		return len(dead) == 1 && dead[0].Attempts == 4
+	})
+}
+
+func TestWebhooksLeaveBatchesAndGCAlone(t *testing.T) {
+	s, err := openStore(filepath.Join(t.TempDir(), "data"))
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	mem, err := s.CreateNamespace("blobs", nsOptions{FlushSize: 1, ValueThreshold: 100, VlogSegmentSize: 1000})
+	if err != nil {
+		t.Fatalf("Error creating namespace: %v", err)
+	}
+	// Never delivered, the dispatcher is stopped right away
+	h, err := startWebhooks(s, webhookConfig{InitialBackoff: time.Hour, MaxBackoff: time.Hour, MaxAttempts: 1, Timeout: time.Second, PollInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("Error starting webhooks: %v", err)
+	}
+	h.Stop()
+	if _, err := h.PutRule(webhookRule{ID: "blobs", Namespace: "blobs", Prefix: "big-", URL: "http://127.0.0.1:1"}); err != nil {
+		t.Fatalf("Error adding rule: %v", err)
+	}
+
+	large := strings.Repeat("x", 400)
+	b := &writeBatch{}
+	for i := 0; i < 6; i++ {
+		b.Put("blobs", []byte(fmt.Sprintf("big-%d", i)), []byte(large))
+	}
+	if err := s.Write(b); err != nil {
+		t.Fatalf("Error writing batch: %v", err)
+	}
+	if b.Len() != 6 {
+		t.Errorf("Expected the batch to keep its 6 ops, got %d", b.Len())
+	}
+	queued, _ := h.Deliveries(false)
+	if len(queued) != 6 {
+		t.Fatalf("Expected 6 queued deliveries, got %d", len(queued))
+	}
+	mem.Del("big-0")
+	mem.Del("big-2")
+
+	w := mem.Watch("")
+	defer w.Close()
+	seq := storeSeq(s)
+	result, err := mem.GCValueLog(0.1)
+	if err != nil || result.SegmentsRemoved == 0 || result.ValuesRewritten == 0 {
+		t.Fatalf("Expected values to be rewritten, got %+v, %v", result, err)
+	}
+	select {
+	case ev := <-w.Events():
+		t.Errorf("Expected no watch event from garbage collection, got %+v", ev)
+	default:
+	}
+	if queued, _ := h.Deliveries(false); len(queued) != 8 {
+		t.Errorf("Expected no delivery from garbage collection, got %d queued", len(queued))
+	}
+	if got := storeSeq(s); got != seq {
+		t.Errorf("Expected garbage collection to keep the sequence number %d, got %d", seq, got)
+	}
+	for _, i := range []int{1, 3, 4, 5} {
+		if v, err := mem.Get([]byte(fmt.Sprintf("big-%d", i))); err != nil || string(v) != large {
+			t.Errorf("Expected big-%d to survive collection, got %d bytes (%v)", i, len(v), err)
+		}
+	}
+}
+
+func TestWebhooksSlowURL(t *testing.T) {
+	s, err := openStore(filepath.Join(t.TempDir(), "data"))
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	mem := s.namespaces[defaultNamespace]
+
+	// The slow receiver answers once released, the fast one right away
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	received := make(chan string, 10)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p webhookPayload
+		json.NewDecoder(r.Body).Decode(&p)
+		received <- string(p.Key)
+	}))
+	defer fast.Close()
+
+	h, err := startWebhooks(s, webhookConfig{InitialBackoff: time.Hour, MaxBackoff: time.Hour, MaxAttempts: 1, Timeout: time.Minute, PollInterval: 5 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Error starting webhooks: %v", err)
+	}
+	defer h.Stop()
+	defer close(release)
+	if _, err := h.PutRule(webhookRule{ID: "slow", Prefix: "s", URL: slow.URL}); err != nil {
+		t.Fatalf("Error adding rule: %v", err)
+	}
+	if _, err := h.PutRule(webhookRule{ID: "fast", Prefix: "f", URL: fast.URL}); err != nil {
+		t.Fatalf("Error adding rule: %v", err)
+	}
+
+	mem.Set([]byte("s1"), []byte("x"))
+	mem.Set([]byte("s2"), []byte("x"))
+	mem.Set([]byte("f1"), []byte("x"))
+	mem.Set([]byte("f2"), []byte("x"))
+	for _, want := range []string{"f1", "f2"} {
+		select {
+		case key := <-received:
+			if key != want {
+				t.Errorf("Expected %s, got %s", want, key)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s not delivered while another URL hangs", want)
+		}
+	}
+}